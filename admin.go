@@ -0,0 +1,89 @@
+// Administrative endpoints for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Start the store read-only, e.g. on a replica, with this reason.
+var startReadOnly bool
+var startReadOnlyReason string = "maintenance"
+
+// Public: whether the store currently refuses new submissions.
+type readOnlyStatus struct {
+	ReadOnly bool       `json:"read_only"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// readOnlyState guards the store's read-only switch.  While it is on,
+// submissions are turned away but lookups of existing results carry on.
+type readOnlyState struct {
+	mu     sync.RWMutex
+	status readOnlyStatus
+}
+
+var storeReadOnly readOnlyState
+
+func (ro *readOnlyState) get() readOnlyStatus {
+	ro.mu.RLock()
+	defer ro.mu.RUnlock()
+	return ro.status
+}
+
+func (ro *readOnlyState) set(enabled bool, reason string) readOnlyStatus {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	switch {
+	case !enabled:
+		ro.status = readOnlyStatus{}
+	case !ro.status.ReadOnly:
+		now := time.Now()
+		ro.status = readOnlyStatus{ReadOnly: true, Reason: reason, Since: &now}
+	default:
+		ro.status.Reason = reason
+	}
+	return ro.status
+}
+
+// writeJSON renders v as the JSON response body.
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	jsonStr, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "%s", jsonStr)
+}
+
+// readOnlyHandler reports the read-only switch on GET and flips it on POST
+// with form fields "enabled" and optional "reason".
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, storeReadOnly.get())
+
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			writeError(w, r, "Form field 'enabled' must be true or false.", http.StatusBadRequest)
+			return
+		}
+		reason := r.FormValue("reason")
+		if len(reason) == 0 {
+			reason = "maintenance"
+		}
+		status := storeReadOnly.set(enabled, reason)
+		logInfo("Store read-only changed", "read_only", status.ReadOnly, "reason", status.Reason,
+			"request_id", requestID(r))
+		writeJSON(w, http.StatusOK, status)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
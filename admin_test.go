@@ -0,0 +1,56 @@
+// Unit Tests for the administrative endpoints.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postForm(h http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	defer storeReadOnly.set(false, "")
+
+	rec := postForm(readOnlyHandler, "/admin/readonly", url.Values{"enabled": {"true"}, "reason": {"replica"}})
+	if http.StatusOK != rec.Code {
+		t.Fatalf("Expected StatusCode [%d], got [%d]", http.StatusOK, rec.Code)
+	}
+	var status readOnlyStatus
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if !status.ReadOnly || "replica" != status.Reason || status.Since == nil {
+		t.Errorf("Unexpected status %s", rec.Body.String())
+	}
+
+	// Submissions bounce with an explanation, lookups carry on.
+	rec = postForm(hashHandler, "/hash", url.Values{"password": {"angryMonkey"}})
+	if http.StatusServiceUnavailable != rec.Code || !strings.Contains(rec.Body.String(), "replica") {
+		t.Errorf("Expected a 503 naming the reason, got [%d] %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	hashHandler(rec, httptest.NewRequest("GET", "/hash/999999", nil))
+	if http.StatusNotFound != rec.Code {
+		t.Errorf("Expected lookups to continue, got StatusCode [%d]", rec.Code)
+	}
+
+	rec = postForm(readOnlyHandler, "/admin/readonly", url.Values{"enabled": {"false"}})
+	if strings.Contains(rec.Body.String(), "true") {
+		t.Errorf("Expected read-only to be off, got %s", rec.Body.String())
+	}
+
+	rec = postForm(readOnlyHandler, "/admin/readonly", url.Values{"enabled": {"maybe"}})
+	if http.StatusBadRequest != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusBadRequest, rec.Code)
+	}
+}
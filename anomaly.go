@@ -0,0 +1,210 @@
+// Traffic anomaly detection for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Request counts are compared interval by interval against a baseline.  An
+// interval is anomalous when its count exceeds the baseline mean by
+// anomalyThreshold standard deviations and is at least anomalyMinCount, so
+// a quiet endpoint going from 0 to 2 requests doesn't page anyone.
+var anomalyInterval time.Duration = 10 * time.Second
+var anomalyThreshold float64 = 4
+var anomalyMinCount int = 50
+
+// Raise a notification for each anomaly, not just record it.
+var anomalyNotify bool
+
+const (
+	anomalyAlpha     = 0.1 // EWMA weight given to the newest interval.
+	anomalyWarmup    = 6   // Intervals of baseline before anything is flagged.
+	anomalyRecentCap = 100 // Anomalies kept for /stats/anomalies.
+	anomalyIdleCap   = 360 // Empty intervals closed before skipping ahead.
+)
+
+// Signals tracked beyond the per-endpoint names, e.g. a surge of lookup
+// misses suggests someone is scanning for IDs.
+const signalHashGetMiss = "hash_get_miss"
+
+// Public: one flagged interval.
+type anomalyEvent struct {
+	Signal string    `json:"signal"`
+	At     time.Time `json:"at"`
+	Count  uint64    `json:"count"`
+	Mean   float64   `json:"mean"`
+	StdDev float64   `json:"stddev"`
+}
+
+// Public: the learned baseline for one signal.
+type baselineStatus struct {
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"`
+	Current uint64  `json:"current"`
+}
+
+// Public: response body of /stats/anomalies.
+type anomalyReport struct {
+	Interval  string                    `json:"interval"`
+	Baselines map[string]baselineStatus `json:"baselines"`
+	Anomalies []anomalyEvent            `json:"anomalies"`
+}
+
+// rateBaseline keeps an exponentially weighted mean and variance of the
+// per-interval count for one signal.
+type rateBaseline struct {
+	mean      float64
+	variance  float64
+	intervals int
+	current   uint64
+}
+
+func (b *rateBaseline) stdDev() float64 {
+	return math.Sqrt(b.variance)
+}
+
+// close ends the interval, reporting whether its count was anomalous before
+// folding it into the baseline.
+func (b *rateBaseline) close() bool {
+	count := float64(b.current)
+	// A floor of one request keeps a flat baseline from flagging noise.
+	limit := b.mean + anomalyThreshold*math.Max(b.stdDev(), 1)
+	anomalous := b.intervals >= anomalyWarmup && count > limit && b.current >= uint64(anomalyMinCount)
+
+	if b.intervals == 0 {
+		b.mean = count
+	} else {
+		diff := count - b.mean
+		b.mean += anomalyAlpha * diff
+		b.variance = (1 - anomalyAlpha) * (b.variance + anomalyAlpha*diff*diff)
+	}
+	b.intervals++
+	b.current = 0
+	return anomalous
+}
+
+// anomalyDetector tracks per-signal baselines.
+type anomalyDetector struct {
+	mu            sync.Mutex
+	intervalStart time.Time
+	signals       map[string]*rateBaseline
+	recent        []anomalyEvent
+}
+
+var anomalies = newAnomalyDetector(time.Now())
+
+func newAnomalyDetector(now time.Time) *anomalyDetector {
+	return &anomalyDetector{intervalStart: now, signals: map[string]*rateBaseline{}}
+}
+
+// roll closes every interval that has ended by now.  Idle intervals count
+// as zero so the baseline decays when traffic stops.  Caller holds mu.
+func (d *anomalyDetector) roll(now time.Time) []anomalyEvent {
+	var found []anomalyEvent
+
+	// After a long idle spell the baselines have decayed to nothing anyway,
+	// so skip ahead rather than closing every empty interval one by one.
+	if idle := now.Sub(d.intervalStart) / anomalyInterval; idle > anomalyIdleCap {
+		d.intervalStart = d.intervalStart.Add((idle - anomalyIdleCap) * anomalyInterval)
+	}
+
+	for now.Sub(d.intervalStart) >= anomalyInterval {
+		d.intervalStart = d.intervalStart.Add(anomalyInterval)
+		for name, b := range d.signals {
+			count, mean, stdDev := b.current, b.mean, b.stdDev()
+			if b.close() {
+				found = append(found, anomalyEvent{name, d.intervalStart, count, mean, stdDev})
+			}
+		}
+	}
+
+	d.recent = append(d.recent, found...)
+	if len(d.recent) > anomalyRecentCap {
+		d.recent = d.recent[len(d.recent)-anomalyRecentCap:]
+	}
+	return found
+}
+
+// observe counts one event for a signal.
+func (d *anomalyDetector) observe(signal string, now time.Time) {
+	d.mu.Lock()
+	found := d.roll(now)
+	b, ok := d.signals[signal]
+	if !ok {
+		b = &rateBaseline{}
+		d.signals[signal] = b
+	}
+	b.current++
+	d.mu.Unlock()
+
+	reportAnomalies(found)
+}
+
+// tick closes out finished intervals even when no traffic arrives.
+func (d *anomalyDetector) tick(now time.Time) {
+	d.mu.Lock()
+	found := d.roll(now)
+	d.mu.Unlock()
+
+	reportAnomalies(found)
+}
+
+func (d *anomalyDetector) report() anomalyReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rep := anomalyReport{
+		Interval:  anomalyInterval.String(),
+		Baselines: make(map[string]baselineStatus, len(d.signals)),
+		Anomalies: append([]anomalyEvent{}, d.recent...),
+	}
+	for name, b := range d.signals {
+		rep.Baselines[name] = baselineStatus{b.mean, b.stdDev(), b.current}
+	}
+	return rep
+}
+
+func reportAnomalies(found []anomalyEvent) {
+	if !anomalyNotify {
+		return
+	}
+	for _, a := range found {
+		notify("anomaly", fmt.Sprintf("%s surged to %d per %v against a baseline of %.1f",
+			a.Signal, a.Count, anomalyInterval, a.Mean), a)
+	}
+}
+
+// watchAnomalies closes intervals on schedule until stop is closed.
+func watchAnomalies(stop chan struct{}) {
+	ticker := time.NewTicker(anomalyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			anomalies.tick(now)
+		}
+	}
+}
+
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	anomalies.tick(time.Now())
+	writeJSON(w, http.StatusOK, anomalies.report())
+}
+
+// validateAnomalyConfig checks the detector settings.
+func validateAnomalyConfig() error {
+	if anomalyInterval < time.Second {
+		return fmt.Errorf("anomaly-interval %v must be at least 1s", anomalyInterval)
+	}
+	if anomalyThreshold <= 0 {
+		return fmt.Errorf("anomaly-threshold %v must be positive", anomalyThreshold)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Unit Tests for traffic anomaly detection.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetectorFlagsSurge(t *testing.T) {
+	start := time.Now()
+	d := newAnomalyDetector(start)
+	at := func(interval int, offset time.Duration) time.Time {
+		return start.Add(time.Duration(interval)*anomalyInterval + offset)
+	}
+
+	// A steady baseline of lookups and a trickle of misses.
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 20; j++ {
+			d.observe(endpointHashGet, at(i, time.Duration(j)*time.Millisecond))
+		}
+		d.observe(signalHashGetMiss, at(i, time.Second))
+	}
+	d.tick(at(10, 0))
+	if 0 != len(d.report().Anomalies) {
+		t.Fatalf("Expected no anomalies in steady traffic, got %+v", d.report().Anomalies)
+	}
+
+	// Someone starts walking the ID space.
+	for j := 0; j < 200; j++ {
+		d.observe(signalHashGetMiss, at(10, time.Duration(j)*time.Millisecond))
+	}
+	d.tick(at(11, 0))
+
+	rep := d.report()
+	if 1 != len(rep.Anomalies) || signalHashGetMiss != rep.Anomalies[0].Signal || 200 != rep.Anomalies[0].Count {
+		t.Errorf("Expected one hash_get_miss anomaly of 200, got %+v", rep.Anomalies)
+	}
+	if rep.Baselines[endpointHashGet].Mean < 15 {
+		t.Errorf("Expected a lookup baseline near 20, got %+v", rep.Baselines[endpointHashGet])
+	}
+}
+
+func TestAnomalyDetectorWarmupAndIdle(t *testing.T) {
+	start := time.Now()
+	d := newAnomalyDetector(start)
+
+	// Bursts during warm-up are not flagged.
+	for j := 0; j < 500; j++ {
+		d.observe(endpointHashPost, start)
+	}
+	d.tick(start.Add(anomalyInterval))
+	if 0 != len(d.report().Anomalies) {
+		t.Errorf("Expected no anomalies during warm-up")
+	}
+
+	// A day of silence decays the baseline without stalling.
+	d.tick(start.Add(24 * time.Hour))
+	if mean := d.report().Baselines[endpointHashPost].Mean; mean > 1 {
+		t.Errorf("Expected the baseline to decay while idle, got %v", mean)
+	}
+}
+
+func TestAnomaliesHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	anomaliesHandler(rec, httptest.NewRequest("GET", "/stats/anomalies", nil))
+	if !strings.Contains(rec.Body.String(), `"baselines"`) {
+		t.Errorf("Expected an anomaly report, got %s", rec.Body.String())
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+	for raw, valid := range map[string]bool{"": true, "https://hooks.example.com/ops": true, "hooks.example.com/ops": false} {
+		notifyURL = raw
+		if err := validateNotifyConfig(); valid != (err == nil) {
+			t.Errorf("%q: expected valid %v, got %v", raw, valid, err)
+		}
+	}
+}
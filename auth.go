@@ -0,0 +1,297 @@
+// Authentication for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// API keys given inline as a comma separated list, and/or a file with one
+// entry per line.  Either way an entry is "key", "key:name", or
+// "key:name:admin".  With no keys at all authentication is off, which is
+// meant for local development only.
+var apiKeysInline string
+var apiKeysFile string
+
+// Comma separated paths that never require a key.  The probes are exempt
+// by default since orchestrators don't carry keys.
+var authExemptPaths string = "/healthz,/readyz"
+
+// Secret standbys, and nodes checking their hand-off to one, present as
+// X-JMPC-Replication-Key to export a tenant's results by name.  It isn't an
+// API key and names no tenant, so it reads nothing of its own: it is good
+// for GET /export of a named tenant and nothing else.  None if empty.
+var replicationKey string
+
+// The configured providers, nil while authentication is off.
+var authenticator authProvider
+
+// Identity behind a request's credentials, whichever provider checked them.
+// Admins may also use the admin endpoints.
+type apiKey struct {
+	name  string
+	admin bool
+}
+
+// authProvider identifies the caller behind a request.  It returns
+// errNoCredentials when the request carries none it understands, an
+// authUnavailable error when it couldn't reach a verdict, and any other
+// error when the credentials are bad.
+type authProvider interface {
+	authenticate(r *http.Request) (apiKey, error)
+}
+
+var errNoCredentials = errors.New("credentials required")
+
+// authUnavailable reports a provider that could not check credentials,
+// e.g. an external authorizer that is down.
+type authUnavailable struct {
+	err error
+}
+
+func (e authUnavailable) Error() string { return "authentication unavailable: " + e.err.Error() }
+
+// authChain tries providers in turn; the first to accept the credentials
+// wins.  Otherwise the first real failure is reported.
+type authChain []authProvider
+
+func (ac authChain) authenticate(r *http.Request) (apiKey, error) {
+	failure := errNoCredentials
+	for _, provider := range ac {
+		key, err := provider.authenticate(r)
+		if err == nil {
+			return key, nil
+		}
+		if err != errNoCredentials && failure == errNoCredentials {
+			failure = err
+		}
+	}
+	return apiKey{}, failure
+}
+
+// Keys are looked up by their SHA-256 so the raw secrets aren't kept in
+// memory and lookups don't leak timing about partial matches.
+type apiKeySet map[[sha256.Size]byte]apiKey
+
+// parseAPIKeyEntry splits a "key[:name[:admin]]" entry.
+func parseAPIKeyEntry(entry string) (string, apiKey, error) {
+	fields := strings.Split(entry, ":")
+	secret := strings.TrimSpace(fields[0])
+	if len(secret) == 0 || len(fields) > 3 {
+		return "", apiKey{}, fmt.Errorf("malformed API key entry")
+	}
+
+	// Name the key after a short prefix of its hash unless told otherwise,
+	// so logs can tell clients apart without giving any of the secret away.
+	sum := sha256.Sum256([]byte(secret))
+	key := apiKey{name: fmt.Sprintf("key-%x", sum[:4])}
+	if len(fields) > 1 && len(strings.TrimSpace(fields[1])) > 0 {
+		key.name = strings.TrimSpace(fields[1])
+	}
+	if len(fields) > 2 {
+		switch strings.TrimSpace(fields[2]) {
+		case "admin":
+			key.admin = true
+		case "", "user":
+		default:
+			return "", apiKey{}, fmt.Errorf("API key %s: unknown role %q", key.name, fields[2])
+		}
+	}
+	return secret, key, nil
+}
+
+// loadAPIKeys gathers the inline and file entries, nil if there are none.
+func loadAPIKeys(inline, file string) (apiKeySet, error) {
+	var entries []string
+	for _, entry := range strings.Split(inline, ",") {
+		if len(strings.TrimSpace(entry)) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) > 0 && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	keys := make(apiKeySet, len(entries))
+	for i, entry := range entries {
+		secret, key, err := parseAPIKeyEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("API key entry %d: %v", i+1, err)
+		}
+		keys[sha256.Sum256([]byte(secret))] = key
+	}
+	return keys, nil
+}
+
+// authenticate looks up the key a request presents.
+func (keys apiKeySet) authenticate(r *http.Request) (apiKey, error) {
+	secret := requestAPIKey(r)
+	if len(secret) == 0 {
+		return apiKey{}, errNoCredentials
+	}
+	key, found := keys[sha256.Sum256([]byte(secret))]
+	if !found {
+		return apiKey{}, errors.New("API key not recognized.")
+	}
+	return key, nil
+}
+
+// validateAuthConfig loads the configured keys and sets up the other
+// providers.  Client certificates are tried first, then keys, then tokens,
+// then the external authorizer.
+func validateAuthConfig() error {
+	keys, err := loadAPIKeys(apiKeysInline, apiKeysFile)
+	if err != nil {
+		return err
+	}
+	if err := validateAuthProviderConfig(); err != nil {
+		return err
+	}
+
+	var chain authChain
+	if len(tlsClientCAFile) > 0 {
+		chain = append(chain, mtlsProvider{admins: exemptPathSet(authMTLSAdmins)})
+	}
+	if keys != nil {
+		chain = append(chain, keys)
+	}
+	if len(authJWTSecret) > 0 {
+		chain = append(chain, jwtProvider{secret: []byte(authJWTSecret), issuer: authJWTIssuer, audience: authJWTAudience})
+	}
+	if len(authURL) > 0 {
+		chain = append(chain, newHTTPAuthProvider(authURL))
+	}
+
+	authenticator = nil
+	if len(chain) > 0 {
+		authenticator = chain
+	}
+	return nil
+}
+
+// requestAPIKey pulls the key from "Authorization: Bearer" or X-Api-Key.
+func requestAPIKey(r *http.Request) string {
+	if authz := r.Header.Get("Authorization"); len(authz) > 7 && strings.EqualFold(authz[:7], "Bearer ") {
+		return strings.TrimSpace(authz[7:])
+	}
+	return r.Header.Get("X-Api-Key")
+}
+
+// isAdminPath reports whether a path needs an admin key.
+func isAdminPath(path string) bool {
+	return path == "/shutdown" || path == "/export" || strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/")
+}
+
+// authIdentity returns the key a request authenticated with, if any.
+func authIdentity(r *http.Request) (apiKey, bool) {
+	key, ok := r.Context().Value(authIdentityKey).(apiKey)
+	return key, ok
+}
+
+// validReplicationKey reports whether secret is the replication key,
+// comparing hashes so the time taken gives nothing away.
+func validReplicationKey(secret string) bool {
+	if len(replicationKey) == 0 {
+		return false
+	}
+	want, got := sha256.Sum256([]byte(replicationKey)), sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+}
+
+// isReplicationCaller reports whether a request came with the replication
+// key rather than as a tenant.
+func isReplicationCaller(r *http.Request) bool {
+	replicating, _ := r.Context().Value(replicationCallerKey).(bool)
+	return replicating
+}
+
+// exemptPathSet parses the comma separated exempt paths.
+func exemptPathSet(paths string) map[string]bool {
+	exempt := map[string]bool{}
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); len(path) > 0 {
+			exempt[path] = true
+		}
+	}
+	return exempt
+}
+
+// withAuth rejects requests without valid credentials: 401 when they are
+// missing or bad, 403 when a non-admin tries an admin endpoint, and 503
+// when a provider couldn't check them.  With no provider configured every
+// request is let through.
+func withAuth(provider authProvider, exempt map[string]bool, next http.Handler) http.Handler {
+	if provider == nil {
+		logWarn("No authentication configured, authentication is DISABLED")
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt[r.URL.Path] || validShareLink(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if secret := r.Header.Get("X-JMPC-Replication-Key"); len(secret) > 0 && r.URL.Path == "/export" {
+			if !validReplicationKey(secret) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jmpc", error="invalid_token"`)
+				writeError(w, r, "Replication key not recognized.", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), replicationCallerKey, true)))
+			return
+		}
+
+		key, err := provider.authenticate(r)
+		if err == errNoCredentials {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jmpc"`)
+			writeError(w, r, "Credentials required.", http.StatusUnauthorized)
+			return
+		}
+		if _, unavailable := err.(authUnavailable); unavailable {
+			logError("Could not authenticate request", "request_id", requestID(r), "error", err)
+			writeError(w, r, "Authentication is unavailable, try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jmpc", error="invalid_token"`)
+			writeError(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if isAdminPath(r.URL.Path) && !key.admin {
+			writeError(w, r, fmt.Sprintf("Caller %s not permitted for %s", key.name, r.URL.Path),
+				http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authIdentityKey, key)))
+	})
+}
@@ -0,0 +1,85 @@
+// Unit Tests for API key authentication.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	ioutil.WriteFile(path, []byte("# ops team\nfilesecret:ops:admin\n\n"), 0600)
+
+	keys, err := loadAPIKeys("abc123:ci, plainsecret", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 3 != len(keys) {
+		t.Fatalf("Expected 3 keys, got %d", len(keys))
+	}
+	if name := keys[sha256.Sum256([]byte("plainsecret"))].name; "key-17d6c70b" != name {
+		t.Errorf("Expected an unnamed key named after its hash, got %q", name)
+	}
+
+	if keys, _ := loadAPIKeys("", ""); keys != nil {
+		t.Errorf("Expected no keys to mean auth off")
+	}
+	if _, err := loadAPIKeys("secret:name:root", ""); err == nil {
+		t.Errorf("Expected an unknown role to be rejected")
+	}
+	if _, err := loadAPIKeys("", "/nonexistent/keys"); err == nil {
+		t.Errorf("Expected a missing keys file to be rejected")
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	keys, err := loadAPIKeys("usersecret:alice,adminsecret:ops:admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen string
+	h := withAuth(keys, exemptPathSet("/healthz"),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, _ := authIdentity(r)
+			seen = key.name
+		}))
+
+	cases := []struct {
+		path, header, value string
+		status              int
+		identity            string
+	}{
+		{"/stats", "", "", http.StatusUnauthorized, ""},
+		{"/stats", "X-Api-Key", "wrong", http.StatusUnauthorized, ""},
+		{"/stats", "X-Api-Key", "usersecret", http.StatusOK, "alice"},
+		{"/stats", "Authorization", "Bearer usersecret", http.StatusOK, "alice"},
+		{"/shutdown", "X-Api-Key", "usersecret", http.StatusForbidden, ""},
+		{"/shutdown", "Authorization", "bearer adminsecret", http.StatusOK, "ops"},
+		{"/healthz", "", "", http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		seen = ""
+		req := httptest.NewRequest("GET", c.path, nil)
+		if len(c.header) > 0 {
+			req.Header.Set(c.header, c.value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if c.status != rec.Code {
+			t.Errorf("%s %s=%q: expected StatusCode [%d], got [%d]", c.path, c.header, c.value, c.status, rec.Code)
+		}
+		if c.identity != seen {
+			t.Errorf("%s %s=%q: expected identity [%s], got [%s]", c.path, c.header, c.value, c.identity, seen)
+		}
+		if http.StatusUnauthorized == rec.Code && len(rec.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("%s: expected a WWW-Authenticate challenge with the 401", c.path)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Authentication providers beyond static API keys.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Key HS256 bearer tokens are signed with; tokens are off if empty.  When
+// set, a token's "iss" and "aud" must match.  The token's "sub" names the
+// caller, and "role": "admin" makes it an admin.
+var authJWTSecret string
+var authJWTIssuer string
+var authJWTAudience string
+
+// Comma separated client certificate names, by subject common name, that
+// are admins.  Certificates are checked against tls-client-ca.
+var authMTLSAdmins string
+
+// URL of an in-house authorization service.  Each request's credentials are
+// passed on to it, and a 200 answer with {"name", "admin"} accepts them.
+var authURL string
+
+// jwtProvider accepts HS256 signed JSON Web Tokens.
+type jwtProvider struct {
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+// Claims read from a token.  "aud" may be a string or a list.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Role      string          `json:"role"`
+}
+
+func (jp jwtProvider) authenticate(r *http.Request) (apiKey, error) {
+	authz := r.Header.Get("Authorization")
+	if len(authz) <= 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+		return apiKey{}, errNoCredentials
+	}
+	parts := strings.Split(strings.TrimSpace(authz[7:]), ".")
+	if len(parts) != 3 {
+		return apiKey{}, errNoCredentials
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return apiKey{}, errors.New("Token must be signed with HS256.")
+	}
+	mac := hmac.New(sha256.New, jp.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return apiKey{}, errors.New("Token signature not valid.")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil || len(claims.Subject) == 0 {
+		return apiKey{}, errors.New("Token claims not valid.")
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return apiKey{}, errors.New("Token expired.")
+	}
+	if now < claims.NotBefore {
+		return apiKey{}, errors.New("Token not yet valid.")
+	}
+	if len(jp.issuer) > 0 && claims.Issuer != jp.issuer {
+		return apiKey{}, errors.New("Token issuer not accepted.")
+	}
+	if len(jp.audience) > 0 && !jwtAudienceHas(claims.Audience, jp.audience) {
+		return apiKey{}, errors.New("Token audience not accepted.")
+	}
+	return apiKey{name: claims.Subject, admin: claims.Role == "admin"}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func jwtAudienceHas(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	json.Unmarshal(raw, &many)
+	for _, aud := range many {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+// mtlsProvider accepts clients that presented a certificate verified
+// against tls-client-ca.
+type mtlsProvider struct {
+	admins map[string]bool
+}
+
+func (mp mtlsProvider) authenticate(r *http.Request) (apiKey, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return apiKey{}, errNoCredentials
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	name := leaf.Subject.CommonName
+	if len(name) == 0 && len(leaf.DNSNames) > 0 {
+		name = leaf.DNSNames[0]
+	}
+	if len(name) == 0 {
+		return apiKey{}, errors.New("Client certificate names no one.")
+	}
+	return apiKey{name: name, admin: mp.admins[name]}, nil
+}
+
+// httpAuthProvider asks an external service about each request.
+type httpAuthProvider struct {
+	url    string
+	client *http.Client
+}
+
+// Public: what the external authorization service answers with.
+type authServiceIdentity struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+// newInternalClient builds a client for services the operator configured,
+// usually on an internal network: it uses the outbound settings, but not
+// the egress controls callbacks go through.
+func newInternalClient() *http.Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         newOutboundDialer().DialContext,
+		TLSHandshakeTimeout: outboundDialTimeout,
+		MaxIdleConns:        outboundMaxIdle,
+		MaxIdleConnsPerHost: outboundMaxIdlePerHost,
+		IdleConnTimeout:     outboundIdleTimeout,
+	}
+	return &http.Client{Timeout: outboundTimeout, Transport: transport}
+}
+
+func newHTTPAuthProvider(rawURL string) *httpAuthProvider {
+	return &httpAuthProvider{url: rawURL, client: newInternalClient()}
+}
+
+// authenticate passes on the request's credentials, with the method and
+// path it is for.
+func (hp *httpAuthProvider) authenticate(r *http.Request) (apiKey, error) {
+	authz, xKey := r.Header.Get("Authorization"), r.Header.Get("X-Api-Key")
+	if len(authz) == 0 && len(xKey) == 0 {
+		return apiKey{}, errNoCredentials
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, hp.url, nil)
+	if err != nil {
+		return apiKey{}, authUnavailable{err}
+	}
+	req.Header.Set("Authorization", authz)
+	req.Header.Set("X-Api-Key", xKey)
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	req.Header.Set("X-Request-Id", requestID(r))
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return apiKey{}, authUnavailable{err}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var identity authServiceIdentity
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&identity); err != nil || len(identity.Name) == 0 {
+			return apiKey{}, authUnavailable{errors.New("authorizer answer has no name")}
+		}
+		return apiKey{name: identity.Name, admin: identity.Admin}, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return apiKey{}, errors.New("Credentials rejected.")
+	}
+	return apiKey{}, authUnavailable{fmt.Errorf("authorizer answered %s", resp.Status)}
+}
+
+// validateAuthProviderConfig checks the settings of the providers here.
+func validateAuthProviderConfig() error {
+	if len(authURL) > 0 {
+		if _, err := validateHTTPURL("auth-url", authURL); err != nil {
+			return err
+		}
+	}
+	if (len(authJWTIssuer) > 0 || len(authJWTAudience) > 0) && len(authJWTSecret) == 0 {
+		return fmt.Errorf("auth-jwt-issuer and auth-jwt-audience need auth-jwt-secret")
+	}
+	if len(authMTLSAdmins) > 0 && len(tlsClientCAFile) == 0 {
+		return fmt.Errorf("auth-mtls-admins needs tls-client-ca")
+	}
+	return nil
+}
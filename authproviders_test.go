@@ -0,0 +1,171 @@
+// Unit Tests for the authentication providers.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signJWT makes an HS256 token over claims.
+func signJWT(secret string, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	body, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/stats", nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestJWTProvider(t *testing.T) {
+	jp := jwtProvider{secret: []byte("s3cret"), issuer: "sso", audience: "jmpc"}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	key, err := jp.authenticate(bearerRequest(signJWT("s3cret", map[string]interface{}{
+		"sub": "carol", "iss": "sso", "aud": []string{"other", "jmpc"}, "exp": exp, "role": "admin"})))
+	if err != nil || "carol" != key.name || !key.admin {
+		t.Errorf("Expected admin carol, got %+v %v", key, err)
+	}
+
+	bad := []map[string]interface{}{
+		{"sub": "carol", "iss": "sso", "aud": "jmpc", "exp": time.Now().Add(-time.Minute).Unix()},
+		{"sub": "carol", "iss": "sso", "aud": "jmpc", "exp": exp, "nbf": exp},
+		{"sub": "carol", "iss": "elsewhere", "aud": "jmpc", "exp": exp},
+		{"sub": "carol", "iss": "sso", "aud": "other", "exp": exp},
+		{"iss": "sso", "aud": "jmpc", "exp": exp},
+	}
+	for _, claims := range bad {
+		if _, err := jp.authenticate(bearerRequest(signJWT("s3cret", claims))); err == nil || err == errNoCredentials {
+			t.Errorf("Expected claims %v rejected, got %v", claims, err)
+		}
+	}
+	forged := signJWT("guess", map[string]interface{}{"sub": "carol", "iss": "sso", "aud": "jmpc", "exp": exp})
+	if _, err := jp.authenticate(bearerRequest(forged)); err == nil {
+		t.Errorf("Expected a token signed with another key rejected")
+	}
+
+	// Plain API keys aren't tokens, so are left to other providers.
+	if _, err := jp.authenticate(bearerRequest("usersecret")); err != errNoCredentials {
+		t.Errorf("Expected no credentials, got %v", err)
+	}
+}
+
+func TestMTLSProvider(t *testing.T) {
+	mp := mtlsProvider{admins: map[string]bool{"ops-box": true}}
+	req := httptest.NewRequest("GET", "/stats", nil)
+	if _, err := mp.authenticate(req); err != errNoCredentials {
+		t.Errorf("Expected no credentials without TLS, got %v", err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ops-box"}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if key, err := mp.authenticate(req); err != nil || "ops-box" != key.name || !key.admin {
+		t.Errorf("Expected admin ops-box, got %+v %v", key, err)
+	}
+}
+
+func TestHTTPAuthProvider(t *testing.T) {
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Api-Key") {
+		case "good":
+			if "POST" != r.Header.Get("X-Original-Method") || "/hash" != r.Header.Get("X-Original-URI") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(authServiceIdentity{Name: "team-a"})
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer authz.Close()
+
+	var seen string
+	h := withAuth(authChain{newHTTPAuthProvider(authz.URL)}, nil,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, _ := authIdentity(r)
+			seen = key.name
+		}))
+	for _, c := range []struct {
+		key    string
+		status int
+	}{
+		{"good", http.StatusOK},
+		{"bad", http.StatusUnauthorized},
+		{"broken", http.StatusServiceUnavailable},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", "/hash", nil)
+		if len(c.key) > 0 {
+			req.Header.Set("X-Api-Key", c.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if c.status != rec.Code {
+			t.Errorf("Key %q: expected StatusCode [%d], got [%d]", c.key, c.status, rec.Code)
+		}
+	}
+	if "team-a" != seen {
+		t.Errorf("Expected the authorizer's name as identity, got %q", seen)
+	}
+}
+
+func TestAuthChain(t *testing.T) {
+	keys, _ := loadAPIKeys("usersecret:alice", "")
+	chain := authChain{keys, jwtProvider{secret: []byte("s3cret")}}
+
+	if key, err := chain.authenticate(bearerRequest("usersecret")); err != nil || "alice" != key.name {
+		t.Errorf("Expected alice by key, got %+v %v", key, err)
+	}
+	token := signJWT("s3cret", map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()})
+	if key, err := chain.authenticate(bearerRequest(token)); err != nil || "bob" != key.name {
+		t.Errorf("Expected bob by token, got %+v %v", key, err)
+	}
+	if _, err := chain.authenticate(bearerRequest("")); err != errNoCredentials {
+		t.Errorf("Expected no credentials, got %v", err)
+	}
+	if _, err := chain.authenticate(bearerRequest("wrong")); err == nil || err == errNoCredentials {
+		t.Errorf("Expected an unknown key rejected, got %v", err)
+	}
+}
+
+func TestAuthProviderConfig(t *testing.T) {
+	defer validateAuthConfig()
+	defer withSavedConfig(t)()
+
+	authJWTSecret = "s3cret"
+	if err := validateAuthConfig(); err != nil || authenticator == nil {
+		t.Errorf("Expected tokens to turn authentication on, got %v", err)
+	}
+	for _, authURL = range []string{"ftp://authz", "http://:8080/check"} {
+		if err := validateAuthConfig(); err == nil {
+			t.Errorf("Expected authorizer URL %q rejected", authURL)
+		}
+	}
+	authURL, authJWTSecret, authJWTIssuer = "", "", "sso"
+	if err := validateAuthConfig(); err == nil {
+		t.Errorf("Expected an issuer without a secret rejected")
+	}
+	authJWTIssuer, authMTLSAdmins = "", "ops-box"
+	if err := validateAuthConfig(); err == nil {
+		t.Errorf("Expected certificate admins without a client CA rejected")
+	}
+}
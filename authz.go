@@ -0,0 +1,186 @@
+// Delegated authorization through an external policy service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Policy endpoint each authenticated request is checked against, e.g. an
+// OPA data API URL such as http://opa:8181/v1/data/jmpc/allow.  Off if empty.
+var authzURL string
+
+// How long a decision is reused for the same caller, method, and path.
+var authzCacheTTL time.Duration = 30 * time.Second
+
+// Let requests through when the policy service can't be reached, rather
+// than answering 503.
+var authzFailOpen bool
+
+// Decisions cached at most; the cache is emptied when it fills.
+const authzCacheMax = 10000
+
+// Public: what the policy service is asked, as OPA's "input".
+type authzInput struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Identity string `json:"identity,omitempty"`
+	Admin    bool   `json:"admin"`
+	// The caller's name, which is what tenant means elsewhere, e.g. for
+	// webhook secrets.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type authzDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// policyClient asks the policy service for decisions and caches them.
+type policyClient struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[authzInput]authzDecision
+}
+
+// The policy client in service, nil when authz-url is empty.
+var policy *policyClient
+
+func newPolicyClient(rawURL string, ttl time.Duration) *policyClient {
+	return &policyClient{
+		url:    rawURL,
+		ttl:    ttl,
+		client: newInternalClient(),
+		cache:  map[authzInput]authzDecision{},
+	}
+}
+
+// allowed returns the decision for in, from the cache while it is fresh.
+func (pc *policyClient) allowed(r *http.Request, in authzInput) (bool, error) {
+	now := time.Now()
+	pc.mu.Lock()
+	d, found := pc.cache[in]
+	pc.mu.Unlock()
+	if found && now.Before(d.expires) {
+		return d.allow, nil
+	}
+
+	allow, err := pc.ask(r, in)
+	if err != nil {
+		return false, err
+	}
+	if pc.ttl > 0 {
+		pc.mu.Lock()
+		if len(pc.cache) >= authzCacheMax {
+			pc.cache = map[authzInput]authzDecision{}
+		}
+		pc.cache[in] = authzDecision{allow: allow, expires: now.Add(pc.ttl)}
+		pc.mu.Unlock()
+	}
+	return allow, nil
+}
+
+// ask posts {"input": in} and reads "result" as either a bool or an object
+// with an "allow" bool, the two shapes OPA policies usually return.
+func (pc *policyClient) ask(r *http.Request, in authzInput) (bool, error) {
+	body, _ := json.Marshal(map[string]authzInput{"input": in})
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, pc.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-Id", requestID(r))
+
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy service answered %s", resp.Status)
+	}
+
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&answer); err != nil {
+		return false, err
+	}
+	var allow bool
+	if json.Unmarshal(answer.Result, &allow) == nil {
+		return allow, nil
+	}
+	var obj struct {
+		Allow *bool `json:"allow"`
+	}
+	if json.Unmarshal(answer.Result, &obj) == nil && obj.Allow != nil {
+		return *obj.Allow, nil
+	}
+	// An undefined result means no rule allowed the request.
+	if len(answer.Result) == 0 {
+		return false, nil
+	}
+	return false, errors.New("policy result is neither a bool nor has an allow bool")
+}
+
+// withPolicy checks each request with the policy service once it has been
+// authenticated, answering 403 when refused.  Paths exempt from
+// authentication are exempt here too.
+func withPolicy(pc *policyClient, exempt map[string]bool, next http.Handler) http.Handler {
+	if pc == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		in := authzInput{Method: r.Method, Path: r.URL.Path}
+		if key, ok := authIdentity(r); ok {
+			in.Identity, in.Admin, in.Tenant = key.name, key.admin, key.name
+		}
+
+		allow, err := pc.allowed(r, in)
+		if err != nil {
+			logError("Policy check failed", "request_id", requestID(r), "fail_open", authzFailOpen, "error", err)
+			if !authzFailOpen {
+				writeError(w, r, "Authorization is unavailable, try again later.", http.StatusServiceUnavailable)
+				return
+			}
+			allow = true
+		}
+		if !allow {
+			logInfo("Request refused by policy", "request_id", requestID(r), "identity", in.Identity,
+				"method", in.Method, "path", in.Path)
+			writeError(w, r, fmt.Sprintf("Not permitted to %s %s.", r.Method, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateAuthzConfig checks the policy settings and sets up the client.
+func validateAuthzConfig() error {
+	policy = nil
+	if len(authzURL) == 0 {
+		return nil
+	}
+	if _, err := validateHTTPURL("authz-url", authzURL); err != nil {
+		return err
+	}
+	if authzCacheTTL < 0 {
+		return fmt.Errorf("authz-cache-ttl %v must not be negative", authzCacheTTL)
+	}
+	policy = newPolicyClient(authzURL, authzCacheTTL)
+	return nil
+}
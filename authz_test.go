@@ -0,0 +1,119 @@
+// Unit Tests for delegated authorization.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFakeOPA answers like an OPA policy letting admins do anything and
+// others only GET, counting the questions it is asked.
+func newFakeOPA(asked *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(asked, 1)
+		var q struct {
+			Input authzInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&q)
+		switch q.Input.Identity {
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "undefined":
+			w.Write([]byte(`{}`))
+		case "ops":
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]bool{"allow": q.Input.Admin}})
+		default:
+			json.NewEncoder(w).Encode(map[string]bool{"result": q.Input.Method == "GET" && q.Input.Tenant == q.Input.Identity})
+		}
+	}))
+}
+
+func policyRequest(h http.Handler, method, path, identity string, admin bool) int {
+	req := httptest.NewRequest(method, path, nil)
+	if len(identity) > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: identity, admin: admin}))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPolicy(t *testing.T) {
+	var asked int32
+	opa := newFakeOPA(&asked)
+	defer opa.Close()
+
+	h := withPolicy(newPolicyClient(opa.URL, time.Minute), exemptPathSet("/healthz"),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		method, path, identity string
+		admin                  bool
+		status                 int
+	}{
+		{"GET", "/stats", "alice", false, http.StatusOK},
+		{"POST", "/hash", "alice", false, http.StatusForbidden},
+		{"POST", "/hash", "ops", true, http.StatusOK},
+		{"GET", "/stats", "undefined", false, http.StatusForbidden},
+		{"GET", "/stats", "broken", false, http.StatusServiceUnavailable},
+		{"GET", "/healthz", "", false, http.StatusOK},
+	}
+	for _, c := range cases {
+		if status := policyRequest(h, c.method, c.path, c.identity, c.admin); c.status != status {
+			t.Errorf("%s %s as %s: expected StatusCode [%d], got [%d]", c.method, c.path, c.identity, c.status, status)
+		}
+	}
+
+	// Decisions are reused; failures are not.
+	before := atomic.LoadInt32(&asked)
+	policyRequest(h, "GET", "/stats", "alice", false)
+	policyRequest(h, "POST", "/hash", "alice", false)
+	if after := atomic.LoadInt32(&asked); before != after {
+		t.Errorf("Expected cached decisions, the policy was asked %d more times", after-before)
+	}
+	policyRequest(h, "GET", "/stats", "broken", false)
+	if after := atomic.LoadInt32(&asked); before+1 != after {
+		t.Errorf("Expected a failed decision asked again")
+	}
+}
+
+func TestPolicyFailOpen(t *testing.T) {
+	defer withSavedConfig(t)()
+
+	var asked int32
+	opa := newFakeOPA(&asked)
+	defer opa.Close()
+	h := withPolicy(newPolicyClient(opa.URL, 0), nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	authzFailOpen = true
+	if status := policyRequest(h, "GET", "/stats", "broken", false); http.StatusOK != status {
+		t.Errorf("Expected the request let through, got StatusCode [%d]", status)
+	}
+	if status := policyRequest(h, "POST", "/hash", "alice", false); http.StatusForbidden != status {
+		t.Errorf("Expected a refusal still honored, got StatusCode [%d]", status)
+	}
+}
+
+func TestAuthzConfig(t *testing.T) {
+	defer validateAuthzConfig()
+	defer withSavedConfig(t)()
+
+	authzURL = "http://opa:8181/v1/data/jmpc/allow"
+	if err := validateAuthzConfig(); err != nil || policy == nil {
+		t.Errorf("Expected a policy client, got %v", err)
+	}
+	authzURL = "opa:8181"
+	if err := validateAuthzConfig(); err == nil {
+		t.Errorf("Expected a URL without a scheme rejected")
+	}
+	authzURL, authzCacheTTL = "http://opa:8181/", -time.Second
+	if err := validateAuthzConfig(); err == nil {
+		t.Errorf("Expected a negative cache TTL rejected")
+	}
+}
@@ -0,0 +1,176 @@
+// Batch submission and lookup for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Most passwords accepted in one batch.
+var batchMaxSize int = 1000
+
+// Largest batch request body accepted, in bytes.
+const batchMaxBody = 10 << 20
+
+// Public: the 503 answered when a batch stops part way, on a full queue or
+// when IDs run out.  The first Queued passwords were queued under IDs as
+// usual and hash on; the rest were not, and may be resubmitted.
+type batchPartialResponse struct {
+	errorResponse
+	IDs    []uint64 `json:"ids"`
+	Queued int      `json:"queued"`
+}
+
+// batchHandler accepts a JSON array of passwords and answers with the array
+// of IDs assigned to them, in the same order.  Each password is queued and
+// hashed individually, exactly as if it had been submitted on its own.
+// Any "label" query fields are attached to every password in the batch.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Capture timing statistics for the /hash/batch endpont.
+	t0 := time.Now()
+	defer func(startTime time.Time) {
+		nowTime := time.Now()
+		duration := nowTime.Sub(startTime)
+		addTiming(&timeMetricAccumulator, timingMicros(duration))
+		recordLatency(endpointHashBatch, duration)
+		anomalies.observe(endpointHashBatch, nowTime)
+	}(t0)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var passwords []string
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, batchMaxBody))
+	if err := dec.Decode(&passwords); err != nil {
+		writeError(w, r, "Request body must be a JSON array of passwords.", http.StatusBadRequest)
+		return
+	}
+
+	// Check the whole batch before assigning any IDs, so a bad batch
+	// leaves nothing half queued.
+	if len(passwords) == 0 || len(passwords) > batchMaxSize {
+		errMsg := fmt.Sprintf("Batch must hold between 1 and %d passwords, got %d.", batchMaxSize, len(passwords))
+		writeError(w, r, errMsg, http.StatusBadRequest)
+		return
+	}
+	for i, clearText := range passwords {
+		if len(clearText) == 0 {
+			errMsg := fmt.Sprintf("Batch entry %d is an empty password.", i)
+			writeError(w, r, errMsg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	labels, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tags, err := parseTags(r.Header)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if rejectIfReadOnly(w, r) || rejectIfShuttingDown(w, r) || rejectIfRateLimited(w, r, len(passwords)) {
+		return
+	}
+
+	ids := make([]uint64, len(passwords))
+	for i, clearText := range passwords {
+		ids[i], _, err = enqueueSubmission(r, clearText, submitOptions{labels: labels, tags: tags})
+		if err != nil {
+			writeBatchPartial(w, r, err, ids[:i], len(passwords))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, ids)
+}
+
+// writeBatchPartial answers a batch that stopped part way with the IDs of
+// those passwords already queued, so the client knows which to resubmit.
+func writeBatchPartial(w http.ResponseWriter, r *http.Request, err error, ids []uint64, total int) {
+	code, errMsg := statusErrorCode(http.StatusServiceUnavailable), "Could not allocate request IDs, try again later."
+	if errors.Is(err, errQueueTimeout) {
+		code = codeQueueFull
+		errMsg = fmt.Sprintf("Timed out waiting for room in the queue after %d of %d.", len(ids), total)
+	}
+	w.Header().Set("X-JMPC-Error-Code", string(code))
+	writeJSON(w, http.StatusServiceUnavailable, batchPartialResponse{
+		errorResponse: errorResponse{Error: errMsg, Code: code, Status: http.StatusServiceUnavailable, RequestID: requestID(r)},
+		IDs:           ids,
+		Queued:        len(ids),
+	})
+}
+
+// validateBatchConfig checks the batch settings.
+func validateBatchConfig() error {
+	if batchMaxSize < 1 {
+		return fmt.Errorf("batch-max %d must be at least 1", batchMaxSize)
+	}
+	return nil
+}
+
+// Public: one ID's entry in the response to POST /hash/lookup.  Status is
+// what GET /hash/{id} would have answered with, and the digest or error
+// code goes with it.
+type lookupEntry struct {
+	ID     uint64    `json:"id"`
+	Status int       `json:"status"`
+	Digest string    `json:"digest,omitempty"`
+	Code   errorCode `json:"code,omitempty"`
+}
+
+// lookupHandler accepts a JSON array of request IDs and answers with an
+// entry for each, in the same order, so a client tracking many jobs needs
+// one round trip rather than one per ID.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	defer func(startTime time.Time) {
+		recordLatency(endpointHashLookup, time.Now().Sub(startTime))
+	}(time.Now())
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []uint64
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, batchMaxBody))
+	if err := dec.Decode(&ids); err != nil {
+		writeCodedError(w, r, codeBadID, "Request body must be a JSON array of request IDs.", http.StatusBadRequest)
+		return
+	}
+	if len(ids) == 0 || len(ids) > batchMaxSize {
+		errMsg := fmt.Sprintf("Lookup must hold between 1 and %d IDs, got %d.", batchMaxSize, len(ids))
+		writeError(w, r, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	tenant := requestTenant(r)
+	entries := make([]lookupEntry, len(ids))
+	for i, idNum := range ids {
+		hRes, missCode := findResult(r, tenant, idNum)
+		switch missCode {
+		case codeTimeout:
+			writeBudgetSpent(w, r)
+			return
+		case "":
+			entries[i] = lookupEntry{ID: idNum, Status: http.StatusOK, Digest: hRes.b64Str}
+		case codeQuarantined:
+			entries[i] = lookupEntry{ID: idNum, Status: http.StatusLocked, Code: missCode}
+		default:
+			entries[i] = lookupEntry{ID: idNum, Status: http.StatusNotFound, Code: missCode}
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
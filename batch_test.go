@@ -0,0 +1,95 @@
+// Unit Tests for batch submission and lookup.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Bad batches are rejected whole, before any IDs are handed out.
+func TestBatchValidation(t *testing.T) {
+	before := atomic.LoadUint64(&hashRequests)
+
+	for _, body := range []string{
+		`not json`,
+		`{"password": "angryMonkey"}`,
+		`[]`,
+		`["angryMonkey", ""]`,
+		`["` + strings.Repeat(`x", "`, batchMaxSize) + `x"]`,
+	} {
+		rec := httptest.NewRecorder()
+		batchHandler(rec, httptest.NewRequest("POST", "/hash/batch", strings.NewReader(body)))
+		if http.StatusBadRequest != rec.Code {
+			t.Errorf("Expected StatusCode [%d] for %.40s, got [%d]", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	batchHandler(rec, httptest.NewRequest("GET", "/hash/batch", nil))
+	if http.StatusMethodNotAllowed != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	if after := atomic.LoadUint64(&hashRequests); before != after {
+		t.Errorf("Expected no IDs to be assigned, went from %d to %d", before, after)
+	}
+}
+
+func TestBatchLookup(t *testing.T) {
+	const mine, theirs, held, unknown = 1<<40 + 10, 1<<40 + 11, 1<<40 + 12, 1<<40 + 13
+	resultMap.Store(resultKey{"alice", mine}, hashResult{b64Str: "abc"})
+	resultMap.Store(resultKey{"bob", theirs}, hashResult{b64Str: "def"})
+	ownerMap.Store(uint64(mine), "alice")
+	ownerMap.Store(uint64(theirs), "bob")
+	ownerMap.Store(uint64(held), "alice")
+	quarantineHold(hashRequest{idNum: held, tenant: "alice"}, "test")
+	defer func() {
+		resultMap.Delete(resultKey{"alice", mine})
+		resultMap.Delete(resultKey{"bob", theirs})
+		for _, idNum := range []uint64{mine, theirs, held} {
+			ownerMap.Delete(idNum)
+		}
+		quarantineTake(held)
+	}()
+
+	lookup := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hash/lookup", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: "alice"}))
+		rec := httptest.NewRecorder()
+		lookupHandler(rec, req)
+		return rec
+	}
+
+	before := endpointRecorders[endpointHashLookup].snapshot(time.Now()).Lifetime.Count
+	rec := lookup(fmt.Sprintf("[%d, %d, %d, %d]", mine, theirs, held, unknown))
+	var entries []lookupEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil || http.StatusOK != rec.Code {
+		t.Fatalf("Expected entries, got StatusCode [%d] %s", rec.Code, rec.Body)
+	}
+	expected := []lookupEntry{
+		{ID: mine, Status: http.StatusOK, Digest: "abc"},
+		{ID: theirs, Status: http.StatusNotFound, Code: codeNotFound},
+		{ID: held, Status: http.StatusLocked, Code: codeQuarantined},
+		{ID: unknown, Status: http.StatusNotFound, Code: codeNotFound},
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(entries) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+	if after := endpointRecorders[endpointHashLookup].snapshot(time.Now()).Lifetime.Count; before+1 != after {
+		t.Errorf("Expected the lookup timed under %s, got count %d from %d", endpointHashLookup, after, before)
+	}
+
+	for _, body := range []string{`[]`, `["1"]`, `[-1]`, `[1.5]`, `{"ids": [1]}`} {
+		if rec := lookup(body); http.StatusBadRequest != rec.Code {
+			t.Errorf("Expected StatusCode [%d] for %s, got [%d]", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Canary comparison of a candidate hashing algorithm.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Algorithm a sample of requests is also hashed with, to weigh a migration
+// to it before committing, and the percentage sampled, unless a tenant
+// overrides them.  Off if empty.  The candidate's digests are thrown away;
+// only its cost is recorded.
+var canaryAlgorithm string
+var canaryPercent float64 = 1
+
+// Iterations for pbkdf2-sha512, as currently recommended for SHA-512.
+const canaryPBKDF2Iterations = 210000
+
+// Comparisons running at most, across every recorder; samples past this
+// are dropped rather than queued, so a costly candidate never holds up the
+// workers.
+const canaryMaxInFlight = 4
+
+var canaryInFlight = make(chan struct{}, canaryMaxInFlight)
+
+// Candidate algorithms, by name.
+var canaryAlgorithms = map[string]func(clearText string){
+	"sha256": func(clearText string) {
+		sha256.Sum256([]byte(clearText))
+	},
+	"sha3-512": func(clearText string) {
+		sha3.Sum512([]byte(clearText))
+	},
+	"pbkdf2-sha512": func(clearText string) {
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		pbkdf2.Key(sha512.New, clearText, salt, canaryPBKDF2Iterations, sha512.Size)
+	},
+}
+
+// Public: the primary and candidate hashing times, in microseconds, for
+// the same sampled requests.
+type canaryStats struct {
+	Algorithm string         `json:"algorithm"`
+	Primary   latencySummary `json:"primary"`
+	Candidate latencySummary `json:"candidate"`
+	// Samples dropped while canaryMaxInFlight were running.
+	Dropped uint64 `json:"dropped"`
+}
+
+// canaryRecorder keeps the two sides of the comparison.
+type canaryRecorder struct {
+	mu        sync.Mutex
+	primary   latencyHistogram
+	candidate latencyHistogram
+	dropped   uint64
+}
+
+var canary canaryRecorder
+
+// Comparisons of the candidates tenants sample in place of
+// -canary-algorithm, by algorithm, kept apart so each is weighed alone.
+var tenantCanaries = struct {
+	sync.Mutex
+	byAlgorithm map[string]*canaryRecorder
+}{byAlgorithm: map[string]*canaryRecorder{}}
+
+// compareCanary hashes a sampled request with its tenant's candidate
+// algorithm too, recording its time against the primary's.
+func compareCanary(tenant, clearText string, primaryTime time.Duration) {
+	ts := settingsFor(tenant)
+	cr := &canary
+	if ts.canaryAlgorithm != canaryAlgorithm && len(ts.canaryAlgorithm) > 0 {
+		tenantCanaries.Lock()
+		cr = tenantCanaries.byAlgorithm[ts.canaryAlgorithm]
+		if cr == nil {
+			cr = &canaryRecorder{}
+			tenantCanaries.byAlgorithm[ts.canaryAlgorithm] = cr
+		}
+		tenantCanaries.Unlock()
+	}
+	cr.compare(ts.canaryAlgorithm, ts.canaryPercent, clearText, primaryTime)
+}
+
+// compare samples percent of requests into the comparison with algorithm,
+// hashing them in the background.
+func (cr *canaryRecorder) compare(algorithm string, percent float64, clearText string, primaryTime time.Duration) {
+	candidate, enabled := canaryAlgorithms[algorithm]
+	if !enabled || mathrand.Float64()*100 >= percent {
+		return
+	}
+	select {
+	case canaryInFlight <- struct{}{}:
+	default:
+		cr.mu.Lock()
+		cr.dropped++
+		cr.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-canaryInFlight }()
+		t0 := time.Now()
+		candidate(clearText)
+		candidateTime := time.Now().Sub(t0)
+
+		cr.mu.Lock()
+		cr.primary.record(timingMicros(primaryTime))
+		cr.candidate.record(timingMicros(candidateTime))
+		cr.mu.Unlock()
+	}()
+}
+
+func (cr *canaryRecorder) stats(algorithm string) canaryStats {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return canaryStats{Algorithm: algorithm, Primary: cr.primary.summary(), Candidate: cr.candidate.summary(), Dropped: cr.dropped}
+}
+
+// tenantCanaryStats reports the tenants' own comparisons, by algorithm
+// name, nil if there are none.
+func tenantCanaryStats() []canaryStats {
+	tenantCanaries.Lock()
+	defer tenantCanaries.Unlock()
+	var compared []canaryStats
+	for algorithm, cr := range tenantCanaries.byAlgorithm {
+		compared = append(compared, cr.stats(algorithm))
+	}
+	sort.Slice(compared, func(i, j int) bool { return compared[i].Algorithm < compared[j].Algorithm })
+	return compared
+}
+
+// validateCanaryConfig checks the canary settings.
+func validateCanaryConfig() error {
+	return checkCanaryConfig(canaryAlgorithm, canaryPercent)
+}
+
+func checkCanaryConfig(algorithm string, percent float64) error {
+	if len(algorithm) == 0 {
+		return nil
+	}
+	if _, found := canaryAlgorithms[algorithm]; !found {
+		return fmt.Errorf("canary-algorithm %q must be sha256, sha3-512 or pbkdf2-sha512", algorithm)
+	}
+	if percent <= 0 || percent > 100 {
+		return fmt.Errorf("canary-percent %v must be above 0 and at most 100", percent)
+	}
+	return nil
+}
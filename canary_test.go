@@ -0,0 +1,80 @@
+// Unit Tests for the algorithm canary.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The live test server compares with the shared recorder and settings, so
+// these use their own.
+func TestCanary(t *testing.T) {
+	var cr canaryRecorder
+	cr.compare("", 100, "angryMonkey", time.Millisecond)
+	if stats := cr.stats(""); 0 != stats.Candidate.Count {
+		t.Errorf("Expected nothing compared while off, got %+v", stats)
+	}
+
+	if err := checkCanaryConfig("sha3-512", 100); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		cr.compare("sha3-512", 100, "angryMonkey", time.Millisecond)
+		waitFor(func() bool { return uint64(i+1) == cr.stats("sha3-512").Candidate.Count })
+	}
+	stats := cr.stats("sha3-512")
+	if 5 != stats.Primary.Count || 5 != stats.Candidate.Count || 1000 != stats.Primary.P50 || "sha3-512" != stats.Algorithm {
+		t.Errorf("Expected five comparisons of a 1ms primary, got %+v", stats)
+	}
+
+	// With every slot taken, a sample is dropped rather than waited for.
+	for i := 0; i < canaryMaxInFlight; i++ {
+		canaryInFlight <- struct{}{}
+	}
+	cr.compare("sha3-512", 100, "angryMonkey", time.Millisecond)
+	for i := 0; i < canaryMaxInFlight; i++ {
+		<-canaryInFlight
+	}
+	if stats := cr.stats("sha3-512"); 1 != stats.Dropped || 5 != stats.Candidate.Count {
+		t.Errorf("Expected the sample dropped, got %+v", stats)
+	}
+
+	for _, bad := range []struct {
+		algorithm string
+		percent   float64
+	}{{"md5", 1}, {"sha256", 0}, {"sha256", 150}} {
+		if err := checkCanaryConfig(bad.algorithm, bad.percent); err == nil {
+			t.Errorf("Expected %s at %v%% rejected", bad.algorithm, bad.percent)
+		}
+	}
+}
+
+func TestTenantCanary(t *testing.T) {
+	defer validateTenantConfig()
+	defer withSavedConfig(t)()
+	defer func() {
+		tenantCanaries.Lock()
+		delete(tenantCanaries.byAlgorithm, "pbkdf2-sha512")
+		tenantCanaries.Unlock()
+	}()
+
+	// A tenant weighing its own candidate is compared apart from the rest.
+	tenantOverrideList = "weigher:canary-algorithm=pbkdf2-sha512,weigher:canary-percent=100"
+	if err := validateTenantConfig(); err != nil {
+		t.Fatal(err)
+	}
+	compareCanary("weigher", "angryMonkey", time.Millisecond)
+	compared := func() bool {
+		for _, stats := range tenantCanaryStats() {
+			if "pbkdf2-sha512" == stats.Algorithm && 1 == stats.Candidate.Count {
+				return true
+			}
+		}
+		return false
+	}
+	// A real pbkdf2 run takes about a second under the race detector.
+	if !waitForWithin(15*time.Second, compared) {
+		t.Errorf("Expected the tenant's comparison reported, got %+v", tenantCanaryStats())
+	}
+}
@@ -0,0 +1,78 @@
+// Client supplied checksums of submission bodies.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Header a client may send with a submission giving a checksum of the body
+// as sent, "algorithm=hex digest", e.g. "crc32c=e3069283".  A body that
+// doesn't match was damaged on the way, and is refused before anything is
+// queued rather than hashed wrong.
+const checksumHeader = "X-JMPC-Checksum"
+
+// Largest body read for checking, the most either submission path takes.
+const checksumMaxBody = batchMaxBody
+
+// Checksum algorithms by name.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha256": sha256.New,
+}
+
+// parseChecksum splits a checksum header into its algorithm and digest.
+func parseChecksum(value string) (string, []byte, error) {
+	name, digestHex, found := strings.Cut(strings.TrimSpace(value), "=")
+	newHash, known := checksumAlgorithms[strings.ToLower(name)]
+	if !found || !known {
+		return "", nil, fmt.Errorf("Header %s must be crc32, crc32c, or sha256 = hex digest.", checksumHeader)
+	}
+	digest, err := hex.DecodeString(digestHex)
+	if err != nil || len(digest) != newHash().Size() {
+		return "", nil, fmt.Errorf("Header %s has a malformed %s digest.", checksumHeader, name)
+	}
+	return strings.ToLower(name), digest, nil
+}
+
+// withChecksum checks the body of a POST against any checksum sent with
+// it, and hands the handler the body it read.
+func withChecksum(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(checksumHeader)
+		if r.Method != http.MethodPost || len(value) == 0 {
+			next(w, r)
+			return
+		}
+		name, want, err := parseChecksum(value)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, checksumMaxBody))
+		if err != nil {
+			writeError(w, r, "Request body could not be read.", http.StatusBadRequest)
+			return
+		}
+		sum := checksumAlgorithms[name]()
+		sum.Write(body)
+		if !bytes.Equal(sum.Sum(nil), want) {
+			// Not the checksums themselves: they are of the password.
+			logWarn("Submission checksum mismatch", "request_id", requestID(r), "algorithm", name, "bytes", len(body))
+			errMsg := fmt.Sprintf("Request body does not match its %s checksum; it was damaged in transit, resend it.", name)
+			writeCodedError(w, r, codeChecksumMismatch, errMsg, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
@@ -0,0 +1,65 @@
+// Unit Tests for submission checksums.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubmissionChecksums(t *testing.T) {
+	form := "password=checksummed"
+	crc := crc32.Checksum([]byte(form), crc32.MakeTable(crc32.Castagnoli))
+	batch := `["checksummed-1", "checksummed-2"]`
+	batchSum := sha256.Sum256([]byte(batch))
+
+	cases := []struct {
+		path, contentType, body, checksum string
+		status                            int
+		code                              errorCode
+	}{
+		{"/hash", "application/x-www-form-urlencoded", form, fmt.Sprintf("crc32c=%08x", crc), 200, ""},
+		{"/hash", "application/x-www-form-urlencoded", form, fmt.Sprintf("CRC32C=%08X", crc), 200, ""},
+		{"/hash", "application/x-www-form-urlencoded", form, fmt.Sprintf("crc32c=%08x", crc+1), 400, codeChecksumMismatch},
+		{"/hash", "application/x-www-form-urlencoded", form, "crc32=e306", 400, codeBadRequest},
+		{"/hash", "application/x-www-form-urlencoded", form, "md5=00", 400, codeBadRequest},
+		{"/hash/batch", "application/json", batch, "sha256=" + hex.EncodeToString(batchSum[:]), 200, ""},
+		{"/hash/batch", "application/json", batch + " ", "sha256=" + hex.EncodeToString(batchSum[:]), 400, codeChecksumMismatch},
+	}
+	for _, c := range cases {
+		var got string
+		handler := withChecksum(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			got = string(body)
+		})
+		req := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		req.Header.Set(checksumHeader, c.checksum)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if c.status != rec.Code || (len(c.code) > 0 && string(c.code) != rec.Header().Get("X-JMPC-Error-Code")) {
+			t.Errorf("%s %s: expected %d %s, got %d %s", c.path, c.checksum, c.status, c.code,
+				rec.Code, rec.Header().Get("X-JMPC-Error-Code"))
+		}
+		if 200 == c.status && c.body != got {
+			t.Errorf("%s %s: expected the handler to get the body checked, got %q", c.path, c.checksum, got)
+		}
+	}
+
+	// Without a checksum, or on a GET, the body passes untouched.
+	for _, method := range []string{"GET", "POST"} {
+		reached := false
+		withChecksum(func(w http.ResponseWriter, r *http.Request) { reached = true })(
+			httptest.NewRecorder(), httptest.NewRequest(method, "/hash", strings.NewReader(form)))
+		if !reached {
+			t.Errorf("%s: expected an unchecked request passed on", method)
+		}
+	}
+}
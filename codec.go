@@ -0,0 +1,261 @@
+// Serialization of results kept in a shared store.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+)
+
+// How results are written into a shared store: json, raw, or protobuf.
+// Every replica on one store must use the same codec.
+var storeCodec string = "json"
+
+// resultCodec turns results into records and back, so a store that other
+// systems also read can hold results in the format they expect.  Records
+// carry a format version where the codec allows, so ones written by older
+// releases can still be read, then rewritten in the current format.
+type resultCodec interface {
+	encode(idNum uint64, hRes hashResult) string
+	decode(idNum uint64, raw string) (hashResult, recordMeta, error)
+}
+
+// What decoding learned about a record besides its result.
+type recordMeta struct {
+	// It carried a checksum, and it matched.
+	checked bool
+	// It is in an older format and should be rewritten.
+	outdated bool
+}
+
+// The codecs, by name.
+var resultCodecs = map[string]resultCodec{
+	"json":     jsonCodec{},
+	"raw":      rawCodec{},
+	"protobuf": protoCodec{},
+}
+
+var errCorruptRecord = errors.New("record fails its checksum")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// recordChecksum is a CRC-32C over the ID and the stored fields, so a
+// record damaged or misplaced in the store is caught on read.  Labels and
+// tags are only summed when there are some, so older records keep their
+// sums.
+func recordChecksum(idNum uint64, digest string, queueUs, processUs int64, labels map[string]string, tags []string) uint32 {
+	fields := fmt.Sprintf("%d %s %d %d", idNum, digest, queueUs, processUs)
+	if len(labels) > 0 {
+		fields += " " + encodeLabels(labels)
+	}
+	if len(tags) > 0 {
+		fields += " tags:" + encodeTags(tags)
+	}
+	return crc32.Checksum([]byte(fields), crc32c)
+}
+
+// encodeLabels writes labels as a JSON object, keys sorted, so the same
+// labels always encode alike.
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(labels)
+	return string(b)
+}
+
+// encodeTags joins tags with commas, which no tag holds.
+func encodeTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func decodeTags(joined string) []string {
+	if len(joined) == 0 {
+		return nil
+	}
+	return strings.Split(joined, ",")
+}
+
+// jsonCodec writes a JSON document with the timings and a checksum.
+//
+// Versions: 1 had no checksum, and so can't be checked; 2 added "sum", and
+// is the first marked with "v"; 3 added "done_us", the completion time; 4
+// added "labels"; 5 added "tags".
+type jsonCodec struct{}
+
+const jsonRecordVersion = 5
+
+type jsonResult struct {
+	Version   int               `json:"v,omitempty"`
+	Digest    string            `json:"digest"`
+	QueueUs   int64             `json:"queue_us"`
+	ProcessUs int64             `json:"process_us"`
+	DoneUs    int64             `json:"done_us,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Sum       string            `json:"sum,omitempty"`
+}
+
+func (jsonCodec) encode(idNum uint64, hRes hashResult) string {
+	jr := jsonResult{Version: jsonRecordVersion, Digest: hRes.b64Str, QueueUs: hRes.queueTime.Microseconds(),
+		ProcessUs: hRes.processTime.Microseconds(), DoneUs: unixMicros(hRes.completedAt), Labels: hRes.labels,
+		Tags: hRes.tags}
+	jr.Sum = fmt.Sprintf("%08x", recordChecksum(idNum, jr.Digest, jr.QueueUs, jr.ProcessUs, jr.Labels, jr.Tags))
+	b, _ := json.Marshal(jr)
+	return string(b)
+}
+
+func (jsonCodec) decode(idNum uint64, raw string) (hashResult, recordMeta, error) {
+	var jr jsonResult
+	if err := json.Unmarshal([]byte(raw), &jr); err != nil {
+		return hashResult{}, recordMeta{}, err
+	}
+	if jr.Version == 0 {
+		jr.Version = 1
+		if len(jr.Sum) > 0 {
+			jr.Version = 2
+		}
+	}
+	if jr.Version > jsonRecordVersion {
+		return hashResult{}, recordMeta{}, fmt.Errorf("record version %d is newer than this release reads", jr.Version)
+	}
+	meta := recordMeta{checked: len(jr.Sum) > 0, outdated: jr.Version < jsonRecordVersion}
+	if meta.checked && jr.Sum != fmt.Sprintf("%08x", recordChecksum(idNum, jr.Digest, jr.QueueUs, jr.ProcessUs, jr.Labels, jr.Tags)) {
+		return hashResult{}, recordMeta{}, errCorruptRecord
+	}
+	return hashResult{
+		b64Str:      jr.Digest,
+		queueTime:   time.Duration(jr.QueueUs) * time.Microsecond,
+		processTime: time.Duration(jr.ProcessUs) * time.Microsecond,
+		completedAt: fromUnixMicros(jr.DoneUs),
+		labels:      jr.Labels,
+		tags:        jr.Tags,
+	}, meta, nil
+}
+
+// unixMicros and fromUnixMicros store a time, keeping zero as zero.
+func unixMicros(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMicro()
+}
+
+func fromUnixMicros(us int64) time.Time {
+	if us == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(us)
+}
+
+// rawCodec writes the bare base64 digest, for stores read by systems that
+// only want the digest.  Timings, labels, and tags are lost and there is
+// no checksum.  With
+// binary digests it writes the raw 64 bytes instead; a base64 SHA-512 is
+// 88 characters, so the length tells them apart.
+type rawCodec struct{}
+
+func (rawCodec) encode(idNum uint64, hRes hashResult) string {
+	if redisDigests == digestsBinary {
+		if digest, packed := packDigest(hRes.b64Str); packed {
+			return string(digest[:])
+		}
+	}
+	return hRes.b64Str
+}
+
+func (rawCodec) decode(idNum uint64, raw string) (hashResult, recordMeta, error) {
+	if len(raw) == 0 {
+		return hashResult{}, recordMeta{}, errors.New("empty record")
+	}
+	if len(raw) == sha512.Size {
+		return hashResult{b64Str: base64.StdEncoding.EncodeToString([]byte(raw))}, recordMeta{}, nil
+	}
+	return hashResult{b64Str: raw}, recordMeta{}, nil
+}
+
+// protoCodec writes a jmpc.HashResult message, as in jmpc.proto, with the
+// completion time, format version, checksum, labels, and tags in fields
+// 13 to 17, which readers built from jmpc.proto skip.  Version 2 added the
+// completion time; 3 added field 12, the raw digest, written in place of
+// field 2 with binary digests, which readers built from jmpc.proto then
+// don't see; 4 added the labels, as a JSON object; 5 the tags, comma
+// separated.
+type protoCodec struct{}
+
+const (
+	protoRecordVersion  = 5
+	protoRawDigestField = 12
+	protoDoneField      = 13
+	protoVersionField   = 14
+	protoChecksumField  = 15
+	protoLabelsField    = 16
+	protoTagsField      = 17
+)
+
+func (protoCodec) encode(idNum uint64, hRes hashResult) string {
+	sum := recordChecksum(idNum, hRes.b64Str, hRes.queueTime.Microseconds(), hRes.processTime.Microseconds(), hRes.labels, hRes.tags)
+	msg := hashResultMessage(idNum, hRes)
+	if redisDigests == digestsBinary {
+		if digest, packed := packDigest(hRes.b64Str); packed {
+			msg = hashResultMessage(idNum, hashResult{queueTime: hRes.queueTime, processTime: hRes.processTime}).
+				string(protoRawDigestField, string(digest[:]))
+		}
+	}
+	// The checksum goes in as sum+1 so a zero sum isn't left out.
+	return string(msg.
+		varint(protoDoneField, uint64(unixMicros(hRes.completedAt))).
+		varint(protoVersionField, protoRecordVersion).
+		varint(protoChecksumField, uint64(sum)+1).
+		string(protoLabelsField, encodeLabels(hRes.labels)).
+		string(protoTagsField, encodeTags(hRes.tags)))
+}
+
+func (protoCodec) decode(idNum uint64, raw string) (hashResult, recordMeta, error) {
+	msg, err := decodeProto([]byte(raw))
+	if err != nil {
+		return hashResult{}, recordMeta{}, err
+	}
+	version := msg.varints[protoVersionField]
+	if version > protoRecordVersion {
+		return hashResult{}, recordMeta{}, fmt.Errorf("record version %d is newer than this release reads", version)
+	}
+	if msg.varints[1] != idNum {
+		return hashResult{}, recordMeta{}, errCorruptRecord
+	}
+	b64Str := string(msg.bytes[2])
+	if digest, found := msg.bytes[protoRawDigestField]; found {
+		b64Str = base64.StdEncoding.EncodeToString(digest)
+	}
+	hRes := hashResult{
+		b64Str:      b64Str,
+		queueTime:   time.Duration(msg.varints[3]) * time.Microsecond,
+		processTime: time.Duration(msg.varints[4]) * time.Microsecond,
+		completedAt: fromUnixMicros(int64(msg.varints[protoDoneField])),
+		tags:        decodeTags(string(msg.bytes[protoTagsField])),
+	}
+	if labels, found := msg.bytes[protoLabelsField]; found {
+		if err := json.Unmarshal(labels, &hRes.labels); err != nil {
+			return hashResult{}, recordMeta{}, errCorruptRecord
+		}
+	}
+	stored, checked := msg.varints[protoChecksumField]
+	if checked && stored != uint64(recordChecksum(idNum, hRes.b64Str, int64(msg.varints[3]), int64(msg.varints[4]), hRes.labels, hRes.tags))+1 {
+		return hashResult{}, recordMeta{}, errCorruptRecord
+	}
+	return hRes, recordMeta{checked: checked, outdated: version < protoRecordVersion}, nil
+}
+
+// validateCodecConfig checks the codec name.
+func validateCodecConfig() error {
+	if _, found := resultCodecs[storeCodec]; !found {
+		return fmt.Errorf("store-codec %q must be json, raw or protobuf", storeCodec)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Unit Tests for stored result codecs.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultCodecs(t *testing.T) {
+	const idNum = 42
+	hRes := hashResult{b64Str: "ZGlnZXN0", queueTime: 5001000000, processTime: 1234000,
+		completedAt: time.UnixMicro(1600000000123456), labels: map[string]string{"source": "import"},
+		tags: []string{"nightly", "run-42"}}
+
+	for name, codec := range resultCodecs {
+		raw := codec.encode(idNum, hRes)
+		got, meta, err := codec.decode(idNum, raw)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		want := hRes
+		if name == "raw" {
+			want = hashResult{b64Str: hRes.b64Str}
+		}
+		if !reflect.DeepEqual(want, got) || meta.checked == (name == "raw") || meta.outdated {
+			t.Errorf("%s: expected %v back, checked %v, got %v %+v", name, want, name != "raw", got, meta)
+		}
+		if name == "raw" {
+			continue
+		}
+
+		// The same record read back under another ID, or altered, fails.
+		if _, _, err := codec.decode(idNum+1, raw); err == nil {
+			t.Errorf("%s: expected a misplaced record caught", name)
+		}
+		for _, altered := range []string{strings.Replace(raw, "ZGln", "ZGlo", 1), strings.Replace(raw, "import", "imporT", 1),
+			strings.Replace(raw, "run-42", "run-43", 1)} {
+			if _, _, err := codec.decode(idNum, altered); err == nil {
+				t.Errorf("%s: expected an altered record caught", name)
+			}
+		}
+	}
+
+	// Protobuf records stay readable as a plain jmpc.HashResult.
+	msg, err := decodeProto([]byte(protoCodec{}.encode(idNum, hRes)))
+	if err != nil || idNum != msg.varints[1] || hRes.b64Str != string(msg.bytes[2]) {
+		t.Errorf("Expected a HashResult message, got %+v %v", msg, err)
+	}
+}
+
+func TestCodecConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+	storeCodec = "msgpack"
+	if err := validateCodecConfig(); err == nil {
+		t.Errorf("Expected an unknown codec rejected")
+	}
+}
+
+func TestCodecVersions(t *testing.T) {
+	// Version 1 JSON records had no sum; they're read but marked outdated.
+	hRes, meta, err := jsonCodec{}.decode(1, `{"digest":"old","queue_us":1,"process_us":2}`)
+	if err != nil || "old" != hRes.b64Str || meta.checked || !meta.outdated {
+		t.Errorf("Expected a version 1 record read as outdated, got %v %+v %v", hRes, meta, err)
+	}
+	// Ones with a sum but no "v" are version 2, still checked.
+	raw := strings.Replace(jsonCodec{}.encode(1, hRes), `"v":5,`, "", 1)
+	if _, meta, err = (jsonCodec{}).decode(1, raw); err != nil || !meta.checked || !meta.outdated {
+		t.Errorf("Expected an unmarked record with a sum checked but outdated, got %+v %v", meta, err)
+	}
+	// Newer versions than this release knows are refused, not guessed at.
+	if _, _, err = (jsonCodec{}).decode(1, `{"v":6,"digest":"new"}`); err == nil {
+		t.Errorf("Expected a newer JSON record refused")
+	}
+	msg := hashResultMessage(1, hRes).varint(protoVersionField, protoRecordVersion+1)
+	if _, _, err = (protoCodec{}).decode(1, string(msg)); err == nil {
+		t.Errorf("Expected a newer protobuf record refused")
+	}
+}
+
+func TestBinaryDigests(t *testing.T) {
+	defer withSavedConfig(t)()
+	const idNum = 42
+	hRes := hashResult{b64Str: "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==",
+		queueTime: 5001000000, processTime: 1234000, completedAt: time.UnixMicro(1600000000123456)}
+
+	for _, name := range []string{"raw", "protobuf"} {
+		codec := resultCodecs[name]
+		redisDigests = digestsBase64
+		asText := codec.encode(idNum, hRes)
+		redisDigests = digestsBinary
+		asBinary := codec.encode(idNum, hRes)
+		if len(asText)-len(asBinary) != 24 {
+			t.Errorf("%s: expected binary 24 bytes shorter, got %d and %d", name, len(asText), len(asBinary))
+		}
+		// Either form is read whatever the setting.
+		for _, raw := range []string{asText, asBinary} {
+			got, _, err := codec.decode(idNum, raw)
+			if err != nil || hRes.b64Str != got.b64Str {
+				t.Errorf("%s: expected the digest back, got %v %v", name, got, err)
+			}
+		}
+	}
+
+	// Anything but a base64 SHA-512 is kept as it is.  The live test
+	// server saves under memory-digests, so it is left alone here.
+	defer resultMap.Delete(resultKey{id: 1 << 40})
+	defer resultMap.Delete(resultKey{id: 1<<40 + 1})
+	rec := heldResult(hRes, digestsBinary)
+	if _, packed := rec.(packedResult); !packed {
+		t.Errorf("Expected the digest held packed, got %T", rec)
+	}
+	resultMap.Store(resultKey{id: 1 << 40}, rec)
+	resultMap.Store(resultKey{id: 1<<40 + 1}, heldResult(hashResult{b64Str: "abc"}, digestsBinary))
+	if got, found := (memoryStore{}).load(resultKey{id: 1 << 40}); !found || !reflect.DeepEqual(hRes, got) {
+		t.Errorf("Expected %v back, got %v %v", hRes, got, found)
+	}
+	if got, found := (memoryStore{}).load(resultKey{id: 1<<40 + 1}); !found || "abc" != got.b64Str {
+		t.Errorf("Expected an odd digest kept as it is, got %v %v", got, found)
+	}
+
+	storeBackend, storeCodec = "redis", "json"
+	if err := validateDigestConfig(); err == nil {
+		t.Errorf("Expected binary JSON records rejected")
+	}
+	storeCodec = "protobuf"
+	if err := validateDigestConfig(); err != nil {
+		t.Error(err)
+	}
+	redisDigests = "hex"
+	if err := validateDigestConfig(); err == nil {
+		t.Errorf("Expected an unknown digest form rejected")
+	}
+}
@@ -0,0 +1,105 @@
+// Completion notification for queued hash requests.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Longest a synchronous submission may block for its result.  Requests may
+// ask for less with a "timeout" parameter.
+var syncWaitTimeout time.Duration = 30 * time.Second
+
+// A channel closed when one request's hash is stored, shared by everyone
+// waiting on that request.
+type completionWaiter struct {
+	done chan struct{}
+	refs int
+}
+
+var completions = struct {
+	sync.Mutex
+	waiters map[uint64]*completionWaiter
+}{waiters: map[uint64]*completionWaiter{}}
+
+// signalCompletion wakes anyone waiting on idNum.  Call it after the result
+// is stored.
+func signalCompletion(idNum uint64) {
+	completions.Lock()
+	defer completions.Unlock()
+	if cw, found := completions.waiters[idNum]; found {
+		close(cw.done)
+		delete(completions.waiters, idNum)
+	}
+}
+
+// waitForCompletion blocks until rk's hash is stored or ctx is done.
+func waitForCompletion(ctx context.Context, rk resultKey) (hashResult, error) {
+	idNum := rk.id
+	completions.Lock()
+	cw, found := completions.waiters[idNum]
+	if !found {
+		cw = &completionWaiter{done: make(chan struct{})}
+		completions.waiters[idNum] = cw
+	}
+	cw.refs++
+	completions.Unlock()
+
+	defer func() {
+		completions.Lock()
+		cw.refs--
+		if cw.refs == 0 && completions.waiters[idNum] == cw {
+			delete(completions.waiters, idNum)
+		}
+		completions.Unlock()
+	}()
+
+	// The result may have landed before we registered.
+	if hRes, recFound := store.load(rk); recFound {
+		return hRes, nil
+	}
+
+	select {
+	case <-cw.done:
+		hRes, _ := store.load(rk)
+		return hRes, nil
+	case <-ctx.Done():
+		return hashResult{}, ctx.Err()
+	}
+}
+
+// wantsSyncResult reports whether a submission asked, with wait=true or
+// sync=true, to get its digest back instead of an ID.
+func wantsSyncResult(r *http.Request) bool {
+	for _, param := range []string{"wait", "sync"} {
+		if wait, err := strconv.ParseBool(r.FormValue(param)); err == nil && wait {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForSyncResult waits on a synchronous submission for at most
+// syncWaitTimeout, or the request's own shorter "timeout".
+func waitForSyncResult(r *http.Request, idNum uint64) (hashResult, error) {
+	timeout := syncWaitTimeout
+	if requested, err := time.ParseDuration(r.FormValue("timeout")); err == nil && requested > 0 && requested < timeout {
+		timeout = requested
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	return waitForCompletion(ctx, resultKey{requestTenant(r), idNum})
+}
+
+// validateSyncConfig checks the synchronous submission settings.
+func validateSyncConfig() error {
+	if syncWaitTimeout <= 0 {
+		return fmt.Errorf("sync-timeout %v must be positive", syncWaitTimeout)
+	}
+	return nil
+}
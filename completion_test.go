@@ -0,0 +1,47 @@
+// Unit Tests for completion notification.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitForCompletion(t *testing.T) {
+	const idNum = 1 << 62
+	defer resultMap.Delete(resultKey{id: idNum})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		resultMap.Store(resultKey{id: idNum}, hashResult{b64Str: "digest"})
+		signalCompletion(idNum)
+	}()
+
+	hRes, err := waitForCompletion(context.Background(), resultKey{id: idNum})
+	if err != nil || "digest" != hRes.b64Str {
+		t.Errorf("Expected the stored digest, got %q, %v", hRes.b64Str, err)
+	}
+
+	// Already complete returns straight away.
+	hRes, err = waitForCompletion(context.Background(), resultKey{id: idNum})
+	if err != nil || "digest" != hRes.b64Str {
+		t.Errorf("Expected the stored digest, got %q, %v", hRes.b64Str, err)
+	}
+
+	if 0 != len(completions.waiters) {
+		t.Errorf("Expected waiters to be cleaned up, have %d", len(completions.waiters))
+	}
+}
+
+func TestWaitForCompletionTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := waitForCompletion(ctx, resultKey{id: 1<<62 + 1}); err != context.DeadlineExceeded {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if 0 != len(completions.waiters) {
+		t.Errorf("Expected waiters to be cleaned up, have %d", len(completions.waiters))
+	}
+}
@@ -0,0 +1,93 @@
+// Response compression for the bulk endpoints.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Comma separated content codings the bulk endpoints, /export, /hashes,
+// and /hash/batch, may answer with, in order of preference.  Off if empty.
+// Other responses are small and never compressed.
+var compressCodecs string
+
+// Parsed compressCodecs.
+var compressOffered []string
+
+// pickEncoding returns the first offered coding the client accepts, "" for
+// none.  A coding listed with q=0 is refused, even if "*" is accepted.
+func pickEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		accepted[coding] = true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				accepted[coding] = false
+			}
+		}
+	}
+	for _, coding := range compressOffered {
+		if wanted, listed := accepted[coding]; wanted || !listed && accepted["*"] {
+			return coding
+		}
+	}
+	return ""
+}
+
+// gzipResponseWriter compresses everything written through it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	return gw.gz.Write(b)
+}
+
+// withCompression compresses a bulk endpoint's response when the client
+// accepts one of the offered codings.
+func withCompression(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(compressOffered) == 0 {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if pickEncoding(r.Header.Get("Accept-Encoding")) != "gzip" {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	}
+}
+
+// validateCompressConfig checks the offered codings.  Only gzip is built
+// in; zstd would need a codec outside the standard library.
+func validateCompressConfig() error {
+	compressOffered = nil
+	for _, coding := range strings.Split(compressCodecs, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "":
+			continue
+		case "gzip":
+			compressOffered = append(compressOffered, coding)
+		case "zstd":
+			return fmt.Errorf("compress: zstd is not available in this build, use gzip")
+		default:
+			return fmt.Errorf("compress: unknown coding %q, only gzip is supported", coding)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Unit Tests for bulk response compression.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	defer validateCompressConfig()
+	defer withSavedConfig(t)()
+
+	body := strings.Repeat(`{"id":1,"digest":"abc"}`+"\n", 100)
+	h := withCompression(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/export", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	if rec := get("gzip"); len(rec.Header().Get("Content-Encoding")) > 0 || body != rec.Body.String() {
+		t.Errorf("Expected no compression while off")
+	}
+
+	compressCodecs = "gzip"
+	if err := validateCompressConfig(); err != nil {
+		t.Fatal(err)
+	}
+	rec := get("br, gzip;q=0.8")
+	if "gzip" != rec.Header().Get("Content-Encoding") || "Accept-Encoding" != rec.Header().Get("Vary") {
+		t.Fatalf("Expected a gzip response, got headers %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, _ := io.ReadAll(gz); body != string(plain) {
+		t.Errorf("Expected the body back after decompressing, got %q", plain)
+	}
+
+	for _, refused := range []string{"", "identity", "gzip;q=0", "*, gzip; q=0.0"} {
+		if rec := get(refused); len(rec.Header().Get("Content-Encoding")) > 0 {
+			t.Errorf("Expected Accept-Encoding %q answered uncompressed", refused)
+		}
+	}
+
+	for _, bad := range []string{"zstd", "gzip,br"} {
+		compressCodecs = bad
+		if err := validateCompressConfig(); err == nil {
+			t.Errorf("Expected compress %q rejected", bad)
+		}
+	}
+}
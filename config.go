@@ -0,0 +1,400 @@
+// Configuration for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Every setting is a flag on configFlags.  The flag name doubles as the key in
+// the config file, and JMPC_ plus the upper-cased name (dashes to
+// underscores) is its environment variable.  Precedence, highest first:
+// command line, environment, config file, built in default.
+var configFlags = newConfigFlags()
+
+// Where each setting's effective value came from, for -print-config.
+var configSources = map[string]string{}
+
+// Path of the optional config file, JSON or flat YAML by extension.
+var configFile string
+
+// Dump the effective configuration and exit rather than serving.
+var printConfig bool
+
+func newConfigFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("jmpc", flag.ContinueOnError)
+
+	fs.StringVar(&configFile, "config", os.Getenv("JMPC_CONFIG"), "path to a JSON or YAML config file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+
+	fs.StringVar(&nodeID, "node-id", nodeID, "instance identity reported in headers, logs and stats")
+	fs.IntVar(&tagStatsMax, "tag-stats-max", tagStatsMax, "most distinct X-JMPC-Tags tags /stats counts separately; the rest are counted together")
+	fs.StringVar(&statsUnits, "stats-units", statsUnits, "units of the timings /stats reports unless asked otherwise: us or ms")
+	fs.Float64Var(&statsEWMAAlpha, "stats-ewma-alpha", statsEWMAAlpha, "weight of each new processing time in the moving average /stats reports, above 0 and at most 1")
+	fs.DurationVar(&statsMaxAge, "stats-max-age", statsMaxAge, "oldest figures /stats serves while refreshing them in the background, never past twice that, 0 to gather them every request")
+	fs.IntVar(&listenPort, "port", listenPort, "TCP port to listen on")
+	fs.IntVar(&grpcPort, "grpc-port", grpcPort, "TCP port to serve the gRPC API on, 0 for none")
+	fs.DurationVar(&hashDelay, "hash-delay", hashDelay, "delay between submission and hashing")
+	fs.IntVar(&maxConnections, "max-connections", maxConnections, "most connections the API listener holds open, those past it closed at once; 0 for no limit")
+	fs.StringVar(&standbyOf, "standby-of", standbyOf, "base URL of a primary to copy results from as a read-only standby until POST /admin/promote")
+	fs.StringVar(&standbyKey, "standby-key", standbyKey, "the primary's replication key, which the standby calls its /export with")
+	fs.DurationVar(&standbyPoll, "standby-poll", standbyPoll, "how long a standby waits between polls once caught up")
+	fs.DurationVar(&standbyReconcile, "standby-reconcile", standbyReconcile, "how often a standby rereads the primary's whole export to drop results removed there")
+	fs.StringVar(&standbyTenants, "standby-tenants", standbyTenants, "comma separated tenants a standby copies besides unauthenticated requests")
+	fs.IntVar(&workerCount, "workers", workerCount, "number of hashing workers")
+	fs.IntVar(&queueDepth, "queue-depth", queueDepth, "hash requests buffered ahead of the workers")
+	fs.DurationVar(&queueBlockWarn, "queue-block-warn", queueBlockWarn, "how long a submission may block on a full queue before it is logged, 0 for never")
+	fs.Float64Var(&readyQueueThreshold, "ready-queue-threshold", readyQueueThreshold, "queue fill fraction at which /readyz reports not ready")
+	fs.DurationVar(&livenessGrace, "liveness-grace", livenessGrace, "time past hash-delay queued work may go unfinished before /healthz fails")
+	fs.DurationVar(&resultTTL, "result-ttl", resultTTL, "how long results are kept once hashed, 0 for good")
+	fs.BoolVar(&allowDelete, "allow-delete", allowDelete, "let clients remove results with DELETE /hash/{id}; off lets them cache results")
+	fs.BoolVar(&warmupEnabled, "warmup", warmupEnabled, "warm up the hashing path and result cache before reporting ready")
+	fs.DurationVar(&shutdownDrain, "shutdown-drain", shutdownDrain, "time /shutdown keeps serving, not ready, before closing the listener")
+	fs.IntVar(&shutdownRepeatStatus, "shutdown-repeat-status", shutdownRepeatStatus, "status code of /shutdown calls after the first: 200 or 409")
+	fs.DurationVar(&decommissionTimeout, "decommission-timeout", decommissionTimeout, "longest a decommission waits to drain, and for its successor to catch up")
+	fs.StringVar(&logLevelName, "log-level", logLevelName, "least severe log level written: debug, info, warn or error")
+	fs.StringVar(&logFormat, "log-format", logFormat, "log line format: text (key=value) or json")
+	fs.StringVar(&journalPath, "journal", journalPath, "file to journal request metadata to as NDJSON, for audit; never the passwords")
+	fs.IntVar(&journalMaxMB, "journal-max-mb", journalMaxMB, "size in MiB at which the journal is rotated")
+	fs.IntVar(&journalKeep, "journal-keep", journalKeep, "rotated journal files kept, oldest removed first; 0 keeps them all")
+	fs.StringVar(&crashDir, "crash-dir", crashDir, "existing directory a JSON crash report is written to for each panic")
+	fs.StringVar(&crashURL, "crash-url", crashURL, "URL crash reports are POSTed to as JSON")
+	fs.DurationVar(&leakCheckInterval, "leak-check-interval", leakCheckInterval, "how often goroutines are counted for /debug/leaks, 0 for off")
+
+	fs.StringVar(&compressCodecs, "compress", compressCodecs, "content codings /export, /hashes and /hash/batch may be gzip compressed with; off if empty")
+	fs.IntVar(&batchMaxSize, "batch-max", batchMaxSize, "most passwords accepted in one batch submission")
+	fs.DurationVar(&syncWaitTimeout, "sync-timeout", syncWaitTimeout, "longest a wait=true submission blocks for its digest")
+	fs.DurationVar(&hashSubmitTimeout, "hash-submit-timeout", hashSubmitTimeout, "longest a POST /hash or /hash/batch may take, 0 for no limit")
+	fs.DurationVar(&hashGetTimeout, "hash-get-timeout", hashGetTimeout, "longest a GET /hash/{id} may take, 0 for no limit")
+	fs.DurationVar(&adminTimeout, "admin-timeout", adminTimeout, "longest an admin call, e.g. /export, may take, 0 for no limit")
+
+	fs.StringVar(&storeBackend, "store", storeBackend, "where IDs and results are kept: memory, or redis to share them between replicas")
+	fs.StringVar(&memoryDigests, "memory-digests", memoryDigests, "how digests are held in memory: base64, or binary for raw bytes")
+	fs.StringVar(&idStrategy, "id-strategy", idStrategy, "how request IDs are made: sequential, random, time or node")
+	fs.IntVar(&idNode, "id-node", idNode, "this instance's number, 1 to 1023, for id-strategy node")
+	fs.StringVar(&redisAddr, "redis-addr", redisAddr, "Redis host:port for store=redis")
+	fs.StringVar(&redisPassword, "redis-password", redisPassword, "Redis password, if it needs one")
+	fs.IntVar(&redisDB, "redis-db", redisDB, "Redis database number")
+	fs.StringVar(&redisPrefix, "redis-prefix", redisPrefix, "prefix on every Redis key, so deployments can share a server")
+	fs.StringVar(&storeCodec, "store-codec", storeCodec, "how results are written into a shared store: json, raw (digest only) or protobuf")
+	fs.StringVar(&redisDigests, "redis-digests", redisDigests, "how digests are written into Redis: base64, or binary for raw bytes with store-codec raw or protobuf")
+	fs.IntVar(&storeCacheSize, "store-cache-size", storeCacheSize, "results fetched from a shared store kept locally, 0 for none")
+	fs.DurationVar(&storeCacheTTL, "store-cache-ttl", storeCacheTTL, "how long a locally kept result is trusted before it is fetched again")
+	fs.DurationVar(&storeMissTTL, "store-miss-ttl", storeMissTTL, "how long an ID missing from a shared store is taken as still missing, 0 to always ask")
+
+	fs.StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "PEM certificate file; enables TLS")
+	fs.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "PEM private key file for tls-cert")
+	fs.DurationVar(&tlsReloadInterval, "tls-reload-interval", tlsReloadInterval, "how often to check the certificate files for rotation")
+	fs.IntVar(&tlsRedirectPort, "tls-redirect-port", tlsRedirectPort, "plaintext port redirecting to TLS, 0 for none")
+
+	fs.StringVar(&apiKeysInline, "api-keys", apiKeysInline, "comma separated key[:name[:admin]] entries; none disables auth")
+	fs.StringVar(&apiKeysFile, "api-keys-file", apiKeysFile, "file of key[:name[:admin]] entries, one per line")
+	fs.StringVar(&authExemptPaths, "auth-exempt", authExemptPaths, "comma separated paths that need no API key")
+	fs.StringVar(&replicationKey, "replication-key", replicationKey, "secret standbys export any named tenant's results with; not an API key, and none if empty")
+	fs.StringVar(&authJWTSecret, "auth-jwt-secret", authJWTSecret, "key HS256 bearer tokens are signed with; tokens not accepted if empty")
+	fs.StringVar(&authJWTIssuer, "auth-jwt-issuer", authJWTIssuer, "required token issuer (iss), if any")
+	fs.StringVar(&authJWTAudience, "auth-jwt-audience", authJWTAudience, "required token audience (aud), if any")
+	fs.StringVar(&tlsClientCAFile, "tls-client-ca", tlsClientCAFile, "PEM CA bundle client certificates are verified against; enables certificate auth")
+	fs.StringVar(&authMTLSAdmins, "auth-mtls-admins", authMTLSAdmins, "comma separated client certificate names that are admins")
+	fs.StringVar(&authURL, "auth-url", authURL, "external service each request's credentials are checked with")
+	fs.StringVar(&authzURL, "authz-url", authzURL, "policy endpoint, e.g. OPA's data API, each request is authorized with")
+	fs.DurationVar(&authzCacheTTL, "authz-cache-ttl", authzCacheTTL, "how long a policy decision is reused, 0 for never")
+	fs.BoolVar(&authzFailOpen, "authz-fail-open", authzFailOpen, "let requests through when the policy endpoint can't be reached")
+
+	fs.StringVar(&corsOriginList, "cors-origins", corsOriginList, "comma separated origins browsers may call the API from, * for any; none if empty")
+	fs.StringVar(&corsMethods, "cors-methods", corsMethods, "comma separated methods cross-origin requests may use")
+	fs.StringVar(&corsHeaders, "cors-headers", corsHeaders, "comma separated request headers cross-origin requests may send")
+	fs.DurationVar(&corsMaxAge, "cors-max-age", corsMaxAge, "how long browsers may cache a preflight answer")
+
+	fs.Float64Var(&rateLimit, "rate-limit", rateLimit, "hash submissions per second per client, 0 for no limit")
+	fs.IntVar(&rateBurst, "rate-burst", rateBurst, "submissions a client may make back to back")
+	fs.StringVar(&tenantOverrideList, "tenant-overrides", tenantOverrideList, "comma separated tenant:setting=value overrides of hash-delay, rate-limit, rate-burst, result-ttl, canary-algorithm and canary-percent")
+
+	fs.StringVar(&shareSecret, "share-secret", shareSecret, "key share links are signed with; random per process if empty")
+	fs.DurationVar(&shareTTL, "share-ttl", shareTTL, "default lifetime of a share link")
+	fs.DurationVar(&shareMaxTTL, "share-max-ttl", shareMaxTTL, "longest lifetime a share link may ask for")
+
+	fs.IntVar(&webhookMaxAttempts, "webhook-max-attempts", webhookMaxAttempts, "delivery attempts per completion webhook")
+	fs.DurationVar(&webhookBackoff, "webhook-backoff", webhookBackoff, "wait before the first webhook retry, doubling after")
+	fs.DurationVar(&webhookMaxBackoff, "webhook-max-backoff", webhookMaxBackoff, "longest wait between webhook retries")
+	fs.DurationVar(&outboundTimeout, "outbound-timeout", outboundTimeout, "longest an outbound request, e.g. one webhook attempt, may take")
+	fs.DurationVar(&outboundDialTimeout, "outbound-dial-timeout", outboundDialTimeout, "longest an outbound connection or TLS handshake may take")
+	fs.IntVar(&outboundMaxIdle, "outbound-max-idle", outboundMaxIdle, "idle outbound connections kept for reuse")
+	fs.IntVar(&outboundMaxIdlePerHost, "outbound-max-idle-per-host", outboundMaxIdlePerHost, "idle outbound connections kept per host")
+	fs.DurationVar(&outboundIdleTimeout, "outbound-idle-timeout", outboundIdleTimeout, "how long an idle outbound connection is kept")
+	fs.StringVar(&outboundResolver, "outbound-resolver", outboundResolver, "DNS server host:port for outbound names; system resolver if empty")
+	fs.StringVar(&outboundProxy, "outbound-proxy", outboundProxy, "proxy URL callbacks are sent through")
+	fs.StringVar(&egressAllowList, "egress-allow", egressAllowList, "comma separated hosts callbacks may go to, .domain for subdomains; empty for any")
+	fs.BoolVar(&egressAllowPrivate, "egress-allow-private", egressAllowPrivate, "let callbacks reach loopback and private network addresses")
+	fs.StringVar(&webhookSecret, "webhook-secret", webhookSecret, "default key webhook payloads are signed with; unsigned if empty")
+	fs.StringVar(&webhookSecretList, "webhook-secrets", webhookSecretList, "comma separated tenant:secret signing keys, by API key name")
+
+	fs.StringVar(&canaryAlgorithm, "canary-algorithm", canaryAlgorithm, "candidate algorithm sampled requests are also hashed with to compare cost: sha256, sha3-512 or pbkdf2-sha512")
+	fs.Float64Var(&canaryPercent, "canary-percent", canaryPercent, "percentage of requests hashed with canary-algorithm too")
+	fs.StringVar(&shadowURL, "shadow-url", shadowURL, "base URL of a secondary deployment requests are copied to, answers discarded")
+	fs.Float64Var(&shadowPercent, "shadow-percent", shadowPercent, "percentage of requests copied to shadow-url")
+	fs.StringVar(&shadowKey, "shadow-key", shadowKey, "API key sent with shadow copies in place of the client's")
+
+	fs.BoolVar(&quarantineEnabled, "quarantine", quarantineEnabled, "hold suspicious submissions for admin release")
+	fs.IntVar(&quarantineMaxLength, "quarantine-max-length", quarantineMaxLength, "passwords longer than this many bytes are held")
+
+	fs.DurationVar(&anomalyInterval, "anomaly-interval", anomalyInterval, "interval request rates are baselined over")
+	fs.Float64Var(&anomalyThreshold, "anomaly-threshold", anomalyThreshold, "standard deviations above baseline that count as anomalous")
+	fs.IntVar(&anomalyMinCount, "anomaly-min-count", anomalyMinCount, "fewest requests in an interval that can be anomalous")
+	fs.BoolVar(&anomalyNotify, "anomaly-notify", anomalyNotify, "raise a notification for each anomaly")
+	fs.StringVar(&honeyIDList, "honey-ids", honeyIDList, "comma separated decoy IDs that raise an alert when looked up")
+	fs.StringVar(&notifyURL, "notify-url", notifyURL, "URL notifications are POSTed to as JSON")
+
+	fs.BoolVar(&startReadOnly, "read-only", startReadOnly, "start with the store read-only, refusing submissions")
+	fs.StringVar(&startReadOnlyReason, "read-only-reason", startReadOnlyReason, "reason reported while read-only")
+
+	return fs
+}
+
+// Flags that only steer config loading and are not settings themselves.
+var configMetaFlags = map[string]bool{"config": true, "print-config": true}
+
+// Settings holding credentials, which -print-config never shows.
+var configSecretFlags = map[string]bool{
+	"api-keys":        true,
+	"auth-jwt-secret": true,
+	"redis-password":  true,
+	"replication-key": true,
+	"shadow-key":      true,
+	"share-secret":    true,
+	"standby-key":     true,
+	"webhook-secret":  true,
+	"webhook-secrets": true,
+}
+
+func configEnvName(flagName string) string {
+	return "JMPC_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// loadConfig applies the config file, environment, and command line args to
+// the settings, then validates the result.
+func loadConfig(args []string) error {
+	if err := configFlags.Parse(args); err != nil {
+		return err
+	}
+
+	fromArgs := map[string]bool{}
+	configFlags.Visit(func(f *flag.Flag) { fromArgs[f.Name] = true })
+	configFlags.VisitAll(func(f *flag.Flag) { configSources[f.Name] = "default" })
+
+	if len(configFile) > 0 {
+		fileValues, err := readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		for name, value := range fileValues {
+			if configFlags.Lookup(name) == nil || configMetaFlags[name] {
+				return fmt.Errorf("config file %s: unknown setting %q", configFile, name)
+			}
+			if fromArgs[name] {
+				continue
+			}
+			if err := configFlags.Set(name, value); err != nil {
+				return fmt.Errorf("config file %s: %s: %v", configFile, name, err)
+			}
+			configSources[name] = "file"
+		}
+	}
+
+	var envErr error
+	configFlags.VisitAll(func(f *flag.Flag) {
+		envValue, found := os.LookupEnv(configEnvName(f.Name))
+		if !found || fromArgs[f.Name] || configMetaFlags[f.Name] || envErr != nil {
+			return
+		}
+		if err := configFlags.Set(f.Name, envValue); err != nil {
+			envErr = fmt.Errorf("%s: %v", configEnvName(f.Name), err)
+			return
+		}
+		configSources[f.Name] = "env"
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	for name := range fromArgs {
+		configSources[name] = "flag"
+	}
+
+	return validateConfig()
+}
+
+// validateConfig rejects settings the service cannot run with.
+func validateConfig() error {
+	if listenPort < 1 || listenPort > 65535 {
+		return fmt.Errorf("port %d out of range 1-65535", listenPort)
+	}
+	if hashDelay < 0 {
+		return fmt.Errorf("hash-delay %v must not be negative", hashDelay)
+	}
+	if workerCount < 1 {
+		return fmt.Errorf("workers %d must be at least 1", workerCount)
+	}
+	if queueDepth < 0 {
+		return fmt.Errorf("queue-depth %d must not be negative", queueDepth)
+	}
+	if queueBlockWarn < 0 {
+		return fmt.Errorf("queue-block-warn %v must not be negative", queueBlockWarn)
+	}
+	if len(nodeID) == 0 {
+		return fmt.Errorf("node-id must not be empty")
+	}
+
+	// Each subsystem checks its own settings.
+	for _, validate := range []func() error{
+		validateLogConfig,
+		validateHealthConfig,
+		validateTLSConfig,
+		validateGRPCConfig,
+		validateStoreConfig,
+		validateIDConfig,
+		validateAuthConfig,
+		validateAuthzConfig,
+		validateCORSConfig,
+		validateRateLimitConfig,
+		validateTenantConfig,
+		validateQuarantineConfig,
+		validateAnomalyConfig,
+		validateNotifyConfig,
+		validateSyncConfig,
+		validateBatchConfig,
+		validateRetentionConfig,
+		validateCompressConfig,
+		validateHoneyTokenConfig,
+		validateShareConfig,
+		validateWebhookConfig,
+		validateOutboundConfig,
+		validateEgressConfig,
+		validateCrashConfig,
+		validateLeakConfig,
+		validateShadowConfig,
+		validateCanaryConfig,
+		validateTimeoutConfig,
+		validateStatsCacheConfig,
+		validateStatsUnitsConfig,
+		validateTrendConfig,
+		validateJournalConfig,
+		validateTagConfig,
+		validateConnConfig,
+		validateStandbyConfig,
+		validateShutdownConfig,
+		validateDecommissionConfig,
+		validateDigestConfig,
+	} {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateHTTPURL parses raw as an absolute http or https URL, as settings
+// naming another service must be, with name, the setting, in the error.
+func validateHTTPURL(name, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("%s %q must be an http or https URL", name, raw)
+	}
+	return u, nil
+}
+
+// readConfigFile loads settings from a JSON object, or from flat "key: value"
+// YAML when the file is named *.yaml or *.yml.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseFlatYAML(f)
+	default:
+		return parseJSONConfig(f)
+	}
+}
+
+func parseJSONConfig(r io.Reader) (map[string]string, error) {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("config file: %v", err)
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+// parseFlatYAML understands the subset of YAML a flat settings file needs:
+// "key: value" lines, blank lines, comments, and optionally quoted values.
+func parseFlatYAML(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		sep := strings.Index(line, ":")
+		if sep < 1 {
+			return nil, fmt.Errorf("config file line %d: expected 'key: value'", lineNum)
+		}
+		key := strings.TrimSpace(line[:sep])
+		value := strings.TrimSpace(line[sep+1:])
+		if hash := strings.Index(value, " #"); hash >= 0 {
+			value = strings.TrimSpace(value[:hash])
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// writeEffectiveConfig prints each setting with its value and source, secrets
+// as <redacted> when set.
+func writeEffectiveConfig(w io.Writer) {
+	var names []string
+	configFlags.VisitAll(func(f *flag.Flag) {
+		if !configMetaFlags[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	for _, name := range names {
+		source := configSources[name]
+		if len(source) == 0 {
+			source = "default"
+		}
+		value := configFlags.Lookup(name).Value.String()
+		if configSecretFlags[name] && len(value) > 0 {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# %s\n", name, value, source)
+	}
+	tw.Flush()
+}
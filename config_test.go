@@ -0,0 +1,159 @@
+// Unit Tests for configuration loading.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSavedConfig restores every setting once the test is done with them,
+// and returns the restore func for tests that need it sooner.  Only those
+// changed are set back, as the live test server reads some as it runs;
+// tests must not change those, and check values through their validators'
+// helpers instead.
+func withSavedConfig(t *testing.T) func() {
+	saved := map[string]string{}
+	configFlags.VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	restore := func() {
+		// Set through the value, so the flags don't count as given on
+		// the command line to a later loadConfig.
+		for name, value := range saved {
+			if f := configFlags.Lookup(name); f.Value.String() != value {
+				f.Value.Set(value)
+			}
+		}
+	}
+	t.Cleanup(restore)
+	return restore
+}
+
+func TestParseFlatYAML(t *testing.T) {
+	values, err := parseFlatYAML(strings.NewReader(`
+---
+# comment
+port: 9090
+hash-delay: "2s"   # trailing comment
+node-id: 'web-01'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "9090" != values["port"] || "2s" != values["hash-delay"] || "web-01" != values["node-id"] {
+		t.Errorf("Unexpected values %v", values)
+	}
+
+	if _, err := parseFlatYAML(strings.NewReader("no separator here")); err == nil {
+		t.Errorf("Expected an error for a line without a key")
+	}
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	values, err := parseJSONConfig(strings.NewReader(`{"port": 9090, "hash-delay": "2s"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "9090" != values["port"] || "2s" != values["hash-delay"] {
+		t.Errorf("Unexpected values %v", values)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	withSavedConfig(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jmpc.json")
+	if err := ioutil.WriteFile(path, []byte(`{"port": 9001, "hash-delay": "1s", "workers": 2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JMPC_HASH_DELAY", "3s")
+	if err := loadConfig([]string{"-config", path, "-workers", "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if 9001 != listenPort || 3*time.Second != hashDelay || 4 != workerCount {
+		t.Errorf("Expected port 9001, delay 3s, workers 4; got %d, %v, %d", listenPort, hashDelay, workerCount)
+	}
+	if "file" != configSources["port"] || "env" != configSources["hash-delay"] || "flag" != configSources["workers"] {
+		t.Errorf("Unexpected sources %v", configSources)
+	}
+
+	var out bytes.Buffer
+	writeEffectiveConfig(&out)
+	if !strings.Contains(out.String(), "9001") || !strings.Contains(out.String(), "# env") {
+		t.Errorf("Expected effective config to show values and sources, got\n%s", out.String())
+	}
+}
+
+func TestEffectiveConfigRedactsSecrets(t *testing.T) {
+	withSavedConfig(t)
+
+	var secrets []string
+	for name := range configSecretFlags {
+		if configFlags.Lookup(name) == nil {
+			t.Fatalf("Secret setting %q is not a flag", name)
+		}
+		secret := "sekrit-" + name
+		if err := configFlags.Set(name, secret); err != nil {
+			t.Fatal(err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	var out bytes.Buffer
+	writeEffectiveConfig(&out)
+	for _, secret := range secrets {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("Expected %q redacted, got\n%s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "<redacted>") {
+		t.Errorf("Expected set secrets shown as redacted, got\n%s", out.String())
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	restore := withSavedConfig(t)
+
+	for _, args := range [][]string{
+		{"-port", "0"},
+		{"-workers", "0"},
+		{"-hash-delay", "-1s"},
+		{"-queue-depth", "-1"},
+	} {
+		if err := loadConfig(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+		restore()
+	}
+
+	if err := loadConfig([]string{"-config", "/nonexistent/jmpc.yaml"}); err == nil {
+		t.Errorf("Expected a missing config file to be rejected")
+	}
+}
+
+func TestValidateHTTPURL(t *testing.T) {
+	for raw, valid := range map[string]bool{
+		"https://auth.example.com/check": true,
+		"http://10.0.0.5:8080":           true,
+		"ftp://files.example.com":        false,
+		"auth.example.com":               false,
+		"http://:8080":                   false,
+		"https://":                       false,
+		"%zz":                            false,
+	} {
+		u, err := validateHTTPURL("authz-url", raw)
+		if valid != (err == nil) || valid != (u != nil) {
+			t.Errorf("%q: expected valid %v, got %v %v", raw, valid, u, err)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "authz-url ") {
+			t.Errorf("%q: expected the setting named, got %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Connection level metrics for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Most connections the API listener holds open at once; ones past it are
+// closed as soon as they are accepted.  0 for no limit.
+var maxConnections int = 0
+
+// Public: the API listener's connections, for diagnosing how a load
+// balancer in front is treating the node: churning connections shows up as
+// short ages and a high accepted count, idle pools as old ones.
+type connStats struct {
+	// Public: connections open now
+	Open int `json:"open"`
+	// Public: connections accepted, and closed at once for going past
+	// -max-connections
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	// Public: TLS connections that closed before their handshake finished
+	TLSHandshakeFailures uint64 `json:"tls_handshake_failures"`
+	// Public: age of the oldest connection open, in the stats' units
+	OldestOpen uint64 `json:"oldest_open"`
+	// Public: how long closed connections were open, in the stats' units
+	Age latencySummary `json:"age"`
+}
+
+// connTracker follows connections through http.Server's ConnState hook.
+type connTracker struct {
+	// Most open at once, 0 for no limit; -max-connections when serving.
+	limit       int
+	mu          sync.Mutex
+	open        map[net.Conn]time.Time
+	accepted    uint64
+	rejected    uint64
+	tlsFailures uint64
+	ages        latencyHistogram
+}
+
+var connections = connTracker{open: map[net.Conn]time.Time{}}
+
+// track is the ConnState hook.  A rejected connection is never added to
+// the open set, so its closing is not counted again.
+func (ct *connTracker) track(c net.Conn, state http.ConnState) {
+	now := time.Now()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		if ct.limit > 0 && len(ct.open) >= ct.limit {
+			ct.rejected++
+			c.Close()
+			return
+		}
+		ct.accepted++
+		ct.open[c] = now
+	case http.StateHijacked, http.StateClosed:
+		opened, found := ct.open[c]
+		if !found {
+			return
+		}
+		delete(ct.open, c)
+		ct.ages.record(durationMicros(now.Sub(opened)))
+		if tc, secure := c.(*tls.Conn); secure && state == http.StateClosed && !tc.ConnectionState().HandshakeComplete {
+			ct.tlsFailures++
+		}
+	}
+}
+
+func (ct *connTracker) snapshot(now time.Time) connStats {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	stats := connStats{
+		Open:                 len(ct.open),
+		Accepted:             ct.accepted,
+		Rejected:             ct.rejected,
+		TLSHandshakeFailures: ct.tlsFailures,
+		Age:                  ct.ages.summary(),
+	}
+	for _, opened := range ct.open {
+		if age := durationMicros(now.Sub(opened)); age > stats.OldestOpen {
+			stats.OldestOpen = age
+		}
+	}
+	return stats
+}
+
+// durationMicros gives a duration in microseconds, 0 if negative.  Unlike
+// timingMicros it isn't capped, as a pooled connection may well stay open
+// for days.
+func durationMicros(d time.Duration) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d.Microseconds())
+}
+
+// validateConnConfig checks the connection limit.
+func validateConnConfig() error {
+	if maxConnections < 0 {
+		return fmt.Errorf("max-connections %d must not be negative", maxConnections)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Unit Tests for the connection metrics.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trackedServer serves with a connection tracker of its own, closing
+// idle connections as soon as the test is done with them.
+func trackedServer(t *testing.T, ct *connTracker, secure bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.Config.ConnState = ct.track
+	if secure {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// waitFor polls until cond holds or a second has passed.
+func waitFor(cond func() bool) bool {
+	return waitForWithin(time.Second, cond)
+}
+
+// waitForWithin polls until cond holds or timeout has passed.
+func waitForWithin(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestConnTracking(t *testing.T) {
+	ct := connTracker{limit: 1, open: map[net.Conn]time.Time{}}
+	srv := trackedServer(t, &ct, false)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return 1 == ct.snapshot(time.Now()).Open }) {
+		t.Fatalf("Expected one connection open, got %+v", ct.snapshot(time.Now()))
+	}
+
+	// Past the limit, a second is closed as soon as it's accepted.
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _ := second.Read(make([]byte, 1)); n != 0 {
+		t.Errorf("Expected the second connection closed unread")
+	}
+	second.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	first.Close()
+	if !waitFor(func() bool { return 0 == ct.snapshot(time.Now()).Open }) {
+		t.Fatalf("Expected no connections open, got %+v", ct.snapshot(time.Now()))
+	}
+	stats := ct.snapshot(time.Now())
+	if 1 != stats.Accepted || 1 != stats.Rejected || 1 != stats.Age.Count || stats.Age.Min < 20000 || 0 != stats.TLSHandshakeFailures {
+		t.Errorf("Expected one accepted, open at least 20ms, and one rejected, got %+v", stats)
+	}
+}
+
+func TestConnTLSHandshakeFailures(t *testing.T) {
+	ct := connTracker{open: map[net.Conn]time.Time{}}
+	srv := trackedServer(t, &ct, true)
+
+	// A client that speaks plain HTTP to the TLS port never shakes hands.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	// One that does is fine.
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	srv.Client().CloseIdleConnections()
+
+	if !waitFor(func() bool { return 0 == ct.snapshot(time.Now()).Open }) {
+		t.Fatalf("Expected no connections open, got %+v", ct.snapshot(time.Now()))
+	}
+	if stats := ct.snapshot(time.Now()); 2 != stats.Accepted || 1 != stats.TLSHandshakeFailures {
+		t.Errorf("Expected one of two connections to fail its handshake, got %+v", stats)
+	}
+}
+
+func TestConnOldestOpen(t *testing.T) {
+	ct := connTracker{open: map[net.Conn]time.Time{}}
+	now := time.Now()
+	client, server := net.Pipe()
+	defer client.Close()
+	ct.track(server, http.StateNew)
+	ct.open[server] = now.Add(-time.Minute)
+	if stats := ct.snapshot(now); 1 != stats.Open || uint64(time.Minute.Microseconds()) != stats.OldestOpen {
+		t.Errorf("Expected one connection a minute old, got %+v", stats)
+	}
+	ct.track(server, http.StateClosed)
+	if stats := ct.snapshot(now); 0 != stats.Open || 0 != stats.OldestOpen || 1 != stats.Age.Count {
+		t.Errorf("Expected the connection closed and its age recorded, got %+v", stats)
+	}
+}
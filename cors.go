@@ -0,0 +1,127 @@
+// Cross-origin resource sharing for browser clients.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comma separated origins, e.g. https://app.example.com, browsers may call
+// the API from, or "*" for any.  Empty denies every cross-origin call.
+var corsOriginList string
+
+// What a cross-origin request may use, and how long a browser may cache a
+// preflight's answer.
+var corsMethods string = "GET, POST"
+var corsHeaders string = "Authorization, X-Api-Key, Content-Type, Accept, X-JMPC-Tags, X-JMPC-Checksum"
+var corsMaxAge time.Duration = 10 * time.Minute
+
+// Response headers scripts on other origins may read.
+const corsExposedHeaders = "X-JMPC-Id, X-JMPC-Node, X-JMPC-Queue-Time, X-JMPC-Process-Time, X-Request-Id, Server-Timing, " +
+	"X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, ETag, X-JMPC-Error-Code, X-JMPC-Stats-Age"
+
+// corsPolicy is the parsed CORS settings.
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	methods   string
+	headers   string
+	maxAge    string
+}
+
+var cors = &corsPolicy{}
+
+func (cp *corsPolicy) allows(origin string) bool {
+	return cp.anyOrigin || cp.origins[strings.ToLower(origin)]
+}
+
+// withCORS answers preflights and marks responses to allowed origins.
+// Preflights carry no credentials, so this goes ahead of authentication.
+// Requests from other origins pass through untouched, leaving the browser
+// to block them, and their preflights are refused.
+func withCORS(cp *corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0
+
+		if !cp.allows(origin) {
+			if preflight {
+				logDebug("Refused CORS preflight", "origin", origin, "request_id", requestID(r))
+				writeError(w, r, "Origin not allowed.", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowOrigin := origin
+		if cp.anyOrigin {
+			allowOrigin = "*"
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", cp.methods)
+			w.Header().Set("Access-Control-Allow-Headers", cp.headers)
+			w.Header().Set("Access-Control-Max-Age", cp.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitCORSList trims the entries of a comma separated setting.
+func splitCORSList(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// validateCORSConfig checks and parses the CORS settings.
+func validateCORSConfig() error {
+	cp := &corsPolicy{origins: map[string]bool{}}
+	for _, origin := range splitCORSList(corsOriginList) {
+		if origin == "*" {
+			cp.anyOrigin = true
+			continue
+		}
+		u, err := validateHTTPURL("cors-origins", origin)
+		if err != nil || len(strings.TrimSuffix(u.Path, "/")) > 0 || len(u.RawQuery) > 0 {
+			return fmt.Errorf("cors-origins: %q must be * or an origin such as https://app.example.com", origin)
+		}
+		cp.origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+
+	methods := splitCORSList(corsMethods)
+	if len(methods) == 0 {
+		return fmt.Errorf("cors-methods must name at least one method")
+	}
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(method)
+	}
+	cp.methods = strings.Join(methods, ", ")
+	cp.headers = strings.Join(splitCORSList(corsHeaders), ", ")
+
+	if corsMaxAge < 0 {
+		return fmt.Errorf("cors-max-age %v must not be negative", corsMaxAge)
+	}
+	cp.maxAge = strconv.Itoa(int(corsMaxAge.Seconds()))
+
+	cors = cp
+	return nil
+}
@@ -0,0 +1,96 @@
+// Unit Tests for cross-origin resource sharing.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsRequest(cp *corsPolicy, method, origin string, preflight bool) *httptest.ResponseRecorder {
+	h := withCORS(cp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest(method, "/hash", nil)
+	if len(origin) > 0 {
+		req.Header.Set("Origin", origin)
+	}
+	if preflight {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORS(t *testing.T) {
+	defer validateCORSConfig()
+	defer withSavedConfig(t)()
+
+	corsOriginList, corsMaxAge = "https://App.example.com, http://localhost:3000", time.Hour
+	if err := validateCORSConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := corsRequest(cors, "OPTIONS", "https://app.example.com", true)
+	if http.StatusNoContent != rec.Code || "https://app.example.com" != rec.Header().Get("Access-Control-Allow-Origin") {
+		t.Errorf("Expected the preflight allowed, got [%d] %v", rec.Code, rec.Header())
+	}
+	if "GET, POST" != rec.Header().Get("Access-Control-Allow-Methods") || "3600" != rec.Header().Get("Access-Control-Max-Age") {
+		t.Errorf("Unexpected preflight headers %v", rec.Header())
+	}
+
+	rec = corsRequest(cors, "POST", "http://localhost:3000", false)
+	if http.StatusTeapot != rec.Code || "http://localhost:3000" != rec.Header().Get("Access-Control-Allow-Origin") ||
+		len(rec.Header().Get("Access-Control-Expose-Headers")) == 0 {
+		t.Errorf("Expected the request passed on with CORS headers, got [%d] %v", rec.Code, rec.Header())
+	}
+
+	// Unlisted origins are refused, same-origin requests are left alone.
+	rec = corsRequest(cors, "OPTIONS", "https://evil.example.com", true)
+	if http.StatusForbidden != rec.Code || len(rec.Header().Get("Access-Control-Allow-Origin")) > 0 {
+		t.Errorf("Expected the preflight refused, got [%d] %v", rec.Code, rec.Header())
+	}
+	rec = corsRequest(cors, "POST", "https://evil.example.com", false)
+	if http.StatusTeapot != rec.Code || len(rec.Header().Get("Access-Control-Allow-Origin")) > 0 {
+		t.Errorf("Expected no CORS headers, got %v", rec.Header())
+	}
+	rec = corsRequest(cors, "POST", "", false)
+	if http.StatusTeapot != rec.Code || len(rec.Header().Get("Vary")) > 0 {
+		t.Errorf("Expected a request without Origin untouched, got %v", rec.Header())
+	}
+
+	corsOriginList = "*"
+	validateCORSConfig()
+	if rec = corsRequest(cors, "GET", "https://anywhere.example", false); "*" != rec.Header().Get("Access-Control-Allow-Origin") {
+		t.Errorf("Expected any origin allowed, got %v", rec.Header())
+	}
+}
+
+func TestCORSDenyByDefault(t *testing.T) {
+	if rec := corsRequest(&corsPolicy{}, "OPTIONS", "https://app.example.com", true); http.StatusForbidden != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	defer validateCORSConfig()
+	defer withSavedConfig(t)()
+
+	for _, origin := range []string{"app.example.com", "ftp://files.example.com", "https://app.example.com/path", "https://:8443"} {
+		corsOriginList = origin
+		if err := validateCORSConfig(); err == nil {
+			t.Errorf("Expected origin %q rejected", origin)
+		}
+	}
+	corsOriginList, corsMethods = "", " , "
+	if err := validateCORSConfig(); err == nil {
+		t.Errorf("Expected an empty method list rejected")
+	}
+	corsMethods, corsMaxAge = "get,post", -time.Second
+	if err := validateCORSConfig(); err == nil {
+		t.Errorf("Expected a negative max age rejected")
+	}
+}
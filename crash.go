@@ -0,0 +1,130 @@
+// Crash reports for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Directory a JSON crash report is written to for each panic, and URL it is
+// POSTed to.  Either or both may be empty to skip that.
+var crashDir string
+var crashURL string
+
+// Public: what is known about a panic, for a postmortem.
+type crashReport struct {
+	Time    time.Time     `json:"time"`
+	Node    string        `json:"node"`
+	Panic   string        `json:"panic"`
+	Stack   string        `json:"stack"`
+	Request *crashRequest `json:"request,omitempty"`
+	Build   crashBuild    `json:"build"`
+}
+
+// Public: the request being handled when the panic happened.
+type crashRequest struct {
+	ID       string `json:"id"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Identity string `json:"identity,omitempty"`
+}
+
+// Public: the binary that crashed.
+type crashBuild struct {
+	GoVersion string `json:"go_version"`
+	Path      string `json:"path,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func currentBuild() crashBuild {
+	build := crashBuild{GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return build
+	}
+	build.Path = info.Main.Path
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+// reportCrash files a crash report for a panic, r being the request in hand
+// or nil.  It is synchronous, since the process may be about to exit.
+func reportCrash(p interface{}, stack []byte, r *http.Request) {
+	if len(crashDir) == 0 && len(crashURL) == 0 {
+		return
+	}
+	report := crashReport{
+		Time:  time.Now().UTC(),
+		Node:  nodeID,
+		Panic: fmt.Sprint(p),
+		Stack: string(stack),
+		Build: currentBuild(),
+	}
+	if r != nil {
+		report.Request = &crashRequest{ID: requestID(r), Method: r.Method, Path: r.URL.Path}
+		if key, ok := authIdentity(r); ok {
+			report.Request.Identity = key.name
+		}
+	}
+	body, _ := json.MarshalIndent(report, "", "  ")
+
+	if len(crashDir) > 0 {
+		name := filepath.Join(crashDir, "crash-"+report.Time.Format("20060102T150405.000000000")+".json")
+		if err := os.WriteFile(name, body, 0600); err != nil {
+			logError("Could not write crash report", "dir", crashDir, "error", err)
+		} else {
+			logError("Crash report written", "file", name)
+		}
+	}
+	if len(crashURL) > 0 {
+		resp, err := newInternalClient().Post(crashURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logError("Crash report delivery failed", "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logError("Crash report delivery failed", "status", resp.Status)
+		}
+	}
+}
+
+// reportPanics, deferred at the top of a background goroutine, files a
+// crash report for a panic escaping it and then lets the panic carry on.
+func reportPanics() {
+	if p := recover(); p != nil {
+		reportCrash(p, debug.Stack(), nil)
+		panic(p)
+	}
+}
+
+// validateCrashConfig checks the crash report settings.
+func validateCrashConfig() error {
+	if len(crashDir) > 0 {
+		if fi, err := os.Stat(crashDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("crash-dir %q must be an existing directory", crashDir)
+		}
+	}
+	if len(crashURL) > 0 {
+		if _, err := validateHTTPURL("crash-url", crashURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Unit Tests for crash reports.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCrashReport(t *testing.T) {
+	defer withSavedConfig(t)()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	posted := make(chan crashReport, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report crashReport
+		json.NewDecoder(r.Body).Decode(&report)
+		posted <- report
+	}))
+	defer collector.Close()
+	crashDir, crashURL = t.TempDir(), collector.URL
+	if err := validateCrashConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("kaboom")
+	}))
+	req := httptest.NewRequest("POST", "/hash", nil)
+	req = req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: "alice"}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	files, _ := filepath.Glob(filepath.Join(crashDir, "crash-*.json"))
+	if 1 != len(files) {
+		t.Fatalf("Expected one crash report file, got %v", files)
+	}
+	raw, _ := os.ReadFile(files[0])
+	var written crashReport
+	if err := json.Unmarshal(raw, &written); err != nil {
+		t.Fatal(err)
+	}
+	if "kaboom" != written.Panic || !strings.Contains(written.Stack, "TestCrashReport") ||
+		written.Request == nil || "alice" != written.Request.Identity || "/hash" != written.Request.Path ||
+		len(written.Build.GoVersion) == 0 {
+		t.Errorf("Unexpected crash report %+v", written)
+	}
+	if report := <-posted; "kaboom" != report.Panic {
+		t.Errorf("Expected the report POSTed too, got %+v", report)
+	}
+
+	crashDir, crashURL = filepath.Join(crashDir, "missing"), ""
+	if err := validateCrashConfig(); err == nil {
+		t.Errorf("Expected a missing crash directory rejected")
+	}
+	crashDir, crashURL = "", "collector:80"
+	if err := validateCrashConfig(); err == nil {
+		t.Errorf("Expected a crash URL without a scheme rejected")
+	}
+	crashURL = "http://:80/crashes"
+	if err := validateCrashConfig(); err == nil {
+		t.Errorf("Expected a crash URL without a host name rejected")
+	}
+}
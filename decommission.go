@@ -0,0 +1,398 @@
+// Staged decommissioning of a node, for retiring it from a fleet.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Longest a decommission waits for the node to drain, and again for its
+// successor to catch up, before giving up; the node is left read-only then,
+// so nothing is lost by trying again.
+var decommissionTimeout time.Duration = 10 * time.Minute
+
+// How often a decommission checks on draining and on the successor.
+var decommissionPoll = time.Second
+
+// Decommission and step states reported by /admin/decommission.
+const (
+	decommissionIdle    = "idle"
+	decommissionPending = "pending"
+	decommissionRunning = "running"
+	decommissionSkipped = "skipped"
+	decommissionFailed  = "failed"
+	decommissionDone    = "done"
+)
+
+// Public: response body of /admin/decommission.
+type decommissionReport struct {
+	State     string             `json:"state"`
+	Successor string             `json:"successor,omitempty"`
+	Force     bool               `json:"force,omitempty"`
+	Steps     []decommissionStep `json:"steps,omitempty"`
+}
+
+// Public: progress of one step of a decommission.
+type decommissionStep struct {
+	Name     string     `json:"name"`
+	State    string     `json:"state"`
+	Detail   string     `json:"detail,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// decommissionPlan is what a decommission was started with.  successor is
+// the base URL of a standby of this node, none if empty, and key the
+// replication key its /export is called with.  force carries on past held requests and
+// a missing successor, which loses their results.
+type decommissionPlan struct {
+	successor string
+	key       string
+	force     bool
+	client    *http.Client
+}
+
+// decommissioner runs one decommission at a time: drain, hand off to the
+// successor, verify it has every result, then shut down.
+type decommissioner struct {
+	mu     sync.Mutex
+	report decommissionReport
+	plan   decommissionPlan
+}
+
+var decommission decommissioner
+
+// Steps of a decommission, in order.  Each reports a detail for progress,
+// and whether it was skipped.
+var decommissionSteps = []struct {
+	name string
+	run  func(d *decommissioner, ctx context.Context, step int) (string, bool, error)
+}{
+	{"drain", (*decommissioner).drain},
+	{"handoff", (*decommissioner).handoff},
+	{"verify", (*decommissioner).verify},
+	{"shutdown", nil},
+}
+
+// start begins a decommission, with shutdown called once every other step
+// is done.  It reports false, and the decommission under way, if one is
+// running or has finished; a failed one can be started again.
+func (d *decommissioner) start(plan decommissionPlan, shutdown func()) (decommissionReport, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.report.State == decommissionRunning || d.report.State == decommissionDone {
+		return d.copyReport(), false
+	}
+	d.plan = plan
+	d.report = decommissionReport{State: decommissionRunning, Successor: plan.successor, Force: plan.force}
+	for _, step := range decommissionSteps {
+		d.report.Steps = append(d.report.Steps, decommissionStep{Name: step.name, State: decommissionPending})
+	}
+	go d.run(shutdown)
+	return d.copyReport(), true
+}
+
+func (d *decommissioner) run(shutdown func()) {
+	for i, step := range decommissionSteps {
+		d.update(i, decommissionRunning, "")
+		if step.run == nil {
+			shutdown()
+			d.update(i, decommissionDone, "Shutdown requested.")
+			break
+		}
+		detail, skipped, err := step.run(d, context.Background(), i)
+		switch {
+		case err != nil:
+			d.update(i, decommissionFailed, err.Error())
+			logError("Decommission failed", "step", step.name, "error", err)
+			d.mu.Lock()
+			d.report.State = decommissionFailed
+			d.mu.Unlock()
+			return
+		case skipped:
+			d.update(i, decommissionSkipped, detail)
+		default:
+			d.update(i, decommissionDone, detail)
+		}
+		logInfo("Decommission step finished", "step", step.name, "detail", detail)
+	}
+	d.mu.Lock()
+	d.report.State = decommissionDone
+	d.mu.Unlock()
+}
+
+// update sets a step's state and detail, timing it as it starts and ends.
+func (d *decommissioner) update(step int, state, detail string) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := &d.report.Steps[step]
+	switch state {
+	case decommissionRunning:
+		s.Started = &now
+	case decommissionDone, decommissionSkipped, decommissionFailed:
+		if s.Started == nil {
+			s.Started = &now
+		}
+		s.Finished = &now
+	}
+	s.State, s.Detail = state, detail
+}
+
+// progress sets a running step's detail.
+func (d *decommissioner) progress(step int, detail string) {
+	d.mu.Lock()
+	d.report.Steps[step].Detail = detail
+	d.mu.Unlock()
+}
+
+func (d *decommissioner) get() decommissionReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.copyReport()
+}
+
+// copyReport copies the report, with d.mu held, so it can be encoded
+// while the steps go on.
+func (d *decommissioner) copyReport() decommissionReport {
+	rep := d.report
+	if rep.State == "" {
+		rep.State = decommissionIdle
+	}
+	rep.Steps = append([]decommissionStep(nil), d.report.Steps...)
+	return rep
+}
+
+// drain turns submissions away and waits until every request issued is
+// hashed or discarded.  Requests held in quarantine never will be, so they
+// fail it unless forced.
+func (d *decommissioner) drain(ctx context.Context, step int) (string, bool, error) {
+	storeReadOnly.set(true, "decommissioning")
+	deadline := time.Now().Add(decommissionTimeout)
+	for {
+		issued, settled := atomic.LoadUint64(&hashRequests), settledRequests()
+		if settled >= issued {
+			break
+		}
+		d.progress(step, fmt.Sprintf("%d requests still being hashed.", issued-settled))
+		if time.Now().After(deadline) {
+			return "", false, fmt.Errorf("%d requests still unsettled after %v", issued-settled, decommissionTimeout)
+		}
+		time.Sleep(decommissionPoll)
+	}
+	if held := quarantineCount(); held > 0 {
+		if !d.plan.force {
+			return "", false, fmt.Errorf("%d requests held in quarantine; release or reject them, or force", held)
+		}
+		return fmt.Sprintf("Drained, abandoning %d requests held in quarantine.", held), false, nil
+	}
+	return "Drained.", false, nil
+}
+
+// handoff waits until the successor has a copy of every result here.
+func (d *decommissioner) handoff(ctx context.Context, step int) (string, bool, error) {
+	if skip, detail := d.skipSuccessor(); skip {
+		return detail, true, nil
+	}
+	if len(d.plan.successor) == 0 {
+		return "", false, fmt.Errorf("no successor to hand results off to; name one, or force")
+	}
+	local := localResults()
+	deadline := time.Now().Add(decommissionTimeout)
+	for {
+		missing, _, err := d.compare(ctx, local)
+		total := local.count()
+		switch {
+		case err != nil:
+			d.progress(step, fmt.Sprintf("Could not reach successor: %v", err))
+		case len(missing) == 0:
+			return fmt.Sprintf("Successor has all %d results.", total), false, nil
+		default:
+			d.progress(step, fmt.Sprintf("Successor has %d of %d results; missing tenants %s.",
+				total-missing.count(), total, strings.Join(missingTenants(missing), ",")))
+		}
+		if time.Now().After(deadline) {
+			detail := d.get().Steps[step].Detail
+			return "", false, fmt.Errorf("successor not caught up after %v: %s", decommissionTimeout, detail)
+		}
+		time.Sleep(decommissionPoll)
+	}
+}
+
+// verify checks once more that the successor has every result, and with
+// the same digest, now nothing more can arrive.
+func (d *decommissioner) verify(ctx context.Context, step int) (string, bool, error) {
+	if skip, detail := d.skipSuccessor(); skip {
+		return detail, true, nil
+	}
+	local := localResults()
+	missing, differing, err := d.compare(ctx, local)
+	switch {
+	case err != nil:
+		return "", false, fmt.Errorf("could not read successor: %v", err)
+	case len(missing) > 0:
+		return "", false, fmt.Errorf("successor is missing %d results", missing.count())
+	case len(differing) > 0:
+		return "", false, fmt.Errorf("successor has different digests for IDs %s", formatIDs(differing))
+	}
+	return fmt.Sprintf("Successor holds all %d results with matching digests.", local.count()), false, nil
+}
+
+// skipSuccessor reports whether there is nothing to hand off: results in
+// Redis stay there for the other replicas, and a forced decommission with
+// no successor abandons them.
+func (d *decommissioner) skipSuccessor() (bool, string) {
+	switch {
+	case storeBackend == "redis":
+		return true, "Results are kept in Redis for the other replicas."
+	case len(d.plan.successor) == 0 && d.plan.force:
+		return true, fmt.Sprintf("No successor; %d results abandoned.", localResults().count())
+	}
+	return false, ""
+}
+
+// tenantResults are digests by ID, by tenant.
+type tenantResults map[string]map[uint64]string
+
+func (tr tenantResults) count() int {
+	n := 0
+	for _, results := range tr {
+		n += len(results)
+	}
+	return n
+}
+
+// localResults gathers every result held here.
+func localResults() tenantResults {
+	results := tenantResults{}
+	forEachIssuedID(0, func(idNum uint64) bool {
+		tenant := store.owner(idNum)
+		if hRes, found := store.load(resultKey{tenant, idNum}); found {
+			if results[tenant] == nil {
+				results[tenant] = map[uint64]string{}
+			}
+			results[tenant][idNum] = hRes.b64Str
+		}
+		return true
+	})
+	return results
+}
+
+// compare reads the successor's export of each tenant with results here,
+// giving the IDs it is missing, by tenant, and those it has a different
+// digest for.
+func (d *decommissioner) compare(ctx context.Context, local tenantResults) (tenantResults, []uint64, error) {
+	missing := tenantResults{}
+	var differing []uint64
+	for tenant, results := range local {
+		theirs := map[uint64]string{}
+		_, err := streamWholeExport(ctx, d.plan.client, d.plan.successor, d.plan.key, tenant, func(record exportRecord) error {
+			theirs[record.ID] = record.Digest
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for idNum, digest := range results {
+			switch got, found := theirs[idNum]; {
+			case !found:
+				if missing[tenant] == nil {
+					missing[tenant] = map[uint64]string{}
+				}
+				missing[tenant][idNum] = digest
+			case got != digest:
+				differing = append(differing, idNum)
+			}
+		}
+	}
+	sort.Slice(differing, func(i, j int) bool { return differing[i] < differing[j] })
+	return missing, differing, nil
+}
+
+// missingTenants names the tenants with results missing, sorted, with
+// requests made without authenticating shown as "(none)".
+func missingTenants(missing tenantResults) []string {
+	var tenants []string
+	for tenant := range missing {
+		if len(tenant) == 0 {
+			tenant = "(none)"
+		}
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// formatIDs lists up to ten IDs, noting how many more there are.
+func formatIDs(ids []uint64) string {
+	var shown []string
+	for i, idNum := range ids {
+		if i == 10 {
+			shown = append(shown, fmt.Sprintf("and %d more", len(ids)-i))
+			break
+		}
+		shown = append(shown, strconv.FormatUint(idNum, 10))
+	}
+	return strings.Join(shown, ", ")
+}
+
+// decommissionHandler serves /admin/decommission: GET reports progress,
+// and POST starts a decommission, with form fields "successor", the base
+// URL of a standby of this node, "successor_key", its replication key, and
+// "force".  stop closes the server down, as for /shutdown.
+func decommissionHandler(stop func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, decommission.get())
+
+		case http.MethodPost:
+			plan := decommissionPlan{
+				successor: strings.TrimSuffix(r.FormValue("successor"), "/"),
+				key:       r.FormValue("successor_key"),
+				client:    newInternalClient(),
+			}
+			if value := r.FormValue("force"); len(value) > 0 {
+				force, err := strconv.ParseBool(value)
+				if err != nil {
+					writeError(w, r, "Form field 'force' must be true or false.", http.StatusBadRequest)
+					return
+				}
+				plan.force = force
+			}
+			if len(plan.successor) > 0 {
+				if _, err := validateHTTPURL("successor", plan.successor); err != nil {
+					writeError(w, r, "Form field 'successor' must be an http or https URL.", http.StatusBadRequest)
+					return
+				}
+			}
+			rep, started := decommission.start(plan, func() { serverShutdown.request(time.Now(), stop) })
+			if !started {
+				writeJSON(w, http.StatusConflict, rep)
+				return
+			}
+			logWarn("Decommission started", "request_id", requestID(r), "successor", plan.successor, "force", plan.force)
+			writeJSON(w, http.StatusAccepted, rep)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// validateDecommissionConfig checks the decommission settings.
+func validateDecommissionConfig() error {
+	if decommissionTimeout <= 0 {
+		return fmt.Errorf("decommission-timeout %v must be positive", decommissionTimeout)
+	}
+	return nil
+}
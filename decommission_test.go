@@ -0,0 +1,212 @@
+// Unit Tests for decommissioning.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSuccessor serves /export of the records it has been given, by tenant.
+type fakeSuccessor struct {
+	mu      sync.Mutex
+	records map[string][]exportRecord
+}
+
+func (fs *fakeSuccessor) add(tenant string, record exportRecord) {
+	fs.mu.Lock()
+	fs.records[tenant] = append(fs.records[tenant], record)
+	fs.mu.Unlock()
+}
+
+func (fs *fakeSuccessor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	named, found := r.URL.Query()["tenant"]
+	if "successor-replication" != r.Header.Get("X-JMPC-Replication-Key") || "/export" != r.URL.Path || !found {
+		http.Error(w, "no", http.StatusForbidden)
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	enc := json.NewEncoder(w)
+	for _, record := range fs.records[named[0]] {
+		enc.Encode(record)
+	}
+}
+
+// withDecommissionResults stores results for the tenants given here, as a
+// standby would have, and returns them with a func removing them again.
+func withDecommissionResults(t *testing.T, tenants ...string) ([]exportRecord, func()) {
+	oldPoll, oldReplicated := decommissionPoll, atomic.LoadUint64(&replicatedCount)
+	restoreIDs := withFreshIDs()
+	idStrategy = "random"
+	validateIDConfig()
+	decommissionPoll = 10 * time.Millisecond
+
+	const base = 1 << 43
+	var records []exportRecord
+	for i, tenant := range tenants {
+		record := exportRecord{ID: base + uint64(i), Digest: fmt.Sprintf("digest-%d", i)}
+		if _, err := copyRecord(tenant, record); err != nil {
+			t.Fatalf("Could not store %+v: %v", record, err)
+		}
+		records = append(records, record)
+	}
+	return records, func() {
+		for i, record := range records {
+			resultMap.Delete(resultKey{tenants[i], record.ID})
+		}
+		restoreIDs()
+		decommissionPoll = oldPoll
+		atomic.StoreUint64(&replicatedCount, oldReplicated)
+		storeReadOnly.set(false, "")
+	}
+}
+
+func waitDecommission(t *testing.T, d *decommissioner) decommissionReport {
+	if !waitFor(func() bool { return decommissionRunning != d.get().State }) {
+		t.Fatalf("Expected the decommission to finish, got %+v", d.get())
+	}
+	return d.get()
+}
+
+func TestDecommissionHandsOffAndShutsDown(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	tenants := []string{"", "acme", ""}
+	records, restore := withDecommissionResults(t, tenants...)
+	defer restore()
+
+	// The successor is a record behind at first.
+	successor := &fakeSuccessor{records: map[string][]exportRecord{}}
+	for i, record := range records[:2] {
+		successor.add(tenants[i], record)
+	}
+	server := httptest.NewServer(successor)
+	defer server.Close()
+
+	var d decommissioner
+	var shutdowns int32
+	plan := decommissionPlan{successor: server.URL, key: "successor-replication", client: server.Client()}
+	if rep, started := d.start(plan, func() { atomic.AddInt32(&shutdowns, 1) }); !started || 4 != len(rep.Steps) {
+		t.Fatalf("Expected a decommission of four steps started, got %+v", rep)
+	}
+	if !waitFor(func() bool { return strings.HasPrefix(d.get().Steps[1].Detail, "Successor has 2 of 3") }) {
+		t.Fatalf("Expected handoff progress, got %+v", d.get())
+	}
+	if rep, started := d.start(plan, func() {}); started || decommissionRunning != rep.State {
+		t.Errorf("Expected a running decommission not started again, got %+v", rep)
+	}
+	if !storeReadOnly.get().ReadOnly {
+		t.Errorf("Expected submissions refused while decommissioning")
+	}
+
+	successor.add(tenants[2], records[2])
+	rep := waitDecommission(t, &d)
+	if decommissionDone != rep.State || 1 != atomic.LoadInt32(&shutdowns) {
+		t.Fatalf("Expected a finished decommission shut down once, got %+v after %d", rep, shutdowns)
+	}
+	for _, step := range rep.Steps {
+		if decommissionDone != step.State || nil == step.Started || nil == step.Finished {
+			t.Errorf("Expected step %s done, got %+v", step.Name, step)
+		}
+	}
+	if "Successor holds all 3 results with matching digests." != rep.Steps[2].Detail {
+		t.Errorf("Expected verify to count every result, got %q", rep.Steps[2].Detail)
+	}
+}
+
+func TestDecommissionVerifyFailsOnDifferentDigest(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	records, restore := withDecommissionResults(t, "")
+	defer restore()
+
+	successor := &fakeSuccessor{records: map[string][]exportRecord{}}
+	successor.add("", exportRecord{ID: records[0].ID, Digest: "tampered"})
+	server := httptest.NewServer(successor)
+	defer server.Close()
+
+	var d decommissioner
+	var shutdowns int32
+	d.start(decommissionPlan{successor: server.URL, key: "successor-replication", client: server.Client()},
+		func() { atomic.AddInt32(&shutdowns, 1) })
+	rep := waitDecommission(t, &d)
+	if decommissionFailed != rep.State || decommissionFailed != rep.Steps[2].State || 0 != atomic.LoadInt32(&shutdowns) {
+		t.Fatalf("Expected verify to fail without shutting down, got %+v", rep)
+	}
+	if want := fmt.Sprintf("successor has different digests for IDs %d", records[0].ID); want != rep.Steps[2].Detail {
+		t.Errorf("Expected %q, got %q", want, rep.Steps[2].Detail)
+	}
+	if decommissionPending != rep.Steps[3].State || !storeReadOnly.get().ReadOnly {
+		t.Errorf("Expected a failed decommission to stay read-only and go no further, got %+v", rep)
+	}
+}
+
+func TestDecommissionWithoutSuccessor(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	_, restore := withDecommissionResults(t, "", "acme")
+	defer restore()
+
+	var d decommissioner
+	var shutdowns int32
+	shutdown := func() { atomic.AddInt32(&shutdowns, 1) }
+	d.start(decommissionPlan{}, shutdown)
+	rep := waitDecommission(t, &d)
+	if decommissionFailed != rep.State || decommissionFailed != rep.Steps[1].State {
+		t.Fatalf("Expected handoff to fail without a successor, got %+v", rep)
+	}
+
+	// A failed decommission can be started again, here forced.
+	if _, started := d.start(decommissionPlan{force: true}, shutdown); !started {
+		t.Fatalf("Expected a failed decommission to start again")
+	}
+	rep = waitDecommission(t, &d)
+	if decommissionDone != rep.State || 1 != atomic.LoadInt32(&shutdowns) {
+		t.Fatalf("Expected a forced decommission to finish, got %+v", rep)
+	}
+	if decommissionSkipped != rep.Steps[1].State || "No successor; 2 results abandoned." != rep.Steps[1].Detail ||
+		decommissionSkipped != rep.Steps[2].State {
+		t.Errorf("Expected the hand off skipped with a count of results lost, got %+v", rep.Steps)
+	}
+	if rep, started := d.start(decommissionPlan{force: true}, shutdown); started || decommissionDone != rep.State {
+		t.Errorf("Expected a finished decommission not started again, got %+v", rep)
+	}
+}
+
+func TestDecommissionHandler(t *testing.T) {
+	handler := decommissionHandler(func() {})
+	cases := []struct {
+		method, form string
+		status       int
+	}{
+		{"GET", "", http.StatusOK},
+		{"POST", "force=maybe", http.StatusBadRequest},
+		{"POST", "successor=ftp://standby", http.StatusBadRequest},
+		{"POST", "successor=http://:8080", http.StatusBadRequest},
+		{"DELETE", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/admin/decommission", strings.NewReader(c.form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if c.status != rec.Code {
+			t.Errorf("Expected %d for %s %q, got %d: %s", c.status, c.method, c.form, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/admin/decommission", nil))
+	var rep decommissionReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil || decommissionIdle != rep.State {
+		t.Errorf("Expected an idle report, got %s", rec.Body)
+	}
+}
@@ -0,0 +1,158 @@
+// The "jmpc diff" subcommand: identical traffic at two instances, compared.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One side's answer to one request.
+type diffAnswer struct {
+	status   int
+	body     string
+	duration time.Duration
+	err      error
+}
+
+func (a diffAnswer) String() string {
+	if a.err != nil {
+		return "error: " + a.err.Error()
+	}
+	return fmt.Sprintf("%d %q", a.status, a.body)
+}
+
+// diffTarget is one instance under comparison.
+type diffTarget struct {
+	base   string
+	apiKey string
+	client *http.Client
+}
+
+// submit makes a synchronous submission, so the answer is the digest.
+func (dt diffTarget) submit(password string) diffAnswer {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(dt.base, "/")+"/hash?wait=true",
+		strings.NewReader(url.Values{"password": {password}}.Encode()))
+	if err != nil {
+		return diffAnswer{err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(dt.apiKey) > 0 {
+		req.Header.Set("X-Api-Key", dt.apiKey)
+	}
+
+	t0 := time.Now()
+	resp, err := dt.client.Do(req)
+	if err != nil {
+		return diffAnswer{err: err, duration: time.Now().Sub(t0)}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	return diffAnswer{status: resp.StatusCode, body: strings.TrimSpace(string(body)), duration: time.Now().Sub(t0), err: err}
+}
+
+// diverges reports whether two answers to the same request disagree.  IDs
+// differ between instances, so only the status and digest are compared.
+func diverges(a, b diffAnswer) bool {
+	if (a.err != nil) != (b.err != nil) || a.status != b.status {
+		return true
+	}
+	return a.err == nil && a.status == http.StatusOK && a.body != b.body
+}
+
+// durationPercentile returns the p'th percentile of sorted durations.
+func durationPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func writeDiffLatency(out io.Writer, name string, durations []time.Duration) {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	fmt.Fprintf(out, "latency %s: p50 %v  p95 %v  max %v\n", name,
+		durationPercentile(durations, 0.5).Truncate(time.Microsecond),
+		durationPercentile(durations, 0.95).Truncate(time.Microsecond),
+		durationPercentile(durations, 1).Truncate(time.Microsecond))
+}
+
+// runDiff drives the same submissions at two instances, e.g. the current
+// and a new version, and reports where their answers and latencies part
+// ways.  It returns the process exit code: 1 if any answers diverged.
+func runDiff(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("jmpc diff", flag.ContinueOnError)
+	fs.SetOutput(out)
+	baseA := fs.String("a", "", "base URL of the first instance, e.g. http://old:8080")
+	baseB := fs.String("b", "", "base URL of the second instance")
+	keyA := fs.String("a-key", "", "API key for the first instance, if it needs one")
+	keyB := fs.String("b-key", "", "API key for the second instance, if it needs one")
+	count := fs.Int("n", 20, "submissions to make")
+	concurrency := fs.Int("concurrency", 4, "submissions in flight at once")
+	timeout := fs.Duration("timeout", time.Minute, "longest one submission may take, the hash delay included")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if len(*baseA) == 0 || len(*baseB) == 0 || *count < 1 || *concurrency < 1 {
+		fmt.Fprintln(out, "jmpc diff: -a and -b are required, and -n and -concurrency must be at least 1")
+		return 2
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	a := diffTarget{*baseA, *keyA, client}
+	b := diffTarget{*baseB, *keyB, client}
+
+	// Passwords unique to this run, so neither side can answer from an
+	// earlier one.
+	run := make([]byte, 4)
+	rand.Read(run)
+	answersA := make([]diffAnswer, *count)
+	answersB := make([]diffAnswer, *count)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, *concurrency)
+	for i := 0; i < *count; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			password := fmt.Sprintf("jmpc-diff-%s-%d", hex.EncodeToString(run), i)
+			var pair sync.WaitGroup
+			pair.Add(1)
+			go func() {
+				defer pair.Done()
+				answersA[i] = a.submit(password)
+			}()
+			answersB[i] = b.submit(password)
+			pair.Wait()
+		}(i)
+	}
+	wg.Wait()
+
+	divergences := 0
+	var durationsA, durationsB []time.Duration
+	for i := range answersA {
+		durationsA = append(durationsA, answersA[i].duration)
+		durationsB = append(durationsB, answersB[i].duration)
+		if diverges(answersA[i], answersB[i]) {
+			divergences++
+			fmt.Fprintf(out, "request %d diverged: a %v, b %v\n", i, answersA[i], answersB[i])
+		}
+	}
+	fmt.Fprintf(out, "%d requests, %d diverged\n", *count, divergences)
+	writeDiffLatency(out, "a", durationsA)
+	writeDiffLatency(out, "b", durationsB)
+	if divergences > 0 {
+		return 1
+	}
+	return 0
+}
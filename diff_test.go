@@ -0,0 +1,55 @@
+// Unit Tests for the diff subcommand.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	b64 "encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newDiffInstance answers synchronous submissions with the digest,
+// except for passwords ending in the given suffix, which it gets wrong.
+func newDiffInstance(wrongSuffix string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		password := r.PostFormValue("password")
+		if "true" != r.URL.Query().Get("wait") || len(password) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(wrongSuffix) > 0 && strings.HasSuffix(password, wrongSuffix) {
+			password += "!"
+		}
+		ckSum := sha512.Sum512([]byte(password))
+		io.WriteString(w, b64.StdEncoding.EncodeToString(ckSum[:]))
+	}))
+}
+
+func TestDiff(t *testing.T) {
+	old, same, broken := newDiffInstance(""), newDiffInstance(""), newDiffInstance("-3")
+	defer old.Close()
+	defer same.Close()
+	defer broken.Close()
+
+	var out bytes.Buffer
+	if code := runDiff([]string{"-a", old.URL, "-b", same.URL, "-n", "5"}, &out); 0 != code ||
+		!strings.Contains(out.String(), "5 requests, 0 diverged") || !strings.Contains(out.String(), "latency b: p50") {
+		t.Errorf("Expected matching instances to agree, got %d:\n%s", code, out.String())
+	}
+
+	out.Reset()
+	if code := runDiff([]string{"-a", old.URL, "-b", broken.URL, "-n", "5"}, &out); 1 != code ||
+		!strings.Contains(out.String(), "request 3 diverged") || !strings.Contains(out.String(), "5 requests, 1 diverged") {
+		t.Errorf("Expected request 3 to diverge, got %d:\n%s", code, out.String())
+	}
+
+	out.Reset()
+	if code := runDiff([]string{"-a", old.URL}, &out); 2 != code {
+		t.Errorf("Expected a usage error without -b, got %d", code)
+	}
+}
@@ -0,0 +1,89 @@
+// Compact storage of digests for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// How digests are held: base64, as they are served, or binary, the raw 64
+// bytes, base64 encoded again on every read.  Binary takes about a third
+// less room, which matters once results number in the hundreds of
+// millions.  Either form is read whatever the setting, so it can be changed
+// on a running deployment.
+const (
+	digestsBase64 = "base64"
+	digestsBinary = "binary"
+)
+
+// How the memory store, and a shared store's local copies, hold digests.
+var memoryDigests string = digestsBase64
+
+// How digests are written into Redis records.  Binary needs the raw or
+// protobuf codec, as JSON can't hold raw bytes.
+var redisDigests string = digestsBase64
+
+// packedResult is a hashResult with its digest held as raw bytes.
+type packedResult struct {
+	digest      [sha512.Size]byte
+	queueTime   time.Duration
+	processTime time.Duration
+	completedAt time.Time
+	labels      map[string]string
+	tags        []string
+}
+
+// packDigest decodes a base64 SHA-512 digest, reporting false for anything
+// else, which is then kept as it is.
+func packDigest(b64Str string) ([sha512.Size]byte, bool) {
+	var digest [sha512.Size]byte
+	raw, err := base64.StdEncoding.DecodeString(b64Str)
+	if err != nil || len(raw) != sha512.Size {
+		return digest, false
+	}
+	copy(digest[:], raw)
+	return digest, true
+}
+
+func packResult(hRes hashResult) (packedResult, bool) {
+	digest, packed := packDigest(hRes.b64Str)
+	return packedResult{digest, hRes.queueTime, hRes.processTime, hRes.completedAt, hRes.labels, hRes.tags}, packed
+}
+
+// heldResult is what resultMap holds for hRes with digests in the given
+// form.
+func heldResult(hRes hashResult, digests string) interface{} {
+	if digests == digestsBinary {
+		if pr, packed := packResult(hRes); packed {
+			return pr
+		}
+	}
+	return hRes
+}
+
+func (pr packedResult) unpack() hashResult {
+	return hashResult{
+		b64Str:      base64.StdEncoding.EncodeToString(pr.digest[:]),
+		queueTime:   pr.queueTime,
+		processTime: pr.processTime,
+		completedAt: pr.completedAt,
+		labels:      pr.labels,
+		tags:        pr.tags,
+	}
+}
+
+// validateDigestConfig checks the digest forms.
+func validateDigestConfig() error {
+	for name, form := range map[string]string{"memory-digests": memoryDigests, "redis-digests": redisDigests} {
+		if form != digestsBase64 && form != digestsBinary {
+			return fmt.Errorf("%s %q must be base64 or binary", name, form)
+		}
+	}
+	if storeBackend == "redis" && redisDigests == digestsBinary && storeCodec == "json" {
+		return fmt.Errorf("redis-digests binary needs store-codec raw or protobuf, not json")
+	}
+	return nil
+}
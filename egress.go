@@ -0,0 +1,144 @@
+// Outbound request controls for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// Client supplied URLs, i.e. webhook callbacks, are fetched through
+// egressTransport, which optionally goes via a proxy and refuses
+// destinations an attacker could use the service to reach.
+var outboundProxy string
+
+// Comma separated hosts callbacks may go to: "example.com" for exactly
+// that host, ".example.com" for any subdomain.  Empty allows any host that
+// isn't blocked.
+var egressAllowList string
+
+// Loopback and private network destinations are refused unless this is
+// set, e.g. for callbacks to services on the same network.
+var egressAllowPrivate bool
+
+// Parsed egressAllowList.
+var egressAllowed []string
+
+// Hosts that only ever mean a cloud metadata service.
+var egressBlockedHosts = map[string]bool{
+	"metadata":                 true,
+	"metadata.google.internal": true,
+}
+
+// egressTransport carries client supplied outbound requests.
+var egressTransport http.RoundTripper = newEgressTransport(nil)
+
+// blockedIP reports why an address may not be dialed, "" if it may.
+// Link-local covers the 169.254.169.254 metadata endpoints.
+func blockedIP(ip net.IP) string {
+	switch {
+	case ip.IsUnspecified(), ip.IsMulticast(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local, multicast, or unspecified address"
+	case egressAllowPrivate:
+		return ""
+	case ip.IsLoopback(), ip.IsPrivate():
+		return "loopback or private address"
+	}
+	return ""
+}
+
+// checkEgressHost vets a destination host name or IP literal before any
+// connection is attempted.
+func checkEgressHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if egressBlockedHosts[host] {
+		return fmt.Errorf("destination %s is blocked", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if reason := blockedIP(ip); len(reason) > 0 {
+			return fmt.Errorf("destination %s is blocked: %s", host, reason)
+		}
+	}
+	if len(egressAllowed) == 0 {
+		return nil
+	}
+	for _, allowed := range egressAllowed {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination %s is not in the egress allow list", host)
+}
+
+// egressGuard checks each request's host, which is all that can be checked
+// when a proxy does the resolving.
+type egressGuard struct {
+	next http.RoundTripper
+}
+
+func (g egressGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkEgressHost(req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return g.next.RoundTrip(req)
+}
+
+// dialControl checks the address actually being connected to, after DNS,
+// so a name can't be pointed at a blocked address after it was vetted.
+func dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if reason := blockedIP(net.ParseIP(host)); len(reason) > 0 {
+		return fmt.Errorf("connection to %s refused: %s", host, reason)
+	}
+	return nil
+}
+
+// newEgressTransport builds the outbound transport.  Through a proxy only
+// the host name is vetted, as connections go to the proxy itself.
+func newEgressTransport(proxy *url.URL) http.RoundTripper {
+	dialer := newOutboundDialer()
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        outboundMaxIdle,
+		MaxIdleConnsPerHost: outboundMaxIdlePerHost,
+		IdleConnTimeout:     outboundIdleTimeout,
+		TLSHandshakeTimeout: outboundDialTimeout,
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		dialer.Control = dialControl
+	}
+	return egressGuard{transport}
+}
+
+// validateEgressConfig parses the proxy and allow list and builds the
+// transport from them.
+func validateEgressConfig() error {
+	var proxy *url.URL
+	if len(outboundProxy) > 0 {
+		var err error
+		proxy, err = url.Parse(outboundProxy)
+		if err != nil || len(proxy.Host) == 0 {
+			return fmt.Errorf("outbound-proxy %q must be a URL such as http://proxy:3128", outboundProxy)
+		}
+	}
+
+	egressAllowed = nil
+	for _, host := range strings.Split(egressAllowList, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); len(host) > 0 {
+			egressAllowed = append(egressAllowed, host)
+		}
+	}
+
+	egressTransport = newEgressTransport(proxy)
+	webhookClient.Transport = egressTransport
+	return nil
+}
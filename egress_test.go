@@ -0,0 +1,121 @@
+// Unit Tests for outbound request controls.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBlockedIP(t *testing.T) {
+	defer withSavedConfig(t)()
+
+	blocked := []string{"169.254.169.254", "fe80::1", "0.0.0.0", "224.0.0.1", "127.0.0.1", "10.1.2.3", "192.168.0.1", "::1"}
+	for _, addr := range blocked {
+		if len(blockedIP(net.ParseIP(addr))) == 0 {
+			t.Errorf("Expected %s blocked", addr)
+		}
+	}
+	if reason := blockedIP(net.ParseIP("93.184.216.34")); len(reason) > 0 {
+		t.Errorf("Expected a public address allowed, got %s", reason)
+	}
+
+	// Private networks can be let through, metadata never.
+	egressAllowPrivate = true
+	if len(blockedIP(net.ParseIP("10.1.2.3"))) > 0 || len(blockedIP(net.ParseIP("169.254.169.254"))) == 0 {
+		t.Errorf("Expected only private addresses let through")
+	}
+}
+
+func TestEgressAllowList(t *testing.T) {
+	// Rebuild the transport once the settings are restored.
+	defer validateEgressConfig()
+	defer withSavedConfig(t)()
+
+	egressAllowList = "hooks.example.com, .partner.net"
+	if err := validateEgressConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for host, allowed := range map[string]bool{
+		"hooks.example.com":        true,
+		"HOOKS.example.com.":       true,
+		"api.partner.net":          true,
+		"partner.net":              false,
+		"evil.example.com":         false,
+		"metadata.google.internal": false,
+	} {
+		if err := checkEgressHost(host); allowed != (err == nil) {
+			t.Errorf("Expected %s allowed to be %v, got %v", host, allowed, err)
+		}
+	}
+
+	if _, err := parseCallbackURL("http://evil.example.com/hook"); err == nil {
+		t.Errorf("Expected a callback outside the allow list rejected")
+	}
+}
+
+func TestEgressDialRefusesLoopback(t *testing.T) {
+	defer validateEgressConfig()
+	defer withSavedConfig(t)()
+	if err := validateEgressConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	client := &http.Client{Transport: egressTransport}
+	if _, err := client.Get(target.URL); err == nil {
+		t.Errorf("Expected a loopback connection refused")
+	}
+
+	egressAllowPrivate = true
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatalf("Expected loopback allowed, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestEgressThroughProxy(t *testing.T) {
+	defer validateEgressConfig()
+	defer withSavedConfig(t)()
+
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.Host
+	}))
+	defer proxy.Close()
+
+	outboundProxy = proxy.URL
+	if err := validateEgressConfig(); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: egressTransport}
+
+	resp, err := client.Get("http://hooks.example.com/done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if host := <-proxied; "hooks.example.com" != host {
+		t.Errorf("Expected the request proxied for hooks.example.com, got %s", host)
+	}
+
+	if _, err := client.Get("http://169.254.169.254/latest/meta-data/"); err == nil {
+		t.Errorf("Expected the metadata address refused before reaching the proxy")
+	}
+
+	outboundProxy = "::bad"
+	if err := validateEgressConfig(); err == nil {
+		t.Errorf("Expected a bad proxy URL rejected")
+	}
+}
+
+func TestWebhookClientUsesEgress(t *testing.T) {
+	if _, ok := webhookClient.Transport.(egressGuard); !ok {
+		t.Errorf("Expected webhooks sent through the egress controls")
+	}
+}
@@ -0,0 +1,135 @@
+// Error responses and panic recovery for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// Public: error response body for clients that accept JSON.
+type errorResponse struct {
+	Error     string    `json:"error"`
+	Code      errorCode `json:"code"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Public: stable, machine-readable error codes.  Clients should branch on
+// these rather than the messages, whose wording may change.  Codes are only
+// ever added, never renamed or reused, and each is listed in the ErrorCode
+// schema of the OpenAPI document.
+type errorCode string
+
+const (
+	// The request ID is well formed and issued, but its hash isn't done.
+	codePending errorCode = "ERR_PENDING"
+	// No such request, or nothing at that path.
+	codeNotFound errorCode = "ERR_NOT_FOUND"
+	// A request ID that isn't a number.
+	codeBadID errorCode = "ERR_BAD_ID"
+	// The queue stayed full until the submission's time budget ran out.
+	codeQueueFull errorCode = "ERR_QUEUE_FULL"
+	// A shutdown was requested; no new submissions are taken.
+	codeShuttingDown errorCode = "ERR_SHUTTING_DOWN"
+	// The store is read-only and takes no new submissions.
+	codeReadOnly errorCode = "ERR_READ_ONLY"
+	// The request is held in quarantine pending review.
+	codeQuarantined errorCode = "ERR_QUARANTINED"
+	// The body doesn't match the X-JMPC-Checksum sent with it.
+	codeChecksumMismatch errorCode = "ERR_CHECKSUM_MISMATCH"
+
+	// Codes for errors with nothing more specific to say than their status.
+	codeBadRequest       errorCode = "ERR_BAD_REQUEST"
+	codeUnauthenticated  errorCode = "ERR_UNAUTHENTICATED"
+	codeForbidden        errorCode = "ERR_FORBIDDEN"
+	codeMethodNotAllowed errorCode = "ERR_METHOD_NOT_ALLOWED"
+	codeConflict         errorCode = "ERR_CONFLICT"
+	codeUnsupportedMedia errorCode = "ERR_UNSUPPORTED_MEDIA_TYPE"
+	codeRateLimited      errorCode = "ERR_RATE_LIMITED"
+	codeInternal         errorCode = "ERR_INTERNAL"
+	codeNotImplemented   errorCode = "ERR_NOT_IMPLEMENTED"
+	codeUnavailable      errorCode = "ERR_UNAVAILABLE"
+	codeTimeout          errorCode = "ERR_TIMEOUT"
+)
+
+// Codes for statuses reported with writeError.
+var statusErrorCodes = map[int]errorCode{
+	http.StatusBadRequest:           codeBadRequest,
+	http.StatusUnauthorized:         codeUnauthenticated,
+	http.StatusForbidden:            codeForbidden,
+	http.StatusNotFound:             codeNotFound,
+	http.StatusMethodNotAllowed:     codeMethodNotAllowed,
+	http.StatusConflict:             codeConflict,
+	http.StatusUnsupportedMediaType: codeUnsupportedMedia,
+	http.StatusLocked:               codeQuarantined,
+	http.StatusTooManyRequests:      codeRateLimited,
+	http.StatusInternalServerError:  codeInternal,
+	http.StatusNotImplemented:       codeNotImplemented,
+	http.StatusServiceUnavailable:   codeUnavailable,
+	http.StatusGatewayTimeout:       codeTimeout,
+}
+
+// statusErrorCode is the code for a status with no more specific one.
+func statusErrorCode(statusCode int) errorCode {
+	if code, found := statusErrorCodes[statusCode]; found {
+		return code
+	}
+	if statusCode >= 500 {
+		return codeInternal
+	}
+	return codeBadRequest
+}
+
+// wantsJSON reports whether the client explicitly asked for JSON.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeError is how every handler reports a failure: as JSON to clients
+// that ask for it, otherwise as plain text the way http.Error does.  The
+// code comes from the status.
+func writeError(w http.ResponseWriter, r *http.Request, msg string, statusCode int) {
+	writeCodedError(w, r, statusErrorCode(statusCode), msg, statusCode)
+}
+
+// writeCodedError reports a failure with a more specific code than its
+// status gives.  Plain text responses carry the code in a header.
+func writeCodedError(w http.ResponseWriter, r *http.Request, code errorCode, msg string, statusCode int) {
+	w.Header().Set("X-JMPC-Error-Code", string(code))
+	if wantsJSON(r) {
+		writeJSON(w, statusCode, errorResponse{Error: msg, Code: code, Status: statusCode, RequestID: requestID(r)})
+		return
+	}
+	http.Error(w, msg, statusCode)
+}
+
+// withRecovery turns a panicking handler into a logged stack trace, a crash
+// report, and a 500, instead of a dropped connection.  It must sit inside withRequestLog
+// so the failure is logged against the request ID.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// The server's own signal to abort a response quietly.
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			stack := debug.Stack()
+			logError("Handler panicked", "request_id", requestID(r), "path", r.URL.Path,
+				"panic", fmt.Sprint(p), "stack", string(stack))
+			reportCrash(p, stack, r)
+			// Too late to change a response that has already started.
+			if sr.status == 0 {
+				writeError(w, r, "Internal server error.", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(sr, r)
+	})
+}
@@ -0,0 +1,133 @@
+// Unit Tests for error responses and panic recovery.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteErrorNegotiates(t *testing.T) {
+	req := httptest.NewRequest("GET", "/hash/x", nil)
+	rec := httptest.NewRecorder()
+	writeError(rec, req, "Nope.", http.StatusBadRequest)
+	if http.StatusBadRequest != rec.Code || "Nope.\n" != rec.Body.String() {
+		t.Errorf("Expected a plain text error, got [%d] %q", rec.Code, rec.Body.String())
+	}
+
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	writeError(rec, req, "Nope.", http.StatusBadRequest)
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if "Nope." != body.Error || http.StatusBadRequest != body.Status || codeBadRequest != body.Code {
+		t.Errorf("Unexpected JSON error %+v", body)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	defer atomic.AddUint64(&hashRequests, ^uint64(0))
+	pending, _ := store.nextID()
+	if rec, found := resultMap.Load(resultKey{id: pending}); found {
+		defer resultMap.Store(resultKey{id: pending}, rec)
+	}
+	resultMap.Delete(resultKey{id: pending})
+
+	cases := []struct {
+		path string
+		code errorCode
+	}{
+		{"/hash/x", codeBadID},
+		{fmt.Sprintf("/hash/%d", pending), codePending},
+		{fmt.Sprintf("/hash/%d", pending+1<<40), codeNotFound},
+		{"/hash/x/status", codeBadID},
+	}
+	for _, c := range cases {
+		// Plain text clients get the code in a header.
+		req := httptest.NewRequest("GET", c.path, nil)
+		rec := httptest.NewRecorder()
+		hashHandler(rec, req)
+		if string(c.code) != rec.Header().Get("X-JMPC-Error-Code") {
+			t.Errorf("%s: expected code %s, got [%d] %v", c.path, c.code, rec.Code, rec.Header())
+		}
+
+		req.Header.Set("Accept", "application/json")
+		rec = httptest.NewRecorder()
+		hashHandler(rec, req)
+		var body errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || c.code != body.Code {
+			t.Errorf("%s: expected code %s in the body, got %+v %v", c.path, c.code, body, err)
+		}
+	}
+
+	if codeInternal != statusErrorCode(http.StatusBadGateway) || codeBadRequest != statusErrorCode(http.StatusTeapot) {
+		t.Errorf("Expected unlisted statuses to fall back by class")
+	}
+}
+
+func TestRecoveryAnswers500(t *testing.T) {
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	h := withRequestLog(withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("kaboom")
+	})))
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var body errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if http.StatusInternalServerError != rec.Code || rec.Header().Get("X-Request-Id") != body.RequestID {
+		t.Errorf("Expected a 500 carrying the request ID, got [%d] %+v", rec.Code, body)
+	}
+}
+
+func TestRecoveryPassesAbort(t *testing.T) {
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("Expected ErrAbortHandler to propagate, got %v", p)
+		}
+	}()
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil))
+}
+
+func TestBadFormIs400(t *testing.T) {
+	req := httptest.NewRequest("POST", "/hash", strings.NewReader("password=%zz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	hashHandler(rec, req)
+	if http.StatusBadRequest != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestShuttingDownRefusesSubmissions(t *testing.T) {
+	atomic.StoreInt32(&shutdownRequested, 1)
+	defer atomic.StoreInt32(&shutdownRequested, 0)
+
+	for path, h := range map[string]http.HandlerFunc{"/hash": hashHandler, "/hash/batch": batchHandler} {
+		body, contentType := "password=angryMonkey", "application/x-www-form-urlencoded"
+		if "/hash/batch" == path {
+			body, contentType = `["angryMonkey"]`, "application/json"
+		}
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if http.StatusServiceUnavailable != rec.Code || string(codeShuttingDown) != rec.Header().Get("X-JMPC-Error-Code") {
+			t.Errorf("%s: expected a 503 with %s, got [%d] %v", path, codeShuttingDown, rec.Code, rec.Header())
+		}
+	}
+}
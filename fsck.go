@@ -0,0 +1,116 @@
+// Store consistency checks for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Public: outcome of checking every stored result.
+type fsckReport struct {
+	Backend string `json:"backend"`
+	Scanned int    `json:"scanned"`
+	// Records written before checksums were added, which can't be checked.
+	Unverified int `json:"unverified"`
+	// Records in an older format, which /admin/migrate rewrites.
+	Outdated int      `json:"outdated"`
+	Corrupt  []uint64 `json:"corrupt"`
+	// Whether the corrupt records were moved aside.
+	Quarantined bool `json:"quarantined"`
+}
+
+// fsck reads back every issued ID's record and checks it.  With quarantine
+// a corrupt record is renamed to corrupt:<id>, out of the way of lookups
+// but kept for inspection.  It stops with ctx's error once ctx ends.
+func (rs *redisStore) fsck(ctx context.Context, quarantine bool) (fsckReport, error) {
+	rep := fsckReport{Backend: "redis", Corrupt: []uint64{}, Quarantined: quarantine}
+	var scanErr error
+	forEachIssuedID(0, func(idNum uint64) bool {
+		if scanErr = ctx.Err(); scanErr != nil {
+			return false
+		}
+		rk := resultKey{rs.owner(idNum), idNum}
+		key := rs.key(rk.storeKey())
+		reply, err := rs.client.do("GET", key)
+		if err == redisNil {
+			return true
+		}
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		rep.Scanned++
+
+		_, meta, err := rs.codec.decode(idNum, reply.(string))
+		if err == nil {
+			if !meta.checked {
+				rep.Unverified++
+			}
+			if meta.outdated {
+				rep.Outdated++
+			}
+			return true
+		}
+		rep.Corrupt = append(rep.Corrupt, idNum)
+		if quarantine {
+			// An export in flight keeps any good copy cached here.
+			release := holdForExports(rk)
+			_, err := rs.client.do("RENAME", key, rs.key(fmt.Sprintf("corrupt:%d", idNum)))
+			if err == nil {
+				rs.cache.invalidate(rk)
+				err = rs.announceRemoval(rk)
+			}
+			release()
+			if err != nil {
+				scanErr = err
+				return false
+			}
+		}
+		return true
+	})
+	return rep, scanErr
+}
+
+// fsckHandler checks the shared store on GET, and on POST with form field
+// "quarantine=true" also moves corrupt records aside.
+func fsckHandler(w http.ResponseWriter, r *http.Request) {
+	quarantine := false
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		if quarantine, err = strconv.ParseBool(r.FormValue("quarantine")); err != nil {
+			writeError(w, r, "Form field 'quarantine' must be true or false.", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rs, shared := store.(*redisStore)
+	if !shared {
+		writeError(w, r, "The memory store keeps no records outside this process to check.", http.StatusNotImplemented)
+		return
+	}
+	rep, err := rs.fsck(r.Context(), quarantine)
+	if err != nil && r.Context().Err() != nil {
+		logWarn("Store check cut short", "request_id", requestID(r), "scanned", rep.Scanned, "error", err)
+		writeBudgetSpent(w, r)
+		return
+	}
+	if err != nil {
+		logError("Store check failed", "request_id", requestID(r), "error", err)
+		writeError(w, r, "Store check could not finish, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	if len(rep.Corrupt) > 0 {
+		logWarn("Store check found corrupt records", "corrupt", len(rep.Corrupt), "quarantined", quarantine,
+			"request_id", requestID(r))
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
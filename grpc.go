@@ -0,0 +1,293 @@
+// gRPC API for the hashing service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Port the gRPC API, as defined in jmpc.proto, is served on; 0 for none.
+// It speaks HTTP/2 without TLS, so it is meant for internal networks.
+//
+// The service is small enough that the wire format is handled here rather
+// than pulling in a gRPC library: length-prefixed protobuf messages over
+// HTTP/2, with the outcome in grpc-status trailers.
+var grpcPort int = 0
+
+// Largest request message accepted.
+const grpcMaxMessage = 1 << 20
+
+// The gRPC methods that queue work and read results, which middleware
+// treats as POST /hash and GET /hash/{id}.
+const (
+	grpcSubmitPath = "/jmpc.Hasher/SubmitHash"
+	grpcGetPath    = "/jmpc.Hasher/GetHash"
+)
+
+// gRPC status codes used here.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+)
+
+// grpcError carries a status code out of a method.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+// protoMessage is a decoded protobuf message: varint fields by number, and
+// length-delimited ones as raw bytes.  That covers every message in
+// jmpc.proto.
+type protoMessage struct {
+	varints map[int]uint64
+	bytes   map[int][]byte
+}
+
+// decodeProto parses a protobuf message, skipping fixed-width fields no
+// message here uses.
+func decodeProto(b []byte) (protoMessage, error) {
+	msg := protoMessage{varints: map[int]uint64{}, bytes: map[int][]byte{}}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return msg, errors.New("malformed field tag")
+		}
+		b = b[n:]
+		field, wireType := int(tag>>3), tag&7
+
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return msg, errors.New("malformed varint")
+			}
+			msg.varints[field], b = v, b[n:]
+		case 1, 5:
+			width := 8
+			if wireType == 5 {
+				width = 4
+			}
+			if len(b) < width {
+				return msg, errors.New("truncated fixed field")
+			}
+			b = b[width:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return msg, errors.New("truncated length-delimited field")
+			}
+			msg.bytes[field], b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return msg, fmt.Errorf("unsupported wire type %d", wireType)
+		}
+	}
+	return msg, nil
+}
+
+// protoEncoder builds a protobuf message.  Zero values are left out, as
+// proto3 does.
+type protoEncoder []byte
+
+func (e protoEncoder) varint(field int, v uint64) protoEncoder {
+	if v == 0 {
+		return e
+	}
+	e = binary.AppendUvarint(e, uint64(field)<<3)
+	return binary.AppendUvarint(e, v)
+}
+
+func (e protoEncoder) string(field int, s string) protoEncoder {
+	if len(s) == 0 {
+		return e
+	}
+	e = binary.AppendUvarint(e, uint64(field)<<3|2)
+	e = binary.AppendUvarint(e, uint64(len(s)))
+	return append(e, s...)
+}
+
+// readGRPCMessage reads the one request message of a unary or server
+// streaming call.
+func readGRPCMessage(body io.Reader) (protoMessage, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return protoMessage{}, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return protoMessage{}, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return protoMessage{}, &grpcError{grpcInvalidArgument, "request message too large"}
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(body, b); err != nil {
+		return protoMessage{}, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	msg, err := decodeProto(b)
+	if err != nil {
+		return msg, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage frames and sends one response message.
+func writeGRPCMessage(w http.ResponseWriter, msg protoEncoder) {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	w.Write(prefix[:])
+	w.Write(msg)
+	http.NewResponseController(w).Flush()
+}
+
+// grpcHandler serves /jmpc.Hasher/{method}.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	defer func() { recordLatency(endpointGRPC, time.Now().Sub(t0)) }()
+
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeError(w, r, "gRPC requests only.", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	err := serveGRPCMethod(w, r, strings.TrimPrefix(r.URL.Path, "/jmpc.Hasher/"))
+
+	code, msg := grpcOK, ""
+	if gErr, ok := err.(*grpcError); ok {
+		code, msg = gErr.code, gErr.msg
+	} else if err != nil {
+		code, msg = grpcInternal, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if len(msg) > 0 {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", msg)
+	}
+}
+
+func serveGRPCMethod(w http.ResponseWriter, r *http.Request, method string) error {
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case "SubmitHash":
+		clearText := string(req.bytes[1])
+		if len(clearText) == 0 {
+			return &grpcError{grpcInvalidArgument, "password required"}
+		}
+		if status := storeReadOnly.get(); status.ReadOnly {
+			return &grpcError{grpcUnavailable, "store is read-only: " + status.Reason}
+		}
+		if atomic.LoadInt32(&shutdownRequested) != 0 {
+			return &grpcError{grpcUnavailable, "shutting down"}
+		}
+		// Metadata arrives as headers, so tags ride along as x-jmpc-tags.
+		tags, err := parseTags(r.Header)
+		if err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		idNum, _, err := enqueueSubmission(r, clearText, submitOptions{tags: tags})
+		if errors.Is(err, errQueueTimeout) {
+			return &grpcError{grpcDeadlineExceeded, err.Error()}
+		} else if err != nil {
+			return &grpcError{grpcUnavailable, "could not allocate a request ID"}
+		}
+		writeGRPCMessage(w, protoEncoder{}.varint(1, idNum))
+
+	case "GetHash":
+		idNum := req.varints[1]
+		hRes, recFound, err := loadBefore(r.Context(), resultKey{requestTenant(r), idNum})
+		if err != nil {
+			return &grpcError{grpcDeadlineExceeded, err.Error()}
+		}
+		if !recFound {
+			if isHoneyID(idNum) {
+				honeyTokenTripped(r, idNum)
+			}
+			return &grpcError{grpcNotFound, fmt.Sprintf("Results not available for idNum: %d", idNum)}
+		}
+		writeGRPCMessage(w, hashResultMessage(idNum, hRes))
+
+	case "GetStats":
+		stats := currentStats()
+		writeGRPCMessage(w, protoEncoder{}.varint(1, stats.Total).varint(2, stats.Average).string(3, stats.Node))
+
+	case "WatchHash":
+		idNum := req.varints[1]
+		status, found, err := lookupJobStatus(r.Context(), requestTenant(r), idNum)
+		if err != nil {
+			return &grpcError{grpcDeadlineExceeded, err.Error()}
+		}
+		if !found {
+			if isHoneyID(idNum) {
+				honeyTokenTripped(r, idNum)
+			}
+			return &grpcError{grpcNotFound, fmt.Sprintf("No request issued with idNum: %d", idNum)}
+		}
+		if status.State == jobRejected {
+			return &grpcError{grpcFailedPrecondition, fmt.Sprintf("Request rejected from quarantine: %d", idNum)}
+		}
+		hRes, err := waitForCompletion(r.Context(), resultKey{requestTenant(r), idNum})
+		if err != nil {
+			return &grpcError{grpcUnavailable, err.Error()}
+		}
+		writeGRPCMessage(w, hashResultMessage(idNum, hRes))
+
+	default:
+		return &grpcError{grpcUnimplemented, "unknown method " + method}
+	}
+	return nil
+}
+
+func hashResultMessage(idNum uint64, hRes hashResult) protoEncoder {
+	return protoEncoder{}.
+		varint(1, idNum).
+		string(2, hRes.b64Str).
+		varint(3, uint64(hRes.queueTime.Microseconds())).
+		varint(4, uint64(hRes.processTime.Microseconds()))
+}
+
+// newGRPCServer builds the gRPC listener, behind the same middleware as the
+// HTTP API bar shadowing; keys travel as "authorization: Bearer" metadata, and methods
+// are checked as POST /jmpc.Hasher/{method}.
+func newGRPCServer() *http.Server {
+	// HTTP/1 stays on so non-gRPC clients get a readable error.
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr:      fmt.Sprintf(":%d", grpcPort),
+		Handler:   withMiddleware(nil, http.HandlerFunc(grpcHandler)),
+		Protocols: &protocols,
+	}
+}
+
+// validateGRPCConfig checks the gRPC settings.
+func validateGRPCConfig() error {
+	if grpcPort < 0 || grpcPort > 65535 {
+		return fmt.Errorf("grpc-port %d is not a valid port", grpcPort)
+	}
+	if grpcPort != 0 && grpcPort == listenPort {
+		return fmt.Errorf("grpc-port %d must differ from port", grpcPort)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Unit Tests for the gRPC API.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newGRPCTestServer serves grpcHandler over unencrypted HTTP/2.
+func newGRPCTestServer() *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(grpcHandler))
+	ts.Config.Protocols = newGRPCServer().Protocols
+	ts.Start()
+	return ts
+}
+
+// grpcCall makes one call the way a gRPC client would, returning the
+// response messages and the grpc-status trailer.
+func grpcCall(t *testing.T, baseURL, method string, msg protoEncoder) ([]protoMessage, string) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	var body bytes.Buffer
+	writeGRPCMessage(&bufferWriter{&body}, msg)
+	req, _ := http.NewRequest("POST", baseURL+"/jmpc.Hasher/"+method, &body)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if 2 != resp.ProtoMajor {
+		t.Fatalf("Expected HTTP/2, got %s", resp.Proto)
+	}
+
+	var msgs []protoMessage
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err != nil {
+			break
+		}
+		b := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		io.ReadFull(resp.Body, b)
+		decoded, err := decodeProto(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, decoded)
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status")
+}
+
+// bufferWriter lets writeGRPCMessage frame a request body.
+type bufferWriter struct {
+	*bytes.Buffer
+}
+
+func (bw *bufferWriter) Header() http.Header { return http.Header{} }
+func (bw *bufferWriter) WriteHeader(int)     {}
+
+func TestProtoRoundTrip(t *testing.T) {
+	b := protoEncoder{}.varint(1, 300).string(2, "angryMonkey").varint(3, 0)
+	msg, err := decodeProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 300 != msg.varints[1] || "angryMonkey" != string(msg.bytes[2]) {
+		t.Errorf("Unexpected decode %+v", msg)
+	}
+	if _, found := msg.varints[3]; found {
+		t.Errorf("Expected zero values left out")
+	}
+	if _, err := decodeProto([]byte{0x12, 0x05, 'a'}); err == nil {
+		t.Errorf("Expected a truncated message rejected")
+	}
+}
+
+func TestGRPCGetStats(t *testing.T) {
+	ts := newGRPCTestServer()
+	defer ts.Close()
+
+	msgs, status := grpcCall(t, ts.URL, "GetStats", protoEncoder{})
+	if "0" != status || 1 != len(msgs) || nodeID != string(msgs[0].bytes[3]) {
+		t.Errorf("Expected stats for node %s, got status %s %+v", nodeID, status, msgs)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	ts := newGRPCTestServer()
+	defer ts.Close()
+
+	cases := []struct {
+		method string
+		msg    protoEncoder
+		status string
+	}{
+		{"GetHash", protoEncoder{}.varint(1, 99999999), "5"},
+		{"WatchHash", protoEncoder{}.varint(1, 99999999), "5"},
+		{"SubmitHash", protoEncoder{}, "3"},
+		{"Frobnicate", protoEncoder{}, "12"},
+	}
+	for _, c := range cases {
+		if msgs, status := grpcCall(t, ts.URL, c.method, c.msg); c.status != status || 0 != len(msgs) {
+			t.Errorf("Expected %s to end with status %s, got %s", c.method, c.status, status)
+		}
+	}
+
+	resp, err := http.Post(ts.URL+"/jmpc.Hasher/GetStats", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusUnsupportedMediaType != resp.StatusCode {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+}
+
+func TestGRPCMiddleware(t *testing.T) {
+	savedLimiter := submitLimiter
+	defer func() { submitLimiter = savedLimiter }()
+	submitLimiter = newRateLimiter(0.001, 1)
+
+	ts := httptest.NewUnstartedServer(newGRPCServer().Handler)
+	ts.Config.Protocols = newGRPCServer().Protocols
+	ts.Start()
+	defer ts.Close()
+
+	// Calls are tagged and logged, and submissions limited, as over HTTP.
+	// The first is let through, to be refused for having no password, so
+	// no ID is issued.
+	if _, status := grpcCall(t, ts.URL, "SubmitHash", protoEncoder{}); "3" != status {
+		t.Fatalf("Expected the first submission through, got status %s", status)
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	var body bytes.Buffer
+	writeGRPCMessage(&bufferWriter{&body}, protoEncoder{}.string(1, "angryMonkey"))
+	req, _ := http.NewRequest("POST", ts.URL+grpcSubmitPath, &body)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusTooManyRequests != resp.StatusCode || 0 == len(resp.Header.Get("X-Request-Id")) || nodeID != resp.Header.Get("X-JMPC-Node") {
+		t.Errorf("Expected a tagged 429 once the bucket is empty, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if _, status := grpcCall(t, ts.URL, "GetStats", protoEncoder{}); "0" != status {
+		t.Errorf("Expected calls other than submissions left unlimited, got status %s", status)
+	}
+}
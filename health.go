@@ -0,0 +1,284 @@
+// Liveness and readiness probes for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue fill, as a fraction of queueDepth, at which the node reports not
+// ready so a load balancer sends new work elsewhere.
+var readyQueueThreshold float64 = 0.9
+
+// How long past the hash delay the workers may go without finishing a hash
+// while work is queued before the node is reported not live.
+var livenessGrace time.Duration = 30 * time.Second
+
+// Set once /shutdown is called; the node is draining and not ready.
+var shutdownRequested int32
+
+// How long /shutdown keeps serving, reporting not ready, before the
+// listener closes.
+var shutdownDrain time.Duration = 0
+
+// Unix nanoseconds of the last hash a worker finished, or of startup.
+var lastWorkerProgress = time.Now().UnixNano()
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// Public: state of one component in a health report.
+type componentHealth struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Public: response body of /healthz and /readyz.
+type healthReport struct {
+	Status     string                     `json:"status"`
+	Node       string                     `json:"node"`
+	Components map[string]componentHealth `json:"components"`
+	// Public: with verbose=1, how healthy the node is from 0 to 1, and the
+	// signals it's weighed from
+	Score   *float64                `json:"score,omitempty"`
+	Signals map[string]healthSignal `json:"signals,omitempty"`
+}
+
+// Public: one signal in the weighted health score.
+type healthSignal struct {
+	// Public: what was measured: a fill fraction, milliseconds, or a rate
+	Value float64 `json:"value"`
+	// Public: how healthy that is, from 0 to 1
+	Score  float64 `json:"score"`
+	Weight float64 `json:"weight"`
+}
+
+// Weights of the signals in the weighted health score, which add up to 1.
+const (
+	healthQueueWeight = 0.4
+	healthStoreWeight = 0.3
+	healthErrorWeight = 0.3
+)
+
+// Store round trips up to healthStoreGood score 1, falling to 0 at
+// healthStoreBad.  A server error rate of healthErrorRateBad scores 0.
+const (
+	healthStoreGood    = 10 * time.Millisecond
+	healthStoreBad     = 500 * time.Millisecond
+	healthErrorRateBad = 0.5
+)
+
+// Responses are counted per healthErrorInterval; the error rate covers the
+// current interval and the last whole one.
+const healthErrorInterval = time.Minute
+
+// responseCounter keeps recent response and server error counts.
+type responseCounter struct {
+	mu         sync.Mutex
+	start      time.Time
+	total      uint64
+	failed     uint64
+	prevTotal  uint64
+	prevFailed uint64
+}
+
+var recentResponses responseCounter
+
+// rollLocked starts a new interval when the current one is over.
+func (rc *responseCounter) rollLocked(now time.Time) {
+	switch elapsed := now.Sub(rc.start); {
+	case elapsed < healthErrorInterval:
+	case elapsed < 2*healthErrorInterval:
+		rc.prevTotal, rc.prevFailed = rc.total, rc.failed
+		rc.total, rc.failed = 0, 0
+		rc.start = rc.start.Add(healthErrorInterval)
+	default:
+		rc.prevTotal, rc.prevFailed, rc.total, rc.failed = 0, 0, 0, 0
+		rc.start = now
+	}
+}
+
+func (rc *responseCounter) record(status int, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rollLocked(now)
+	rc.total++
+	if status >= 500 {
+		rc.failed++
+	}
+}
+
+// errorRate is the fraction of recent responses that were server errors.
+func (rc *responseCounter) errorRate(now time.Time) float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rollLocked(now)
+	if total := rc.total + rc.prevTotal; total > 0 {
+		return float64(rc.failed+rc.prevFailed) / float64(total)
+	}
+	return 0
+}
+
+// recordResponse counts a response towards the error rate.  The probes are
+// left out, as a failing probe would otherwise feed its own score.
+func recordResponse(path string, status int) {
+	if !strings.HasPrefix(path, "/healthz") && !strings.HasPrefix(path, "/readyz") {
+		recentResponses.record(status, time.Now())
+	}
+}
+
+// markWorkerProgress records that a worker finished a hash.
+func markWorkerProgress() {
+	atomic.StoreInt64(&lastWorkerProgress, time.Now().UnixNano())
+}
+
+// newHealthReport is ok with status 200 when every component is ok, else
+// a failure with 503.
+func newHealthReport(components map[string]componentHealth) (healthReport, int) {
+	report := healthReport{Status: healthOK, Node: nodeID, Components: components}
+	statusCode := http.StatusOK
+	for _, c := range components {
+		if c.Status != healthOK {
+			report.Status = healthFail
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	return report, statusCode
+}
+
+func writeHealth(w http.ResponseWriter, components map[string]componentHealth) {
+	report, statusCode := newHealthReport(components)
+	writeJSON(w, statusCode, report)
+}
+
+// clampScore limits a score to between 0 and 1.
+func clampScore(score float64) float64 {
+	return math.Max(0, math.Min(1, score))
+}
+
+// weighHealth measures how degraded the node is, short of failing, so a
+// load balancer can move traffic off it early: queue fill against the
+// readiness threshold, a shared store's round trip, and the server error
+// rate.
+func weighHealth(now time.Time) (float64, map[string]healthSignal) {
+	fill := 0.0
+	if depth := cap(hashRequestChannel); depth > 0 {
+		fill = float64(len(hashRequestChannel)) / float64(depth)
+	}
+	var storeTime time.Duration
+	storeScore := 1.0
+	if rs, shared := store.(*redisStore); shared {
+		t0 := time.Now()
+		err := rs.ping()
+		storeTime = time.Now().Sub(t0)
+		storeScore = 1 - float64(storeTime-healthStoreGood)/float64(healthStoreBad-healthStoreGood)
+		if err != nil {
+			storeScore = 0
+		}
+	}
+	errorRate := recentResponses.errorRate(now)
+
+	signals := map[string]healthSignal{
+		"queue_saturation": {fill, clampScore(1 - fill/readyQueueThreshold), healthQueueWeight},
+		"store_latency_ms": {float64(storeTime.Microseconds()) / 1000, clampScore(storeScore), healthStoreWeight},
+		"error_rate":       {errorRate, clampScore(1 - errorRate/healthErrorRateBad), healthErrorWeight},
+	}
+	score := 0.0
+	for _, signal := range signals {
+		score += signal.Score * signal.Weight
+	}
+	return math.Round(score*1000) / 1000, signals
+}
+
+// workersHealth checks that queued work is being picked up.  An idle pool
+// is fine however long ago it last finished something, as is one an
+// operator paused.
+func workersHealth(now time.Time) componentHealth {
+	queued := len(hashRequestChannel)
+	if workers.isPaused() {
+		return componentHealth{healthOK, fmt.Sprintf("%d workers paused, %d queued", workerCount, queued)}
+	}
+	since := now.Sub(time.Unix(0, atomic.LoadInt64(&lastWorkerProgress)))
+	detail := fmt.Sprintf("%d workers, %d queued, last hash %v ago", workerCount, queued,
+		since.Truncate(time.Millisecond))
+	if queued > 0 && since > maxHashDelay()+livenessGrace {
+		return componentHealth{healthFail, detail}
+	}
+	return componentHealth{healthOK, detail}
+}
+
+// queueHealth checks there is room for new submissions.
+func queueHealth() componentHealth {
+	queued, depth := len(hashRequestChannel), cap(hashRequestChannel)
+	detail := fmt.Sprintf("%d of %d queued", queued, depth)
+	if depth > 0 && float64(queued) >= readyQueueThreshold*float64(depth) {
+		return componentHealth{healthFail, detail}
+	}
+	return componentHealth{healthOK, detail}
+}
+
+// healthzHandler is the liveness probe: failing it means the process is
+// wedged and should be restarted.  With verbose=1 it adds the weighted
+// health score, which doesn't affect the status code.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	report, statusCode := newHealthReport(map[string]componentHealth{"workers": workersHealth(now)})
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		score, signals := weighHealth(now)
+		report.Score, report.Signals = &score, signals
+	}
+	writeJSON(w, statusCode, report)
+}
+
+// readyzHandler is the readiness probe: failing it means the node should
+// get no new traffic for now, while it drains or catches up.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	shutdown := componentHealth{Status: healthOK}
+	if atomic.LoadInt32(&shutdownRequested) != 0 {
+		shutdown = componentHealth{healthFail, "shutdown requested, draining"}
+	}
+	warmup := componentHealth{Status: healthOK}
+	if atomic.LoadInt32(&warmingUp) != 0 {
+		warmup = componentHealth{healthFail, "warming up"}
+	}
+	// Read-only nodes still serve lookups, so they stay ready.  A shared
+	// store that can't be reached leaves nothing to serve.
+	storeStatus := componentHealth{Status: healthOK, Detail: "read-write"}
+	if status := storeReadOnly.get(); status.ReadOnly {
+		storeStatus.Detail = "read-only: " + status.Reason
+	}
+	if rs, shared := store.(*redisStore); shared {
+		if err := rs.ping(); err != nil {
+			storeStatus = componentHealth{healthFail, "redis unreachable: " + err.Error()}
+		}
+	}
+	writeHealth(w, map[string]componentHealth{
+		"queue":    queueHealth(),
+		"shutdown": shutdown,
+		"store":    storeStatus,
+		"warmup":   warmup,
+	})
+}
+
+// validateHealthConfig checks the probe settings.
+func validateHealthConfig() error {
+	if readyQueueThreshold <= 0 || readyQueueThreshold > 1 {
+		return fmt.Errorf("ready-queue-threshold %v must be above 0 and at most 1", readyQueueThreshold)
+	}
+	if livenessGrace <= 0 {
+		return fmt.Errorf("liveness-grace %v must be positive", livenessGrace)
+	}
+	if shutdownDrain < 0 {
+		return fmt.Errorf("shutdown-drain %v must not be negative", shutdownDrain)
+	}
+	return nil
+}
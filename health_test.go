@@ -0,0 +1,131 @@
+// Unit Tests for liveness and readiness probes.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withTestQueue swaps in a channel no worker reads, so tests control its
+// fill, until the returned func is called.
+func withTestQueue(depth, queued int) func() {
+	saved := hashRequestChannel
+	hashRequestChannel = make(chan hashRequest, depth)
+	for i := 0; i < queued; i++ {
+		hashRequestChannel <- hashRequest{}
+	}
+	return func() { hashRequestChannel = saved }
+}
+
+func probe(t *testing.T, h http.HandlerFunc) (int, healthReport) {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/", nil))
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestReadyz(t *testing.T) {
+	defer withTestQueue(10, 2)()
+
+	code, report := probe(t, readyzHandler)
+	if http.StatusOK != code || healthOK != report.Status || nodeID != report.Node {
+		t.Errorf("Expected ready, got [%d] %+v", code, report)
+	}
+
+	// A nearly full queue sheds new traffic.
+	for len(hashRequestChannel) < 9 {
+		hashRequestChannel <- hashRequest{}
+	}
+	code, report = probe(t, readyzHandler)
+	if http.StatusServiceUnavailable != code || healthFail != report.Components["queue"].Status {
+		t.Errorf("Expected not ready on a saturated queue, got [%d] %+v", code, report)
+	}
+}
+
+func TestReadyzDuringShutdown(t *testing.T) {
+	defer withTestQueue(10, 0)()
+	atomic.StoreInt32(&shutdownRequested, 1)
+	defer atomic.StoreInt32(&shutdownRequested, 0)
+
+	code, report := probe(t, readyzHandler)
+	if http.StatusServiceUnavailable != code || healthFail != report.Components["shutdown"].Status {
+		t.Errorf("Expected not ready while draining, got [%d] %+v", code, report)
+	}
+}
+
+func TestHealthzStall(t *testing.T) {
+	defer withTestQueue(10, 0)()
+	saved := atomic.LoadInt64(&lastWorkerProgress)
+	defer atomic.StoreInt64(&lastWorkerProgress, saved)
+
+	// Idle workers are healthy however long ago they last did anything.
+	atomic.StoreInt64(&lastWorkerProgress, time.Now().Add(-time.Hour).UnixNano())
+	if code, report := probe(t, healthzHandler); http.StatusOK != code {
+		t.Errorf("Expected an idle pool live, got [%d] %+v", code, report)
+	}
+
+	hashRequestChannel <- hashRequest{}
+	if code, report := probe(t, healthzHandler); http.StatusServiceUnavailable != code ||
+		healthFail != report.Components["workers"].Status {
+		t.Errorf("Expected a stalled pool not live, got [%d] %+v", code, report)
+	}
+
+	markWorkerProgress()
+	if code, _ := probe(t, healthzHandler); http.StatusOK != code {
+		t.Errorf("Expected live after progress, got [%d]", code)
+	}
+}
+
+func TestHealthzVerbose(t *testing.T) {
+	defer withTestQueue(10, 9)()
+
+	if _, report := probe(t, healthzHandler); report.Score != nil || report.Signals != nil {
+		t.Errorf("Expected no score unless asked for, got %+v", report)
+	}
+
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz?verbose=1", nil))
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	// A queue at the readiness threshold scores 0, but the node stays live.
+	queue := report.Signals["queue_saturation"]
+	if http.StatusOK != rec.Code || 0.9 != queue.Value || 0 != queue.Score || healthQueueWeight != queue.Weight {
+		t.Errorf("Expected a live node with a saturated queue, got [%d] %+v", rec.Code, report)
+	}
+	if report.Score == nil || *report.Score > 1-healthQueueWeight || 1 != report.Signals["store_latency_ms"].Score {
+		t.Errorf("Expected the score weighed down by the queue alone, got %+v", report)
+	}
+}
+
+func TestResponseErrorRate(t *testing.T) {
+	var rc responseCounter
+	t0 := time.Now()
+	for i := 0; i < 4; i++ {
+		rc.record(http.StatusOK, t0)
+	}
+	rc.record(http.StatusServiceUnavailable, t0)
+	rc.record(http.StatusNotFound, t0)
+	if rate := rc.errorRate(t0); float64(1)/6 != rate {
+		t.Errorf("Expected 1 server error in 6, got %v", rate)
+	}
+
+	// The last whole interval still counts; older ones don't.
+	next := t0.Add(healthErrorInterval)
+	rc.record(http.StatusInternalServerError, next)
+	if rate := rc.errorRate(next); float64(2)/7 != rate {
+		t.Errorf("Expected 2 server errors in 7, got %v", rate)
+	}
+	if rate := rc.errorRate(next.Add(2 * healthErrorInterval)); 0 != rate {
+		t.Errorf("Expected old errors forgotten, got %v", rate)
+	}
+}
@@ -0,0 +1,200 @@
+// Historical stats for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Samples are taken every minute and kept for a day, and folded into hourly
+// samples kept for 30 days, so trends can be charted without external
+// monitoring at a fixed memory cost.
+const (
+	historyMinuteCap = 24 * 60
+	historyHourCap   = 30 * 24
+)
+
+// Public: traffic over one period of stats history.  Counts cover the
+// period; latency and queue depth are the worst seen in it.
+type historySample struct {
+	At         time.Time `json:"at"`
+	Requests   uint64    `json:"requests"`
+	Completed  uint64    `json:"completed"`
+	LatencyP99 uint64    `json:"latency_p99"`
+	QueueDepth int       `json:"queue_depth"`
+}
+
+// Public: response body of /stats/history.
+type historyReport struct {
+	Resolution string          `json:"resolution"`
+	Samples    []historySample `json:"samples"`
+}
+
+// historyRing keeps the newest samples up to a fixed count.
+type historyRing struct {
+	samples []historySample
+	next    int
+}
+
+func newHistoryRing(capacity int) *historyRing {
+	return &historyRing{samples: make([]historySample, 0, capacity)}
+}
+
+func (hr *historyRing) add(s historySample) {
+	if len(hr.samples) < cap(hr.samples) {
+		hr.samples = append(hr.samples, s)
+		return
+	}
+	hr.samples[hr.next] = s
+	hr.next = (hr.next + 1) % len(hr.samples)
+}
+
+// list returns the samples oldest first.
+func (hr *historyRing) list() []historySample {
+	out := make([]historySample, 0, len(hr.samples))
+	out = append(out, hr.samples[hr.next:]...)
+	return append(out, hr.samples[:hr.next]...)
+}
+
+// statsHistory samples the counters and downsamples minutes into hours.
+type statsHistory struct {
+	mu            sync.Mutex
+	minutes       *historyRing
+	hours         *historyRing
+	hour          *historySample // Hour being filled, nil before the first sample.
+	lastRequests  uint64
+	lastCompleted uint64
+}
+
+var history = newStatsHistory()
+
+func newStatsHistory() *statsHistory {
+	return &statsHistory{minutes: newHistoryRing(historyMinuteCap), hours: newHistoryRing(historyHourCap)}
+}
+
+// sample records the minute ending at now.
+func (h *statsHistory) sample(now time.Time) {
+	requests := atomic.LoadUint64(&hashRequests)
+	completed := atomic.LoadUint64(&resultMapCount)
+	overall, _ := latencySnapshot()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := historySample{
+		At:         now.Add(-time.Minute).Truncate(time.Minute),
+		Requests:   requests - h.lastRequests,
+		Completed:  completed - h.lastCompleted,
+		LatencyP99: overall.Windows["1m"].P99,
+		QueueDepth: len(hashRequestChannel),
+	}
+	h.lastRequests, h.lastCompleted = requests, completed
+	h.add(s)
+}
+
+// add files a minute sample, closing out the hour it fills when the next
+// hour begins.  Caller holds mu.
+func (h *statsHistory) add(s historySample) {
+	h.minutes.add(s)
+
+	hourStart := s.At.Truncate(time.Hour)
+	if h.hour != nil && !h.hour.At.Equal(hourStart) {
+		h.hours.add(*h.hour)
+		h.hour = nil
+	}
+	if h.hour == nil {
+		h.hour = &historySample{At: hourStart}
+	}
+	h.hour.Requests += s.Requests
+	h.hour.Completed += s.Completed
+	if s.LatencyP99 > h.hour.LatencyP99 {
+		h.hour.LatencyP99 = s.LatencyP99
+	}
+	if s.QueueDepth > h.hour.QueueDepth {
+		h.hour.QueueDepth = s.QueueDepth
+	}
+}
+
+// report lists samples at a resolution, "minute" or "hour".  The hour in
+// progress is included so far.
+func (h *statsHistory) report(resolution string) historyReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rep := historyReport{Resolution: resolution, Samples: h.minutes.list()}
+	if resolution == "hour" {
+		rep.Samples = h.hours.list()
+		if h.hour != nil {
+			rep.Samples = append(rep.Samples, *h.hour)
+		}
+	}
+	return rep
+}
+
+// watchHistory samples on the minute until stop is closed.
+func watchHistory(stop chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			history.sample(now)
+		}
+	}
+}
+
+// historyResolution reads the "resolution" field, minute by default,
+// answering 400 and returning false if it is neither minute nor hour.
+func historyResolution(w http.ResponseWriter, r *http.Request) (string, bool) {
+	resolution := r.URL.Query().Get("resolution")
+	switch resolution {
+	case "":
+		return "minute", true
+	case "minute", "hour":
+		return resolution, true
+	}
+	writeError(w, r, "Field 'resolution' must be minute or hour.", http.StatusBadRequest)
+	return "", false
+}
+
+// historyHandler serves /stats/history, per minute by default or per hour
+// with resolution=hour.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	resolution, ok := historyResolution(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, history.report(resolution))
+}
+
+// historyCSVHandler serves /stats/history.csv, the same samples as
+// /stats/history with a header row, for spreadsheets.
+func historyCSVHandler(w http.ResponseWriter, r *http.Request) {
+	resolution, ok := historyResolution(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"jmpc-history-%s.csv\"", resolution))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"at", "requests", "completed", "latency_p99", "queue_depth"})
+	for _, s := range history.report(resolution).Samples {
+		cw.Write([]string{
+			s.At.UTC().Format(time.RFC3339),
+			strconv.FormatUint(s.Requests, 10),
+			strconv.FormatUint(s.Completed, 10),
+			strconv.FormatUint(s.LatencyP99, 10),
+			strconv.Itoa(s.QueueDepth),
+		})
+	}
+	cw.Flush()
+}
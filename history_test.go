@@ -0,0 +1,109 @@
+// Unit Tests for historical stats.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryRing(t *testing.T) {
+	hr := newHistoryRing(3)
+	for i := uint64(1); i <= 5; i++ {
+		hr.add(historySample{Requests: i})
+	}
+	samples := hr.list()
+	if 3 != len(samples) || 3 != samples[0].Requests || 5 != samples[2].Requests {
+		t.Errorf("Expected the newest 3 samples oldest first, got %+v", samples)
+	}
+}
+
+func TestHistoryDownsampling(t *testing.T) {
+	h := newStatsHistory()
+	start := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// 90 minutes: one full hour and half of the next.
+	for i := 0; i < 90; i++ {
+		h.add(historySample{At: start.Add(time.Duration(i) * time.Minute), Requests: 2, LatencyP99: uint64(i)})
+	}
+
+	minutes := h.report("minute").Samples
+	if 90 != len(minutes) || !start.Equal(minutes[0].At) {
+		t.Errorf("Expected 90 minute samples from %v, got %d", start, len(minutes))
+	}
+
+	hours := h.report("hour").Samples
+	if 2 != len(hours) {
+		t.Fatalf("Expected a closed hour and one in progress, got %+v", hours)
+	}
+	if 120 != hours[0].Requests || 59 != hours[0].LatencyP99 || !start.Equal(hours[0].At) {
+		t.Errorf("Unexpected first hour %+v", hours[0])
+	}
+	if 60 != hours[1].Requests || 89 != hours[1].LatencyP99 {
+		t.Errorf("Unexpected hour in progress %+v", hours[1])
+	}
+}
+
+func TestHistorySampleDeltas(t *testing.T) {
+	h := newStatsHistory()
+	now := time.Now()
+	h.sample(now)
+	h.sample(now.Add(time.Minute))
+
+	samples := h.report("minute").Samples
+	if 2 != len(samples) || 0 != samples[1].Requests || 0 != samples[1].Completed {
+		t.Errorf("Expected no traffic between samples, got %+v", samples)
+	}
+	if !samples[1].At.Equal(now.Truncate(time.Minute)) {
+		t.Errorf("Expected the sample stamped with its minute, got %v", samples[1].At)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	historyHandler(rec, httptest.NewRequest("GET", "/stats/history?resolution=hour", nil))
+	var rep historyReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil || "hour" != rep.Resolution {
+		t.Errorf("Expected an hourly report, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	historyHandler(rec, httptest.NewRequest("GET", "/stats/history?resolution=day", nil))
+	if http.StatusBadRequest != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHistoryCSV(t *testing.T) {
+	saved := history
+	defer func() { history = saved }()
+	history = newStatsHistory()
+	at := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	history.add(historySample{At: at, Requests: 4, Completed: 3, LatencyP99: 120, QueueDepth: 2})
+
+	rec := httptest.NewRecorder()
+	historyCSVHandler(rec, httptest.NewRequest("GET", "/stats/history.csv", nil))
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("Expected CSV, got %q %v", rec.Header().Get("Content-Type"), err)
+	}
+	want := [][]string{
+		{"at", "requests", "completed", "latency_p99", "queue_depth"},
+		{"2020-03-01T10:00:00Z", "4", "3", "120", "2"},
+	}
+	if !reflect.DeepEqual(want, rows) {
+		t.Errorf("Expected %v, got %v", want, rows)
+	}
+
+	rec = httptest.NewRecorder()
+	historyCSVHandler(rec, httptest.NewRequest("GET", "/stats/history.csv?resolution=week", nil))
+	if http.StatusBadRequest != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,64 @@
+// Honey-token IDs for intrusion detection.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Comma separated decoy IDs.  They are never issued, so anyone looking one up
+// found it somewhere they shouldn't have, or is guessing.
+var honeyIDList string
+
+// Parsed honeyIDList.
+var honeyIDs = map[uint64]bool{}
+
+// Public: details sent with a honey-token alert.
+type honeyTokenAlert struct {
+	ID        uint64 `json:"id"`
+	Client    string `json:"client"`
+	UserAgent string `json:"user_agent"`
+}
+
+func isHoneyID(idNum uint64) bool {
+	return honeyIDs[idNum]
+}
+
+// nextRequestID hands out the next ID, stepping over the decoys.  A skipped
+// decoy still counts as a request, which keeps the ID and request counts in
+// step; it is settled as discarded since it will never have a result.
+func nextRequestID() (uint64, error) {
+	idNum, err := idGen.next()
+	for err == nil && isHoneyID(idNum) {
+		atomic.AddUint64(&discardedCount, 1)
+		idNum, err = idGen.next()
+	}
+	return idNum, err
+}
+
+// honeyTokenTripped raises a security alert for a decoy lookup.
+func honeyTokenTripped(r *http.Request, idNum uint64) {
+	alert := honeyTokenAlert{ID: idNum, Client: rateLimitClient(r), UserAgent: r.UserAgent()}
+	notify("honeytoken", fmt.Sprintf("Decoy ID %d looked up by %s", idNum, alert.Client), alert)
+}
+
+// validateHoneyTokenConfig parses the decoy IDs.
+func validateHoneyTokenConfig() error {
+	ids := map[uint64]bool{}
+	for _, field := range strings.Split(honeyIDList, ",") {
+		if field = strings.TrimSpace(field); len(field) == 0 {
+			continue
+		}
+		idNum, err := strconv.ParseUint(field, 10, 64)
+		if err != nil || idNum == 0 {
+			return fmt.Errorf("honey-ids: %q is not a valid ID", field)
+		}
+		ids[idNum] = true
+	}
+	honeyIDs = ids
+	return nil
+}
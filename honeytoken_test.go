@@ -0,0 +1,111 @@
+// Unit Tests for honey-token IDs.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHoneyIDsAreNeverIssued(t *testing.T) {
+	savedRequests := atomic.LoadUint64(&hashRequests)
+	savedDiscarded := atomic.LoadUint64(&discardedCount)
+	defer func() {
+		atomic.StoreUint64(&hashRequests, savedRequests)
+		atomic.StoreUint64(&discardedCount, savedDiscarded)
+		honeyIDs = map[uint64]bool{}
+	}()
+
+	honeyIDs = map[uint64]bool{savedRequests + 1: true, savedRequests + 2: true}
+	if idNum, _ := nextRequestID(); savedRequests+3 != idNum {
+		t.Errorf("Expected decoys to be skipped, got ID %d after %d", idNum, savedRequests)
+	}
+	if 2 != atomic.LoadUint64(&discardedCount)-savedDiscarded {
+		t.Errorf("Expected skipped decoys to be settled as discarded")
+	}
+}
+
+func TestHoneyIDLookupAlerts(t *testing.T) {
+	alerts := make(chan notification, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		json.NewDecoder(r.Body).Decode(&n)
+		alerts <- n
+	}))
+	defer hook.Close()
+
+	notifyURL = hook.URL
+	honeyIDs = map[uint64]bool{424242: true}
+	defer func() {
+		notifyURL = ""
+		honeyIDs = map[uint64]bool{}
+	}()
+
+	// Every way of looking an ID up trips the alert.
+	for _, lookup := range []struct{ method, path string }{
+		{"GET", "/hash/424242"}, {"GET", "/hash/424242/status"}, {"POST", "/hash/424242/share"},
+		{"DELETE", "/hash/424242"},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(lookup.method, lookup.path, nil)
+		req.Header.Set("User-Agent", "scanner/1.0")
+		hashHandler(rec, req)
+
+		// To the caller it looks like any other missing result.
+		if http.StatusNotFound != rec.Code {
+			t.Errorf("%s %s: expected StatusCode [%d], got [%d]", lookup.method, lookup.path, http.StatusNotFound, rec.Code)
+		}
+
+		select {
+		case n := <-alerts:
+			if "honeytoken" != n.Kind || !strings.Contains(n.Message, "424242") {
+				t.Errorf("Unexpected alert %+v", n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s %s: expected a honey-token alert", lookup.method, lookup.path)
+		}
+	}
+
+	restore := withSavedConfig(t)
+	defer restore()
+	if err := loadConfig([]string{"-honey-ids", "12,abc"}); err == nil {
+		t.Errorf("Expected a malformed decoy ID to be rejected")
+	}
+}
+
+// A flood of probes can't run more deliveries than notifyMaxInFlight.
+func TestNotifyBoundsInFlight(t *testing.T) {
+	delivered := make(chan notification, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		json.NewDecoder(r.Body).Decode(&n)
+		delivered <- n
+	}))
+	defer hook.Close()
+	notifyURL = hook.URL
+	defer func() { notifyURL = "" }()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	for i := 0; i < notifyMaxInFlight; i++ {
+		notifyInFlight <- struct{}{}
+	}
+	notify("honeytoken", "dropped", nil)
+	for i := 0; i < notifyMaxInFlight; i++ {
+		<-notifyInFlight
+	}
+	notify("honeytoken", "delivered", nil)
+	select {
+	case n := <-delivered:
+		if "delivered" != n.Message {
+			t.Errorf("Expected only the notification with room delivered, got %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected a notification delivered once there was room")
+	}
+}
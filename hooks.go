@@ -0,0 +1,72 @@
+// Job lifecycle hooks for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// jobEvent describes one step in a hash request's life.
+type jobEvent struct {
+	ID     uint64
+	Tenant string // The submitting caller's name, "" if unauthenticated.
+	At     time.Time
+	Hash   string // Set on completion.
+	Err    error  // Set on failure.
+}
+
+// Steps hooks can be attached to.
+type jobStage int
+
+const (
+	jobSubmitted jobStage = iota // Accepted, queued or held in quarantine.
+	jobStarted                   // Taken by a worker.
+	jobCompleted                 // Hashed and stored.
+	jobFailed                    // Rejected from quarantine, or not stored.
+	jobStages
+)
+
+var errRejected = errors.New("rejected from quarantine")
+
+// Hooks by stage, run in the order added.
+var jobHooks struct {
+	sync.RWMutex
+	byStage [jobStages][]func(jobEvent)
+}
+
+// onSubmit, onStart, onComplete, and onFail attach code to the job
+// lifecycle, e.g. for billing or caching, without touching the handlers or
+// workers.  Hooks run in the goroutine the step happens in, a handler or a
+// worker, so anything slow should be handed off.
+func onSubmit(fn func(jobEvent))   { addJobHook(jobSubmitted, fn) }
+func onStart(fn func(jobEvent))    { addJobHook(jobStarted, fn) }
+func onComplete(fn func(jobEvent)) { addJobHook(jobCompleted, fn) }
+func onFail(fn func(jobEvent))     { addJobHook(jobFailed, fn) }
+
+func addJobHook(stage jobStage, fn func(jobEvent)) {
+	jobHooks.Lock()
+	jobHooks.byStage[stage] = append(jobHooks.byStage[stage], fn)
+	jobHooks.Unlock()
+}
+
+// runJobHooks calls the hooks for a stage.  A hook that panics is logged
+// and skipped so it can't take a worker down with it.
+func runJobHooks(stage jobStage, ev jobEvent) {
+	jobHooks.RLock()
+	hooks := jobHooks.byStage[stage]
+	jobHooks.RUnlock()
+
+	ev.At = time.Now()
+	for _, fn := range hooks {
+		func() {
+			defer func() {
+				if p := recover(); p != nil {
+					logError("Job hook panicked", "id", ev.ID, "stage", int(stage), "panic", p)
+				}
+			}()
+			fn(ev)
+		}()
+	}
+}
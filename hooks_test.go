@@ -0,0 +1,198 @@
+// Unit Tests for job lifecycle hooks.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestJobHooks(t *testing.T) {
+	saved := jobHooks.byStage
+	defer func() { jobHooks.byStage = saved }()
+
+	var seen []string
+	onSubmit(func(ev jobEvent) { seen = append(seen, "submit:"+ev.Tenant) })
+	onStart(func(ev jobEvent) { panic("broken hook") })
+	onStart(func(ev jobEvent) { seen = append(seen, "start") })
+	onComplete(func(ev jobEvent) { seen = append(seen, "complete:"+ev.Hash) })
+	onFail(func(ev jobEvent) {
+		if ev.Err == errRejected && !ev.At.IsZero() {
+			seen = append(seen, "fail")
+		}
+	})
+
+	runJobHooks(jobSubmitted, jobEvent{ID: 1, Tenant: "alice"})
+	runJobHooks(jobStarted, jobEvent{ID: 1})
+	runJobHooks(jobCompleted, jobEvent{ID: 1, Hash: "abc"})
+	runJobHooks(jobFailed, jobEvent{ID: 2, Err: errRejected})
+
+	expected := []string{"submit:alice", "start", "complete:abc", "fail"}
+	if len(expected) != len(seen) {
+		t.Fatalf("Expected hooks %v, got %v", expected, seen)
+	}
+	for i := range expected {
+		if expected[i] != seen[i] {
+			t.Errorf("Expected hooks %v, got %v", expected, seen)
+			break
+		}
+	}
+}
+
+// failingStore keeps results in memory, but refuses to save some IDs.
+type failingStore struct {
+	memoryStore
+	fail map[uint64]bool
+}
+
+func (fs failingStore) save(rk resultKey, hRes hashResult) error {
+	if fs.fail[rk.id] {
+		return errors.New("store unavailable")
+	}
+	return fs.memoryStore.save(rk, hRes)
+}
+
+// lifecycleScenario is a run of submissions for quick.Check to generate.
+// The pool is paused just before job PauseAt is queued, if there is one,
+// and resumed once the rest are.
+type lifecycleScenario struct {
+	Jobs    []lifecycleJob
+	PauseAt uint8
+}
+
+type lifecycleJob struct {
+	DelayMs   uint8
+	SaveFails bool
+}
+
+// Above any ID the other tests issue.
+var lifecycleIDs uint64 = 1 << 50
+
+// TestJobLifecycleProperties checks, over generated runs through the real
+// queue and workers, that every queued job is started once and then reaches
+// exactly one terminal state, that a paused pool starts nothing queued while
+// paused, and that the counters reconcile once the queue drains.
+func TestJobLifecycleProperties(t *testing.T) {
+	saved := jobHooks.byStage
+	defer func() { jobHooks.byStage = saved }()
+	savedStore := store
+	defer func() { store = savedStore }()
+
+	var mu sync.Mutex
+	var events map[uint64][]jobStage
+	var startedAt map[uint64]time.Time
+	terminal := make(chan uint64, 1024)
+	record := func(stage jobStage) func(jobEvent) {
+		return func(ev jobEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ours := events[ev.ID]; !ours {
+				return
+			}
+			events[ev.ID] = append(events[ev.ID], stage)
+			if jobStarted == stage {
+				startedAt[ev.ID] = ev.At
+			}
+			if jobCompleted == stage || jobFailed == stage {
+				terminal <- ev.ID
+			}
+		}
+	}
+	onStart(record(jobStarted))
+	onComplete(record(jobCompleted))
+	onFail(record(jobFailed))
+
+	property := func(sc lifecycleScenario) bool {
+		if len(sc.Jobs) > cap(terminal) {
+			sc.Jobs = sc.Jobs[:cap(terminal)]
+		}
+		fs := failingStore{fail: map[uint64]bool{}}
+		store = fs
+		mu.Lock()
+		events, startedAt = map[uint64][]jobStage{}, map[uint64]time.Time{}
+		ids := make([]uint64, len(sc.Jobs))
+		for i, job := range sc.Jobs {
+			ids[i] = atomic.AddUint64(&lifecycleIDs, 1)
+			events[ids[i]] = nil
+			fs.fail[ids[i]] = job.SaveFails
+		}
+		mu.Unlock()
+		countBefore := atomic.LoadUint64(&resultMapCount)
+		defer func() {
+			atomic.AddUint64(&resultMapCount, ^uint64(len(sc.Jobs)-1))
+			for _, idNum := range ids {
+				resultMap.Delete(resultKey{id: idNum})
+			}
+		}()
+
+		var resumedAt time.Time
+		for i, job := range sc.Jobs {
+			if i == int(sc.PauseAt) {
+				workers.pause()
+			}
+			queueHashRequest(context.Background(), hashRequest{
+				idNum:     ids[i],
+				clearText: fmt.Sprint(ids[i]),
+				queuedAt:  time.Now(),
+				delay:     time.Duration(job.DelayMs%10) * time.Millisecond,
+			})
+		}
+		if int(sc.PauseAt) < len(sc.Jobs) {
+			time.Sleep(10 * time.Millisecond)
+			resumedAt = time.Now()
+			workers.resume()
+		}
+
+		timeout := time.After(5 * time.Second)
+		for n := range sc.Jobs {
+			select {
+			case <-terminal:
+			case <-timeout:
+				t.Logf("%d jobs never finished", len(sc.Jobs)-n)
+				return false
+			}
+		}
+		// Let any second terminal event show up.
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for i, idNum := range ids {
+			expected := []jobStage{jobStarted, jobCompleted}
+			if sc.Jobs[i].SaveFails {
+				expected[1] = jobFailed
+			}
+			if fmt.Sprint(expected) != fmt.Sprint(events[idNum]) {
+				t.Logf("Job %d went through %v, expected %v", i, events[idNum], expected)
+				return false
+			}
+			if i >= int(sc.PauseAt) && startedAt[idNum].Before(resumedAt) {
+				t.Logf("Job %d started while the pool was paused", i)
+				return false
+			}
+			ckSum := sha512.Sum512([]byte(fmt.Sprint(idNum)))
+			hRes, found := store.load(resultKey{id: idNum})
+			if found == sc.Jobs[i].SaveFails || (found && base64.StdEncoding.EncodeToString(ckSum[:]) != hRes.b64Str) {
+				t.Logf("Job %d stored %v %v, expected failure %v", i, hRes, found, sc.Jobs[i].SaveFails)
+				return false
+			}
+		}
+		if counted := atomic.LoadUint64(&resultMapCount) - countBefore; uint64(len(sc.Jobs)) != counted || 0 != workers.remaining() {
+			t.Logf("Expected %d jobs counted and none pending, got %d and %d", len(sc.Jobs), counted, workers.remaining())
+			return false
+		}
+		return len(terminal) == 0
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 25}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,278 @@
+// Request ID generation strategies.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How request IDs are made: "sequential" counts up from 1, "random" makes
+// them unguessable, "time" orders them by creation time across restarts,
+// and "node" puts id-node in the top bits so IDs from several instances
+// never clash and can be routed back to their instance.
+var idStrategy string = "sequential"
+
+// This instance's number for the node strategy, 1 to idNodeMax.
+var idNode int = 0
+
+// IDs other than sequential ones stay below 2^53, so JavaScript clients
+// can hold them exactly.
+const idBits = 53
+
+// node IDs: a 10 bit node number over a 43 bit per-process sequence.
+const (
+	idNodeBits = 10
+	idNodeMax  = 1<<idNodeBits - 1
+	idSeqBits  = idBits - idNodeBits
+)
+
+// time IDs: milliseconds since idEpoch over 12 random bits, good for 69
+// years.  They serve where a ULID would, which is too wide for the numeric
+// IDs the API uses.
+const idRandomBits = 12
+
+var idEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// idGenerator makes request IDs.  It counts what it makes in hashRequests.
+type idGenerator interface {
+	next() (uint64, error)
+}
+
+// The generator in service.
+var idGen idGenerator = sequentialIDs{}
+
+// sequentialIDs leaves allocation to the store, so replicas sharing one
+// count up together.
+type sequentialIDs struct{}
+
+func (sequentialIDs) next() (uint64, error) {
+	return store.nextID()
+}
+
+// issuedIDs remembers IDs that don't come from a counter, in the order they
+// were made, since their values alone no longer tell which were issued.
+// An ID is let go once its removal is forgotten, so the record is bounded
+// by the results held and removals remembered, not every ID ever made.
+// Positions in issue order never change: a released ID leaves a 0 in
+// order, and released IDs at the front are dropped, base counting them.
+type issuedIDs struct {
+	mu    sync.Mutex
+	base  uint64
+	order []uint64
+	index map[uint64]uint64
+}
+
+var issued = &issuedIDs{index: map[uint64]uint64{}}
+
+// add records idNum, false if it was already issued.
+func (ii *issuedIDs) add(idNum uint64) bool {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	if _, found := ii.index[idNum]; found {
+		return false
+	}
+	ii.index[idNum] = ii.base + uint64(len(ii.order))
+	ii.order = append(ii.order, idNum)
+	return true
+}
+
+// release forgets idNum, which then reads as never issued.
+func (ii *issuedIDs) release(idNum uint64) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	at, found := ii.index[idNum]
+	if !found {
+		return
+	}
+	delete(ii.index, idNum)
+	ii.order[at-ii.base] = 0
+	dropped := 0
+	for dropped < len(ii.order) && ii.order[dropped] == 0 {
+		dropped++
+	}
+	ii.order = ii.order[dropped:]
+	ii.base += uint64(dropped)
+	// Let the array go once most of it is behind us.
+	if dropped > 0 && cap(ii.order) > 2*len(ii.order)+1024 {
+		ii.order = append([]uint64(nil), ii.order...)
+	}
+}
+
+// claim records a freshly made ID, counting it as a request.
+func (ii *issuedIDs) claim(idNum uint64) bool {
+	if idNum == 0 || !ii.add(idNum) {
+		return false
+	}
+	atomic.AddUint64(&hashRequests, 1)
+	return true
+}
+
+// randomIDs draws IDs at random, redrawing on a clash.
+type randomIDs struct{}
+
+func (randomIDs) next() (uint64, error) {
+	for tries := 0; tries < 8; tries++ {
+		n, err := randomBits(idBits)
+		if err != nil {
+			return 0, err
+		}
+		if issued.claim(n) {
+			return n, nil
+		}
+	}
+	return 0, errors.New("no unused random ID found")
+}
+
+// timeIDs stamp IDs with the millisecond they were made.
+type timeIDs struct{}
+
+func (timeIDs) next() (uint64, error) {
+	for tries := 0; tries < 8; tries++ {
+		n, err := randomBits(idRandomBits)
+		if err != nil {
+			return 0, err
+		}
+		ms := uint64(time.Since(idEpoch).Milliseconds())
+		if idNum := ms<<idRandomBits | n; issued.claim(idNum) {
+			return idNum, nil
+		}
+	}
+	return 0, errors.New("no unused time ID found")
+}
+
+// nodeIDs count up under this instance's node number.
+type nodeIDs struct {
+	seq uint64
+}
+
+func (ng *nodeIDs) next() (uint64, error) {
+	seq := atomic.AddUint64(&ng.seq, 1)
+	if seq >= 1<<idSeqBits {
+		return 0, errors.New("node ID sequence exhausted")
+	}
+	idNum := uint64(idNode)<<idSeqBits | seq
+	issued.claim(idNum)
+	return idNum, nil
+}
+
+// randomBits draws a random number of the given width.
+func randomBits(width uint) (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]) & (1<<width - 1), nil
+}
+
+// idIssued reports whether idNum was handed out.
+func idIssued(idNum uint64) bool {
+	if _, counted := idGen.(sequentialIDs); counted {
+		return idNum > 0 && idNum <= store.lastID()
+	}
+	issued.mu.Lock()
+	defer issued.mu.Unlock()
+	_, found := issued.index[idNum]
+	return found
+}
+
+// forEachIssuedID calls fn with every ID issued after the one given, 0 for
+// all, until fn returns false.  Sequential IDs come in ID order, others in
+// the order they were made.
+func forEachIssuedID(after uint64, fn func(idNum uint64) bool) {
+	forEachIssuedFrom(issuedPosition(after), func(idNum, next uint64) bool { return fn(idNum) })
+}
+
+// issuedPosition gives the position in issue order following an ID, or 0,
+// the start, for one never issued.
+func issuedPosition(idNum uint64) uint64 {
+	if _, counted := idGen.(sequentialIDs); counted {
+		return idNum
+	}
+	issued.mu.Lock()
+	defer issued.mu.Unlock()
+	if at, found := issued.index[idNum]; found {
+		return at + 1
+	}
+	return 0
+}
+
+// forEachIssuedFrom calls fn with every ID from position pos in the order
+// they were issued on, 0 for all, and the position following it, until fn
+// returns false.  Positions never change once given, unlike which IDs have
+// results, so they are what paging cursors hold.
+func forEachIssuedFrom(pos uint64, fn func(idNum, next uint64) bool) {
+	if _, counted := idGen.(sequentialIDs); counted {
+		last := store.lastID()
+		for idNum := pos + 1; idNum <= last; idNum++ {
+			if !fn(idNum, idNum) {
+				return
+			}
+		}
+		return
+	}
+
+	issued.mu.Lock()
+	if pos < issued.base {
+		pos = issued.base
+	}
+	var ids []uint64
+	if pos-issued.base < uint64(len(issued.order)) {
+		ids = append(ids, issued.order[pos-issued.base:]...)
+	}
+	issued.mu.Unlock()
+
+	for i, idNum := range ids {
+		if idNum == 0 {
+			continue
+		}
+		if !fn(idNum, pos+uint64(i)+1) {
+			return
+		}
+	}
+}
+
+// issuedAt gives the ID issued at position pos, counting from 0: 0 if it
+// has been released, and false if nothing was issued there.
+func issuedAt(pos uint64) (uint64, bool) {
+	if _, counted := idGen.(sequentialIDs); counted {
+		return pos + 1, pos < store.lastID()
+	}
+	issued.mu.Lock()
+	defer issued.mu.Unlock()
+	if pos < issued.base {
+		return 0, true
+	}
+	if pos-issued.base >= uint64(len(issued.order)) {
+		return 0, false
+	}
+	return issued.order[pos-issued.base], true
+}
+
+// validateIDConfig picks the generator.
+func validateIDConfig() error {
+	if idStrategy != "sequential" && storeBackend != "memory" {
+		return fmt.Errorf("id-strategy %s needs store=memory; a shared store allocates IDs itself", idStrategy)
+	}
+	switch idStrategy {
+	case "sequential":
+		idGen = sequentialIDs{}
+	case "random":
+		idGen = randomIDs{}
+	case "time":
+		idGen = timeIDs{}
+	case "node":
+		if idNode < 1 || idNode > idNodeMax {
+			return fmt.Errorf("id-node %d must be between 1 and %d for id-strategy node", idNode, idNodeMax)
+		}
+		idGen = &nodeIDs{}
+	default:
+		return fmt.Errorf("id-strategy %q must be sequential, random, time or node", idStrategy)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Unit Tests for request ID generation.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// withFreshIDs swaps in an empty issued ID record and takes the IDs a test
+// makes back out of the request count.
+func withFreshIDs() func() {
+	savedIssued, savedRequests := issued, atomic.LoadUint64(&hashRequests)
+	issued = &issuedIDs{index: map[uint64]uint64{}}
+	return func() {
+		atomic.AddUint64(&hashRequests, -(atomic.LoadUint64(&hashRequests) - savedRequests))
+		issued = savedIssued
+	}
+}
+
+func TestIDStrategies(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+
+	for _, strategy := range []string{"random", "time", "node"} {
+		restore := withFreshIDs()
+		idStrategy, idNode = strategy, 5
+		if err := validateIDConfig(); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := map[uint64]bool{}
+		var prev uint64
+		for i := 0; i < 1000; i++ {
+			idNum, err := idGen.next()
+			if err != nil || idNum == 0 || idNum >= 1<<idBits || seen[idNum] {
+				t.Fatalf("%s: expected a new ID under 2^53, got %d %v", strategy, idNum, err)
+			}
+			if strategy == "node" && (5 != idNum>>idSeqBits || idNum <= prev) {
+				t.Fatalf("node: expected ascending IDs for node 5, got %d after %d", idNum, prev)
+			}
+			if !idIssued(idNum) {
+				t.Fatalf("%s: expected %d recorded as issued", strategy, idNum)
+			}
+			seen[idNum], prev = true, idNum
+		}
+		if idIssued(1) {
+			t.Errorf("%s: expected an ID never made to be unknown", strategy)
+		}
+		restore()
+	}
+}
+
+func TestForEachIssuedID(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+
+	idStrategy = "random"
+	validateIDConfig()
+	for _, idNum := range []uint64{40, 10, 30} {
+		issued.claim(idNum)
+	}
+
+	var got []uint64
+	forEachIssuedID(10, func(idNum uint64) bool {
+		got = append(got, idNum)
+		return true
+	})
+	if 1 != len(got) || 30 != got[0] {
+		t.Errorf("Expected the IDs issued after 10 in issue order, got %v", got)
+	}
+
+	got = nil
+	forEachIssuedID(0, func(idNum uint64) bool {
+		got = append(got, idNum)
+		return len(got) < 2
+	})
+	if 2 != len(got) || 40 != got[0] || 10 != got[1] {
+		t.Errorf("Expected to stop after 40 and 10, got %v", got)
+	}
+}
+
+func TestIssuedIDsReleased(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+
+	idStrategy = "random"
+	validateIDConfig()
+	for _, idNum := range []uint64{40, 10, 30, 20} {
+		issued.claim(idNum)
+	}
+	cursor := encodeCursor(issuedPosition(10), 10)
+
+	// Released IDs read as never issued, but keep their positions, and
+	// those at the front take no room.
+	issued.release(40)
+	issued.release(30)
+	if idIssued(40) || idIssued(30) || !idIssued(10) || 1 != issued.base || 3 != len(issued.order) {
+		t.Errorf("Expected 40 and 30 released and 40 dropped, got base %d order %v", issued.base, issued.order)
+	}
+	if 2 != issuedPosition(10) || 4 != issuedPosition(20) {
+		t.Errorf("Expected positions unchanged, got %d and %d", issuedPosition(10), issuedPosition(20))
+	}
+	var got []uint64
+	forEachIssuedID(0, func(idNum uint64) bool {
+		got = append(got, idNum)
+		return true
+	})
+	if 2 != len(got) || 10 != got[0] || 20 != got[1] {
+		t.Errorf("Expected 10 and 20 left, got %v", got)
+	}
+
+	// A cursor past an ID since released still resumes where it was.
+	issued.release(10)
+	if pos, err := decodeCursor(cursor); err != nil || 2 != pos {
+		t.Errorf("Expected the cursor at position 2 still good, got %d %v", pos, err)
+	}
+	if 3 != issued.base || 1 != len(issued.order) {
+		t.Errorf("Expected only 20 held, got base %d order %v", issued.base, issued.order)
+	}
+}
+
+func TestIDConfig(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+
+	idStrategy = "uuid"
+	if err := validateIDConfig(); err == nil {
+		t.Errorf("Expected an unknown strategy rejected")
+	}
+	idStrategy, idNode = "node", 0
+	if err := validateIDConfig(); err == nil {
+		t.Errorf("Expected node IDs without a node number rejected")
+	}
+	idStrategy, storeBackend = "random", "redis"
+	if err := validateIDConfig(); err == nil {
+		t.Errorf("Expected random IDs with a shared store rejected")
+	}
+}
@@ -0,0 +1,175 @@
+//go:build integration
+
+// Integration Tests running the API against each storage backend.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+// Run with "go test -tags integration -run Integration".  Redis is started
+// in a throwaway container with the docker CLI, or taken from
+// JMPC_TEST_REDIS_ADDR; without either the Redis run is skipped.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const integrationRedisImage = "redis:7-alpine"
+
+// integrationBackends builds each storage backend the suite is run against.
+var integrationBackends = []struct {
+	name  string
+	start func(t *testing.T) hashStore
+}{
+	{"memory", func(t *testing.T) hashStore { return memoryStore{} }},
+	{"redis", startIntegrationRedis},
+}
+
+func TestIntegrationBackends(t *testing.T) {
+	defer withSavedConfig(t)()
+	hashDelay = 100 * time.Millisecond
+	savedStore := store
+	defer func() { store = savedStore }()
+
+	for _, backend := range integrationBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			bs := backend.start(t)
+			// Backends share the local result cache, so carry on from the
+			// IDs the last one issued rather than serving its results.
+			if rs, shared := bs.(*redisStore); shared {
+				if _, err := rs.client.do("SET", rs.key("ids"), strconv.FormatUint(store.lastID(), 10)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store = bs
+			runAPISuite(t)
+		})
+	}
+}
+
+// startIntegrationRedis gives a Redis store on an empty server.
+func startIntegrationRedis(t *testing.T) hashStore {
+	addr := os.Getenv("JMPC_TEST_REDIS_ADDR")
+	if len(addr) == 0 {
+		if _, err := exec.LookPath("docker"); err != nil {
+			t.Skip("No docker to start Redis in, and JMPC_TEST_REDIS_ADDR not set")
+		}
+		out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::6379", integrationRedisImage).Output()
+		if err != nil {
+			t.Fatalf("Could not start %s: %v", integrationRedisImage, err)
+		}
+		container := strings.TrimSpace(string(out))
+		t.Cleanup(func() { exec.Command("docker", "rm", "-f", container).Run() })
+		out, err = exec.Command("docker", "port", container, "6379/tcp").Output()
+		if err != nil {
+			t.Fatalf("Could not find the Redis port: %v", err)
+		}
+		addr = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	}
+
+	rs := newRedisStore(newRedisClient(addr, "", 0))
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := rs.ping()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Redis at %s not up: %v", addr, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := rs.client.do("FLUSHDB"); err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+// runAPISuite drives the HTTP API against whatever store is in use, checking
+// what every backend must agree on.
+func runAPISuite(t *testing.T) {
+	const digest = "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="
+	base := "http://localhost:8080"
+	totalBefore, _ := store.totals()
+
+	resp, err := http.PostForm(base+"/hash", url.Values{"password": {"angryMonkey"}, "label": {"suite=integration"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	idNum, err := strconv.ParseUint(strings.TrimSpace(string(idBody)), 10, 64)
+	if err != nil || http.StatusOK != resp.StatusCode {
+		t.Fatalf("Expected an ID, got StatusCode [%d] %q", resp.StatusCode, idBody)
+	}
+	idPath := fmt.Sprintf("%s/hash/%d", base, idNum)
+
+	if code, errCode, _ := integrationGet(t, idPath); http.StatusNotFound != code || codePending != errCode {
+		t.Errorf("Expected the result pending, got StatusCode [%d] %s", code, errCode)
+	}
+
+	var code int
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		code, _, body = integrationGet(t, idPath)
+	}
+	if http.StatusOK != code || digest != strings.TrimSpace(body) {
+		t.Fatalf("Expected the digest, got StatusCode [%d] %q", code, body)
+	}
+
+	var status jobStatus
+	if code, _, body := integrationGet(t, idPath+"/status"); http.StatusOK != code || json.Unmarshal([]byte(body), &status) != nil ||
+		jobComplete != status.State || "integration" != status.Labels["suite"] {
+		t.Errorf("Expected the job complete and labelled, got StatusCode [%d] %q", code, body)
+	}
+
+	if code, errCode, _ := integrationGet(t, fmt.Sprintf("%s/hash/%d", base, idNum+1000)); http.StatusNotFound != code || codeNotFound != errCode {
+		t.Errorf("Expected an unissued ID not found, got StatusCode [%d] %s", code, errCode)
+	}
+
+	var listing jobListing
+	if code, _, body := integrationGet(t, base+"/hashes?label=suite&after="+strconv.FormatUint(idNum-1, 10)); http.StatusOK != code ||
+		json.Unmarshal([]byte(body), &listing) != nil || 1 != len(listing.Results) || idNum != listing.Results[0].ID {
+		t.Errorf("Expected the listing to hold only ID %d, got StatusCode [%d] %q", idNum, code, body)
+	}
+
+	code, _, body = integrationGet(t, base+"/export?label=suite=integration")
+	exported := false
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Expected export records, got %q: %v", scanner.Text(), err)
+		}
+		exported = exported || (idNum == rec.ID && digest == rec.Digest)
+	}
+	if http.StatusOK != code || !exported {
+		t.Errorf("Expected ID %d exported with its digest, got StatusCode [%d] %q", idNum, code, body)
+	}
+
+	if total, completed := store.totals(); totalBefore+1 != total || completed < 1 {
+		t.Errorf("Expected one more request counted and one completed, got %d, %d", total, completed)
+	}
+}
+
+// integrationGet gives the status code, error code, and body of a GET.
+func integrationGet(t *testing.T, url string) (int, errorCode, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, errorCode(resp.Header.Get("X-JMPC-Error-Code")), string(body)
+}
@@ -0,0 +1,89 @@
+// Job status for submitted hash requests.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Job states.
+const (
+	jobPending     = "pending"
+	jobQuarantined = "quarantined"
+	jobRejected    = "rejected"
+	jobComplete    = "complete"
+	jobRemoved     = "removed"
+)
+
+// Public: where a submitted request has got to.  The digest itself is only
+// served by GET /hash/{id}.
+type jobStatus struct {
+	ID            uint64            `json:"id"`
+	State         string            `json:"state"`
+	QueueTimeUs   int64             `json:"queue_time_us,omitempty"`
+	ProcessTimeUs int64             `json:"process_time_us,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Webhook       *webhookDelivery  `json:"webhook,omitempty"`
+}
+
+// lookupJobStatus reports on idNum for tenant, false if it was never
+// issued to them, or ctx's error if it ends before the store answers.
+func lookupJobStatus(ctx context.Context, tenant string, idNum uint64) (jobStatus, bool, error) {
+	if !idIssued(idNum) || isHoneyID(idNum) || ownerOf(idNum) != tenant {
+		return jobStatus{}, false, nil
+	}
+
+	hRes, recFound, err := loadBefore(ctx, resultKey{tenant, idNum})
+	if err != nil {
+		return jobStatus{}, false, err
+	}
+	status := jobStatus{ID: idNum, State: jobPending, Labels: labelsOf(idNum), Tags: tagsOf(idNum)}
+	if recFound {
+		status.State = jobComplete
+		status.Labels, status.Tags = hRes.labels, hRes.tags
+		status.QueueTimeUs = hRes.queueTime.Microseconds()
+		status.ProcessTimeUs = hRes.processTime.Microseconds()
+	} else if isQuarantined(idNum) {
+		status.State = jobQuarantined
+	} else if wasRejected(idNum) {
+		status.State = jobRejected
+	} else if wasRemoved(idNum) {
+		status.State = jobRemoved
+	}
+
+	if wd, found := webhookStatus(idNum); found {
+		status.Webhook = &wd
+	}
+	return status, true, nil
+}
+
+// jobStatusHandler serves GET /hash/{id}/status.
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hash/"), "/status")
+	idNum, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		errMsg := fmt.Sprintf("Requested idNum not valid integer: %s", idStr)
+		writeCodedError(w, r, codeBadID, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	status, found, err := lookupJobStatus(r.Context(), requestTenant(r), idNum)
+	if err != nil {
+		writeBudgetSpent(w, r)
+		return
+	}
+	if !found {
+		if isHoneyID(idNum) {
+			honeyTokenTripped(r, idNum)
+		}
+		errMsg := fmt.Sprintf("No request issued with idNum: %d", idNum)
+		writeError(w, r, errMsg, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
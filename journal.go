@@ -0,0 +1,209 @@
+// Compliance journal of hash requests.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File the request journal is appended to, none if empty.  Audit
+// retention is often longer, and kept elsewhere, than the results
+// themselves, so the journal stands apart from the store: a line for each
+// request submitted, hashed, or failed, with when, whose, and what
+// happened, but never the password.
+var journalPath string
+
+// Size a journal file may reach before it is rotated, in MiB, and the
+// rotated files kept, oldest removed first; 0 keeps them all.
+var (
+	journalMaxMB int = 100
+	journalKeep  int = 0
+)
+
+// The only algorithm requests are hashed with; journaled so the records
+// stand on their own should that ever change.
+const journalAlgorithm = "sha512"
+
+// Public: one line of the journal.
+type journalEntry struct {
+	Time      time.Time `json:"time"`
+	Node      string    `json:"node"`
+	Tenant    string    `json:"tenant"`
+	ID        uint64    `json:"id"`
+	Algorithm string    `json:"algorithm"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// requestJournal appends entries to the journal file, rotating it once it
+// grows past maxBytes.  Rotated files keep the name with the time of
+// rotation after it, so they sort oldest first.
+type requestJournal struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+	closed   bool
+}
+
+// Layout of the time of rotation after a rotated file's name.
+const journalRotatedLayout = "20060102T150405.000000000Z"
+
+// openJournal opens, or creates, the journal file for appending.
+func openJournal(path string, maxBytes int64, keep int) (*requestJournal, error) {
+	rj := &requestJournal{path: path, maxBytes: maxBytes, keep: keep}
+	if err := rj.open(); err != nil {
+		return nil, err
+	}
+	return rj, nil
+}
+
+func (rj *requestJournal) open() error {
+	file, err := os.OpenFile(rj.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rj.file, rj.size = file, info.Size()
+	return nil
+}
+
+// attach journals every request from here on through the job hooks.
+func (rj *requestJournal) attach() {
+	onSubmit(func(ev jobEvent) { rj.record(ev, "submitted") })
+	onComplete(func(ev jobEvent) { rj.record(ev, "completed") })
+	onFail(func(ev jobEvent) { rj.record(ev, "failed") })
+}
+
+// record appends an entry for a job event.  A journal that can't be
+// written is logged rather than failing the request.
+func (rj *requestJournal) record(ev jobEvent, outcome string) {
+	entry := journalEntry{
+		Time:      ev.At.UTC(),
+		Node:      nodeID,
+		Tenant:    ev.Tenant,
+		ID:        ev.ID,
+		Algorithm: journalAlgorithm,
+		Outcome:   outcome,
+	}
+	if ev.Err != nil {
+		entry.Error = ev.Err.Error()
+	}
+	line, _ := json.Marshal(entry)
+	if err := rj.write(append(line, '\n')); err != nil {
+		logError("Could not write request journal", "path", rj.path, "id", ev.ID, "error", err)
+	}
+}
+
+// write appends a line in a single write, so lines from concurrent
+// requests never interleave.  A journal left without a file by a failed
+// rotation tries to open it again first.
+func (rj *requestJournal) write(line []byte) error {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	if rj.closed {
+		return os.ErrClosed
+	}
+	if rj.file == nil {
+		if err := rj.open(); err != nil {
+			return err
+		}
+	}
+	if rj.size > 0 && rj.size+int64(len(line)) > rj.maxBytes {
+		if err := rj.rotate(); err != nil {
+			if rj.file == nil {
+				return err
+			}
+			logWarn("Could not rotate request journal, appending past the limit", "path", rj.path, "error", err)
+		}
+	}
+	n, err := rj.file.Write(line)
+	rj.size += int64(n)
+	return err
+}
+
+// rotate moves the full journal aside and starts a new one, then removes
+// the oldest rotated files past the number kept.  When the close or the
+// move fails the journal is reopened where it was, so it can still be
+// written; when that fails too, the next write tries again.
+func (rj *requestJournal) rotate() error {
+	err := rj.file.Close()
+	rj.file = nil
+	rotated := rj.path + "." + time.Now().UTC().Format(journalRotatedLayout)
+	if err == nil {
+		err = os.Rename(rj.path, rotated)
+	}
+	if err != nil {
+		if reopenErr := rj.open(); reopenErr != nil {
+			logError("Could not reopen request journal", "path", rj.path, "error", reopenErr)
+		}
+		return err
+	}
+	if err := rj.open(); err != nil {
+		return err
+	}
+	if rj.keep > 0 {
+		old := rj.rotatedFiles()
+		for len(old) > rj.keep {
+			if err := os.Remove(old[0]); err != nil {
+				logWarn("Could not remove rotated journal", "path", old[0], "error", err)
+			}
+			old = old[1:]
+		}
+	}
+	return nil
+}
+
+// rotatedFiles lists the journal's rotated files, oldest first as
+// ReadDir sorts them by name: those named after it with a time of
+// rotation, and no others that happen to share the name.
+func (rj *requestJournal) rotatedFiles() []string {
+	dir, prefix := filepath.Dir(rj.path), filepath.Base(rj.path)+"."
+	entries, _ := os.ReadDir(dir)
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(journalRotatedLayout, strings.TrimPrefix(name, prefix)); err == nil {
+			rotated = append(rotated, filepath.Join(dir, name))
+		}
+	}
+	return rotated
+}
+
+func (rj *requestJournal) close() error {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	rj.closed = true
+	if rj.file == nil {
+		return nil
+	}
+	err := rj.file.Close()
+	rj.file = nil
+	return err
+}
+
+// validateJournalConfig checks the journal settings.
+func validateJournalConfig() error {
+	if journalMaxMB < 1 {
+		return fmt.Errorf("journal-max-mb %d must be at least 1", journalMaxMB)
+	}
+	if journalKeep < 0 {
+		return fmt.Errorf("journal-keep %d must not be negative", journalKeep)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Unit Tests for the request journal.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// journalLines reads the entries from a journal file.
+func journalLines(t *testing.T, path string) []journalEntry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%v: %s", err, scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJournalHooks(t *testing.T) {
+	saved := jobHooks.byStage
+	defer func() { jobHooks.byStage = saved }()
+
+	path := filepath.Join(t.TempDir(), "journal.ndjson")
+	rj, err := openJournal(path, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rj.close()
+	rj.attach()
+
+	runJobHooks(jobSubmitted, jobEvent{ID: 7, Tenant: "alice"})
+	runJobHooks(jobStarted, jobEvent{ID: 7, Tenant: "alice"})
+	runJobHooks(jobCompleted, jobEvent{ID: 7, Tenant: "alice", Hash: "digest"})
+	runJobHooks(jobFailed, jobEvent{ID: 8, Err: errors.New("store down")})
+
+	entries := journalLines(t, path)
+	if 3 != len(entries) {
+		t.Fatalf("Expected submitted, completed, and failed journaled, got %+v", entries)
+	}
+	want := []struct {
+		id      uint64
+		tenant  string
+		outcome string
+		err     string
+	}{{7, "alice", "submitted", ""}, {7, "alice", "completed", ""}, {8, "", "failed", "store down"}}
+	for i, w := range want {
+		got := entries[i]
+		if w.id != got.ID || w.tenant != got.Tenant || w.outcome != got.Outcome || w.err != got.Error ||
+			journalAlgorithm != got.Algorithm || got.Time.IsZero() {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if raw, _ := os.ReadFile(path); strings.Contains(string(raw), "digest") {
+		t.Errorf("Expected no digests in the journal, got %s", raw)
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.ndjson")
+	line := []byte(strings.Repeat("x", 99) + "\n")
+
+	// Room for two lines a file, the last two rotated files kept.
+	rj, err := openJournal(path, 250, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 9; i++ {
+		if err := rj.write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rj.close()
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if 2 != len(rotated) {
+		t.Errorf("Expected 2 rotated files kept, got %v", rotated)
+	}
+	for _, name := range append(rotated, path) {
+		info, err := os.Stat(name)
+		if err != nil || info.Size() > 250 {
+			t.Errorf("%s: expected at most 250 bytes, got %v %v", name, info, err)
+		}
+	}
+	if info, _ := os.Stat(path); 100 != info.Size() {
+		t.Errorf("Expected the ninth line alone in the current file, got %d bytes", info.Size())
+	}
+
+	// Reopening carries on appending, counting what's there.
+	rj, err = openJournal(path, 250, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rj.close()
+	if 100 != rj.size {
+		t.Errorf("Expected the existing 100 bytes counted, got %d", rj.size)
+	}
+}
+
+func TestJournalConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+	journalMaxMB = 0
+	if err := validateJournalConfig(); err == nil {
+		t.Errorf("Expected a zero rotation size refused")
+	}
+	journalMaxMB, journalKeep = 1, -1
+	if err := validateJournalConfig(); err == nil {
+		t.Errorf("Expected a negative keep count refused")
+	}
+}
+
+func TestJournalRotationFailure(t *testing.T) {
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+	path := filepath.Join(t.TempDir(), "journal.ndjson")
+	line := []byte(strings.Repeat("x", 99) + "\n")
+
+	rj, err := openJournal(path, 150, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rj.close()
+	if err := rj.write(line); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the file gone from under it the rename fails, and the journal
+	// carries on in a new file where the old one was.
+	os.Remove(path)
+	if err := rj.write(line); err != nil {
+		t.Fatalf("Expected the journal still writable, got %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || 100 != info.Size() {
+		t.Errorf("Expected the line in the reopened file, got %v %v", info, err)
+	}
+
+	// Rotation works again once there is a file to move.
+	if err := rj.write(line); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, _ := filepath.Glob(path + ".*"); 1 != len(rotated) {
+		t.Errorf("Expected one rotated file, got %v", rotated)
+	}
+}
+
+// Only files named with a time of rotation count against the number kept.
+func TestJournalRotationKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.ndjson")
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	others := []string{path + ".bak", path + ".00000000T000000.000000000Z.gz"}
+	for _, name := range others {
+		if err := os.WriteFile(name, line, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rj, err := openJournal(path, 150, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rj.close()
+	for i := 0; i < 4; i++ {
+		if err := rj.write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rotated := rj.rotatedFiles(); 1 != len(rotated) {
+		t.Errorf("Expected 1 rotated file kept, got %v", rotated)
+	}
+	for _, name := range others {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s left alone, got %v", name, err)
+		}
+	}
+}
+
+// A journal whose file couldn't be closed or reopened in rotation is not
+// dead for good.
+func TestJournalRotationRecovers(t *testing.T) {
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+	dir := filepath.Join(t.TempDir(), "journal")
+	os.Mkdir(dir, 0o700)
+	path := filepath.Join(dir, "journal.ndjson")
+	line := []byte(strings.Repeat("x", 99) + "\n")
+
+	rj, err := openJournal(path, 150, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rj.close()
+	if err := rj.write(line); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the full file fails, and the journal reopens it in place.
+	rj.file.Close()
+	if err := rj.write(line); err != nil {
+		t.Fatalf("Expected the journal still writable after a failed close, got %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || 200 != info.Size() {
+		t.Errorf("Expected both lines in the reopened file, got %v %v", info, err)
+	}
+
+	// With the directory gone nothing can be reopened, until it is back.
+	os.RemoveAll(dir)
+	if err := rj.write(line); err == nil {
+		t.Errorf("Expected the write to fail with no directory")
+	}
+	os.Mkdir(dir, 0o700)
+	if err := rj.write(line); err != nil {
+		t.Fatalf("Expected the journal reopened on a later write, got %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || 100 != info.Size() {
+		t.Errorf("Expected the line in a new file, got %v %v", info, err)
+	}
+
+	rj.close()
+	if err := rj.write(line); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected a closed journal to stay closed, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Caller supplied labels on submissions.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Limits on what a caller may attach to one submission.
+const (
+	labelMaxCount  = 16
+	labelMaxLength = 128
+)
+
+// Labels of requests not yet hashed, by request ID.  Once hashed they are
+// stored with the result, so every replica sees them, and dropped here.
+// A label set is never modified once set.
+var resultLabels = struct {
+	sync.Mutex
+	byID map[uint64]map[string]string
+}{byID: map[uint64]map[string]string{}}
+
+// validLabelKey allows letters, digits, and "_.-/", so keys stay easy to
+// pass in a query string.
+func validLabelKey(key string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("_.-/", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseLabels turns "key=value" fields into a label set, nil if there are
+// none.
+func parseLabels(fields []string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) > labelMaxCount {
+		return nil, fmt.Errorf("At most %d labels allowed, got %d.", labelMaxCount, len(fields))
+	}
+	labels := make(map[string]string, len(fields))
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || !validLabelKey(parts[0]) || len(field) > labelMaxLength {
+			return nil, fmt.Errorf("Label %q must be key=value, at most %d bytes.", field, labelMaxLength)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+func setLabels(idNum uint64, labels map[string]string) {
+	resultLabels.Lock()
+	resultLabels.byID[idNum] = labels
+	resultLabels.Unlock()
+}
+
+func forgetLabels(idNum uint64) {
+	resultLabels.Lock()
+	delete(resultLabels.byID, idNum)
+	resultLabels.Unlock()
+}
+
+// labelsOf is the labels of a request not yet hashed.
+func labelsOf(idNum uint64) map[string]string {
+	resultLabels.Lock()
+	defer resultLabels.Unlock()
+	return resultLabels.byID[idNum]
+}
+
+// labelFilter selects requests by label.  Every entry must match: a value
+// must be equal, and "" only asks for the key to be present.
+type labelFilter map[string]string
+
+// parseLabelFilter reads "key=value" or bare "key" fields.
+func parseLabelFilter(fields []string) (labelFilter, error) {
+	filter := labelFilter{}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if !validLabelKey(parts[0]) {
+			return nil, fmt.Errorf("Label filter %q must be key or key=value.", field)
+		}
+		filter[parts[0]] = ""
+		if len(parts) == 2 {
+			filter[parts[0]] = parts[1]
+		}
+	}
+	return filter, nil
+}
+
+func (f labelFilter) matches(labels map[string]string) bool {
+	for key, want := range f {
+		got, found := labels[key]
+		if !found || (len(want) > 0 && got != want) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+// Unit Tests for submission labels.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"source=import-batch-7", "note=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "import-batch-7" != labels["source"] || "a=b" != labels["note"] || "" != labels["empty"] {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+
+	if labels, err = parseLabels(nil); labels != nil || err != nil {
+		t.Errorf("Expected no labels, got %v %v", labels, err)
+	}
+
+	tooMany := make([]string, labelMaxCount+1)
+	for i := range tooMany {
+		tooMany[i] = "k=v"
+	}
+	for _, fields := range [][]string{{"novalue"}, {"=v"}, {"bad key=v"},
+		{"k=" + strings.Repeat("x", labelMaxLength)}, tooMany} {
+		if _, err := parseLabels(fields); err == nil {
+			t.Errorf("Expected %q to be rejected", fields[0])
+		}
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	labels := map[string]string{"source": "import-batch-7", "owner": "qa"}
+
+	cases := []struct {
+		fields []string
+		match  bool
+	}{
+		{nil, true},
+		{[]string{"source=import-batch-7"}, true},
+		{[]string{"source"}, true},
+		{[]string{"source=import-batch-8"}, false},
+		{[]string{"source", "owner=qa"}, true},
+		{[]string{"source", "team"}, false},
+	}
+	for _, c := range cases {
+		filter, err := parseLabelFilter(c.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.match != filter.matches(labels) {
+			t.Errorf("Expected filter %v match to be %v", c.fields, c.match)
+		}
+	}
+
+	if _, err := parseLabelFilter([]string{"bad key"}); err == nil {
+		t.Errorf("Expected a bad filter key to be rejected")
+	}
+}
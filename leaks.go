@@ -0,0 +1,115 @@
+// Goroutine leak detection for debugging the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// How often the goroutine count is sampled for /debug/leaks, 0 for off.
+var leakCheckInterval time.Duration
+
+// Samples kept.  A count that rose at every one of them is flagged.
+const leakSamples = 10
+
+// Public: one goroutine count.
+type goroutineSample struct {
+	At    time.Time `json:"at"`
+	Count int       `json:"count"`
+}
+
+// Public: response body of GET /debug/leaks.
+type leakReport struct {
+	Interval string            `json:"interval"`
+	Samples  []goroutineSample `json:"samples"`
+	// Whether the count rose at every sample, as a leak would make it.
+	Growing bool `json:"growing"`
+	// Goroutine stacks grouped and counted, as pprof's debug=1 text, when
+	// growing or asked for with stacks=true.
+	Stacks string `json:"stacks,omitempty"`
+}
+
+// leakWatch holds the most recent samples.
+type leakWatch struct {
+	mu      sync.Mutex
+	samples []goroutineSample
+}
+
+var leaks leakWatch
+
+func (lw *leakWatch) sample(now time.Time, count int) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.samples = append(lw.samples, goroutineSample{At: now, Count: count})
+	if len(lw.samples) > leakSamples {
+		lw.samples = lw.samples[len(lw.samples)-leakSamples:]
+	}
+	if lw.growingLocked() {
+		logWarn("Goroutine count rising steadily, possible leak", "goroutines", count,
+			"since", lw.samples[0].Count)
+	}
+}
+
+// growingLocked reports whether a full set of samples rose every time.
+func (lw *leakWatch) growingLocked() bool {
+	if len(lw.samples) < leakSamples {
+		return false
+	}
+	for i := 1; i < len(lw.samples); i++ {
+		if lw.samples[i].Count <= lw.samples[i-1].Count {
+			return false
+		}
+	}
+	return true
+}
+
+func (lw *leakWatch) report(withStacks bool) leakReport {
+	lw.mu.Lock()
+	rep := leakReport{
+		Interval: leakCheckInterval.String(),
+		Samples:  append([]goroutineSample{}, lw.samples...),
+		Growing:  lw.growingLocked(),
+	}
+	lw.mu.Unlock()
+
+	if rep.Growing || withStacks {
+		var buf bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		rep.Stacks = buf.String()
+	}
+	return rep
+}
+
+// watchLeaks samples the goroutine count until stop is closed.
+func watchLeaks(stop chan struct{}) {
+	ticker := time.NewTicker(leakCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			leaks.sample(now, runtime.NumGoroutine())
+		}
+	}
+}
+
+// leaksHandler reports the recent goroutine counts, with stacks when they
+// look to be leaking or "stacks=true" is given.
+func leaksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, leaks.report(r.URL.Query().Get("stacks") == "true"))
+}
+
+// validateLeakConfig checks the leak detector settings.
+func validateLeakConfig() error {
+	if leakCheckInterval < 0 {
+		return fmt.Errorf("leak-check-interval %v must not be negative", leakCheckInterval)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Unit Tests for goroutine leak detection.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakWatch(t *testing.T) {
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	var lw leakWatch
+	now := time.Now()
+	for i := 0; i < leakSamples; i++ {
+		lw.sample(now.Add(time.Duration(i)*time.Second), 10+i%2)
+	}
+	if rep := lw.report(false); rep.Growing || len(rep.Stacks) > 0 || leakSamples != len(rep.Samples) {
+		t.Errorf("Expected a steady count not flagged, got %+v", rep)
+	}
+
+	for i := 0; i < leakSamples+5; i++ {
+		lw.sample(now.Add(time.Duration(i)*time.Second), 20+i)
+	}
+	rep := lw.report(false)
+	if !rep.Growing || leakSamples != len(rep.Samples) || 34 != rep.Samples[len(rep.Samples)-1].Count {
+		t.Errorf("Expected steady growth flagged over the last %d samples, got %+v", leakSamples, rep.Samples)
+	}
+	if !strings.Contains(rep.Stacks, "TestLeakWatch") {
+		t.Errorf("Expected goroutine stacks with a leak report")
+	}
+}
@@ -0,0 +1,360 @@
+// Listing and export of submitted requests.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Page size of GET /hashes when none is asked for, and the most allowed.
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+)
+
+// IDs one page of GET /hashes, or one GET /export, looks up at most.
+// Every issued ID is looked up to find the caller's, one store round trip
+// each under Redis, where they are the whole cluster's; a page that runs
+// out stops short, with a cursor where it stopped.
+var pageMaxScan = 10000
+
+// Public: response body of GET /hashes.  Next is the "after" value for the
+// following page, and Cursor the "cursor" value, both absent on the last
+// one.  A page that stopped at pageMaxScan may hold fewer results than
+// asked for, even none, and still have a following one.
+type jobListing struct {
+	Results []jobStatus `json:"results"`
+	Next    uint64      `json:"next,omitempty"`
+	Cursor  string      `json:"cursor,omitempty"`
+}
+
+// Public: one line of GET /export.  Cursor resumes an export that was cut
+// short after this record.  Resume is where a tail of the export carries on
+// instead, so as not to pass over results still to come: before the first
+// one left out as not yet stored, "" for the start, or Cursor if none was.
+type exportRecord struct {
+	ID            uint64 `json:"id"`
+	Digest        string `json:"digest"`
+	QueueTimeUs   int64  `json:"queue_time_us"`
+	ProcessTimeUs int64  `json:"process_time_us"`
+	// When it was finished, in Unix microseconds; left out if unknown.
+	CompletedUs int64             `json:"completed_us,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Cursor      string            `json:"cursor"`
+	Resume      string            `json:"resume"`
+}
+
+var errBadCursor = errors.New("Field 'cursor' is not a cursor this service gave out.")
+
+// encodeCursor makes the opaque token for resuming after an ID: its
+// position in issue order, which stays put whatever is inserted or removed
+// around it, with the ID itself to check the position against.
+func encodeCursor(next, idNum uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", next, idNum)))
+}
+
+// cursorAt is the cursor resuming from position pos in issue order, ""
+// for the start.
+func cursorAt(pos uint64) string {
+	if pos == 0 {
+		return ""
+	}
+	idNum, _ := issuedAt(pos - 1)
+	return encodeCursor(pos, idNum)
+}
+
+// decodeCursor gives the position in issue order a cursor resumes from.  It
+// refuses cursors whose ID isn't the one issued there, from before a restart
+// under random IDs, say, rather than skip or repeat entries.  One whose ID
+// has since been released can't be checked, and is taken as it is.
+func decodeCursor(cursor string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errBadCursor
+	}
+	nextStr, idStr, found := strings.Cut(string(raw), ".")
+	if !found {
+		return 0, errBadCursor
+	}
+	next, err := strconv.ParseUint(nextStr, 10, 64)
+	if err != nil || next == 0 {
+		return 0, errBadCursor
+	}
+	idNum, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return 0, errBadCursor
+	}
+	if issued, found := issuedAt(next - 1); !found || (issued != 0 && issued != idNum) {
+		return 0, errBadCursor
+	}
+	return next, nil
+}
+
+// pageStart gives the position in issue order a request asks to start from:
+// its "cursor", or the legacy "after" ID.
+func pageStart(r *http.Request) (uint64, error) {
+	query := r.URL.Query()
+	cursor, afterStr := query.Get("cursor"), query.Get("after")
+	switch {
+	case len(cursor) > 0 && len(afterStr) > 0:
+		return 0, errors.New("Fields 'cursor' and 'after' can't be used together.")
+	case len(cursor) > 0:
+		return decodeCursor(cursor)
+	case len(afterStr) > 0:
+		after, err := strconv.ParseUint(afterStr, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Requested idNum not valid integer: %s", afterStr)
+		}
+		return issuedPosition(after), nil
+	}
+	return 0, nil
+}
+
+// listHandler pages through request statuses in the order they were
+// issued, optionally filtered by "label" fields.
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseLabelFilter(r.URL.Query()["label"])
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start, err := pageStart(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := listDefaultLimit
+	if limitStr := r.URL.Query().Get("limit"); len(limitStr) > 0 {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > listMaxLimit {
+			errMsg := fmt.Sprintf("Field 'limit' must be between 1 and %d.", listMaxLimit)
+			writeError(w, r, errMsg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tenant := requestTenant(r)
+	listing := jobListing{Results: []jobStatus{}}
+	var lastNext, scannedID, scannedNext uint64
+	var lookupErr error
+	scanned := 0
+	forEachIssuedFrom(start, func(idNum, next uint64) bool {
+		if scanned == pageMaxScan {
+			listing.Next, listing.Cursor = scannedID, encodeCursor(scannedNext, scannedID)
+			return false
+		}
+		scanned, scannedID, scannedNext = scanned+1, idNum, next
+		status, found, err := lookupJobStatus(r.Context(), tenant, idNum)
+		if err != nil {
+			lookupErr = err
+			return false
+		}
+		if !found || !filter.matches(status.Labels) {
+			return true
+		}
+		if len(listing.Results) == limit {
+			listing.Next = listing.Results[limit-1].ID
+			listing.Cursor = encodeCursor(lastNext, listing.Next)
+			return false
+		}
+		listing.Results = append(listing.Results, status)
+		lastNext = next
+		return true
+	})
+	if lookupErr != nil {
+		writeBudgetSpent(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// Exports streaming now.  Anything removing a stored record hands it to
+// each of them first, with holdForExports, so none disappears from an
+// export part way, yet removals never wait for an export to finish.
+var exports = struct {
+	sync.Mutex
+	active map[*exportView]bool
+}{active: map[*exportView]bool{}}
+
+// exportView is one export in flight: when it is as of, and the records
+// it would include that were removed since it started.  kept is guarded
+// by exports.
+type exportView struct {
+	asOf time.Time
+	kept map[resultKey]keptRecord
+}
+
+type keptRecord struct {
+	hRes   hashResult
+	labels map[string]string
+	tags   []string
+}
+
+func startExport(asOf time.Time) *exportView {
+	view := &exportView{asOf: asOf, kept: map[resultKey]keptRecord{}}
+	exports.Lock()
+	exports.active[view] = true
+	exports.Unlock()
+	return view
+}
+
+func (view *exportView) finish() {
+	exports.Lock()
+	delete(exports.active, view)
+	exports.Unlock()
+}
+
+// load reads a record as the export sees it: from the store, or as it was
+// when removed since the export started.  It gives ctx's error if ctx ends
+// before the store answers.
+func (view *exportView) load(ctx context.Context, rk resultKey) (keptRecord, bool, error) {
+	hRes, found, err := loadBefore(ctx, rk)
+	if err != nil {
+		return keptRecord{}, false, err
+	}
+	if found {
+		return keptRecord{hRes, hRes.labels, hRes.tags}, true, nil
+	}
+	exports.Lock()
+	defer exports.Unlock()
+	kept, found := view.kept[rk]
+	return kept, found, nil
+}
+
+// holdForExports hands rk's record to every export in flight that would
+// include it, then holds new exports off until the returned func is
+// called, once the caller has taken the record out of the store.
+func holdForExports(rk resultKey) func() {
+	exports.Lock()
+	if len(exports.active) > 0 {
+		if hRes, found := store.load(rk); found {
+			kept := keptRecord{hRes, hRes.labels, hRes.tags}
+			for view := range exports.active {
+				if !hRes.completedAt.After(view.asOf) {
+					view.kept[rk] = kept
+				}
+			}
+		}
+	}
+	return exports.Unlock
+}
+
+// exportHandler streams every completed result as newline delimited JSON,
+// optionally filtered by "label" fields.  It serves digests in bulk, so it
+// needs an admin key.  It covers the caller's own namespace only; another
+// tenant's, named with "tenant", is only for the replication key, which
+// has none.  Each record carries a cursor, and an export given one as
+// "cursor" carries on after that record.  One that looks up pageMaxScan
+// IDs stops there, ending with trailers that say where to carry on.
+//
+// The export is as of its start: results are never changed once stored, so
+// leaving out IDs issued and results finished since gives the store as it
+// stood then, without pausing writers while it streams.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	asOf := time.Now()
+	filter, err := parseLabelFilter(r.URL.Query()["label"])
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, err := pageStart(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenant := requestTenant(r)
+	named, found := r.URL.Query()["tenant"]
+	switch {
+	case isReplicationCaller(r) && !found:
+		writeError(w, r, "Field 'tenant' is required with the replication key.", http.StatusBadRequest)
+		return
+	case isReplicationCaller(r):
+		tenant = named[0]
+	case found && named[0] != tenant:
+		writeError(w, r, "Only the replication key may export another tenant's results.", http.StatusForbidden)
+		return
+	}
+
+	view := startExport(asOf)
+	defer view.finish()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	// Standbys drop what an export that ran to the end leaves out, and an
+	// export stopped at pageMaxScan says where to carry on.
+	w.Header().Set("Trailer", strings.Join([]string{exportCompleteTrailer, exportNextTrailer, exportResumeTrailer}, ", "))
+	enc := json.NewEncoder(w)
+	unsettled, resume, complete := false, "", true
+	scanned, stoppedAt, capped := 0, "", false
+	forEachIssuedFrom(start, func(idNum, next uint64) bool {
+		if scanned == pageMaxScan {
+			capped, complete = true, false
+			return false
+		}
+		scanned, stoppedAt = scanned+1, encodeCursor(next, idNum)
+		if err := r.Context().Err(); err != nil {
+			logWarn("Export cut short", "request_id", requestID(r), "after_id", idNum, "error", err)
+			complete = false
+			return false
+		}
+		record, recFound, err := view.load(r.Context(), resultKey{tenant, idNum})
+		if err != nil {
+			logWarn("Export cut short", "request_id", requestID(r), "after_id", idNum, "error", err)
+			complete = false
+			return false
+		}
+		hRes, labels := record.hRes, record.labels
+		if !recFound || hRes.completedAt.After(asOf) {
+			if !unsettled && (recFound || mayYetBeStored(r.Context(), tenant, idNum)) {
+				unsettled, resume = true, cursorAt(next-1)
+			}
+			return true
+		}
+		if !filter.matches(labels) {
+			return true
+		}
+		cursor := encodeCursor(next, idNum)
+		if !unsettled {
+			resume = cursor
+		}
+		enc.Encode(exportRecord{
+			ID:            idNum,
+			Digest:        hRes.b64Str,
+			QueueTimeUs:   hRes.queueTime.Microseconds(),
+			ProcessTimeUs: hRes.processTime.Microseconds(),
+			CompletedUs:   unixMicros(hRes.completedAt),
+			Labels:        labels,
+			Tags:          record.tags,
+			Cursor:        cursor,
+			Resume:        resume,
+		})
+		return true
+	})
+	switch {
+	case complete:
+		w.Header().Set(exportCompleteTrailer, "true")
+	case capped:
+		if !unsettled {
+			resume = stoppedAt
+		}
+		w.Header().Set(exportNextTrailer, stoppedAt)
+		w.Header().Set(exportResumeTrailer, resume)
+	}
+}
+
+// mayYetBeStored reports whether tenant's idNum, with no result now, could
+// have one later: still queued or held in quarantine.  Past the end of ctx
+// it can't tell, and says not.
+func mayYetBeStored(ctx context.Context, tenant string, idNum uint64) bool {
+	status, issued, err := lookupJobStatus(ctx, tenant, idNum)
+	return err == nil && issued && (status.State == jobPending || status.State == jobQuarantined)
+}
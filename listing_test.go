@@ -0,0 +1,257 @@
+// Unit Tests for listing and export.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExportPointInTime(t *testing.T) {
+	defer atomic.AddUint64(&hashRequests, ^uint64(3-1))
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		idNum, _ := store.nextID()
+		if rec, found := resultMap.Load(resultKey{id: idNum}); found {
+			defer resultMap.Store(resultKey{id: idNum}, rec)
+		} else {
+			defer resultMap.Delete(resultKey{id: idNum})
+		}
+		ids = append(ids, idNum)
+	}
+	// One finished before the export, one stored before completion times
+	// were kept, and one that finishes while it streams.
+	resultMap.Store(resultKey{id: ids[0]}, hashResult{b64Str: "before", completedAt: time.Now().Add(-time.Second)})
+	resultMap.Store(resultKey{id: ids[1]}, hashResult{b64Str: "untimed"})
+	resultMap.Store(resultKey{id: ids[2]}, hashResult{b64Str: "during", completedAt: time.Now().Add(time.Hour)})
+
+	rec := httptest.NewRecorder()
+	exportHandler(rec, httptest.NewRequest("GET", "/export", nil))
+	exported := map[uint64]string{}
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var record exportRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		exported[record.ID] = record.Digest
+	}
+	if "before" != exported[ids[0]] || "untimed" != exported[ids[1]] {
+		t.Errorf("Expected results finished before the export included, got %v", exported)
+	}
+	if _, found := exported[ids[2]]; found {
+		t.Errorf("Expected a result finished after the export started left out")
+	}
+	if "true" != rec.Result().Trailer.Get(exportCompleteTrailer) {
+		t.Errorf("Expected an export that ran to the end to say so, got trailers %v", rec.Result().Trailer)
+	}
+}
+
+func TestExportResume(t *testing.T) {
+	defer atomic.AddUint64(&hashRequests, ^uint64(3-1))
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		idNum, _ := store.nextID()
+		defer resultMap.Delete(resultKey{id: idNum})
+		ids = append(ids, idNum)
+	}
+	// The middle one is still queued.
+	resultMap.Store(resultKey{id: ids[0]}, hashResult{b64Str: "first", completedAt: time.Now().Add(-time.Second)})
+	resultMap.Store(resultKey{id: ids[2]}, hashResult{b64Str: "third", completedAt: time.Now().Add(-time.Second)})
+
+	export := func(query string) []exportRecord {
+		rec := httptest.NewRecorder()
+		exportHandler(rec, httptest.NewRequest("GET", "/export?"+query, nil))
+		var records []exportRecord
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			var record exportRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%v: %s", err, rec.Body)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+	records := export(fmt.Sprintf("after=%d", ids[0]-1))
+	if 2 != len(records) || ids[0] != records[0].ID || ids[2] != records[1].ID {
+		t.Fatalf("Expected the stored results exported, got %+v", records)
+	}
+	if records[0].Cursor != records[0].Resume || records[0].Cursor != records[1].Resume {
+		t.Errorf("Expected a tail to resume before the queued result, got %+v", records)
+	}
+
+	// Resumed there once it is stored, nothing is missed.
+	resultMap.Store(resultKey{id: ids[1]}, hashResult{b64Str: "second", completedAt: time.Now().Add(-time.Second)})
+	records = export("cursor=" + records[1].Resume)
+	if 2 != len(records) || ids[1] != records[0].ID || records[1].Cursor != records[1].Resume {
+		t.Errorf("Expected the export resumed from the queued result, got %+v", records)
+	}
+}
+
+func TestListingCursors(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+
+	idStrategy = "random"
+	validateIDConfig()
+	const base = 1 << 40
+	claim := func(idNum uint64) {
+		issued.claim(idNum)
+		resultMap.Store(resultKey{id: idNum}, hashResult{b64Str: "digest", completedAt: time.Now().Add(-time.Second)})
+		t.Cleanup(func() { resultMap.Delete(resultKey{id: idNum}) })
+	}
+	for _, idNum := range []uint64{base + 40, base + 10, base + 30} {
+		claim(idNum)
+	}
+
+	// One at a time, with an ID issued and the last one listed removed
+	// part way: nothing skipped, nothing twice.
+	var listed []uint64
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		rec := httptest.NewRecorder()
+		listHandler(rec, httptest.NewRequest("GET", "/hashes?limit=1&cursor="+cursor, nil))
+		var listing jobListing
+		if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+			t.Fatalf("%v: %s", err, rec.Body)
+		}
+		for _, status := range listing.Results {
+			listed = append(listed, status.ID)
+		}
+		if page == 1 {
+			claim(base + 20)
+			resultMap.Delete(resultKey{id: listed[len(listed)-1]})
+		}
+		if len(listing.Cursor) == 0 {
+			break
+		}
+		cursor = listing.Cursor
+	}
+	want := []uint64{base + 40, base + 10, base + 30, base + 20}
+	if fmt.Sprint(want) != fmt.Sprint(listed) {
+		t.Errorf("Expected %v listed, got %v", want, listed)
+	}
+
+	for _, bad := range []string{"?cursor=nonsense", "?cursor=" + encodeCursor(2, base+30), "?cursor=" + cursor + "&after=1"} {
+		rec := httptest.NewRecorder()
+		listHandler(rec, httptest.NewRequest("GET", "/hashes"+bad, nil))
+		if 400 != rec.Code {
+			t.Errorf("%s: expected 400, got %d", bad, rec.Code)
+		}
+	}
+
+	// An export resumed from a record's cursor carries on after it.
+	rec := httptest.NewRecorder()
+	exportHandler(rec, httptest.NewRequest("GET", "/export", nil))
+	var records []exportRecord
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var record exportRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if 3 != len(records) {
+		t.Fatalf("Expected 3 records exported, got %v", records)
+	}
+	rec = httptest.NewRecorder()
+	exportHandler(rec, httptest.NewRequest("GET", "/export?cursor="+records[0].Cursor, nil))
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); 2 != len(lines) || !strings.Contains(lines[0], fmt.Sprint(records[1].ID)) {
+		t.Errorf("Expected the export resumed after %d, got %s", records[0].ID, rec.Body)
+	}
+}
+
+// Pages stop after pageMaxScan IDs looked up, with a cursor where they
+// stopped, however few of them were the caller's.
+func TestPagesStopAtScanCap(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+	defer func(saved int) { pageMaxScan = saved }(pageMaxScan)
+
+	idStrategy = "random"
+	validateIDConfig()
+	pageMaxScan = 2
+	const base = 1 << 41
+	for i := uint64(1); i <= 6; i++ {
+		idNum := base + i
+		issued.claim(idNum)
+		t.Cleanup(func() { store.forgetOwner(idNum) })
+	}
+	// Only the first and fifth are capped's, and its second is still queued.
+	for _, idNum := range []uint64{base + 1, base + 2, base + 5} {
+		store.setOwner(idNum, "capped")
+	}
+	for _, idNum := range []uint64{base + 1, base + 5} {
+		rk := resultKey{"capped", idNum}
+		resultMap.Store(rk, hashResult{b64Str: "digest", completedAt: time.Now().Add(-time.Second)})
+		t.Cleanup(func() { resultMap.Delete(rk) })
+	}
+	asCapped := func(req *http.Request) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: "capped"}))
+	}
+
+	var pages [][]uint64
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		rec := httptest.NewRecorder()
+		listHandler(rec, asCapped(httptest.NewRequest("GET", "/hashes?cursor="+cursor, nil)))
+		var listing jobListing
+		if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+			t.Fatalf("%v: %s", err, rec.Body)
+		}
+		var ids []uint64
+		for _, status := range listing.Results {
+			ids = append(ids, status.ID)
+		}
+		pages = append(pages, ids)
+		if len(listing.Cursor) == 0 {
+			break
+		}
+		cursor = listing.Cursor
+	}
+	if want := fmt.Sprint([][]uint64{{base + 1, base + 2}, nil, {base + 5}}); want != fmt.Sprint(pages) {
+		t.Errorf("Expected pages %s, got %v", want, pages)
+	}
+
+	// An export stops there too, saying where to carry on, and where a tail
+	// resumes: before the queued one.
+	rec := httptest.NewRecorder()
+	exportHandler(rec, asCapped(httptest.NewRequest("GET", "/export", nil)))
+	trailer := rec.Result().Trailer
+	if "" != trailer.Get(exportCompleteTrailer) || encodeCursor(2, base+2) != trailer.Get(exportNextTrailer) ||
+		encodeCursor(1, base+1) != trailer.Get(exportResumeTrailer) {
+		t.Errorf("Expected the export stopped after %d, resuming after %d, got trailers %v", base+2, base+1, trailer)
+	}
+
+	// Carried on to the end, the whole export is read.
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exportHandler(w, asCapped(r))
+	}))
+	defer primary.Close()
+	var exported []uint64
+	complete, err := streamWholeExport(context.Background(), primary.Client(), primary.URL, "", "capped", func(record exportRecord) error {
+		exported = append(exported, record.ID)
+		return nil
+	})
+	if err != nil || !complete || fmt.Sprint([]uint64{base + 1, base + 5}) != fmt.Sprint(exported) {
+		t.Errorf("Expected the whole export read, got %v complete %v: %v", exported, complete, err)
+	}
+
+	// A standby pulling it reads every part, but next resumes before the
+	// queued one, passed over in the first.
+	ss := standbyState{cursors: map[string]string{}}
+	if _, err := ss.pull(context.Background(), primary.URL, primary.Client(), "capped"); err != nil {
+		t.Fatal(err)
+	}
+	if encodeCursor(1, base+1) != ss.cursors["capped"] {
+		t.Errorf("Expected the pull to resume after %d, got %q", base+1, ss.cursors["capped"])
+	}
+}
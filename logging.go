@@ -0,0 +1,227 @@
+// Structured logging for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Least severe level written, and the line format: "text" for key=value
+// pairs or "json" for one object per line.
+var logLevelName string = "info"
+var logFormat string = "text"
+
+// Log levels, least severe first.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// Parsed logLevelName.
+var logLevel = levelInfo
+
+// Where log lines go; tests swap it out.
+var logOutput io.Writer = os.Stderr
+var logMu sync.Mutex
+
+// Fields whose values never reach the logs, whoever passes them.
+var sensitiveFields = map[string]bool{
+	"password":      true,
+	"clear_text":    true,
+	"authorization": true,
+	"api_key":       true,
+	"secret":        true,
+	"sig":           true,
+}
+
+const redacted = "[REDACTED]"
+
+// logAt writes msg with alternating key, value fields, when level is
+// enabled.  Every line also carries the time, level, and node.
+func logAt(level int, msg string, kv ...interface{}) {
+	if level < logLevel {
+		return
+	}
+
+	keys := []string{"time", "level", "node", "msg"}
+	fields := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+		"node":  nodeID,
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if _, dup := fields[key]; !dup {
+			keys = append(keys, key)
+		}
+		fields[key] = kv[i+1]
+		if sensitiveFields[strings.ToLower(key)] {
+			fields[key] = redacted
+		}
+		if err, ok := fields[key].(error); ok {
+			fields[key] = err.Error()
+		}
+	}
+
+	var line string
+	if logFormat == "json" {
+		b, _ := json.Marshal(fields)
+		line = string(b)
+	} else {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key + "=" + logfmtValue(fields[key])
+		}
+		line = strings.Join(parts, " ")
+	}
+
+	logMu.Lock()
+	fmt.Fprintln(logOutput, line)
+	logMu.Unlock()
+}
+
+// logfmtValue quotes values that would otherwise be ambiguous.
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if len(s) == 0 || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func logDebug(msg string, kv ...interface{}) { logAt(levelDebug, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logAt(levelInfo, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logAt(levelWarn, msg, kv...) }
+func logError(msg string, kv ...interface{}) { logAt(levelError, msg, kv...) }
+
+// logFatal logs at error level and exits.
+func logFatal(msg string, kv ...interface{}) {
+	logAt(levelError, msg, kv...)
+	os.Exit(1)
+}
+
+// stdLogWriter routes the standard logger, which net/http writes its own
+// errors to, through logAt.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(b []byte) (int, error) {
+	logWarn(strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// newRequestID makes a random ID for a request that didn't bring one.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID withRequestLog assigned, "" outside it.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// validRequestID accepts a caller's X-Request-Id if it is short and
+// printable, so it can be echoed into logs safely.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// Unwrap lets http.ResponseController reach the writer underneath, to
+// flush streamed responses.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.status == 0 {
+		sr.status = statusCode
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// withRequestLog tags each request with an ID, taken from X-Request-Id when
+// the caller sent a usable one, echoes it back, and logs one line per
+// request.  Only the path is logged; query strings and bodies may carry
+// passwords or signatures.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		startTime := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		recordResponse(r.URL.Path, sr.status)
+
+		fields := []interface{}{"request_id", id, "method", r.Method, "path", r.URL.Path,
+			"status", sr.status, "duration_us", time.Now().Sub(startTime).Microseconds(),
+			"client", r.RemoteAddr}
+		if tags, err := parseTags(r.Header); err == nil && len(tags) > 0 {
+			fields = append(fields, "tags", strings.Join(tags, ","))
+		}
+		logInfo("request", fields...)
+	})
+}
+
+// validateLogConfig parses the level and checks the format.
+func validateLogConfig() error {
+	level := -1
+	for i, name := range levelNames {
+		if name == strings.ToLower(logLevelName) {
+			level = i
+		}
+	}
+	if level < 0 {
+		return fmt.Errorf("log-level %q must be one of %s", logLevelName, strings.Join(levelNames, ", "))
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("log-format %q must be text or json", logFormat)
+	}
+	logLevel = level
+	return nil
+}
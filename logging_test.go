@@ -0,0 +1,117 @@
+// Unit Tests for structured logging.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog sends log lines to a buffer until the returned func is called.
+func captureLog(level int, format string) (*bytes.Buffer, func()) {
+	savedOutput, savedLevel, savedFormat := logOutput, logLevel, logFormat
+	buf := &bytes.Buffer{}
+	logOutput, logLevel, logFormat = buf, level, format
+	return buf, func() { logOutput, logLevel, logFormat = savedOutput, savedLevel, savedFormat }
+}
+
+func TestLogRedactsSensitiveFields(t *testing.T) {
+	buf, restore := captureLog(levelDebug, "text")
+	defer restore()
+
+	logInfo("submitted", "password", "angryMonkey", "Authorization", "Bearer s3cret", "id", 7)
+	line := buf.String()
+	if strings.Contains(line, "angryMonkey") || strings.Contains(line, "s3cret") {
+		t.Errorf("Expected sensitive values redacted, got %s", line)
+	}
+	if !strings.Contains(line, "password="+redacted) || !strings.Contains(line, "id=7") {
+		t.Errorf("Unexpected log line %s", line)
+	}
+}
+
+func TestLogLevelsAndFormats(t *testing.T) {
+	buf, restore := captureLog(levelWarn, "json")
+	defer restore()
+
+	logInfo("quiet")
+	logWarn("loud message", "error", errors.New("boom"))
+	if strings.Contains(buf.String(), "quiet") {
+		t.Errorf("Expected info suppressed at warn level, got %s", buf.String())
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if "warn" != fields["level"] || "loud message" != fields["msg"] || "boom" != fields["error"] || nodeID != fields["node"] {
+		t.Errorf("Unexpected JSON log line %v", fields)
+	}
+
+	buf.Reset()
+	logFormat = "text"
+	logError("spaced out", "note", "a b")
+	if !strings.Contains(buf.String(), `msg="spaced out"`) || !strings.Contains(buf.String(), `note="a b"`) {
+		t.Errorf("Expected quoted values, got %s", buf.String())
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	buf, restore := captureLog(levelInfo, "text")
+	defer restore()
+
+	var seenID string
+	h := withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = requestID(r)
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/hash?password=angryMonkey", nil))
+	if len(seenID) == 0 || seenID != rec.Header().Get("X-Request-Id") {
+		t.Errorf("Expected request ID %q echoed, got %q", seenID, rec.Header().Get("X-Request-Id"))
+	}
+	line := buf.String()
+	if !strings.Contains(line, "status=418") || !strings.Contains(line, "request_id="+seenID) ||
+		strings.Contains(line, "angryMonkey") {
+		t.Errorf("Unexpected request log line %s", line)
+	}
+
+	// A caller's own ID is kept, a garbage one replaced.
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("X-Request-Id", "trace-123")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if "trace-123" != rec.Header().Get("X-Request-Id") {
+		t.Errorf("Expected caller's request ID kept, got %q", rec.Header().Get("X-Request-Id"))
+	}
+	req.Header.Set("X-Request-Id", "bad\nid")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if "bad\nid" == rec.Header().Get("X-Request-Id") {
+		t.Errorf("Expected unprintable request ID replaced")
+	}
+}
+
+func TestValidateLogConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+	savedLevel := logLevel
+	defer func() { logLevel = savedLevel }()
+
+	logLevelName, logFormat = "DEBUG", "json"
+	if err := validateLogConfig(); err != nil || levelDebug != logLevel {
+		t.Errorf("Expected debug level accepted, got %v", err)
+	}
+	logLevelName = "chatty"
+	if err := validateLogConfig(); err == nil {
+		t.Errorf("Expected unknown level rejected")
+	}
+	logLevelName, logFormat = "info", "xml"
+	if err := validateLogConfig(); err == nil {
+		t.Errorf("Expected unknown format rejected")
+	}
+}
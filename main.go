@@ -7,9 +7,14 @@ import (
 	"crypto/sha512"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"net/http"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,85 +27,354 @@ import (
 type hashRequest struct {
 	idNum     uint64
 	clearText string
+	queuedAt  time.Time
+	delay     time.Duration // hashDelay, or the submitting tenant's own.
+	tenant    string
+}
+
+// A completed hash along with where its time was spent: queueTime runs from
+// submission until hashing started, delay included, and processTime covers
+// the hash calculation itself.
+type hashResult struct {
+	b64Str      string
+	queueTime   time.Duration
+	processTime time.Duration
+	// When it was finished; zero for results stored before this was kept.
+	completedAt time.Time
+	// The caller's labels and tags, stored with the result; nil if none.
+	labels map[string]string
+	tags   []string
 }
 
 // Result container for the stats endpoint.
 type statsResult struct {
 	// Public: count of requests to the ​/hash​ endpoint made to the server
 	Total uint64 `json:"total"`
-	// Public: average time taken to process all requests in microseconds
+	// Public: results held now, as some may have expired or been removed
+	Stored int64 `json:"stored"`
+	// Public: average time taken to process all requests, in Units
 	Average uint64 `json:"average"`
+	// Public: units of every timing here, "us" or "ms"
+	Units string `json:"units"`
+	// Public: identity of the node that produced these figures
+	Node string `json:"node"`
+	// Public: recent trend of the time taken to hash
+	Processing processingTrend `json:"processing"`
+	// Public: requests by X-JMPC-Tags tag, when any were tagged
+	Tags map[string]tagCounts `json:"tags,omitempty"`
+	// Public: the API listener's connections
+	Connections connStats `json:"connections"`
+	// Public: handler latency distribution across all endpoints
+	Latency endpointLatency `json:"latency"`
+	// Public: handler latency distribution split by endpoint
+	Endpoints map[string]endpointLatency `json:"endpoints"`
+	// Public: rate limiter counters, when rate limiting is on
+	RateLimit *rateLimitStats `json:"rate_limit,omitempty"`
+	// Public: counters across every replica, when the store is shared
+	Cluster *clusterStats `json:"cluster,omitempty"`
+	// Public: requests copied to a secondary deployment, when shadowing
+	Shadow *shadowStats `json:"shadow,omitempty"`
+	// Public: primary and candidate algorithm hashing times, when comparing
+	Canary *canaryStats `json:"canary,omitempty"`
+	// Public: the same for candidates tenants compare in its place
+	Canaries []canaryStats `json:"canaries,omitempty"`
+}
+
+// Public: work done by every replica sharing the store.
+type clusterStats struct {
+	// Public: request IDs allocated
+	Total uint64 `json:"total"`
+	// Public: results computed
+	Completed uint64 `json:"completed"`
 }
 
+// Keys for values middleware hangs off the request context.
+type contextKey int
+
+const (
+	serverTimingKey contextKey = iota
+	authIdentityKey
+	requestIDKey
+	replicationCallerKey
+	batchChargeKey
+)
+
 // Fixed delay before hashing as required by the project specification.
 var hashDelay time.Duration = 5 * time.Second
 
+// TCP port the HTTP service listens on.
+var listenPort int = 8080
+
+// Number of workers pulling from hashRequestChannel.  Workers mostly sleep
+// out the delay, so this bounds concurrency, not throughput.
+var workerCount int = runtime.NumCPU()
+
+// Buffer size of hashRequestChannel; submissions block once it is full.
+var queueDepth int = 1024
+
+// Identity of this instance, reported in response headers, log lines, and
+// the stats payload so a misbehaving node can be picked out of a fleet.
+// Defaults to the hostname.
+var nodeID = defaultNodeID()
+
 // Serial number for hash requests.
 var hashRequests uint64 = 0
 
 // Total time accumulated in processing the requests.
 var timeMetricAccumulator uint64 = 0
 
-// Channel for hashRequest queued to process their SHA512 hashes.
-var hashRequestChannel = make(chan hashRequest)
+// Channel for hashRequest queued to process their SHA512 hashes.  Sized to
+// queueDepth when the service starts.
+var hashRequestChannel chan hashRequest
 
-// Concurrent map housting the mapping from request ID uint64 to hash string.
+// Concurrent map housting the mapping from resultKey to hashResult.
 var resultMap sync.Map
 
+// The tenant each request ID was issued to, for those issued to one.
+var ownerMap sync.Map
+
 // The implementation of `sync.Map` does not offer a count, so track it ourselves.
 var resultMapCount uint64 = 0
 
+// defaultNodeID uses the hostname as the node identity.
+func defaultNodeID() string {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostName
+}
+
+// withNodeHeader stamps every response with the node identity.
+func withNodeHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-JMPC-Node", nodeID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withMiddleware wraps a listener's handler in what every request goes
+// through, so the HTTP and gRPC APIs are logged, limited, and recovered
+// from alike.  Only listeners given sh have requests shadowed.
+func withMiddleware(sh *shadower, next http.Handler) http.Handler {
+	return withNodeHeader(withRequestLog(withRecovery(withTimeouts(withCORS(cors, withServerTiming(
+		withAuth(authenticator, exemptPathSet(authExemptPaths),
+			withPolicy(policy, exemptPathSet(authExemptPaths), withRateLimit(submitLimiter, withShadow(sh, next))))))))))
+}
+
+// hashWorker processes queued hash requests until the channel is closed.
+func hashWorker(hReqCh chan hashRequest) {
+	defer reportPanics()
+	n := workers.register()
+	for hReq := range hReqCh {
+		workers.take(n, hReq.idNum)
+		runJobHooks(jobStarted, jobEvent{ID: hReq.idNum, Tenant: hReq.tenant})
+		calcHashDelayed(hReq)
+		workers.done(n, hReq.idNum)
+	}
+}
+
 // calcHashDelayed processes a hashRequest and keeps track how long it took.
-func calcHashDelayed(hReqCh chan hashRequest) {
+func calcHashDelayed(hReq hashRequest) {
 
-	// Pull the channel record and apply the sleep delay.
-	hReq := <-hReqCh
-	time.Sleep(hashDelay)
+	// Apply the sleep delay, counted from when the request was queued so
+	// time spent waiting for a worker is not added on top.
+	time.Sleep(hReq.delay - time.Now().Sub(hReq.queuedAt))
 
 	// Capture timing statistics for the /hash endpont.
 	t0 := time.Now()
 	defer func(startTime time.Time) {
-		duration := time.Now().Sub(startTime)
-		microSecs := uint64(duration.Microseconds())
-		atomic.AddUint64(&timeMetricAccumulator, microSecs)
+		addTiming(&timeMetricAccumulator, timingMicros(time.Now().Sub(startTime)))
 	}(t0)
 
 	ckSum := sha512.Sum512([]byte(hReq.clearText))
 	b64Str := b64.StdEncoding.EncodeToString([]byte(ckSum[:]))
-	// log.Printf("%s --> %s \n", hReq.clearText, b64Str)
 
-	resultMap.Store(hReq.idNum, b64Str)  // Store the value.
+	hRes := hashResult{
+		b64Str:      b64Str,
+		queueTime:   t0.Sub(hReq.queuedAt),
+		processTime: time.Now().Sub(t0),
+		completedAt: time.Now(),
+		labels:      labelsOf(hReq.idNum),
+		tags:        tagsOf(hReq.idNum),
+	}
+	processingTimes.record(statsEWMAAlpha, timingMicros(hRes.processTime))
+	if err := store.save(resultKey{hReq.tenant, hReq.idNum}, hRes); err != nil {
+		logError("Could not save result to shared store", "id", hReq.idNum, "error", err)
+		runJobHooks(jobFailed, jobEvent{ID: hReq.idNum, Tenant: hReq.tenant, Err: err})
+	} else {
+		runJobHooks(jobCompleted, jobEvent{ID: hReq.idNum, Tenant: hReq.tenant, Hash: b64Str})
+	}
 	atomic.AddUint64(&resultMapCount, 1) // Bump peg counter after.
+	markWorkerProgress()
+	signalCompletion(hReq.idNum)
+	fireWebhook(hReq.idNum, hRes)
+	compareCanary(hReq.tenant, hReq.clearText, hRes.processTime)
+	// From here on the labels and tags are read from the stored result.
+	forgetLabels(hReq.idNum)
+	forgetTags(hReq.idNum)
 
 	return
 }
 
+// rejectIfReadOnly answers 503 to a submission while the store is
+// read-only, reporting whether it did.
+func rejectIfReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	status := storeReadOnly.get()
+	if status.ReadOnly {
+		errMsg := fmt.Sprintf("Store is read-only (%s): new submissions are not accepted, "+
+			"existing results can still be fetched.", status.Reason)
+		writeCodedError(w, r, codeReadOnly, errMsg, http.StatusServiceUnavailable)
+	}
+	return status.ReadOnly
+}
+
+// Optional extras a submission may carry.
+type submitOptions struct {
+	// POSTed the result once it is ready, when not empty.
+	callbackURL string
+	// Stored with the request for listing and export.
+	labels map[string]string
+	// From X-JMPC-Tags, stored with the request and counted in the stats.
+	tags []string
+}
+
+// enqueueSubmission assigns an ID to a password and queues it to be hashed
+// in the future, unless screening diverts it to quarantine.  It fails when
+// no ID can be allocated, or with errQueueTimeout when the request's context
+// ends while the queue is full; that ID is dropped unhashed.
+func enqueueSubmission(r *http.Request, clearText string, opts submitOptions) (idNum uint64, suspicious bool, err error) {
+	idNum, err = nextRequestID()
+	if err != nil {
+		logError("Could not allocate request ID", "request_id", requestID(r), "error", err)
+		return 0, false, err
+	}
+
+	tenant := requestTenant(r)
+	if err = store.setOwner(idNum, tenant); err != nil {
+		logError("Could not record request owner", "request_id", requestID(r), "id", idNum, "error", err)
+		return 0, false, err
+	}
+	if len(opts.callbackURL) > 0 {
+		registerWebhook(idNum, opts.callbackURL, tenant)
+	}
+	if len(opts.labels) > 0 {
+		setLabels(idNum, opts.labels)
+	}
+	if len(opts.tags) > 0 {
+		setTags(idNum, opts.tags)
+	}
+
+	var hReq = hashRequest{idNum, clearText, time.Now(), settingsFor(tenant).hashDelay, tenant}
+	runJobHooks(jobSubmitted, jobEvent{ID: idNum, Tenant: tenant})
+	rule, suspicious := screenSubmission(clearText)
+	if suspicious {
+		quarantineHold(hReq, rule)
+	} else {
+		if err = queueHashRequest(r.Context(), hReq); err != nil {
+			markRemoved(resultKey{tenant, idNum}, time.Now())
+			atomic.AddUint64(&discardedCount, 1)
+			runJobHooks(jobFailed, jobEvent{ID: idNum, Tenant: tenant, Err: err})
+			// It will never have a result, so nothing else is left to drop it.
+			forgetRequest(idNum)
+			if ownerErr := store.forgetOwner(idNum); ownerErr != nil {
+				logWarn("Could not drop request owner", "request_id", requestID(r), "id", idNum, "error", ownerErr)
+			}
+			return 0, false, err
+		}
+		addServerTiming(r, "queue", time.Now().Sub(hReq.queuedAt))
+	}
+	return idNum, suspicious, nil
+}
+
 func hashHandler(w http.ResponseWriter, r *http.Request) {
 
-	// Capture timing statistics for the /hash endpont.
+	switch hashSubresource(r.URL.Path) {
+	case "share":
+		shareHandler(w, r)
+		return
+	case "status":
+		jobStatusHandler(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		deleteResultHandler(w, r)
+		return
+	}
+
+	// Capture timing statistics for the /hash endpont.  Time spent blocked
+	// on a synchronous submission is the hash delay, so leave it out.
+	var waited time.Duration
 	t0 := time.Now()
 	defer func(startTime time.Time) {
 		nowTime := time.Now()
-		duration := nowTime.Sub(startTime)
-		microSecs := uint64(duration.Microseconds())
-		atomic.AddUint64(&timeMetricAccumulator, microSecs)
+		duration := nowTime.Sub(startTime) - waited
+		addTiming(&timeMetricAccumulator, timingMicros(duration))
+		recordLatency(hashEndpoint(r), duration)
+		anomalies.observe(hashEndpoint(r), nowTime)
 	}(t0)
 
 	err := r.ParseForm()
 	if err != nil {
-		panic(err)
+		writeError(w, r, "Request form could not be parsed.", http.StatusBadRequest)
+		return
 	}
 
 	// Sanity check to make sure we recieve valid input.
 	clearText := r.PostFormValue("password")
 	if len(clearText) > 0 {
-		idNum := atomic.AddUint64(&hashRequests, 1)
-		// fmt.Printf("req %d --> %s \n", idNum, clearText)
+		if rejectIfReadOnly(w, r) || rejectIfShuttingDown(w, r) {
+			return
+		}
+
+		var opts submitOptions
+		if rawURL := r.FormValue("callback_url"); len(rawURL) > 0 {
+			opts.callbackURL, err = parseCallbackURL(rawURL)
+			if err != nil {
+				writeError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		opts.labels, err = parseLabels(r.Form["label"])
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.tags, err = parseTags(r.Header)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		// Enqueue the request to calculate the hash in the future.
-		var hReq = hashRequest{idNum, clearText}
-		go calcHashDelayed(hashRequestChannel)
-		hashRequestChannel <- hReq
+		idNum, suspicious, err := enqueueSubmission(r, clearText, opts)
+		if errors.Is(err, errQueueTimeout) {
+			writeCodedError(w, r, codeQueueFull, "Timed out waiting for room in the queue.", http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			writeError(w, r, "Could not allocate a request ID, try again later.", http.StatusServiceUnavailable)
+			return
+		}
+
+		if wantsSyncResult(r) {
+			if suspicious {
+				errMsg := fmt.Sprintf("Request held in quarantine pending review: %d", idNum)
+				writeError(w, r, errMsg, http.StatusLocked)
+				return
+			}
+			w.Header().Set("X-JMPC-Id", strconv.FormatUint(idNum, 10))
+			waitStart := time.Now()
+			hRes, waitErr := waitForSyncResult(r, idNum)
+			waited = time.Now().Sub(waitStart)
+			if waitErr != nil {
+				errMsg := fmt.Sprintf("Timed out waiting for idNum: %d", idNum)
+				writeError(w, r, errMsg, http.StatusGatewayTimeout)
+				return
+			}
+			addServerTiming(r, "wait", waited)
+			addServerTiming(r, "hash", hRes.processTime)
+			fmt.Fprintf(w, "%s", hRes.b64Str)
+			return
+		}
 
 		// Return the idNum to the client.
 		fmt.Fprintf(w, "%d", idNum)
@@ -113,40 +387,144 @@ func hashHandler(w http.ResponseWriter, r *http.Request) {
 		idNum, parseErr := strconv.ParseUint(idStr, 10, 64)
 		if parseErr != nil {
 			errMsg := fmt.Sprintf("Requested idNum not valid integer: %s", idStr)
-			http.Error(w, errMsg, http.StatusBadRequest)
+			writeCodedError(w, r, codeBadID, errMsg, http.StatusBadRequest)
 			return
 		}
 
-		b64Str, recFound := resultMap.Load(idNum)
-		if !recFound {
+		// A share link reads from the namespace of the tenant that made it;
+		// anyone else reads from their own.
+		tenant := requestTenant(r)
+		if validShareLink(r) {
+			tenant = ownerOf(idNum)
+		}
+		loadStart := time.Now()
+		hRes, missCode := findResult(r, tenant, idNum)
+		addServerTiming(r, "store", time.Now().Sub(loadStart))
+		if missCode == codeTimeout {
+			writeBudgetSpent(w, r)
+			return
+		}
+		if missCode == codeQuarantined {
+			errMsg := fmt.Sprintf("Request held in quarantine pending review: %d", idNum)
+			writeCodedError(w, r, missCode, errMsg, http.StatusLocked)
+			return
+		}
+		if len(missCode) > 0 {
 			errMsg := fmt.Sprintf("Results not available for idNum: %d", idNum)
-			http.Error(w, errMsg, http.StatusNotFound)
+			writeCodedError(w, r, missCode, errMsg, http.StatusNotFound)
+			return
+		}
+
+		// Results never change once stored, so clients can revalidate
+		// cheaply, and keep them as long as they will still be here.
+		etag := resultETag(idNum, hRes)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", resultCacheControl(hRes, allowDelete, settingsFor(tenant).resultTTL, time.Now()))
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
 
-		fmt.Fprintf(w, "%s", b64Str)
+		// Let the client see where the latency went, in microseconds.
+		w.Header().Set("X-JMPC-Queue-Time", strconv.FormatInt(hRes.queueTime.Microseconds(), 10))
+		w.Header().Set("X-JMPC-Process-Time", strconv.FormatInt(hRes.processTime.Microseconds(), 10))
+		addServerTiming(r, "queue", hRes.queueTime)
+		addServerTiming(r, "hash", hRes.processTime)
+
+		fmt.Fprintf(w, "%s", hRes.b64Str)
 		return
 	}
 
-	http.Error(w, "Form field 'password' or path request ID parameter required.",
+	writeError(w, r, "Form field 'password' or path request ID parameter required.",
 		http.StatusBadRequest)
 
 	return
 }
 
+// findResult looks up a tenant's result, or gives the code saying why there
+// is none: held in quarantine, pending, or not found, or ERR_TIMEOUT if the
+// request's budget ran out first.  Misses count towards anomaly detection,
+// and trip honey tokens.
+func findResult(r *http.Request, tenant string, idNum uint64) (hashResult, errorCode) {
+	hRes, recFound, err := loadBefore(r.Context(), resultKey{tenant, idNum})
+	if err != nil {
+		return hashResult{}, codeTimeout
+	}
+	if recFound {
+		return hRes, ""
+	}
+	// Another tenant's request is no more than not found.
+	owned := ownerOf(idNum) == tenant
+	if owned && isQuarantined(idNum) {
+		return hashResult{}, codeQuarantined
+	}
+	if isHoneyID(idNum) {
+		honeyTokenTripped(r, idNum)
+	}
+	anomalies.observe(signalHashGetMiss, time.Now())
+	if owned && idIssued(idNum) && !isHoneyID(idNum) && !wasRemoved(idNum) {
+		return hashResult{}, codePending
+	}
+	return hashResult{}, codeNotFound
+}
+
+// resultETag identifies a stored result: its ID and a CRC-32C of the digest.
+func resultETag(idNum uint64, hRes hashResult) string {
+	return fmt.Sprintf(`"%d-%08x"`, idNum, crc32.Checksum([]byte(hRes.b64Str), crc32c))
+}
+
+// etagMatches reports whether an If-None-Match header names etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// hashSubresource returns what follows the ID in /hash/{id}/..., if
+// anything.
+func hashSubresource(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/hash/"), "/", 2)
+	if !strings.HasPrefix(path, "/hash/") || len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// hashEndpoint classifies a request to hashHandler as a submission or a
+// result lookup for the per-endpoint statistics.
+func hashEndpoint(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/hash/") && len(r.URL.Path) > len("/hash/") {
+		return endpointHashGet
+	}
+	return endpointHashPost
+}
+
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 
-	// These could share a common lock but this average metric can be fuzzy.
-	totalMicroSecs := atomic.LoadUint64(&timeMetricAccumulator)
-	requestCount := atomic.LoadUint64(&hashRequests)
-	var avgMicroSecs uint64 = 0
-	if 0 != requestCount {
-		avgMicroSecs = totalMicroSecs / requestCount
+	defer func(startTime time.Time) {
+		recordLatency(endpointStatsGet, time.Now().Sub(startTime))
+	}(time.Now())
+
+	units, err := requestStatsUnits(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
 	}
+	snap, age := servedStats.get(time.Now())
+	nowStats := snap.Stats.inUnits(units)
+	w.Header().Set("X-JMPC-Stats-Age", strconv.FormatInt(age.Milliseconds(), 10))
 
-	w.Header().Set("Content-Type", "application/json")
+	// Browsers get a readable page instead of raw JSON.
+	if wantsHTML(r) {
+		writeStatsHTML(w, r, nowStats)
+		return
+	}
 
-	nowStats := statsResult{Total: requestCount, Average: avgMicroSecs}
+	w.Header().Set("Content-Type", "application/json")
 	jsonStr, _ := json.Marshal(nowStats)
 
 	fmt.Fprintf(w, "%s", jsonStr)
@@ -154,41 +532,224 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// currentStats gathers the figures the stats endpoint reports.
+func currentStats() statsResult {
+
+	// These could share a common lock but this average metric can be fuzzy.
+	totalMicroSecs := atomic.LoadUint64(&timeMetricAccumulator)
+	requestCount := atomic.LoadUint64(&hashRequests)
+	var avgMicroSecs uint64 = 0
+	if 0 != requestCount {
+		avgMicroSecs = totalMicroSecs / requestCount
+	}
+
+	overall, perEndpoint := latencySnapshot()
+	nowStats := statsResult{
+		Total:       requestCount,
+		Stored:      atomic.LoadInt64(&storedResults),
+		Average:     avgMicroSecs,
+		Units:       statsUnitsMicro,
+		Node:        nodeID,
+		Processing:  processingTimes.snapshot(statsEWMAAlpha),
+		Tags:        tagStats.snapshot(),
+		Connections: connections.snapshot(time.Now()),
+		Latency:     overall,
+		Endpoints:   perEndpoint,
+	}
+	if submitLimiter != nil {
+		limiterStats := submitLimiter.stats()
+		nowStats.RateLimit = &limiterStats
+	}
+	if len(canaryAlgorithm) > 0 {
+		compared := canary.stats(canaryAlgorithm)
+		nowStats.Canary = &compared
+	}
+	nowStats.Canaries = tenantCanaryStats()
+	if shadow != nil {
+		shadowed := shadow.stats()
+		nowStats.Shadow = &shadowed
+	}
+	if _, shared := store.(*redisStore); shared {
+		requests, completed := store.totals()
+		nowStats.Cluster = &clusterStats{Total: requests, Completed: completed}
+	}
+	return nowStats
+}
+
 func startupHTTPServices() {
 
-	// Wait for in-flight work to complete.
+	// Wait for in-flight work to complete.  Requests held in quarantine or
+	// discarded will never complete, nor will ones taken over from a
+	// primary, so don't wait on them.
 	defer func() {
+		if workers.isPaused() {
+			logWarn("Resuming paused workers to finish queued hashes")
+			workers.resume()
+		}
 		requestCount := atomic.LoadUint64(&hashRequests)
 		resultMapCnt := atomic.LoadUint64(&resultMapCount)
-		for requestCount != resultMapCnt {
-			log.Printf("Shutting down, waiting for %d / %d ...", resultMapCnt, requestCount)
+		settledCnt := settledRequests()
+		for requestCount != settledCnt {
+			logInfo("Shutting down, waiting for in-flight hashes", "done", resultMapCnt, "requests", requestCount)
 			time.Sleep(1 * time.Second)
 			requestCount = atomic.LoadUint64(&hashRequests)
 			resultMapCnt = atomic.LoadUint64(&resultMapCount)
+			settledCnt = settledRequests()
+		}
+		if held := quarantineCount(); held > 0 {
+			logWarn("Abandoning requests still in quarantine", "held", held)
 		}
-		log.Printf("Exiting cleanly, hashes processed: %d", hashRequests)
+		logInfo("Exiting cleanly", "hashes_processed", resultMapCnt)
 	}()
 
+	// Stray standard library output, e.g. from net/http, joins the
+	// structured log.
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+
+	if startReadOnly {
+		storeReadOnly.set(true, startReadOnlyReason)
+	}
+
+	ensureShareKey()
+
+	if rs, shared := store.(*redisStore); shared {
+		if err := rs.ping(); err != nil {
+			logFatal("Shared store unreachable", "redis_addr", redisAddr, "error", err)
+		}
+		logInfo("Sharing IDs and results through Redis", "redis_addr", redisAddr, "prefix", redisPrefix)
+	}
+
+	if len(standbyOf) > 0 {
+		standby.start(standbyOf, newInternalClient(), standbyTenantList())
+	}
+
+	if anyRateLimit() {
+		submitLimiter = newRateLimiter(rateLimit, rateBurst)
+	}
+
+	tagStats.attach()
+
+	// The journal is written unbuffered, so it is left open to the end to
+	// catch the last in-flight hashes finishing.
+	if len(journalPath) > 0 {
+		rj, err := openJournal(journalPath, int64(journalMaxMB)<<20, journalKeep)
+		if err != nil {
+			logFatal("Request journal unavailable", "path", journalPath, "error", err)
+		}
+		rj.attach()
+		logInfo("Journaling requests", "path", journalPath, "max_mb", journalMaxMB, "keep", journalKeep)
+	}
+
+	stopAnomalies := make(chan struct{})
+	go watchAnomalies(stopAnomalies)
+	defer close(stopAnomalies)
+
+	stopHistory := make(chan struct{})
+	go watchHistory(stopHistory)
+	defer close(stopHistory)
+
+	if shortestResultTTL() > 0 {
+		stopExpiry := make(chan struct{})
+		go watchExpiry(stopExpiry)
+		defer close(stopExpiry)
+	}
+	if rs, shared := store.(*redisStore); shared && rs.cache != nil {
+		stopRemovals := make(chan struct{})
+		go rs.watchRemovals(stopRemovals)
+		defer close(stopRemovals)
+	}
+	if leakCheckInterval > 0 {
+		stopLeaks := make(chan struct{})
+		go watchLeaks(stopLeaks)
+		defer close(stopLeaks)
+	}
+
+	hashRequestChannel = make(chan hashRequest, queueDepth)
+	for i := 0; i < workerCount; i++ {
+		go hashWorker(hashRequestChannel)
+	}
+
+	// Not ready until warmed up, though the probes answer meanwhile.
+	if warmupEnabled {
+		atomic.StoreInt32(&warmingUp, 1)
+		go warmUp(store)
+	}
+
 	m := http.NewServeMux()
-	s := http.Server{Addr: ":8080", Handler: m}
+	s := http.Server{Addr: fmt.Sprintf(":%d", listenPort), Handler: withMiddleware(shadow, m)}
+	connections.limit = maxConnections
+	s.ConnState = connections.track
 
-	m.HandleFunc("/hash", hashHandler)
+	m.HandleFunc("/hash", withChecksum(hashHandler))
 	m.HandleFunc("/hash/", hashHandler)
+	m.HandleFunc("/hash/batch", withCompression(withChecksum(batchHandler)))
+	m.HandleFunc("/hash/lookup", withCompression(lookupHandler))
+	m.HandleFunc("/hashes", withCompression(listHandler))
+	m.HandleFunc("/export", withCompression(exportHandler))
 	m.HandleFunc("/stats", statsHandler)
+	m.HandleFunc("/openapi.json", openAPIHandler)
+	m.HandleFunc("/healthz", healthzHandler)
+	m.HandleFunc("/readyz", readyzHandler)
+	m.HandleFunc("/stats/anomalies", anomaliesHandler)
+	m.HandleFunc("/stats/history", historyHandler)
+	m.HandleFunc("/stats/history.csv", historyCSVHandler)
+	m.HandleFunc("/admin/readonly", readOnlyHandler)
+	m.HandleFunc("/admin/standby", standbyHandler)
+	m.HandleFunc("/admin/promote", promoteHandler)
+	m.HandleFunc("/admin/queue", queueHandler)
+	m.HandleFunc("/admin/fsck", fsckHandler)
+	m.HandleFunc("/admin/migrate", migrateHandler)
+	m.HandleFunc("/admin/pause", pauseHandler(true))
+	m.HandleFunc("/admin/resume", pauseHandler(false))
+	m.HandleFunc("/admin/quarantine", quarantineHandler)
+	m.HandleFunc("/admin/quarantine/release", quarantineDecisionHandler(true))
+	m.HandleFunc("/admin/quarantine/reject", quarantineDecisionHandler(false))
+	m.HandleFunc("/admin/webhooks", webhooksHandler)
+	m.HandleFunc("/admin/webhooks/redeliver", redeliverHandler)
+	if leakCheckInterval > 0 {
+		m.HandleFunc("/debug/leaks", leaksHandler)
+	}
 
-	// Shutdown is treated specially.
-	m.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Shutdown requested...")
-		fmt.Fprintf(w, "Shutdown requested.")
-		defer func() {
-			s.Shutdown(context.Background())
+	if grpcPort != 0 {
+		gs := newGRPCServer()
+		s.RegisterOnShutdown(func() { gs.Shutdown(context.Background()) })
+		go func() {
+			if err := gs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logFatal("gRPC service failed", "error", err)
+			}
 		}()
-	})
-	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	}
+
+	// Shutdown is treated specially.  The node reports not ready for the
+	// drain period first, so load balancers stop sending it work.
+	m.HandleFunc("/shutdown", shutdownHandler(func() { s.Shutdown(context.Background()) }))
+	m.HandleFunc("/admin/decommission", decommissionHandler(func() { s.Shutdown(context.Background()) }))
+	if err := listenAndServe(&s); err != nil && err != http.ErrServerClosed {
+		logFatal("HTTP service failed", "error", err)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(runDiff(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(runSoak(os.Args[2:], os.Stdout))
+	}
+
+	if err := loadConfig(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "jmpc: %v\n", err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		writeEffectiveConfig(os.Stdout)
+		return
+	}
+
 	startupHTTPServices()
 }
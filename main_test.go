@@ -4,11 +4,14 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -27,6 +30,16 @@ func init() {
 	go func() {
 		startupHTTPServices()
 	}()
+
+	// Don't let the first test race the listener coming up.
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 // TestInitialStats - stats should report zero initially.
@@ -39,8 +52,6 @@ func TestInitialStats(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	desiredResponse := "{\"total\":0,\"average\":0}"
-
 	bodyBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Fatal(err)
@@ -48,8 +59,21 @@ func TestInitialStats(t *testing.T) {
 	}
 	bodyStr := string(bodyBytes)
 
-	if 0 != strings.Compare(desiredResponse, bodyStr) {
-		t.Errorf("Expected a match to [%s], got [%s]", desiredResponse, bodyStr)
+	var stats statsResult
+	if err := json.Unmarshal(bodyBytes, &stats); err != nil {
+		t.Fatalf("Expected stats JSON, got [%s]: %v", bodyStr, err)
+	}
+
+	if 0 != stats.Total || 0 != stats.Average || nodeID != stats.Node {
+		t.Errorf("Expected total 0, average 0, node %s, got [%s]", nodeID, bodyStr)
+	}
+
+	if nodeID != resp.Header.Get("X-JMPC-Node") {
+		t.Errorf("Expected X-JMPC-Node [%s], got [%s]", nodeID, resp.Header.Get("X-JMPC-Node"))
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Server-Timing"), "total;dur=") {
+		t.Errorf("Expected a Server-Timing header, got [%s]", resp.Header.Get("Server-Timing"))
 	}
 
 }
@@ -129,6 +153,172 @@ func TestSingleHash(t *testing.T) {
 		t.Errorf("Expected a match to [%s], got [%s]", desiredResponse, bodyStrExp)
 	}
 
+	queueMicros, _ := strconv.ParseInt(respExp.Header.Get("X-JMPC-Queue-Time"), 10, 64)
+	if queueMicros < hashDelay.Microseconds() {
+		t.Errorf("Expected X-JMPC-Queue-Time to cover the %v delay, got [%s]",
+			hashDelay, respExp.Header.Get("X-JMPC-Queue-Time"))
+	}
+
+	if len(respExp.Header.Get("X-JMPC-Process-Time")) == 0 {
+		t.Errorf("Expected an X-JMPC-Process-Time header")
+	}
+
+	for _, metric := range []string{"store;dur=", "queue;dur=", "hash;dur=", "total;dur="} {
+		if !strings.Contains(respExp.Header.Get("Server-Timing"), metric) {
+			t.Errorf("Expected Server-Timing to contain [%s], got [%s]", metric, respExp.Header.Get("Server-Timing"))
+		}
+	}
+
+	// Results never change, so a client holding one can revalidate it,
+	// but while it may be removed it isn't to be kept.
+	etag := respExp.Header.Get("ETag")
+	if len(etag) == 0 || "private, no-store" != respExp.Header.Get("Cache-Control") {
+		t.Errorf("Expected an ETag and no caching, got %v", respExp.Header)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8080/hash/1", nil)
+	req.Header.Set("If-None-Match", `"stale", `+etag)
+	respCached, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyCached, _ := ioutil.ReadAll(respCached.Body)
+	respCached.Body.Close()
+	if http.StatusNotModified != respCached.StatusCode || len(bodyCached) > 0 {
+		t.Errorf("Expected StatusCode [%d] with no body, got [%d] %q", http.StatusNotModified, respCached.StatusCode, bodyCached)
+	}
+
+}
+
+func TestSyncHash(t *testing.T) {
+
+	resp, err := http.PostForm("http://localhost:8080/hash?wait=true",
+		url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		log.Fatal(err)
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusOK, resp.StatusCode)
+	}
+
+	desiredResponse := "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+		t.Error(err)
+	}
+	bodyStr := string(bodyBytes)
+
+	if 0 != strings.Compare(desiredResponse, bodyStr) {
+		t.Errorf("Expected a match to [%s], got [%s]", desiredResponse, bodyStr)
+	}
+
+	if len(resp.Header.Get("X-JMPC-Id")) == 0 {
+		t.Errorf("Expected the assigned ID in X-JMPC-Id")
+	}
+
+	// A wait shorter than the hash delay gives up with a 504.
+	respTimeout, errTimeout := http.PostForm("http://localhost:8080/hash?sync=true&timeout=100ms",
+		url.Values{"password": {"angryMonkey"}})
+	if errTimeout != nil {
+		log.Fatal(errTimeout)
+		t.Error(errTimeout)
+	}
+	defer respTimeout.Body.Close()
+
+	if http.StatusGatewayTimeout != respTimeout.StatusCode {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusGatewayTimeout, respTimeout.StatusCode)
+	}
+
+}
+
+func TestBatchHash(t *testing.T) {
+
+	resp, err := http.Post("http://localhost:8080/hash/batch", "application/json",
+		strings.NewReader(`["angryMonkey", "calmMonkey", "angryMonkey"]`))
+	if err != nil {
+		log.Fatal(err)
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusOK, resp.StatusCode)
+	}
+
+	var ids []uint64
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		t.Fatal(err)
+	}
+
+	if 3 != len(ids) || ids[0]+1 != ids[1] || ids[1]+1 != ids[2] {
+		t.Errorf("Expected three consecutive IDs, got %v", ids)
+	}
+
+}
+
+func TestLabels(t *testing.T) {
+
+	resp, err := http.PostForm("http://localhost:8080/hash?wait=true",
+		url.Values{"password": {"angryMonkey"}, "label": {"source=import-batch-7", "owner=qa"}})
+	if err != nil {
+		log.Fatal(err)
+		t.Error(err)
+	}
+	resp.Body.Close()
+	idStr := resp.Header.Get("X-JMPC-Id")
+
+	resp, err = http.Get("http://localhost:8080/hashes?label=source=import-batch-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing jobListing
+	json.NewDecoder(resp.Body).Decode(&listing)
+	resp.Body.Close()
+	if 1 != len(listing.Results) || idStr != fmt.Sprint(listing.Results[0].ID) ||
+		"qa" != listing.Results[0].Labels["owner"] {
+		t.Errorf("Expected only request %s in the listing, got %+v", idStr, listing.Results)
+	}
+
+	resp, err = http.Get("http://localhost:8080/export?label=owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record exportRecord
+	json.NewDecoder(resp.Body).Decode(&record)
+	resp.Body.Close()
+	want := "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="
+	if idStr != fmt.Sprint(record.ID) || want != record.Digest {
+		t.Errorf("Expected request %s exported, got %+v", idStr, record)
+	}
+
+}
+
+func TestGRPCSubmitAndWatch(t *testing.T) {
+
+	ts := newGRPCTestServer()
+	defer ts.Close()
+
+	msgs, status := grpcCall(t, ts.URL, "SubmitHash", protoEncoder{}.string(1, "angryMonkey"))
+	if "0" != status || 1 != len(msgs) || 0 == msgs[0].varints[1] {
+		t.Fatalf("Expected an ID, got status %s %+v", status, msgs)
+	}
+	idNum := msgs[0].varints[1]
+
+	msgs, status = grpcCall(t, ts.URL, "WatchHash", protoEncoder{}.varint(1, idNum))
+	want := "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="
+	if "0" != status || 1 != len(msgs) || want != string(msgs[0].bytes[2]) {
+		t.Errorf("Expected the digest once computed, got status %s %+v", status, msgs)
+	}
+
+	msgs, status = grpcCall(t, ts.URL, "GetHash", protoEncoder{}.varint(1, idNum))
+	if "0" != status || 1 != len(msgs) || want != string(msgs[0].bytes[2]) {
+		t.Errorf("Expected the digest, got status %s %+v", status, msgs)
+	}
+
 }
 
 func doOneRequest(tReq testRequest) {
@@ -204,6 +394,12 @@ func TestStats(t *testing.T) {
 		t.Errorf("Expected a string to contain 'average', got [%s]", bodyStr)
 	}
 
+	for _, key := range []string{"p50", "p95", "p99", "hash_post", "hash_get", "1m", "5m"} {
+		if !strings.Contains(bodyStr, key) {
+			t.Errorf("Expected a string to contain '%s', got [%s]", key, bodyStr)
+		}
+	}
+
 }
 
 // TestShutDown tests shuttind down the server, so keep it at the bottom of
@@ -0,0 +1,96 @@
+// Migration of stored records to the current format.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Public: outcome of migrating every stored result.
+type migrateReport struct {
+	Scanned  int `json:"scanned"`
+	Migrated int `json:"migrated"`
+	// Records that couldn't be decoded, and were left for /admin/fsck.
+	Unreadable int `json:"unreadable"`
+}
+
+// rewrite writes a record read in an older format back in the current one.
+// Records are otherwise migrated lazily, as they're read; a failed rewrite
+// is only logged, as the next read tries again.
+func (rs *redisStore) rewrite(rk resultKey, hRes hashResult) bool {
+	if _, err := rs.client.do("SET", rs.key(rk.storeKey()), rs.codec.encode(rk.id, hRes)); err != nil {
+		logWarn("Redis record migration failed", "id", rk.id, "error", err)
+		return false
+	}
+	logDebug("Migrated Redis record", "id", rk.id, "codec", storeCodec)
+	return true
+}
+
+// migrate reads back every issued ID's record and rewrites those in an
+// older format, for when every record should be current, e.g. before
+// rolling out a release that no longer reads the old one.  It stops with
+// ctx's error once ctx ends; records already rewritten stay rewritten.
+func (rs *redisStore) migrate(ctx context.Context) (migrateReport, error) {
+	var rep migrateReport
+	var scanErr error
+	forEachIssuedID(0, func(idNum uint64) bool {
+		if scanErr = ctx.Err(); scanErr != nil {
+			return false
+		}
+		rk := resultKey{rs.owner(idNum), idNum}
+		reply, err := rs.client.do("GET", rs.key(rk.storeKey()))
+		if err == redisNil {
+			return true
+		}
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		rep.Scanned++
+
+		hRes, meta, err := rs.codec.decode(idNum, reply.(string))
+		if err != nil {
+			rep.Unreadable++
+			return true
+		}
+		if meta.outdated {
+			if !rs.rewrite(rk, hRes) {
+				scanErr = fmt.Errorf("rewriting record %d failed", idNum)
+				return false
+			}
+			rep.Migrated++
+		}
+		return true
+	})
+	return rep, scanErr
+}
+
+// migrateHandler rewrites every outdated record in the shared store, on POST.
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	rs, shared := store.(*redisStore)
+	if !shared {
+		writeError(w, r, "The memory store keeps no records outside this process to migrate.", http.StatusNotImplemented)
+		return
+	}
+	rep, err := rs.migrate(r.Context())
+	if err != nil && r.Context().Err() != nil {
+		logWarn("Store migration cut short", "request_id", requestID(r), "migrated", rep.Migrated, "error", err)
+		writeBudgetSpent(w, r)
+		return
+	}
+	if err != nil {
+		logError("Store migration failed", "request_id", requestID(r), "error", err)
+		writeError(w, r, "Store migration could not finish, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	logInfo("Migrated store records", "scanned", rep.Scanned, "migrated", rep.Migrated,
+		"unreadable", rep.Unreadable, "request_id", requestID(r))
+	writeJSON(w, http.StatusOK, rep)
+}
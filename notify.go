@@ -0,0 +1,73 @@
+// Operator notifications for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Notifications are always logged, and also POSTed as JSON to this URL when
+// one is configured, e.g. a chat or paging webhook.
+var notifyURL string
+
+// Client notifications are POSTed with, rebuilt by validateOutboundConfig.
+var notifyClient = newInternalClient()
+
+// Deliveries running at most; notifications past this are only logged, so
+// a burst of them, honey-token probes say, can't pile up connections.
+const notifyMaxInFlight = 16
+
+var notifyInFlight = make(chan struct{}, notifyMaxInFlight)
+
+// Public: payload POSTed to notifyURL.
+type notification struct {
+	Kind    string      `json:"kind"`
+	Node    string      `json:"node"`
+	At      time.Time   `json:"at"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// notify raises an operator notification.  Delivery is best effort and
+// never blocks the caller.  The URL is the operator's own, so it is sent
+// with the outbound settings but outside the callback egress controls.
+func notify(kind, message string, details interface{}) {
+	logWarn(message, "notify", kind)
+	if len(notifyURL) == 0 {
+		return
+	}
+
+	select {
+	case notifyInFlight <- struct{}{}:
+	default:
+		logWarn("Notification not delivered, too many in flight", "notify", kind)
+		return
+	}
+	n := notification{Kind: kind, Node: nodeID, At: time.Now(), Message: message, Details: details}
+	client := notifyClient
+	go func() {
+		defer func() { <-notifyInFlight }()
+		body, _ := json.Marshal(n)
+		resp, err := client.Post(notifyURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logWarn("Notification delivery failed", "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logWarn("Notification delivery failed", "status", resp.Status)
+		}
+	}()
+}
+
+// validateNotifyConfig checks the notification URL, so a bad one fails at
+// startup rather than at the first notification.
+func validateNotifyConfig() error {
+	if len(notifyURL) == 0 {
+		return nil
+	}
+	_, err := validateHTTPURL("notify-url", notifyURL)
+	return err
+}
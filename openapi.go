@@ -0,0 +1,483 @@
+// OpenAPI description of the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// openAPISpec describes the public API: submissions, lookups, listing,
+// export, stats, and the probes.  The admin endpoints are left to the
+// README.  The contract tests check live responses against it, so a
+// handler change that isn't reflected here fails them.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "jmpc",
+    "description": "Password hashing service: submit a password, get an ID back, and look the SHA-512 digest up once the hash delay has passed.",
+    "version": "1"
+  },
+  "paths": {
+    "/hash": {
+      "post": {
+        "summary": "Submit a password for hashing",
+        "parameters": [{"$ref": "#/components/parameters/Tags"}, {"$ref": "#/components/parameters/Checksum"}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["password"],
+                "properties": {
+                  "password": {"type": "string"},
+                  "label": {"type": "array", "items": {"type": "string"}, "maxItems": 16},
+                  "callback_url": {"type": "string"},
+                  "wait": {"type": "boolean"}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The request ID, or with wait=true the base64 digest",
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "423": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"},
+          "504": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hash/{id}": {
+      "get": {
+        "summary": "Look a digest up",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {
+            "description": "The base64 SHA-512 digest",
+            "headers": {
+              "ETag": {"schema": {"type": "string"}},
+              "X-JMPC-Queue-Time": {"schema": {"type": "integer"}},
+              "X-JMPC-Process-Time": {"schema": {"type": "integer"}}
+            },
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          },
+          "304": {"description": "The result the If-None-Match ETag names is current"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "423": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a result the caller has finished with",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "204": {"description": "The result was removed"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "405": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hash/{id}/status": {
+      "get": {
+        "summary": "Where a request has got to",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {
+            "description": "The request's state",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobStatus"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hash/batch": {
+      "post": {
+        "summary": "Submit several passwords at once",
+        "parameters": [
+          {"$ref": "#/components/parameters/Label"},
+          {"$ref": "#/components/parameters/Tags"},
+          {"$ref": "#/components/parameters/Checksum"}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"type": "array", "items": {"type": "string"}, "minItems": 1}
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The IDs assigned, in the order the passwords were given",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"type": "integer"}}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "405": {"$ref": "#/components/responses/Error"},
+          "503": {
+            "description": "Stopped part way; the first queued passwords hash under ids, the rest may be resubmitted",
+            "headers": {"X-JMPC-Error-Code": {"schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchPartial"}}}
+          },
+          "504": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hash/lookup": {
+      "post": {
+        "summary": "Look several digests up at once",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"type": "array", "items": {"type": "integer"}, "minItems": 1}
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "An entry for each ID, in the order they were given",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/LookupEntry"}}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "405": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hashes": {
+      "get": {
+        "summary": "List requests in the order they were issued",
+        "parameters": [
+          {"$ref": "#/components/parameters/Label"},
+          {"$ref": "#/components/parameters/Cursor"},
+          {"name": "after", "in": "query", "description": "Legacy: the ID to list after", "schema": {"type": "integer"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000}}
+        ],
+        "responses": {
+          "200": {
+            "description": "One page of requests",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobListing"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/export": {
+      "get": {
+        "summary": "Stream every completed result, digest included; needs an admin key",
+        "parameters": [
+          {"$ref": "#/components/parameters/Label"},
+          {"$ref": "#/components/parameters/Cursor"},
+          {"name": "tenant", "in": "query", "description": "Tenant to export: the caller's own, or any with X-JMPC-Replication-Key, which requires it", "schema": {"type": "string"}},
+          {"name": "X-JMPC-Replication-Key", "in": "header", "description": "The -replication-key, in place of an API key", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "One JSON record per line",
+            "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/ExportRecord"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/stats": {
+      "get": {
+        "summary": "Request counts and latencies",
+        "parameters": [{"name": "units", "in": "query", "description": "Units of the timings, overriding -stats-units", "schema": {"type": "string", "enum": ["us", "ms"]}}],
+        "responses": {
+          "200": {
+            "description": "The node's figures, as HTML for browsers",
+            "headers": {"X-JMPC-Stats-Age": {"schema": {"type": "integer"}}},
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Stats"}},
+              "text/html": {"schema": {"type": "string"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness probe",
+        "parameters": [{"name": "verbose", "in": "query", "schema": {"type": "integer", "enum": [0, 1]}}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness probe",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {
+            "description": "The OpenAPI description of the public API",
+            "content": {"application/json": {"schema": {"type": "object", "required": ["openapi", "paths"]}}}
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "ID": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}},
+      "Tags": {
+        "name": "X-JMPC-Tags",
+        "in": "header",
+        "description": "Comma separated operator tags, stored with the request and counted in /stats",
+        "schema": {"type": "string"}
+      },
+      "Checksum": {
+        "name": "X-JMPC-Checksum",
+        "in": "header",
+        "description": "crc32c, crc32, or sha256 = hex digest of the body as sent; a mismatch is refused with ERR_CHECKSUM_MISMATCH",
+        "schema": {"type": "string"}
+      },
+      "Cursor": {
+        "name": "cursor",
+        "in": "query",
+        "description": "Opaque token from a previous page or export record to carry on after",
+        "schema": {"type": "string"}
+      },
+      "Label": {
+        "name": "label",
+        "in": "query",
+        "description": "key=value, or a bare key for any value",
+        "schema": {"type": "array", "items": {"type": "string"}}
+      }
+    },
+    "responses": {
+      "Error": {
+        "description": "A failure; the X-JMPC-Error-Code header carries the code for plain text",
+        "headers": {"X-JMPC-Error-Code": {"schema": {"type": "string"}}},
+        "content": {
+          "text/plain": {"schema": {"type": "string"}},
+          "application/json": {"schema": {"$ref": "#/components/schemas/Error"}}
+        }
+      },
+      "Health": {
+        "description": "The node's health by component",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "required": ["error", "code", "status"],
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"$ref": "#/components/schemas/ErrorCode"},
+          "status": {"type": "integer"},
+          "request_id": {"type": "string"}
+        }
+      },
+      "ErrorCode": {
+        "type": "string",
+        "enum": [
+          "ERR_PENDING", "ERR_NOT_FOUND", "ERR_BAD_ID", "ERR_QUEUE_FULL", "ERR_SHUTTING_DOWN",
+          "ERR_READ_ONLY", "ERR_QUARANTINED", "ERR_CHECKSUM_MISMATCH", "ERR_BAD_REQUEST",
+          "ERR_UNAUTHENTICATED", "ERR_FORBIDDEN", "ERR_METHOD_NOT_ALLOWED", "ERR_CONFLICT",
+          "ERR_UNSUPPORTED_MEDIA_TYPE", "ERR_RATE_LIMITED", "ERR_INTERNAL", "ERR_NOT_IMPLEMENTED",
+          "ERR_UNAVAILABLE", "ERR_TIMEOUT"
+        ]
+      },
+      "BatchPartial": {
+        "type": "object",
+        "required": ["error", "code", "status", "ids", "queued"],
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"$ref": "#/components/schemas/ErrorCode"},
+          "status": {"type": "integer"},
+          "request_id": {"type": "string"},
+          "ids": {"type": "array", "items": {"type": "integer"}},
+          "queued": {"type": "integer"}
+        }
+      },
+      "Labels": {"type": "object", "additionalProperties": {"type": "string"}},
+      "Tags": {"type": "array", "items": {"type": "string"}},
+      "JobStatus": {
+        "type": "object",
+        "required": ["id", "state"],
+        "properties": {
+          "id": {"type": "integer"},
+          "state": {"type": "string", "enum": ["pending", "quarantined", "rejected", "complete", "removed"]},
+          "queue_time_us": {"type": "integer"},
+          "process_time_us": {"type": "integer"},
+          "labels": {"$ref": "#/components/schemas/Labels"},
+          "tags": {"$ref": "#/components/schemas/Tags"},
+          "webhook": {
+            "type": "object",
+            "required": ["url", "state", "attempts"],
+            "properties": {
+              "url": {"type": "string"},
+              "state": {"type": "string"},
+              "attempts": {"type": "integer"},
+              "last_error": {"type": "string"},
+              "last_attempt": {"type": "string"},
+              "delivered_at": {"type": "string"}
+            }
+          }
+        }
+      },
+      "LookupEntry": {
+        "type": "object",
+        "required": ["id", "status"],
+        "properties": {
+          "id": {"type": "integer"},
+          "status": {"type": "integer", "enum": [200, 404, 423]},
+          "digest": {"type": "string"},
+          "code": {"$ref": "#/components/schemas/ErrorCode"}
+        }
+      },
+      "JobListing": {
+        "type": "object",
+        "required": ["results"],
+        "properties": {
+          "results": {"type": "array", "items": {"$ref": "#/components/schemas/JobStatus"}},
+          "next": {"type": "integer"},
+          "cursor": {"type": "string"}
+        }
+      },
+      "ExportRecord": {
+        "type": "object",
+        "required": ["id", "digest", "queue_time_us", "process_time_us", "cursor", "resume"],
+        "properties": {
+          "id": {"type": "integer"},
+          "digest": {"type": "string"},
+          "queue_time_us": {"type": "integer"},
+          "process_time_us": {"type": "integer"},
+          "completed_us": {"type": "integer", "description": "When the result was finished, in Unix microseconds"},
+          "labels": {"$ref": "#/components/schemas/Labels"},
+          "tags": {"$ref": "#/components/schemas/Tags"},
+          "cursor": {"type": "string"},
+          "resume": {"type": "string"}
+        }
+      },
+      "LatencySummary": {
+        "type": "object",
+        "required": ["count", "min", "max", "mean", "p50", "p95", "p99"],
+        "properties": {
+          "count": {"type": "integer"},
+          "min": {"type": "integer"},
+          "max": {"type": "integer"},
+          "mean": {"type": "integer"},
+          "p50": {"type": "integer"},
+          "p95": {"type": "integer"},
+          "p99": {"type": "integer"}
+        }
+      },
+      "EndpointLatency": {
+        "type": "object",
+        "required": ["lifetime", "windows"],
+        "properties": {
+          "lifetime": {"$ref": "#/components/schemas/LatencySummary"},
+          "windows": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/LatencySummary"}}
+        }
+      },
+      "Stats": {
+        "type": "object",
+        "required": ["total", "stored", "average", "units", "node", "processing", "connections", "latency", "endpoints"],
+        "properties": {
+          "total": {"type": "integer"},
+          "stored": {"type": "integer"},
+          "average": {"type": "integer"},
+          "units": {"type": "string", "enum": ["us", "ms"]},
+          "node": {"type": "string"},
+          "processing": {
+            "type": "object",
+            "required": ["count", "alpha", "ewma", "stddev"],
+            "properties": {
+              "count": {"type": "integer"},
+              "alpha": {"type": "number"},
+              "ewma": {"type": "integer"},
+              "stddev": {"type": "integer"}
+            }
+          },
+          "connections": {
+            "type": "object",
+            "required": ["open", "accepted", "rejected", "tls_handshake_failures", "oldest_open", "age"],
+            "properties": {
+              "open": {"type": "integer"},
+              "accepted": {"type": "integer"},
+              "rejected": {"type": "integer"},
+              "tls_handshake_failures": {"type": "integer"},
+              "oldest_open": {"type": "integer"},
+              "age": {"$ref": "#/components/schemas/LatencySummary"}
+            }
+          },
+          "tags": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "required": ["submitted", "completed", "failed"],
+              "properties": {"submitted": {"type": "integer"}, "completed": {"type": "integer"}, "failed": {"type": "integer"}}
+            }
+          },
+          "latency": {"$ref": "#/components/schemas/EndpointLatency"},
+          "endpoints": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/EndpointLatency"}},
+          "rate_limit": {"type": "object"},
+          "cluster": {"type": "object"},
+          "shadow": {"type": "object"},
+          "canary": {"type": "object"},
+          "canaries": {"type": "array", "items": {"type": "object"}}
+        }
+      },
+      "Health": {
+        "type": "object",
+        "required": ["status", "node", "components"],
+        "properties": {
+          "status": {"type": "string"},
+          "node": {"type": "string"},
+          "components": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "required": ["status"],
+              "properties": {"status": {"type": "string"}, "detail": {"type": "string"}}
+            }
+          },
+          "score": {"type": "number", "minimum": 0, "maximum": 1},
+          "signals": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "required": ["value", "score", "weight"],
+              "properties": {"value": {"type": "number"}, "score": {"type": "number"}, "weight": {"type": "number"}}
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
+
+// openAPIHandler serves GET /openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, openAPISpec)
+}
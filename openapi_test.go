@@ -0,0 +1,379 @@
+// Contract Tests checking live responses against the served OpenAPI document.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// contractSpec is the served OpenAPI document, decoded loosely.
+type contractSpec map[string]interface{}
+
+// resolve follows a node's "$ref"s within the document.
+func (spec contractSpec) resolve(node map[string]interface{}) map[string]interface{} {
+	for ref, found := node["$ref"].(string); found; ref, found = node["$ref"].(string) {
+		node = spec
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node, _ = node[part].(map[string]interface{})
+		}
+	}
+	return node
+}
+
+// operation finds the path template a request path falls under, preferring
+// literal segments over parameters, e.g. /hash/batch over /hash/{id}.
+func (spec contractSpec) operation(method, path string) (string, map[string]interface{}) {
+	paths, _ := spec["paths"].(map[string]interface{})
+	best, bestLiterals := "", -1
+	for tmpl := range paths {
+		want, got := strings.Split(tmpl, "/"), strings.Split(path, "/")
+		if len(want) != len(got) {
+			continue
+		}
+		literals := 0
+		for i := range want {
+			if strings.HasPrefix(want[i], "{") {
+				continue
+			}
+			if want[i] != got[i] {
+				literals = -1
+				break
+			}
+			literals++
+		}
+		if literals > bestLiterals {
+			best, bestLiterals = tmpl, literals
+		}
+	}
+	if bestLiterals < 0 {
+		return "", nil
+	}
+	pathItem, _ := paths[best].(map[string]interface{})
+	op, _ := pathItem[strings.ToLower(method)].(map[string]interface{})
+	return best, op
+}
+
+// validate checks a decoded JSON value against a schema, reporting the
+// first mismatch.  Object fields the schema doesn't list are mismatches
+// too, unless it allows additional properties or lists none at all.
+func (spec contractSpec) validate(schema map[string]interface{}, v interface{}, at string) error {
+	schema = spec.resolve(schema)
+	if enum, found := schema["enum"].([]interface{}); found {
+		matched := false
+		for _, allowed := range enum {
+			matched = matched || fmt.Sprint(allowed) == fmt.Sprint(v)
+		}
+		if !matched {
+			return fmt.Errorf("%s: %v not one of %v", at, v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %T", at, v)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, found := obj[name.(string)]; !found {
+				return fmt.Errorf("%s: missing required %q", at, name)
+			}
+		}
+		props, listed := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, field := range obj {
+			if prop, found := props[name].(map[string]interface{}); found {
+				if err := spec.validate(prop, field, at+"."+name); err != nil {
+					return err
+				}
+			} else if additional != nil {
+				if err := spec.validate(additional, field, at+"."+name); err != nil {
+					return err
+				}
+			} else if listed {
+				return fmt.Errorf("%s: undocumented field %q", at, name)
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %T", at, v)
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range list {
+			if err := spec.validate(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected a string, got %T", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean, got %T", at, v)
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || (schema["type"] == "integer" && n != math.Trunc(n)) {
+			return fmt.Errorf("%s: expected an %s, got %v", at, schema["type"], v)
+		}
+		if min, found := schema["minimum"].(float64); found && n < min {
+			return fmt.Errorf("%s: %v below the minimum %v", at, n, min)
+		}
+		if max, found := schema["maximum"].(float64); found && n > max {
+			return fmt.Errorf("%s: %v above the maximum %v", at, n, max)
+		}
+	}
+	return nil
+}
+
+// checkResponse checks a response's status, content type, and body against
+// what the document gives for the operation.
+func (spec contractSpec) checkResponse(op map[string]interface{}, resp *http.Response, body []byte) error {
+	responses, _ := op["responses"].(map[string]interface{})
+	documented, found := responses[strconv.Itoa(resp.StatusCode)].(map[string]interface{})
+	if !found {
+		return fmt.Errorf("undocumented status %d", resp.StatusCode)
+	}
+	documented = spec.resolve(documented)
+	content, found := documented["content"].(map[string]interface{})
+	if !found {
+		if len(body) > 0 {
+			return fmt.Errorf("status %d is documented without a body, got %q", resp.StatusCode, body)
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("bad Content-Type %q: %v", resp.Header.Get("Content-Type"), err)
+	}
+	media, found := content[mediaType].(map[string]interface{})
+	if !found {
+		return fmt.Errorf("undocumented Content-Type %q for status %d", mediaType, resp.StatusCode)
+	}
+	schema, _ := media["schema"].(map[string]interface{})
+
+	switch mediaType {
+	case "application/json":
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return fmt.Errorf("body isn't JSON: %v", err)
+		}
+		return spec.validate(schema, v, "body")
+	case "application/x-ndjson":
+		for i, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if len(line) == 0 {
+				continue
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				return fmt.Errorf("line %d isn't JSON: %v", i+1, err)
+			}
+			if err := spec.validate(schema, v, fmt.Sprintf("line %d", i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	defer withSavedConfig(t)()
+	hashDelay = 0
+
+	resp, err := http.Get("http://localhost:8080/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specBytes, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var spec contractSpec
+	if err := json.Unmarshal(specBytes, &spec); err != nil {
+		t.Fatalf("Expected the OpenAPI document to be JSON: %v", err)
+	}
+
+	// "{id}" in a path or body is replaced by the ID the first submission
+	// gets.
+	cases := []struct {
+		method, path, accept, contentType, body string
+		status                                  int
+	}{
+		{"POST", "/hash?wait=true", "", "application/x-www-form-urlencoded", "password=contract&label=contract=yes", http.StatusOK},
+		{"POST", "/hash", "", "application/x-www-form-urlencoded", "password=contract", http.StatusOK},
+		{"POST", "/hash", "", "application/x-www-form-urlencoded", "", http.StatusBadRequest},
+		{"POST", "/hash", "application/json", "application/x-www-form-urlencoded", "", http.StatusBadRequest},
+		{"GET", "/hash/{id}", "", "", "", http.StatusOK},
+		{"GET", "/hash/abc", "", "", "", http.StatusBadRequest},
+		{"GET", "/hash/99999999", "application/json", "", "", http.StatusNotFound},
+		{"GET", "/hash/{id}/status", "", "", "", http.StatusOK},
+		{"GET", "/hash/99999999/status", "", "", "", http.StatusNotFound},
+		{"DELETE", "/hash/99999999", "", "", "", http.StatusNotFound},
+		{"DELETE", "/hash/abc", "", "", "", http.StatusBadRequest},
+		{"POST", "/hash/batch", "", "application/json", `["contract-1", "contract-2"]`, http.StatusOK},
+		{"POST", "/hash/batch", "application/json", "application/json", `"contract"`, http.StatusBadRequest},
+		{"GET", "/hash/batch", "", "", "", http.StatusMethodNotAllowed},
+		{"POST", "/hash/lookup", "", "application/json", "[{id}, 99999999]", http.StatusOK},
+		{"POST", "/hash/lookup", "", "application/json", "[-1]", http.StatusBadRequest},
+		{"POST", "/openapi.json", "", "", "", http.StatusMethodNotAllowed},
+		{"GET", "/hashes?limit=2", "", "", "", http.StatusOK},
+		{"GET", "/hashes?limit=0", "", "", "", http.StatusBadRequest},
+		{"GET", "/hashes?cursor=nonsense", "", "", "", http.StatusBadRequest},
+		{"GET", "/export?label=contract=yes", "", "", "", http.StatusOK},
+		{"GET", "/export?label==", "", "", "", http.StatusBadRequest},
+		{"GET", "/stats", "", "", "", http.StatusOK},
+		{"GET", "/stats", "text/html", "", "", http.StatusOK},
+		{"GET", "/stats?units=ms", "", "", "", http.StatusOK},
+		{"GET", "/stats?units=s", "", "", "", http.StatusBadRequest},
+		{"GET", "/healthz?verbose=1", "", "", "", 0},
+		{"GET", "/readyz", "", "", "", 0},
+		{"GET", "/openapi.json", "", "", "", http.StatusOK},
+	}
+
+	var idStr string
+	exercised := map[string]bool{}
+	for _, c := range cases {
+		path := strings.Replace(c.path, "{id}", idStr, 1)
+		reqBody := strings.Replace(c.body, "{id}", idStr, 1)
+		req, _ := http.NewRequest(c.method, "http://localhost:8080"+path, strings.NewReader(reqBody))
+		if len(c.contentType) > 0 {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		if len(c.accept) > 0 {
+			req.Header.Set("Accept", c.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if len(idStr) == 0 {
+			idStr = resp.Header.Get("X-JMPC-Id")
+		}
+
+		if c.status != 0 && c.status != resp.StatusCode {
+			t.Errorf("%s %s: expected StatusCode [%d], got [%d] %q", c.method, path, c.status, resp.StatusCode, body)
+			continue
+		}
+		tmpl, op := spec.operation(c.method, req.URL.Path)
+		if len(tmpl) == 0 {
+			t.Errorf("%s %s: not in the OpenAPI document", c.method, path)
+			continue
+		}
+		// A method the document doesn't give for a path must be refused,
+		// naming the ones it does.
+		if op == nil {
+			var allowed []string
+			for method := range spec["paths"].(map[string]interface{})[tmpl].(map[string]interface{}) {
+				allowed = append(allowed, strings.ToUpper(method))
+			}
+			sort.Strings(allowed)
+			if http.StatusMethodNotAllowed != resp.StatusCode || strings.Join(allowed, ", ") != resp.Header.Get("Allow") {
+				t.Errorf("%s %s: expected StatusCode [%d] allowing %v, got [%d] allowing %q", c.method, path,
+					http.StatusMethodNotAllowed, allowed, resp.StatusCode, resp.Header.Get("Allow"))
+			}
+			continue
+		}
+		exercised[c.method+" "+tmpl] = true
+		if err := spec.checkResponse(op, resp, body); err != nil {
+			t.Errorf("%s %s: %v", c.method, path, err)
+		}
+	}
+
+	// Every documented operation must be checked by some case above.
+	var unchecked []string
+	paths, _ := spec["paths"].(map[string]interface{})
+	for tmpl, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if !exercised[strings.ToUpper(method)+" "+tmpl] {
+				unchecked = append(unchecked, strings.ToUpper(method)+" "+tmpl)
+			}
+		}
+	}
+	sort.Strings(unchecked)
+	if len(unchecked) > 0 {
+		t.Errorf("Expected every documented operation checked, missing %v", unchecked)
+	}
+}
+
+func TestContractValidate(t *testing.T) {
+	var spec contractSpec
+	json.Unmarshal([]byte(openAPISpec), &spec)
+	schema := map[string]interface{}{"$ref": "#/components/schemas/JobStatus"}
+
+	for body, valid := range map[string]bool{
+		`{"id": 1, "state": "complete", "labels": {"a": "b"}}`: true,
+		`{"id": 1}`:                                         false,
+		`{"id": 1.5, "state": "complete"}`:                  false,
+		`{"id": 1, "state": "lost"}`:                        false,
+		`{"id": 1, "state": "pending", "x": 1}`:             false,
+		`{"id": 1, "state": "pending", "labels": {"a": 1}}`: false,
+	} {
+		var v interface{}
+		json.Unmarshal([]byte(body), &v)
+		if err := spec.validate(schema, v, "body"); valid != (err == nil) {
+			t.Errorf("Expected %s valid %v, got %v", body, valid, err)
+		}
+	}
+}
+
+// The ErrorCode schema lists exactly the errorCode constants in errors.go,
+// and every code field in the document uses it.
+func TestOpenAPIErrorCodes(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "errors.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var declared []string
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		if ident, typed := spec.Type.(*ast.Ident); !typed || "errorCode" != ident.Name {
+			return true
+		}
+		for _, value := range spec.Values {
+			if lit, ok := value.(*ast.BasicLit); ok {
+				code, _ := strconv.Unquote(lit.Value)
+				declared = append(declared, code)
+			}
+		}
+		return true
+	})
+
+	var spec contractSpec
+	json.Unmarshal([]byte(openAPISpec), &spec)
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	var documented []string
+	for _, code := range schemas["ErrorCode"].(map[string]interface{})["enum"].([]interface{}) {
+		documented = append(documented, code.(string))
+	}
+	sort.Strings(declared)
+	sort.Strings(documented)
+	if len(declared) == 0 || strings.Join(declared, " ") != strings.Join(documented, " ") {
+		t.Errorf("Expected the ErrorCode enum to list %v, got %v", declared, documented)
+	}
+
+	for _, name := range []string{"Error", "BatchPartial", "LookupEntry"} {
+		code := schemas[name].(map[string]interface{})["properties"].(map[string]interface{})["code"].(map[string]interface{})
+		if "#/components/schemas/ErrorCode" != code["$ref"] {
+			t.Errorf("Expected %s.code to be an ErrorCode, got %v", name, code)
+		}
+	}
+}
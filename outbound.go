@@ -0,0 +1,59 @@
+// Outbound HTTP client settings for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Settings shared by every outbound call made on a client's behalf, so
+// behavior under load is predictable: timeouts for a whole request and for
+// connecting, and how many idle connections are kept for reuse.
+var outboundTimeout time.Duration = 10 * time.Second
+var outboundDialTimeout time.Duration = 5 * time.Second
+var outboundMaxIdle int = 100
+var outboundMaxIdlePerHost int = 10
+var outboundIdleTimeout time.Duration = 90 * time.Second
+
+// DNS server, as host:port, outbound names are resolved with instead of
+// the system resolver, e.g. one that only knows public names.
+var outboundResolver string
+
+// newOutboundDialer builds the dialer the outbound transport connects with.
+func newOutboundDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: outboundDialTimeout, KeepAlive: 30 * time.Second}
+	if len(outboundResolver) > 0 {
+		server := outboundResolver
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: outboundDialTimeout}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return dialer
+}
+
+// validateOutboundConfig checks the client settings.  It runs before
+// validateEgressConfig, which builds the transport from them.
+func validateOutboundConfig() error {
+	if outboundTimeout <= 0 || outboundDialTimeout <= 0 || outboundIdleTimeout <= 0 {
+		return fmt.Errorf("outbound-timeout, outbound-dial-timeout and outbound-idle-timeout must be positive")
+	}
+	if outboundMaxIdle < 0 || outboundMaxIdlePerHost < 0 {
+		return fmt.Errorf("outbound-max-idle and outbound-max-idle-per-host must not be negative")
+	}
+	if len(outboundResolver) > 0 {
+		if _, _, err := net.SplitHostPort(outboundResolver); err != nil {
+			return fmt.Errorf("outbound-resolver %q must be host:port: %v", outboundResolver, err)
+		}
+	}
+	webhookClient.Timeout = outboundTimeout
+	notifyClient.CloseIdleConnections()
+	notifyClient = newInternalClient()
+	return nil
+}
@@ -0,0 +1,66 @@
+// Unit Tests for outbound HTTP client settings.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutboundResolver(t *testing.T) {
+	defer withSavedConfig(t)()
+
+	// A DNS server that notes it was asked and never answers.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	asked := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 512)
+		if _, _, err := conn.ReadFrom(buf); err == nil {
+			asked <- true
+		}
+	}()
+
+	outboundResolver = conn.LocalAddr().String()
+	if err := validateOutboundConfig(); err != nil {
+		t.Fatal(err)
+	}
+	dialer := newOutboundDialer()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	dialer.Resolver.LookupHost(ctx, "hooks.example.com")
+
+	select {
+	case <-asked:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the lookup sent to the configured resolver")
+	}
+}
+
+func TestOutboundConfig(t *testing.T) {
+	defer validateOutboundConfig()
+	defer withSavedConfig(t)()
+
+	outboundTimeout = 3 * time.Second
+	if err := validateOutboundConfig(); err != nil || 3*time.Second != webhookClient.Timeout {
+		t.Errorf("Expected the webhook client timeout applied, got %v %v", webhookClient.Timeout, err)
+	}
+
+	outboundResolver = "no-port"
+	if err := validateOutboundConfig(); err == nil {
+		t.Errorf("Expected a resolver without a port rejected")
+	}
+	outboundResolver, outboundMaxIdle = "", -1
+	if err := validateOutboundConfig(); err == nil {
+		t.Errorf("Expected a negative pool size rejected")
+	}
+	outboundMaxIdle, outboundDialTimeout = 10, 0
+	if err := validateOutboundConfig(); err == nil {
+		t.Errorf("Expected a zero dial timeout rejected")
+	}
+}
@@ -0,0 +1,183 @@
+// Quarantine of suspicious submissions for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Screen submissions and hold suspicious ones for an admin to release.
+var quarantineEnabled bool
+
+// Passwords longer than this many bytes are held as a size anomaly.
+var quarantineMaxLength int = 1024
+
+// A screening rule names the anomaly and detects it in a password.
+type screeningRule struct {
+	name  string
+	match func(clearText string) bool
+}
+
+var screeningRules = []screeningRule{
+	{"oversize", func(clearText string) bool {
+		return len(clearText) > quarantineMaxLength
+	}},
+	{"binary", func(clearText string) bool {
+		if !utf8.ValidString(clearText) {
+			return true
+		}
+		for _, c := range clearText {
+			if unicode.IsControl(c) {
+				return true
+			}
+		}
+		return false
+	}},
+}
+
+// screenSubmission returns the first rule the password trips, if any.
+func screenSubmission(clearText string) (string, bool) {
+	if !quarantineEnabled {
+		return "", false
+	}
+	for _, rule := range screeningRules {
+		if rule.match(clearText) {
+			return rule.name, true
+		}
+	}
+	return "", false
+}
+
+// Public: a held submission as admins see it.  The password itself is never
+// shown, only its length.
+type quarantineEntry struct {
+	ID       uint64    `json:"id"`
+	Rule     string    `json:"rule"`
+	Length   int       `json:"length"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+type quarantinedRequest struct {
+	hReq hashRequest
+	rule string
+}
+
+// Submissions held out of the hash queue, by ID.
+var quarantine = struct {
+	sync.Mutex
+	held map[uint64]quarantinedRequest
+}{held: map[uint64]quarantinedRequest{}}
+
+// Count of requests that will never have results: those rejected out of
+// quarantine, and decoy IDs skipped over.
+var discardedCount uint64 = 0
+
+func quarantineHold(hReq hashRequest, rule string) {
+	quarantine.Lock()
+	quarantine.held[hReq.idNum] = quarantinedRequest{hReq, rule}
+	quarantine.Unlock()
+	logInfo("Quarantined request", "id", hReq.idNum, "rule", rule)
+}
+
+// quarantineTake removes a held submission.
+func quarantineTake(idNum uint64) (quarantinedRequest, bool) {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+	qReq, found := quarantine.held[idNum]
+	delete(quarantine.held, idNum)
+	return qReq, found
+}
+
+func isQuarantined(idNum uint64) bool {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+	_, found := quarantine.held[idNum]
+	return found
+}
+
+func quarantineCount() int {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+	return len(quarantine.held)
+}
+
+// validateQuarantineConfig checks the screening settings.
+func validateQuarantineConfig() error {
+	if quarantineEnabled && quarantineMaxLength < 1 {
+		return fmt.Errorf("quarantine-max-length %d must be at least 1", quarantineMaxLength)
+	}
+	return nil
+}
+
+// quarantineHandler lists held submissions, oldest first.
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	quarantine.Lock()
+	entries := make([]quarantineEntry, 0, len(quarantine.held))
+	for _, qReq := range quarantine.held {
+		entries = append(entries, quarantineEntry{
+			ID:       qReq.hReq.idNum,
+			Rule:     qReq.rule,
+			Length:   len(qReq.hReq.clearText),
+			QueuedAt: qReq.hReq.queuedAt,
+		})
+	}
+	quarantine.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// quarantineDecisionHandler releases a held submission to the hash queue, or
+// rejects it for good, by form field "id".
+func quarantineDecisionHandler(release bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		idNum, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			writeCodedError(w, r, codeBadID, "Form field 'id' must be a request ID.", http.StatusBadRequest)
+			return
+		}
+
+		qReq, found := quarantineTake(idNum)
+		if !found {
+			writeError(w, r, fmt.Sprintf("Request %d is not in quarantine.", idNum), http.StatusNotFound)
+			return
+		}
+
+		if release {
+			if err := queueHashRequest(r.Context(), qReq.hReq); err != nil {
+				quarantineHold(qReq.hReq, qReq.rule)
+				errMsg := fmt.Sprintf("Timed out waiting for room in the queue; %d is still in quarantine.", idNum)
+				writeCodedError(w, r, codeQueueFull, errMsg, http.StatusServiceUnavailable)
+				return
+			}
+			logInfo("Released request from quarantine", "id", idNum, "request_id", requestID(r))
+			fmt.Fprintf(w, "Released %d.", idNum)
+			return
+		}
+
+		logInfo("Rejected request from quarantine", "id", idNum, "request_id", requestID(r))
+		markRejected(resultKey{qReq.hReq.tenant, idNum}, time.Now())
+		atomic.AddUint64(&discardedCount, 1)
+		runJobHooks(jobFailed, jobEvent{ID: idNum, Tenant: qReq.hReq.tenant, Err: errRejected})
+		// It will never have a result, so nothing else is left to drop it.
+		forgetRequest(idNum)
+		if err := store.forgetOwner(idNum); err != nil {
+			logWarn("Could not drop request owner", "request_id", requestID(r), "id", idNum, "error", err)
+		}
+		fmt.Fprintf(w, "Rejected %d.", idNum)
+	}
+}
@@ -0,0 +1,112 @@
+// Unit Tests for quarantine of suspicious submissions.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestScreenSubmission(t *testing.T) {
+	quarantineEnabled = true
+	defer func() { quarantineEnabled = false }()
+
+	cases := []struct {
+		clearText, rule string
+	}{
+		{"angryMonkey", ""},
+		{"pässwörd", ""},
+		{strings.Repeat("x", quarantineMaxLength+1), "oversize"},
+		{"pass\x00word", "binary"},
+		{"\xff\xfe", "binary"},
+	}
+	for _, c := range cases {
+		rule, _ := screenSubmission(c.clearText)
+		if c.rule != rule {
+			t.Errorf("Expected %q to trip [%s], got [%s]", c.clearText, c.rule, rule)
+		}
+	}
+
+	quarantineEnabled = false
+	if _, suspicious := screenSubmission("pass\x00word"); suspicious {
+		t.Errorf("Expected no screening while quarantine is off")
+	}
+}
+
+func TestQuarantineHoldAndDecide(t *testing.T) {
+	quarantineEnabled = true
+	defer func() { quarantineEnabled = false }()
+
+	submit := func() string {
+		rec := postForm(hashHandler, "/hash", url.Values{"password": {"bin\x01ary"}})
+		if http.StatusOK != rec.Code {
+			t.Fatalf("Expected the submission to get an ID, got [%d]", rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	heldID := submit()
+	rec := httptest.NewRecorder()
+	hashHandler(rec, httptest.NewRequest("GET", "/hash/"+heldID, nil))
+	if http.StatusLocked != rec.Code {
+		t.Errorf("Expected StatusCode [%d] for a held request, got [%d]", http.StatusLocked, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	quarantineHandler(rec, httptest.NewRequest("GET", "/admin/quarantine", nil))
+	var entries []quarantineEntry
+	json.Unmarshal(rec.Body.Bytes(), &entries)
+	if 1 != len(entries) || "binary" != entries[0].Rule || strings.Contains(rec.Body.String(), `bin\u0001ary`) {
+		t.Errorf("Expected one held entry without the password, got %s", rec.Body.String())
+	}
+
+	rec = postForm(quarantineDecisionHandler(false), "/admin/quarantine/reject", url.Values{"id": {heldID}})
+	if http.StatusOK != rec.Code || isQuarantined(entries[0].ID) {
+		t.Errorf("Expected the reject to clear the entry, got [%d]", rec.Code)
+	}
+
+	releasedID := submit()
+	rec = postForm(quarantineDecisionHandler(true), "/admin/quarantine/release", url.Values{"id": {releasedID}})
+	if http.StatusOK != rec.Code || 0 != quarantineCount() {
+		t.Errorf("Expected the release to clear the entry, got [%d]", rec.Code)
+	}
+
+	rec = postForm(quarantineDecisionHandler(true), "/admin/quarantine/release", url.Values{"id": {releasedID}})
+	if http.StatusNotFound != rec.Code {
+		t.Errorf("Expected StatusCode [%d] releasing twice, got [%d]", http.StatusNotFound, rec.Code)
+	}
+}
+
+// A rejected request will never have a result, so nothing is kept for it
+// but the record that it was rejected.
+func TestQuarantineRejectForgetsRequest(t *testing.T) {
+	defer withSavedConfig(t)()
+	quarantineEnabled = true
+
+	req := httptest.NewRequest("POST", "/hash", nil)
+	req = req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: "alice"}))
+	idNum, held, err := enqueueSubmission(req, "bin\x01ary", submitOptions{callbackURL: "https://hooks.example.com/done",
+		labels: map[string]string{"source": "quarantine"}, tags: []string{"quarantine"}})
+	if err != nil || !held {
+		t.Fatalf("Expected the submission held, got %v", err)
+	}
+	rec := postForm(quarantineDecisionHandler(false), "/admin/quarantine/reject", url.Values{"id": {strconv.FormatUint(idNum, 10)}})
+	if http.StatusOK != rec.Code {
+		t.Fatalf("Expected the reject to succeed, got [%d]", rec.Code)
+	}
+	if _, found := webhookStatus(idNum); found || labelsOf(idNum) != nil || tagsOf(idNum) != nil {
+		t.Errorf("Expected the webhook, labels, and tags dropped")
+	}
+	if owner := store.owner(idNum); "" != owner {
+		t.Errorf("Expected the owner record dropped, got %q", owner)
+	}
+	if status, found, _ := lookupJobStatus(context.Background(), "alice", idNum); !found || jobRejected != status.State {
+		t.Errorf("Expected alice's request rejected, got %q", status.State)
+	}
+}
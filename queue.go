@@ -0,0 +1,249 @@
+// Worker pool control for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A submission blocked this long on a full queue is logged and counted, 0
+// to never warn.  It still waits its turn either way, until its request's
+// context ends.
+var queueBlockWarn time.Duration = 5 * time.Second
+
+// Submissions waiting on a full queue now, and how many ever waited past
+// queueBlockWarn.
+var queueWaiting int64
+var queueBlockedSends uint64
+
+// Worker states reported by /admin/queue.
+const (
+	workerIdle    = "idle"
+	workerHashing = "hashing"
+	workerPaused  = "paused"
+)
+
+// Public: what one worker is doing.
+type workerStatus struct {
+	Worker    int       `json:"worker"`
+	State     string    `json:"state"`
+	RequestID uint64    `json:"request_id,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Public: response body of /admin/queue, /admin/pause and /admin/resume.
+type queueReport struct {
+	Paused      bool       `json:"paused"`
+	PausedSince *time.Time `json:"paused_since,omitempty"`
+	Queued      int        `json:"queued"`
+	Capacity    int        `json:"capacity"`
+	// Submissions blocked on a full queue now, and how many ever waited
+	// past queue-block-warn.
+	WaitingSends int64  `json:"waiting_sends"`
+	BlockedSends uint64 `json:"blocked_sends"`
+	// Oldest request queued or being hashed, 0 if none.
+	OldestPendingID  uint64         `json:"oldest_pending_id,omitempty"`
+	OldestPendingAge string         `json:"oldest_pending_age,omitempty"`
+	Workers          []workerStatus `json:"workers"`
+}
+
+// workerPool tracks the workers and lets an operator pause them.  A paused
+// worker finishes the hash in hand, then holds the next request it takes
+// until resumed, so queued work waits rather than being dropped.
+type workerPool struct {
+	mu          sync.Mutex
+	resumed     *sync.Cond
+	paused      bool
+	pausedSince time.Time
+	workers     []workerStatus
+	// Requests queued or being hashed, by ID, with when they were queued.
+	pending map[uint64]time.Time
+}
+
+var workers = newWorkerPool()
+
+func newWorkerPool() *workerPool {
+	wp := &workerPool{pending: map[uint64]time.Time{}}
+	wp.resumed = sync.NewCond(&wp.mu)
+	return wp
+}
+
+// register adds a worker, returning its number.
+func (wp *workerPool) register() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.workers = append(wp.workers, workerStatus{Worker: len(wp.workers), State: workerIdle, Since: time.Now()})
+	return len(wp.workers) - 1
+}
+
+// setState records what worker n is doing.  Caller holds mu.
+func (wp *workerPool) setState(n int, state string, idNum uint64) {
+	wp.workers[n] = workerStatus{Worker: n, State: state, RequestID: idNum, Since: time.Now()}
+}
+
+// take is called by worker n with the request it has just taken off the
+// queue; it blocks while the pool is paused.
+func (wp *workerPool) take(n int, idNum uint64) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	for wp.paused {
+		if wp.workers[n].State != workerPaused {
+			wp.setState(n, workerPaused, idNum)
+		}
+		wp.resumed.Wait()
+	}
+	wp.setState(n, workerHashing, idNum)
+}
+
+// done is called by worker n once its request has been hashed.
+func (wp *workerPool) done(n int, idNum uint64) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	delete(wp.pending, idNum)
+	wp.setState(n, workerIdle, 0)
+}
+
+// pause stops workers taking up new hashes.
+func (wp *workerPool) pause() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if !wp.paused {
+		wp.paused, wp.pausedSince = true, time.Now()
+	}
+}
+
+// resume lets the workers carry on.
+func (wp *workerPool) resume() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.paused = false
+	wp.resumed.Broadcast()
+}
+
+func (wp *workerPool) isPaused() bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.paused
+}
+
+// isPending reports whether idNum is queued or being hashed.
+func (wp *workerPool) isPending(idNum uint64) bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	_, found := wp.pending[idNum]
+	return found
+}
+
+// remaining counts the requests queued or being hashed.
+func (wp *workerPool) remaining() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.pending)
+}
+
+func (wp *workerPool) report(now time.Time) queueReport {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	rep := queueReport{
+		Paused:       wp.paused,
+		Queued:       len(hashRequestChannel),
+		Capacity:     cap(hashRequestChannel),
+		WaitingSends: atomic.LoadInt64(&queueWaiting),
+		BlockedSends: atomic.LoadUint64(&queueBlockedSends),
+		Workers:      append([]workerStatus{}, wp.workers...),
+	}
+	if wp.paused {
+		since := wp.pausedSince
+		rep.PausedSince = &since
+	}
+	for idNum, queuedAt := range wp.pending {
+		if rep.OldestPendingID == 0 || idNum < rep.OldestPendingID {
+			rep.OldestPendingID = idNum
+			rep.OldestPendingAge = now.Sub(queuedAt).Truncate(time.Millisecond).String()
+		}
+	}
+	return rep
+}
+
+// errQueueTimeout is returned when a request's context ends while it waits
+// on a full queue.
+var errQueueTimeout = errors.New("timed out waiting for room in the queue")
+
+// queueHashRequest hands a request to the workers, blocking while the
+// queue is full until ctx ends.  A send blocked past queueBlockWarn is
+// logged and counted, since a handler stuck here holds its client and
+// connection with it.
+func queueHashRequest(ctx context.Context, hReq hashRequest) error {
+	workers.mu.Lock()
+	workers.pending[hReq.idNum] = hReq.queuedAt
+	workers.mu.Unlock()
+
+	select {
+	case hashRequestChannel <- hReq:
+		return nil
+	default:
+	}
+	atomic.AddInt64(&queueWaiting, 1)
+	defer atomic.AddInt64(&queueWaiting, -1)
+
+	var warn <-chan time.Time
+	if queueBlockWarn > 0 {
+		timer := time.NewTimer(queueBlockWarn)
+		defer timer.Stop()
+		warn = timer.C
+	}
+	for {
+		select {
+		case hashRequestChannel <- hReq:
+			if warn == nil && queueBlockWarn > 0 {
+				logInfo("Blocked submission queued", "id", hReq.idNum, "waited", time.Now().Sub(hReq.queuedAt))
+			}
+			return nil
+		case <-warn:
+			warn = nil
+			atomic.AddUint64(&queueBlockedSends, 1)
+			logWarn("Submission blocked on a full queue", "id", hReq.idNum, "waited", queueBlockWarn,
+				"capacity", cap(hashRequestChannel), "waiting", atomic.LoadInt64(&queueWaiting), "paused", workers.isPaused())
+		case <-ctx.Done():
+			workers.mu.Lock()
+			delete(workers.pending, hReq.idNum)
+			workers.mu.Unlock()
+			logWarn("Submission gave up on a full queue", "id", hReq.idNum, "waited", time.Now().Sub(hReq.queuedAt), "error", ctx.Err())
+			return errQueueTimeout
+		}
+	}
+}
+
+// queueHandler serves GET /admin/queue.
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, takeSnapshot(time.Now()).Queue)
+}
+
+// pauseHandler serves POST /admin/pause and POST /admin/resume.
+func pauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		if pause {
+			workers.pause()
+		} else {
+			workers.resume()
+		}
+		logInfo("Worker pool paused changed", "paused", pause, "request_id", requestID(r))
+		writeJSON(w, http.StatusOK, workers.report(time.Now()))
+	}
+}
@@ -0,0 +1,221 @@
+// Unit Tests for worker pool control.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolPause(t *testing.T) {
+	wp := newWorkerPool()
+	n := wp.register()
+	wp.pending[7] = time.Now().Add(-time.Second)
+	wp.pending[9] = time.Now()
+
+	wp.pause()
+	took := make(chan bool)
+	go func() {
+		wp.take(n, 7)
+		took <- true
+	}()
+
+	select {
+	case <-took:
+		t.Fatalf("Expected a paused worker to hold its request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rep := wp.report(time.Now())
+	if !rep.Paused || rep.PausedSince == nil || workerPaused != rep.Workers[0].State || 7 != rep.Workers[0].RequestID {
+		t.Errorf("Expected worker 0 paused holding 7, got %+v", rep)
+	}
+	if 7 != rep.OldestPendingID || len(rep.OldestPendingAge) == 0 {
+		t.Errorf("Expected 7 as the oldest pending request, got %d %q", rep.OldestPendingID, rep.OldestPendingAge)
+	}
+
+	wp.resume()
+	select {
+	case <-took:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the worker to carry on once resumed")
+	}
+	if rep := wp.report(time.Now()); rep.Paused || workerHashing != rep.Workers[0].State {
+		t.Errorf("Expected worker 0 hashing, got %+v", rep)
+	}
+
+	wp.done(n, 7)
+	if rep := wp.report(time.Now()); workerIdle != rep.Workers[0].State || 9 != rep.OldestPendingID {
+		t.Errorf("Expected worker 0 idle and 9 the oldest pending, got %+v", rep)
+	}
+}
+
+func TestPauseEndpoints(t *testing.T) {
+	defer workers.resume()
+
+	rec := postForm(pauseHandler(true), "/admin/pause", nil)
+	var rep queueReport
+	json.Unmarshal(rec.Body.Bytes(), &rep)
+	if http.StatusOK != rec.Code || !rep.Paused {
+		t.Errorf("Expected the pool paused, got [%d] %s", rec.Code, rec.Body.String())
+	}
+
+	// Pausing is not a fault, whatever is queued.
+	if code, report := probe(t, healthzHandler); http.StatusOK != code {
+		t.Errorf("Expected a paused pool live, got %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	queueHandler(rec, httptest.NewRequest("GET", "/admin/queue", nil))
+	json.Unmarshal(rec.Body.Bytes(), &rep)
+	if !rep.Paused || workerCount != len(rep.Workers) {
+		t.Errorf("Expected %d workers paused, got %s", workerCount, rec.Body.String())
+	}
+
+	rec = postForm(pauseHandler(false), "/admin/resume", nil)
+	json.Unmarshal(rec.Body.Bytes(), &rep)
+	if rep.Paused {
+		t.Errorf("Expected the pool resumed, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	pauseHandler(true)(rec, httptest.NewRequest("GET", "/admin/pause", nil))
+	if http.StatusMethodNotAllowed != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestQueueBlockedSend(t *testing.T) {
+	defer withSavedConfig(t)()
+	defer withTestQueue(1, 1)()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	queueBlockWarn = 10 * time.Millisecond
+	before := atomic.LoadUint64(&queueBlockedSends)
+	sent := make(chan bool)
+	go func() {
+		queueHashRequest(context.Background(), hashRequest{idNum: 1 << 50, queuedAt: time.Now()})
+		sent <- true
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rep := workers.report(time.Now())
+	if 1 != rep.WaitingSends || before+1 != rep.BlockedSends {
+		t.Errorf("Expected one send blocked past the warning, got %d waiting and %d blocked", rep.WaitingSends, rep.BlockedSends-before)
+	}
+
+	// The blocked send still goes through once there is room.
+	<-hashRequestChannel
+	<-sent
+	if hReq := <-hashRequestChannel; 1<<50 != hReq.idNum {
+		t.Errorf("Expected the blocked request queued, got %d", hReq.idNum)
+	}
+	if waiting := atomic.LoadInt64(&queueWaiting); 0 != waiting {
+		t.Errorf("Expected no sends waiting, got %d", waiting)
+	}
+	workers.mu.Lock()
+	delete(workers.pending, 1<<50)
+	workers.mu.Unlock()
+}
+
+func TestQueueBlockedSendGivesUp(t *testing.T) {
+	defer withSavedConfig(t)()
+	defer withTestQueue(1, 1)()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := queueHashRequest(ctx, hashRequest{idNum: 1 << 50, queuedAt: time.Now()})
+	if err != errQueueTimeout {
+		t.Errorf("Expected [%v], got [%v]", errQueueTimeout, err)
+	}
+	workers.mu.Lock()
+	_, pending := workers.pending[1<<50]
+	workers.mu.Unlock()
+	if pending {
+		t.Errorf("Expected the abandoned request no longer pending")
+	}
+	if waiting := atomic.LoadInt64(&queueWaiting); 0 != waiting {
+		t.Errorf("Expected no sends waiting, got %d", waiting)
+	}
+}
+
+func TestQueueFullAnswers503(t *testing.T) {
+	defer withSavedConfig(t)()
+	defer withTestQueue(1, 1)()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey")).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	hashHandler(rec, req)
+	if http.StatusServiceUnavailable != rec.Code || string(codeQueueFull) != rec.Header().Get("X-JMPC-Error-Code") {
+		t.Errorf("Expected a 503 with %s, got [%d] %v", codeQueueFull, rec.Code, rec.Header())
+	}
+}
+
+// A submission dropped on a full queue leaves nothing registered behind.
+func TestQueueTimeoutForgetsRequest(t *testing.T) {
+	defer withSavedConfig(t)()
+	defer withTestQueue(1, 1)()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/hash", nil)
+	req = req.WithContext(context.WithValue(ctx, authIdentityKey, apiKey{name: "alice"}))
+	_, _, err := enqueueSubmission(req, "angryMonkey", submitOptions{callbackURL: "https://hooks.example.com/done",
+		labels: map[string]string{"source": "timeout"}, tags: []string{"timeout"}})
+	if err != errQueueTimeout {
+		t.Fatalf("Expected [%v], got [%v]", errQueueTimeout, err)
+	}
+	idNum := atomic.LoadUint64(&hashRequests)
+	if _, found := webhookStatus(idNum); found || labelsOf(idNum) != nil || tagsOf(idNum) != nil {
+		t.Errorf("Expected the webhook, labels, and tags dropped")
+	}
+	if owner := store.owner(idNum); "" != owner {
+		t.Errorf("Expected the owner record dropped, got %q", owner)
+	}
+	if status, _, _ := lookupJobStatus(context.Background(), "alice", idNum); jobRemoved != status.State {
+		t.Errorf("Expected the dropped request removed, got %q", status.State)
+	}
+}
+
+// A batch the queue fills part way through reports the IDs it did queue.
+func TestBatchQueueFullReportsQueued(t *testing.T) {
+	defer withSavedConfig(t)()
+	defer withTestQueue(2, 1)()
+	_, restore := captureLog(levelError, "text")
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/hash/batch", strings.NewReader(`["angryMonkey", "calmMonkey", "boredMonkey"]`)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	batchHandler(rec, req)
+	var partial batchPartialResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &partial); err != nil {
+		t.Fatalf("Expected a JSON body, got %q: %v", rec.Body.String(), err)
+	}
+	if http.StatusServiceUnavailable != rec.Code || codeQueueFull != partial.Code || 1 != partial.Queued || 1 != len(partial.IDs) {
+		t.Fatalf("Expected a 503 naming the one password queued, got [%d] %+v", rec.Code, partial)
+	}
+	<-hashRequestChannel
+	if hReq := <-hashRequestChannel; partial.IDs[0] != hReq.idNum {
+		t.Errorf("Expected ID %d queued, got %d", partial.IDs[0], hReq.idNum)
+	}
+	workers.mu.Lock()
+	delete(workers.pending, partial.IDs[0])
+	workers.mu.Unlock()
+}
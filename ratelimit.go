@@ -0,0 +1,229 @@
+// Per-client rate limiting for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sustained hash submissions per second allowed per client, 0 for no limit,
+// and how many may arrive back to back before the limit bites.
+var rateLimit float64 = 0
+var rateBurst int = 10
+
+// Buckets untouched this long are full again and can be forgotten.
+const rateBucketIdle = 10 * time.Minute
+
+// Public: rate limiter counters for the stats endpoint.
+type rateLimitStats struct {
+	Allowed uint64 `json:"allowed"`
+	Limited uint64 `json:"limited"`
+	Clients int    `json:"clients"`
+}
+
+// tokenBucket refills at rate tokens per second up to burst, and each
+// password submitted takes one token.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter holds a token bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	allowed uint64
+	limited uint64
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from the client's bucket at the limiter's own rate.
+// When none is left it reports how long until one will be.
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	return rl.allowAt(client, 1, rl.rate, rl.burst, now)
+}
+
+// allowAt is allow for cost tokens at a given rate and burst, e.g. a
+// tenant's own.  Either all cost tokens are taken or none are.
+func (rl *rateLimiter) allowAt(client string, cost, rate, burst float64, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateBucketIdle {
+		for key, b := range rl.buckets {
+			if now.Sub(b.lastSeen) > rateBucketIdle {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, found := rl.buckets[client]
+	if !found {
+		b = &tokenBucket{tokens: burst, lastSeen: now}
+		rl.buckets[client] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.lastSeen).Seconds()*rate)
+	b.lastSeen = now
+
+	if b.tokens < cost {
+		atomic.AddUint64(&rl.limited, 1)
+		wait := time.Duration((cost - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens -= cost
+	atomic.AddUint64(&rl.allowed, 1)
+	return true, 0
+}
+
+// remaining reports the tokens left in the client's bucket, without taking
+// any, and how long until it is full again.
+func (rl *rateLimiter) remaining(client string, rate, burst float64, now time.Time) (float64, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	tokens := burst
+	if b, found := rl.buckets[client]; found {
+		tokens = math.Min(burst, b.tokens+now.Sub(b.lastSeen).Seconds()*rate)
+	}
+	return tokens, time.Duration((burst - tokens) / rate * float64(time.Second))
+}
+
+func (rl *rateLimiter) stats() rateLimitStats {
+	rl.mu.Lock()
+	clients := len(rl.buckets)
+	rl.mu.Unlock()
+	return rateLimitStats{
+		Allowed: atomic.LoadUint64(&rl.allowed),
+		Limited: atomic.LoadUint64(&rl.limited),
+		Clients: clients,
+	}
+}
+
+// The limiter in service, nil when rate limiting is off.
+var submitLimiter *rateLimiter
+
+// rateLimitClient keys a request by API key identity when authenticated,
+// otherwise by client IP.
+func rateLimitClient(r *http.Request) string {
+	if key, ok := authIdentity(r); ok {
+		return "key:" + key.name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// isSubmission reports whether a request would queue hashing work, which
+// is what the limiter protects.
+func isSubmission(r *http.Request) bool {
+	return r.Method == http.MethodPost && (r.URL.Path == "/hash" || r.URL.Path == "/hash/batch" || r.URL.Path == grpcSubmitPath)
+}
+
+// batchCharge is where a batch's tokens are to be taken from, once
+// batchHandler knows how many passwords it holds.
+type batchCharge struct {
+	rl          *rateLimiter
+	client      string
+	rate, burst float64
+}
+
+// withRateLimit answers 429 with Retry-After once a client exhausts its
+// bucket.  Every response to a limited client says where its bucket
+// stands, so it can slow down before that happens.  Batches are charged
+// a token a password by batchHandler, through rejectIfRateLimited.  It
+// must sit inside withAuth to key on identity.
+func withRateLimit(rl *rateLimiter, next http.Handler) http.Handler {
+	if rl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := tenantSettings{rateLimit: rl.rate, rateBurst: int(rl.burst)}
+		limits.override(requestTenant(r))
+		if limits.rateLimit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, rate, burst, now := rateLimitClient(r), limits.rateLimit, float64(limits.rateBurst), time.Now()
+
+		ok, wait := true, time.Duration(0)
+		if isSubmission(r) && r.URL.Path == "/hash/batch" {
+			charge := &batchCharge{rl, client, rate, burst}
+			r = r.WithContext(context.WithValue(r.Context(), batchChargeKey, charge))
+		} else if isSubmission(r) {
+			ok, wait = rl.allowAt(client, 1, rate, burst, now)
+		}
+		tokens, untilFull := rl.remaining(client, rate, burst, now)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limits.rateBurst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(untilFull.Seconds()))))
+
+		if !ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, "Rate limit exceeded, retry later.", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectIfRateLimited takes a token for each of a batch's n passwords,
+// answering 429 instead when the client hasn't that many left, or when
+// the batch is bigger than its bucket can ever hold.
+func rejectIfRateLimited(w http.ResponseWriter, r *http.Request, n int) bool {
+	charge, limited := r.Context().Value(batchChargeKey).(*batchCharge)
+	if !limited {
+		return false
+	}
+	if float64(n) > charge.burst {
+		atomic.AddUint64(&charge.rl.limited, 1)
+		errMsg := fmt.Sprintf("Batch of %d exceeds the rate limit burst of %d, split it.", n, int(charge.burst))
+		writeError(w, r, errMsg, http.StatusTooManyRequests)
+		return true
+	}
+	now := time.Now()
+	ok, wait := charge.rl.allowAt(charge.client, float64(n), charge.rate, charge.burst, now)
+	tokens, untilFull := charge.rl.remaining(charge.client, charge.rate, charge.burst, now)
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(untilFull.Seconds()))))
+	if !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, "Rate limit exceeded, retry later.", http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+// validateRateLimitConfig checks the limiter settings.
+func validateRateLimitConfig() error {
+	if rateLimit < 0 {
+		return fmt.Errorf("rate-limit %v must not be negative", rateLimit)
+	}
+	if rateLimit > 0 && rateBurst < 1 {
+		return fmt.Errorf("rate-burst %d must be at least 1", rateBurst)
+	}
+	return nil
+}
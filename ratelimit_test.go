@@ -0,0 +1,102 @@
+// Unit Tests for per-client rate limiting.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	rl := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("a", now); !ok {
+			t.Fatalf("Expected request %d within the burst to pass", i+1)
+		}
+	}
+	ok, wait := rl.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected a refusal with 500ms wait, got %v, %v", ok, wait)
+	}
+
+	// Other clients have their own bucket.
+	if ok, _ := rl.allow("b", now); !ok {
+		t.Errorf("Expected another client to be unaffected")
+	}
+
+	// Half a second refills one token at two per second.
+	if ok, _ := rl.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("Expected a refilled token to pass")
+	}
+
+	stats := rl.stats()
+	if 5 != stats.Allowed || 1 != stats.Limited || 2 != stats.Clients {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Idle buckets are swept once they are long since full.
+	rl.allow("c", now.Add(2*rateBucketIdle))
+	if 1 != rl.stats().Clients {
+		t.Errorf("Expected idle buckets to be swept, have %d", rl.stats().Clients)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	h := withRateLimit(newRateLimiter(0.1, 1), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.1.2.3:5555"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("POST", "/hash"); http.StatusOK != rec.Code || "0" != rec.Header().Get("X-RateLimit-Remaining") {
+		t.Errorf("Expected the first submission to pass, the bucket left empty, got [%d] %v", rec.Code, rec.Header())
+	}
+	rec := send("POST", "/hash")
+	if http.StatusTooManyRequests != rec.Code || "10" != rec.Header().Get("Retry-After") {
+		t.Errorf("Expected a 429 with Retry-After 10, got [%d] [%s]", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Lookups are not limited, but still report on the bucket.
+	rec = send("GET", "/hash/1")
+	if http.StatusOK != rec.Code {
+		t.Errorf("Expected lookups to pass, got [%d]", rec.Code)
+	}
+	if "1" != rec.Header().Get("X-RateLimit-Limit") || "0" != rec.Header().Get("X-RateLimit-Remaining") ||
+		"10" != rec.Header().Get("X-RateLimit-Reset") {
+		t.Errorf("Expected limit 1, remaining 0, reset 10, got %v", rec.Header())
+	}
+}
+
+// A batch takes a token for each password it holds.
+func TestRateLimitBatch(t *testing.T) {
+	h := withRateLimit(newRateLimiter(0.1, 3), http.HandlerFunc(batchHandler))
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hash/batch", strings.NewReader(body))
+		req.RemoteAddr = "10.1.2.4:5555"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(`["a", "b", "c", "d"]`)
+	if http.StatusTooManyRequests != rec.Code || "" != rec.Header().Get("Retry-After") {
+		t.Errorf("Expected a batch bigger than the bucket refused for good, got [%d] %v", rec.Code, rec.Header())
+	}
+	if rec = send(`["a", "b"]`); http.StatusOK != rec.Code || "1" != rec.Header().Get("X-RateLimit-Remaining") {
+		t.Errorf("Expected the batch to pass, one token left, got [%d] %v", rec.Code, rec.Header())
+	}
+	rec = send(`["a", "b"]`)
+	if http.StatusTooManyRequests != rec.Code || "10" != rec.Header().Get("Retry-After") {
+		t.Errorf("Expected a 429 with Retry-After 10, got [%d] %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,498 @@
+// Redis backed shared store for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Where the shared store lives, and the prefix on every key it uses, so
+// several deployments can share one Redis.
+var redisAddr string = "localhost:6379"
+var redisPassword string
+var redisDB int = 0
+var redisPrefix string = "jmpc:"
+
+// Per-command timeout, connection included.
+var redisTimeout time.Duration = 2 * time.Second
+
+// redisClient speaks just enough of the Redis protocol (RESP) for the
+// store, over one connection that is redialed after any error.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// redisNil is the reply to a GET of a missing key.
+var redisNil = errors.New("redis: nil")
+
+func newRedisClient(addr, password string, db int) *redisClient {
+	return &redisClient{addr: addr, password: password, db: db}
+}
+
+// connect dials and selects the database.  Caller holds mu.
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+	if len(c.password) > 0 {
+		if _, err := c.roundTrip("AUTH", c.password); err != nil {
+			c.close()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip("SELECT", strconv.Itoa(c.db)); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// close drops the connection.  Caller holds mu.
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.rd = nil, nil
+	}
+}
+
+// do sends one command and returns its reply: a string, an int64, or nil
+// with redisNil.  Error replies come back as errors and leave the
+// connection usable; anything else drops it.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args...)
+	if _, isReply := err.(redisError); err != nil && !isReply && err != redisNil {
+		c.close()
+	}
+	return reply, err
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// roundTrip writes a command and reads the reply.  Caller holds mu.
+func (c *redisClient) roundTrip(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRESP(c.rd)
+}
+
+// readRESP reads one reply.  Arrays are only of bulk strings and integers
+// here, so they come back as []string, a missing element as "" and an
+// integer in decimal.
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, redisNil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		elems := make([]string, 0, max(count, 0))
+		for i := 0; i < count; i++ {
+			elem, err := readRESP(rd)
+			if err == redisNil {
+				elem, err = "", nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n, isInt := elem.(int64); isInt {
+				elem = strconv.FormatInt(n, 10)
+			}
+			s, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("redis: unsupported array element %v", elem)
+			}
+			elems = append(elems, s)
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply type %q", kind)
+}
+
+// redisStore shares IDs and results between replicas.  Redis is the only
+// copy of every result: one this process computed is read back like any
+// other, so a removal through any replica is seen by all of them, and a
+// replica's memory doesn't grow with the results it computes.
+type redisStore struct {
+	client *redisClient
+	// Results as recently fetched.
+	cache *resultCache
+	// IDs recently found to have no result yet.
+	misses *missCache
+	// Fetches in flight, shared by everyone asking for the same ID.
+	lookups lookupGroup
+	// How results are written.
+	codec resultCodec
+	// Tenants IDs were issued to, as recently looked up.
+	owners *ownerCache
+}
+
+func newRedisStore(client *redisClient) *redisStore {
+	return &redisStore{
+		client: client,
+		cache:  newResultCache(storeCacheSize, storeCacheTTL),
+		misses: newMissCache(storeMissTTL),
+		codec:  resultCodecs[storeCodec],
+		owners: newOwnerCache(),
+	}
+}
+
+func (rs *redisStore) key(name string) string {
+	return redisPrefix + name
+}
+
+// nextID allocates from one counter every replica shares.
+func (rs *redisStore) nextID() (uint64, error) {
+	reply, err := rs.client.do("INCR", rs.key("ids"))
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&hashRequests, 1)
+	return uint64(reply.(int64)), nil
+}
+
+func (rs *redisStore) counter(name string) uint64 {
+	reply, err := rs.client.do("GET", rs.key(name))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(reply.(string), 10, 64)
+	return n
+}
+
+func (rs *redisStore) lastID() uint64 {
+	return rs.counter("ids")
+}
+
+func (rs *redisStore) load(rk resultKey) (hashResult, bool) {
+	now := time.Now()
+	if hRes, found := rs.cache.get(rk, now); found {
+		return hRes, true
+	}
+	if rs.misses.missing(rk, now) {
+		return hashResult{}, false
+	}
+	return rs.lookups.do(rk, func() (hashResult, bool) { return rs.fetch(rk) })
+}
+
+// fetch reads a result from Redis and caches it, or that it is missing.
+func (rs *redisStore) fetch(rk resultKey) (hashResult, bool) {
+	asOf := rs.cache.currentGeneration()
+	reply, err := rs.client.do("GET", rs.key(rk.storeKey()))
+	if err == redisNil {
+		rs.misses.add(rk, time.Now())
+		return hashResult{}, false
+	}
+	if err != nil {
+		logWarn("Redis lookup failed", "id", rk.id, "error", err)
+		return hashResult{}, false
+	}
+	hRes, meta, err := rs.codec.decode(rk.id, reply.(string))
+	if err != nil {
+		logError("Corrupt result in Redis", "id", rk.id, "error", err)
+		return hashResult{}, false
+	}
+	if meta.outdated {
+		rs.rewrite(rk, hRes)
+	}
+	rs.cache.put(rk, hRes, time.Now(), asOf)
+	return hRes, true
+}
+
+func (rs *redisStore) save(rk resultKey, hRes hashResult) error {
+	rs.misses.forget(rk)
+	if _, err := rs.client.do("SET", rs.key(rk.storeKey()), rs.codec.encode(rk.id, hRes)); err != nil {
+		return err
+	}
+	if ttl := settingsFor(rk.tenant).resultTTL; ttl > 0 && !hRes.completedAt.IsZero() {
+		deadline := hRes.completedAt.Add(ttl).UnixMilli()
+		member := fmt.Sprintf("%d %s", rk.id, rk.tenant)
+		if _, err := rs.client.do("ZADD", rs.key("expiring"), strconv.FormatInt(deadline, 10), member); err != nil {
+			return err
+		}
+	}
+	_, err := rs.client.do("INCR", rs.key("completed"))
+	return err
+}
+
+// How many expired results a sweep of Redis asks for at a time.
+const sweepBatch = 100
+
+// sweepShared removes results any replica saved whose time is up by now,
+// so those whose replica is gone still expire.  Saves add them to the
+// expiring sorted set as "<id> <tenant>", scored by when their tenant's
+// result-ttl at the time runs out; one is only taken off once its result
+// is removed, so a sweep cut short loses none.
+func (rs *redisStore) sweepShared(now time.Time) int {
+	swept := 0
+	for {
+		reply, err := rs.client.do("ZRANGEBYSCORE", rs.key("expiring"), "-inf", strconv.FormatInt(now.UnixMilli(), 10),
+			"LIMIT", "0", strconv.Itoa(sweepBatch))
+		if err != nil {
+			logWarn("Redis expiry lookup failed", "error", err)
+			return swept
+		}
+		members := reply.([]string)
+		for _, member := range members {
+			rk, err := parseExpiring(member)
+			if err != nil {
+				logError("Corrupt expiry entry in Redis", "entry", member, "error", err)
+			} else {
+				found, err := removeResult(rk)
+				if err != nil {
+					logWarn("Could not remove expired result", "id", rk.id, "error", err)
+					return swept
+				}
+				if found {
+					swept++
+				}
+			}
+			if _, err := rs.client.do("ZREM", rs.key("expiring"), member); err != nil {
+				logWarn("Redis expiry update failed", "error", err)
+				return swept
+			}
+		}
+		if len(members) < sweepBatch {
+			return swept
+		}
+	}
+}
+
+func parseExpiring(member string) (resultKey, error) {
+	idStr, tenant, _ := strings.Cut(member, " ")
+	idNum, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return resultKey{}, err
+	}
+	return resultKey{tenant, idNum}, nil
+}
+
+func (rs *redisStore) remove(rk resultKey) (bool, error) {
+	rs.cache.invalidate(rk)
+	reply, err := rs.client.do("DEL", rs.key(rk.storeKey()))
+	if err != nil {
+		return false, err
+	}
+	rs.misses.add(rk, time.Now())
+	rs.owners.forget(rk.id)
+	if reply.(int64) == 0 {
+		return false, nil
+	}
+	if err := rs.announceRemoval(rk); err != nil {
+		return true, err
+	}
+	if _, err := rs.client.do("ZREM", rs.key("expiring"), fmt.Sprintf("%d %s", rk.id, rk.tenant)); err != nil {
+		return true, err
+	}
+	_, err = rs.client.do("DEL", rs.key(fmt.Sprintf("owner:%d", rk.id)))
+	return true, err
+}
+
+// How long to wait before following removals again once the feed is lost.
+var removalFeedRetry time.Duration = time.Second
+
+// announceRemoval tells every replica following removals to drop rk from
+// its cache.  The message is "<id> <tenant>", as in the expiring set.
+func (rs *redisStore) announceRemoval(rk resultKey) error {
+	_, err := rs.client.do("PUBLISH", rs.key("removed"), fmt.Sprintf("%d %s", rk.id, rk.tenant))
+	return err
+}
+
+// watchRemovals follows removals made through any replica, dropping each
+// from the local cache, until stop is closed.  The cache is only live
+// while it is subscribed: any removal announced while it isn't could have
+// been missed, so the cache is emptied and left unused until it is back.
+func (rs *redisStore) watchRemovals(stop chan struct{}) {
+	for {
+		err := rs.followRemovals(stop)
+		rs.cache.setLive(false)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logWarn("Not following Redis removals; cached results unused meanwhile", "error", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(removalFeedRetry):
+		}
+	}
+}
+
+// followRemovals subscribes on a connection of its own and applies each
+// removal announced, until the connection fails or stop is closed.
+func (rs *redisStore) followRemovals(stop chan struct{}) error {
+	sub := newRedisClient(rs.client.addr, rs.client.password, rs.client.db)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		sub.mu.Lock()
+		sub.close()
+		sub.mu.Unlock()
+	}()
+
+	sub.mu.Lock()
+	select {
+	case <-stop:
+		sub.mu.Unlock()
+		return nil
+	default:
+	}
+	err := sub.connect()
+	if err == nil {
+		if _, err = sub.roundTrip("SUBSCRIBE", rs.key("removed")); err != nil {
+			sub.close()
+		}
+	}
+	if err != nil {
+		sub.mu.Unlock()
+		return err
+	}
+	// Messages come whenever; only the client's own timeout is dropped.
+	sub.conn.SetDeadline(time.Time{})
+	rd := sub.rd
+	sub.mu.Unlock()
+
+	rs.cache.setLive(true)
+	for {
+		reply, err := readRESP(rd)
+		if err != nil {
+			return err
+		}
+		msg, isMsg := reply.([]string)
+		if !isMsg || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		rk, err := parseExpiring(msg[2])
+		if err != nil {
+			logError("Corrupt removal announced in Redis", "entry", msg[2], "error", err)
+			continue
+		}
+		rs.cache.invalidate(rk)
+	}
+}
+
+// setOwner writes owner:<id> for IDs issued to a tenant.  IDs without one
+// cost nothing extra.
+func (rs *redisStore) setOwner(idNum uint64, tenant string) error {
+	if len(tenant) == 0 {
+		return nil
+	}
+	rs.owners.add(idNum, tenant)
+	_, err := rs.client.do("SET", rs.key(fmt.Sprintf("owner:%d", idNum)), tenant)
+	return err
+}
+
+// owner looks an ID's tenant up among those recently seen, then in Redis.
+// Owners never change, so one found is kept until the cache fills.  A
+// failed lookup gives "", which finds nothing of a tenant's.
+func (rs *redisStore) owner(idNum uint64) string {
+	if tenant, found := rs.owners.get(idNum); found {
+		return tenant
+	}
+	reply, err := rs.client.do("GET", rs.key(fmt.Sprintf("owner:%d", idNum)))
+	if err != nil {
+		if err != redisNil {
+			logWarn("Redis owner lookup failed", "id", idNum, "error", err)
+		}
+		return ""
+	}
+	rs.owners.add(idNum, reply.(string))
+	return reply.(string)
+}
+
+func (rs *redisStore) forgetOwner(idNum uint64) error {
+	rs.owners.forget(idNum)
+	_, err := rs.client.do("DEL", rs.key(fmt.Sprintf("owner:%d", idNum)))
+	return err
+}
+
+func (rs *redisStore) totals() (uint64, uint64) {
+	return rs.counter("ids"), rs.counter("completed")
+}
+
+// ping checks Redis can be reached, for startup.
+func (rs *redisStore) ping() error {
+	_, err := rs.client.do("PING")
+	return err
+}
+
+// validateRedisConfig checks the Redis settings.
+func validateRedisConfig() error {
+	if _, _, err := net.SplitHostPort(redisAddr); err != nil {
+		return fmt.Errorf("redis-addr %q must be host:port: %v", redisAddr, err)
+	}
+	if redisDB < 0 {
+		return fmt.Errorf("redis-db %d must not be negative", redisDB)
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+// Unit Tests for the Redis backed shared store.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers the handful of commands the store sends, from memory.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	keys  map[string]string
+	zsets map[string]map[string]float64
+	subs  map[string][]net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, password: password, keys: map[string]string{}, zsets: map[string]map[string]float64{},
+		subs: map[string][]net.Conn{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := len(fr.password) == 0
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		argc, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, argc)
+		for i := range args {
+			header, _ := rd.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+			arg := make([]byte, size+2)
+			io.ReadFull(rd, arg)
+			args[i] = string(arg[:size])
+		}
+		if args[0] == "AUTH" {
+			authed = args[1] == fr.password
+		}
+		if !authed {
+			fmt.Fprintf(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		fr.mu.Lock()
+		switch args[0] {
+		case "PING", "AUTH", "SELECT":
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "INCR":
+			n, _ := strconv.ParseInt(fr.keys[args[1]], 10, 64)
+			fr.keys[args[1]] = strconv.FormatInt(n+1, 10)
+			fmt.Fprintf(conn, ":%d\r\n", n+1)
+		case "GET":
+			if v, found := fr.keys[args[1]]; found {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprintf(conn, "$-1\r\n")
+			}
+		case "SET":
+			fr.keys[args[1]] = args[2]
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "DEL":
+			_, found := fr.keys[args[1]]
+			delete(fr.keys, args[1])
+			if found {
+				fmt.Fprintf(conn, ":1\r\n")
+			} else {
+				fmt.Fprintf(conn, ":0\r\n")
+			}
+		case "ZADD":
+			if fr.zsets[args[1]] == nil {
+				fr.zsets[args[1]] = map[string]float64{}
+			}
+			score, _ := strconv.ParseFloat(args[2], 64)
+			fr.zsets[args[1]][args[3]] = score
+			fmt.Fprintf(conn, ":1\r\n")
+		case "ZRANGEBYSCORE":
+			// Only "-inf" to a score, with a LIMIT from 0.
+			top, _ := strconv.ParseFloat(args[3], 64)
+			limit, _ := strconv.Atoi(args[6])
+			var members []string
+			for member, score := range fr.zsets[args[1]] {
+				if score <= top {
+					members = append(members, member)
+				}
+			}
+			sort.Slice(members, func(i, j int) bool {
+				zset := fr.zsets[args[1]]
+				return zset[members[i]] < zset[members[j]] || (zset[members[i]] == zset[members[j]] && members[i] < members[j])
+			})
+			if len(members) > limit {
+				members = members[:limit]
+			}
+			fmt.Fprintf(conn, "*%d\r\n", len(members))
+			for _, member := range members {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(member), member)
+			}
+		case "ZREM":
+			_, found := fr.zsets[args[1]][args[2]]
+			delete(fr.zsets[args[1]], args[2])
+			if found {
+				fmt.Fprintf(conn, ":1\r\n")
+			} else {
+				fmt.Fprintf(conn, ":0\r\n")
+			}
+		case "SUBSCRIBE":
+			fr.subs[args[1]] = append(fr.subs[args[1]], conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			for _, sub := range fr.subs[args[1]] {
+				fmt.Fprintf(sub, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2])
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(fr.subs[args[1]]))
+		case "RENAME":
+			fr.keys[args[2]] = fr.keys[args[1]]
+			delete(fr.keys, args[1])
+			fmt.Fprintf(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		fr.mu.Unlock()
+	}
+}
+
+// followRemovals has rs follow removals until the test ends, and waits
+// for its cache to go live.
+func followRemovals(t *testing.T, rs *redisStore) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rs.watchRemovals(stop)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	if !rs.cache.awaitLive(time.Second) {
+		t.Fatal("Expected the cache live once following removals")
+	}
+}
+
+func TestRedisStoreSharing(t *testing.T) {
+	fr := newFakeRedis(t, "hunter2")
+	defer fr.ln.Close()
+
+	// Two replicas on one Redis.
+	replicaA := newRedisStore(newRedisClient(fr.ln.Addr().String(), "hunter2", 0))
+	replicaB := newRedisStore(newRedisClient(fr.ln.Addr().String(), "hunter2", 0))
+	if err := replicaA.ping(); err != nil {
+		t.Fatal(err)
+	}
+	followRemovals(t, replicaB)
+
+	// The local request count includes these, so take them back out.
+	defer atomic.AddUint64(&hashRequests, ^uint64(3-1))
+	idA, errA := replicaA.nextID()
+	idB, errB := replicaB.nextID()
+	idA2, _ := replicaA.nextID()
+	if errA != nil || errB != nil || 1 != idA || 2 != idB || 3 != idA2 {
+		t.Errorf("Expected IDs 1, 2, 3 from the shared counter, got %d %d %d (%v %v)", idA, idB, idA2, errA, errB)
+	}
+	if last := replicaB.lastID(); 3 != last {
+		t.Errorf("Expected last ID 3 seen by either replica, got %d", last)
+	}
+
+	// A result one replica computed can be fetched through the other, labels
+	// and all.
+	const idNum = 1 << 40
+	hRes := hashResult{b64Str: "digest", queueTime: 1500000, processTime: 2000,
+		labels: map[string]string{"source": "replica-a"}, tags: []string{"nightly"}}
+	if err := replicaA.save(resultKey{id: idNum}, hRes); err != nil {
+		t.Fatal(err)
+	}
+	if _, held := resultMap.Load(resultKey{id: idNum}); held {
+		t.Errorf("Expected the result kept in Redis only, not in this process too")
+	}
+	got, found := replicaB.load(resultKey{id: idNum})
+	if !found || !reflect.DeepEqual(hRes, got) {
+		t.Errorf("Expected %v fetched from Redis, got %v %v", hRes, got, found)
+	}
+	fr.mu.Lock()
+	delete(fr.keys, fmt.Sprintf("jmpc:result:%d", idNum))
+	fr.mu.Unlock()
+	if got, found := replicaB.load(resultKey{id: idNum}); !found || !reflect.DeepEqual(hRes, got) {
+		t.Errorf("Expected the fetched result served from the local cache")
+	}
+	if _, found := replicaB.load(resultKey{id: idNum + 1}); found {
+		t.Errorf("Expected no result for an ID never saved")
+	}
+
+	// Saving through a replica clears its remembered miss.
+	replicaB.save(resultKey{id: idNum + 1}, hRes)
+	if _, found := replicaB.load(resultKey{id: idNum + 1}); !found {
+		t.Errorf("Expected a saved result no longer taken as missing")
+	}
+
+	if requests, completed := replicaB.totals(); 3 != requests || 2 != completed {
+		t.Errorf("Expected cluster totals 3 and 2, got %d and %d", requests, completed)
+	}
+
+	// Removal through either replica takes it out of Redis and the cache,
+	// and the replica that computed it stops serving it too.
+	replicaA.save(resultKey{id: idNum}, hRes)
+	if found, err := replicaB.remove(resultKey{id: idNum}); !found || err != nil {
+		t.Errorf("Expected the result removed from Redis, got %v %v", found, err)
+	}
+	if _, found := replicaB.load(resultKey{id: idNum}); found {
+		t.Errorf("Expected no result once removed")
+	}
+	if _, found := replicaA.load(resultKey{id: idNum}); found {
+		t.Errorf("Expected the computing replica not to serve a result removed elsewhere")
+	}
+}
+
+func TestRedisRemovalsReachOtherCaches(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	replicaA := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	replicaB := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	followRemovals(t, replicaA)
+
+	// Cached by A, then removed through B.
+	rk := resultKey{"alice", 1 << 43}
+	replicaB.save(rk, hashResult{b64Str: "digest"})
+	if _, found := replicaA.load(rk); !found {
+		t.Fatal("Expected the result fetched through A")
+	}
+	if found, err := replicaB.remove(rk); !found || err != nil {
+		t.Fatalf("Expected the result removed through B, got %v %v", found, err)
+	}
+	if !waitFor(func() bool { _, found := replicaA.cache.get(rk, time.Now()); return !found }) {
+		t.Errorf("Expected A's cached copy dropped once B removed it")
+	}
+	if _, found := replicaA.load(rk); found {
+		t.Errorf("Expected A not to serve a result removed through B")
+	}
+
+	// Without the feed, removals could be missed, so nothing is served
+	// from the cache until it is back.
+	rk.id++
+	replicaB.save(rk, hashResult{b64Str: "digest"})
+	replicaA.load(rk)
+	fr.mu.Lock()
+	delete(fr.keys, "jmpc:"+rk.storeKey())
+	for _, sub := range fr.subs["jmpc:removed"] {
+		sub.Close()
+	}
+	delete(fr.subs, "jmpc:removed")
+	fr.mu.Unlock()
+	if !waitFor(func() bool { _, found := replicaA.cache.get(rk, time.Now()); return !found }) {
+		t.Errorf("Expected the cache unused once the feed was lost")
+	}
+	if _, found := replicaA.load(rk); found {
+		t.Errorf("Expected a result gone from Redis not served while the feed is lost")
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	fr := newFakeRedis(t, "hunter2")
+	addr := fr.ln.Addr().String()
+
+	wrongPassword := newRedisStore(newRedisClient(addr, "nope", 0))
+	if err := wrongPassword.ping(); err == nil {
+		t.Errorf("Expected a bad password refused")
+	}
+
+	fr.ln.Close()
+	gone := newRedisStore(newRedisClient(addr, "hunter2", 0))
+	if _, err := gone.nextID(); err == nil {
+		t.Errorf("Expected no ID without Redis")
+	}
+	if last := gone.lastID(); 0 != last {
+		t.Errorf("Expected last ID 0 without Redis, got %d", last)
+	}
+}
+
+func TestStoreConfig(t *testing.T) {
+	defer validateStoreConfig()
+	defer withSavedConfig(t)()
+
+	storeBackend = "redis"
+	if err := validateStoreConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, shared := store.(*redisStore); !shared {
+		t.Errorf("Expected the Redis store in service, got %T", store)
+	}
+
+	redisAddr = "no-port"
+	if err := validateStoreConfig(); err == nil {
+		t.Errorf("Expected a Redis address without a port rejected")
+	}
+	redisAddr, redisDB = "localhost:6379", -1
+	if err := validateStoreConfig(); err == nil {
+		t.Errorf("Expected a negative database rejected")
+	}
+	storeBackend = "postgres"
+	if err := validateStoreConfig(); err == nil {
+		t.Errorf("Expected an unknown store rejected")
+	}
+}
+
+func TestRedisFsck(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	savedStore := store
+	defer func() { store = savedStore }()
+	store = rs
+
+	defer atomic.AddUint64(&hashRequests, ^uint64(4-1))
+	for idNum := uint64(1); idNum <= 4; idNum++ {
+		rs.nextID()
+	}
+	for idNum := uint64(1); idNum <= 2; idNum++ {
+		rs.save(resultKey{id: idNum}, hashResult{b64Str: "abc", processTime: 2000})
+	}
+	fr.mu.Lock()
+	fr.keys["jmpc:result:2"] = strings.Replace(fr.keys["jmpc:result:2"], "abc", "abd", 1)
+	fr.keys["jmpc:result:3"] = `{"digest":"old","queue_us":1,"process_us":2}`
+	fr.keys["jmpc:result:4"] = `{"digest":"old","queue_us":1,"process_us":2}`
+	fr.mu.Unlock()
+
+	if _, found := rs.load(resultKey{id: 2}); found {
+		t.Errorf("Expected a corrupt record not served")
+	}
+	if hRes, found := rs.load(resultKey{id: 3}); !found || "old" != hRes.b64Str {
+		t.Errorf("Expected a record without a sum still served, got %v %v", hRes, found)
+	}
+
+	// Record 3 was rewritten with a sum when read; record 4 wasn't read.
+	rep, err := rs.fsck(context.Background(), false)
+	if err != nil || 4 != rep.Scanned || 1 != rep.Unverified || 1 != rep.Outdated || 1 != len(rep.Corrupt) || 2 != rep.Corrupt[0] {
+		t.Fatalf("Expected 4 scanned, 1 unverified and outdated, and 2 corrupt, got %+v %v", rep, err)
+	}
+	if rep, _ = rs.fsck(context.Background(), true); 1 != len(rep.Corrupt) {
+		t.Errorf("Expected the corrupt record found again, got %+v", rep)
+	}
+	fr.mu.Lock()
+	_, moved := fr.keys["jmpc:corrupt:2"]
+	fr.mu.Unlock()
+	if rep, _ = rs.fsck(context.Background(), false); !moved || 0 != len(rep.Corrupt) || 3 != rep.Scanned {
+		t.Errorf("Expected the corrupt record moved aside, got %+v", rep)
+	}
+}
+
+func TestQuarantineDoesNotWaitForExport(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+
+	view := startExport(time.Now())
+	defer view.finish()
+	done := make(chan struct{})
+	go func() {
+		rs.fsck(context.Background(), true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected quarantine not to wait for the export in flight")
+	}
+}
+
+func TestRedisMigration(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+
+	defer atomic.AddUint64(&hashRequests, ^uint64(3-1))
+	for idNum := uint64(1); idNum <= 3; idNum++ {
+		rs.nextID()
+	}
+	rs.save(resultKey{id: 1}, hashResult{b64Str: "new"})
+	fr.mu.Lock()
+	current := fr.keys["jmpc:result:1"]
+	fr.keys["jmpc:result:2"] = `{"digest":"old","queue_us":1,"process_us":2}`
+	fr.keys["jmpc:result:3"] = `not json`
+	fr.mu.Unlock()
+
+	rep, err := rs.migrate(context.Background())
+	if err != nil || 3 != rep.Scanned || 1 != rep.Migrated || 1 != rep.Unreadable {
+		t.Fatalf("Expected 3 scanned, 1 migrated, and 1 unreadable, got %+v %v", rep, err)
+	}
+	fr.mu.Lock()
+	migrated, untouched := fr.keys["jmpc:result:2"], fr.keys["jmpc:result:1"]
+	fr.mu.Unlock()
+	if !strings.Contains(migrated, `"v":5`) || current != untouched {
+		t.Errorf("Expected only the old record rewritten, got %s and %s", migrated, untouched)
+	}
+	if hRes, found := rs.load(resultKey{id: 2}); !found || "old" != hRes.b64Str || 2*time.Microsecond != hRes.processTime {
+		t.Errorf("Expected the migrated record served, got %v %v", hRes, found)
+	}
+	if rep, _ = rs.migrate(context.Background()); 0 != rep.Migrated {
+		t.Errorf("Expected nothing left to migrate, got %+v", rep)
+	}
+}
+
+func TestRedisProtobufRecords(t *testing.T) {
+	defer withSavedConfig(t)()
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+
+	storeCodec = "protobuf"
+	writer := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	reader := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	const idNum = 1 << 42
+	hRes := hashResult{b64Str: "digest", queueTime: 10 * 1000 * 1000, processTime: 2000}
+	if err := writer.save(resultKey{id: idNum}, hRes); err != nil {
+		t.Fatal(err)
+	}
+	if got, found := reader.load(resultKey{id: idNum}); !found || !reflect.DeepEqual(hRes, got) {
+		t.Errorf("Expected %v read back as protobuf, got %v %v", hRes, got, found)
+	}
+}
+
+func TestRedisTenantNamespaces(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	savedStore := store
+	defer func() { store = savedStore }()
+	store = rs
+
+	defer atomic.AddUint64(&hashRequests, ^uint64(1-1))
+	idNum, err := rs.nextID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.setOwner(idNum, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	rs.save(resultKey{"alice", idNum}, hashResult{b64Str: "abc"})
+
+	fr.mu.Lock()
+	_, namespaced := fr.keys[fmt.Sprintf("jmpc:tenant:alice:result:%d", idNum)]
+	recordedOwner := fr.keys[fmt.Sprintf("jmpc:owner:%d", idNum)]
+	fr.mu.Unlock()
+	if !namespaced || "alice" != recordedOwner {
+		t.Errorf("Expected the result under alice's namespace and its owner recorded, got %v %q", namespaced, recordedOwner)
+	}
+
+	// Another replica learns the owner from Redis.
+	rs.owners.forget(idNum)
+	if owner := rs.owner(idNum); "alice" != owner {
+		t.Errorf("Expected owner alice, got %q", owner)
+	}
+
+	for _, tenant := range []string{"bob", ""} {
+		if _, found := rs.load(resultKey{tenant, idNum}); found {
+			t.Errorf("Expected alice's result hidden from tenant %q", tenant)
+		}
+		if _, found, _ := lookupJobStatus(context.Background(), tenant, idNum); found {
+			t.Errorf("Expected alice's job status hidden from tenant %q", tenant)
+		}
+	}
+	if hRes, found := rs.load(resultKey{"alice", idNum}); !found || "abc" != hRes.b64Str {
+		t.Errorf("Expected alice's result served to alice, got %v %v", hRes, found)
+	}
+	if _, found, _ := lookupJobStatus(context.Background(), "alice", idNum); !found {
+		t.Errorf("Expected alice's job status served to alice")
+	}
+}
+
+func TestRedisSweepShared(t *testing.T) {
+	defer validateTenantConfig()
+	defer withSavedConfig(t)()
+	resultTTL, tenantOverrideList = time.Hour, "alice:result-ttl=1m"
+	if err := validateTenantConfig(); err != nil {
+		t.Fatal(err)
+	}
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	savedStore := store
+	defer func() { store = savedStore }()
+	store = rs
+
+	// Both were hashed two minutes ago, which is past alice's result-ttl
+	// only.
+	now := time.Now()
+	const aliceID, otherID = 1<<41 + 1, 1<<41 + 2
+	rs.save(resultKey{"alice", aliceID}, hashResult{b64Str: "alice", completedAt: now.Add(-2 * time.Minute)})
+	rs.save(resultKey{id: otherID}, hashResult{b64Str: "other", completedAt: now.Add(-2 * time.Minute)})
+	defer rs.remove(resultKey{id: otherID})
+
+	if swept := sweepExpired(now); swept != 1 {
+		t.Errorf("Expected one result swept from Redis, got %d", swept)
+	}
+	fr.mu.Lock()
+	_, aliceKept := fr.keys[fmt.Sprintf("jmpc:tenant:alice:result:%d", aliceID)]
+	_, otherKept := fr.keys[fmt.Sprintf("jmpc:result:%d", otherID)]
+	pending := len(fr.zsets["jmpc:expiring"])
+	fr.mu.Unlock()
+	if aliceKept || !otherKept || pending != 1 {
+		t.Errorf("Expected only alice's result expired and the other still due, got %v %v %d", aliceKept, otherKept, pending)
+	}
+	if tenant, removed := removedFrom(aliceID); !removed || "alice" != tenant {
+		t.Errorf("Expected the expired result remembered as alice's, got %q %v", tenant, removed)
+	}
+
+	// Sweeps hand records to exports in flight, as removals by request do.
+	view := startExport(now)
+	defer view.finish()
+	if swept := rs.sweepShared(now.Add(time.Hour)); swept != 1 {
+		t.Errorf("Expected the other result swept once expired, got %d", swept)
+	}
+	if record, found, _ := view.load(context.Background(), resultKey{id: otherID}); !found || "other" != record.hRes.b64Str {
+		t.Errorf("Expected the export in flight still to see the swept result, got %+v %v", record, found)
+	}
+}
@@ -0,0 +1,278 @@
+// Result retention: expiry of old results and removal on request.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a result is kept once hashed, 0 for good, unless its tenant
+// overrides it.  Stored digests are as sensitive as the passwords are
+// guessable, and a long-lived node would otherwise hold every one it ever
+// made; past this they are swept away.
+var resultTTL time.Duration = 0
+
+// Whether clients may remove results with DELETE /hash/{id}.  Results that
+// can be removed are served uncacheable, as a cached copy would outlive
+// the removal; turning this off lets clients keep them.
+var allowDelete bool = true
+
+// Results held here now, as opposed to ever made.
+var storedResults int64
+
+// How long, and how many, removed IDs are remembered.  A removed ID's
+// status says so rather than pending, and its tenant stands in for the
+// owner record removal drops.  Once forgotten only a watermark is left:
+// see wasRemoved.
+const removedRemembered = 24 * time.Hour
+const removedMax = 100000
+
+// IDs whose results were removed, by request or expiry, or that were
+// rejected from quarantine, oldest first.  Only the ID, its tenant, and
+// whether it was rejected are kept, and of those forgotten, the latest
+// position in issue order.
+var removedResults = struct {
+	sync.Mutex
+	byID        map[uint64]removal
+	order       []uint64
+	forgottenTo uint64
+}{byID: map[uint64]removal{}}
+
+type removal struct {
+	tenant   string
+	at       time.Time
+	rejected bool
+}
+
+// markRemoved remembers rk as removed at now, forgetting the oldest
+// removals past removedRemembered or removedMax.
+func markRemoved(rk resultKey, now time.Time) {
+	rememberRemoval(rk.id, removal{tenant: rk.tenant, at: now})
+}
+
+// markRejected remembers rk as rejected from quarantine at now.  It never
+// had a result, but is remembered, and forgotten, like one removed.
+func markRejected(rk resultKey, now time.Time) {
+	rememberRemoval(rk.id, removal{tenant: rk.tenant, at: now, rejected: true})
+}
+
+func rememberRemoval(idNum uint64, rm removal) {
+	removedResults.Lock()
+	defer removedResults.Unlock()
+	if _, found := removedResults.byID[idNum]; !found {
+		removedResults.order = append(removedResults.order, idNum)
+	}
+	removedResults.byID[idNum] = rm
+	now := rm.at
+	for len(removedResults.order) > 0 {
+		oldest := removedResults.order[0]
+		if len(removedResults.order) <= removedMax && now.Sub(removedResults.byID[oldest].at) < removedRemembered {
+			break
+		}
+		if pos := issuedPosition(oldest); pos > removedResults.forgottenTo {
+			removedResults.forgottenTo = pos
+		}
+		issued.release(oldest)
+		delete(removedResults.byID, oldest)
+		removedResults.order = removedResults.order[1:]
+	}
+}
+
+// wasRejected reports whether idNum was rejected from quarantine, for as
+// long as that is remembered.
+func wasRejected(idNum uint64) bool {
+	removedResults.Lock()
+	defer removedResults.Unlock()
+	return removedResults.byID[idNum].rejected
+}
+
+// removedFrom reports whether idNum was removed, and from which tenant.
+func removedFrom(idNum uint64) (string, bool) {
+	removedResults.Lock()
+	defer removedResults.Unlock()
+	rm, removed := removedResults.byID[idNum]
+	return rm.tenant, removed
+}
+
+// wasRemoved reports whether an ID with no stored result had it removed.
+// Past the removals remembered, an issued ID at or before the last one
+// forgotten, and not quarantined or queued here, is taken as removed too:
+// it was issued before a removal now long gone, so any result it was to
+// have is stored by now, and it must not read as pending for good.
+func wasRemoved(idNum uint64) bool {
+	if _, removed := removedFrom(idNum); removed {
+		return true
+	}
+	removedResults.Lock()
+	forgottenTo := removedResults.forgottenTo
+	removedResults.Unlock()
+	pos := issuedPosition(idNum)
+	return pos > 0 && pos <= forgottenTo && idIssued(idNum) && !isQuarantined(idNum) && !workers.isPending(idNum)
+}
+
+// ownerOf is the tenant idNum was issued to, remembered past removal.
+func ownerOf(idNum uint64) string {
+	if tenant, removed := removedFrom(idNum); removed {
+		return tenant
+	}
+	return store.owner(idNum)
+}
+
+// removeResult removes a result from the store along with its labels and
+// tags, reporting whether there was one.
+func removeResult(rk resultKey) (bool, error) {
+	release := holdForExports(rk)
+	found, err := store.remove(rk)
+	release()
+	if !found {
+		return false, err
+	}
+	markRemoved(rk, time.Now())
+	forgetRequest(rk.id)
+	return true, err
+}
+
+// forgetRequest drops what is kept about idNum beside its result: its
+// labels, tags, and webhook.
+func forgetRequest(idNum uint64) {
+	forgetLabels(idNum)
+	forgetTags(idNum)
+	forgetWebhook(idNum)
+}
+
+// sweepExpired removes results hashed longer than their tenant's
+// result-ttl before now, reporting how many.  Results with no completion
+// time are kept.  With Redis, those other replicas saved are swept too,
+// handed to exports in flight as every removal is.
+func sweepExpired(now time.Time) int {
+	var expired []resultKey
+	ttls := map[string]time.Duration{}
+	resultMap.Range(func(key, rec interface{}) bool {
+		hRes, stored := rec.(hashResult)
+		if pr, packed := rec.(packedResult); packed {
+			hRes, stored = pr.unpack(), true
+		}
+		rk := key.(resultKey)
+		ttl, resolved := ttls[rk.tenant]
+		if !resolved {
+			ttl = settingsFor(rk.tenant).resultTTL
+			ttls[rk.tenant] = ttl
+		}
+		if stored && ttl > 0 && !hRes.completedAt.IsZero() && now.Sub(hRes.completedAt) >= ttl {
+			expired = append(expired, rk)
+		}
+		return true
+	})
+	swept := 0
+	for _, rk := range expired {
+		found, err := removeResult(rk)
+		if err != nil {
+			logWarn("Could not remove expired result", "id", rk.id, "error", err)
+		}
+		if found {
+			swept++
+		}
+	}
+	if rs, shared := store.(*redisStore); shared {
+		swept += rs.sweepShared(now)
+	}
+	return swept
+}
+
+// sweepInterval is how often expired results are swept: a tenth of the
+// shortest TTL, between a second and a minute.
+func sweepInterval() time.Duration {
+	interval := shortestResultTTL() / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+func watchExpiry(stop chan struct{}) {
+	ticker := time.NewTicker(sweepInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if swept := sweepExpired(now); swept > 0 {
+				logInfo("Swept expired results", "count", swept)
+			}
+		}
+	}
+}
+
+// resultCacheControl is how long a client may keep hRes: not at all while
+// it can be removed, otherwise no longer than it has left under ttl, and
+// for good without one.
+func resultCacheControl(hRes hashResult, deletable bool, ttl time.Duration, now time.Time) string {
+	if deletable {
+		return "private, no-store"
+	}
+	if ttl > 0 && !hRes.completedAt.IsZero() {
+		remaining := hRes.completedAt.Add(ttl).Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		return fmt.Sprintf("private, max-age=%d", int64(remaining/time.Second))
+	}
+	return "private, max-age=31536000, immutable"
+}
+
+// deleteResultHandler serves DELETE /hash/{id}, removing a result the
+// caller has finished with.  Callers can only remove their own tenant's.
+func deleteResultHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowDelete {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	idStr := strings.TrimPrefix(r.URL.Path, "/hash/")
+	idNum, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		errMsg := fmt.Sprintf("Requested idNum not valid integer: %s", idStr)
+		writeCodedError(w, r, codeBadID, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	tenant := requestTenant(r)
+	found, err := removeResult(resultKey{tenant, idNum})
+	if err != nil {
+		logError("Could not remove result from shared store", "id", idNum, "error", err)
+	}
+	if !found {
+		if isHoneyID(idNum) {
+			honeyTokenTripped(r, idNum)
+		}
+		// Not yet hashed can be removed once it is; anything else is gone.
+		status, issued, _ := lookupJobStatus(r.Context(), tenant, idNum)
+		if issued && (status.State == jobPending || status.State == jobQuarantined) {
+			errMsg := fmt.Sprintf("Results not yet available for idNum: %d", idNum)
+			writeCodedError(w, r, codePending, errMsg, http.StatusConflict)
+			return
+		}
+		errMsg := fmt.Sprintf("Results not available for idNum: %d", idNum)
+		writeCodedError(w, r, codeNotFound, errMsg, http.StatusNotFound)
+		return
+	}
+	logInfo("Result removed", "request_id", requestID(r), "id", idNum)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateRetentionConfig checks the retention settings.
+func validateRetentionConfig() error {
+	if resultTTL < 0 {
+		return fmt.Errorf("result-ttl %v must not be negative", resultTTL)
+	}
+	return nil
+}
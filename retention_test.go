@@ -0,0 +1,254 @@
+// Unit Tests for result retention.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func deleteResult(idNum uint64) int {
+	rec := httptest.NewRecorder()
+	deleteResultHandler(rec, httptest.NewRequest("DELETE", "/hash/"+strconv.FormatUint(idNum, 10), nil))
+	return rec.Code
+}
+
+func TestDeleteResult(t *testing.T) {
+	idNum, _ := nextRequestID()
+	if code := deleteResult(idNum); code != http.StatusConflict {
+		t.Errorf("Expected a pending result to answer 409, got %d", code)
+	}
+
+	(memoryStore{}).save(resultKey{id: idNum}, hashResult{b64Str: "digest", completedAt: time.Now()})
+	setLabels(idNum, map[string]string{"source": "retention"})
+	setTags(idNum, []string{"nightly"})
+	stored := atomic.LoadInt64(&storedResults)
+	if code := deleteResult(idNum); code != http.StatusNoContent {
+		t.Fatalf("Expected removal to answer 204, got %d", code)
+	}
+	if _, found := resultMap.Load(resultKey{id: idNum}); found {
+		t.Errorf("Expected the result to be gone")
+	}
+	if labelsOf(idNum) != nil || tagsOf(idNum) != nil {
+		t.Errorf("Expected the labels and tags to be gone")
+	}
+	if atomic.LoadInt64(&storedResults) != stored-1 {
+		t.Errorf("Expected the stored count to drop")
+	}
+	if status, _, _ := lookupJobStatus(context.Background(), "", idNum); status.State != jobRemoved {
+		t.Errorf("Expected status %q, got %q", jobRemoved, status.State)
+	}
+	if code := deleteResult(idNum); code != http.StatusNotFound {
+		t.Errorf("Expected a second removal to answer 404, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	hashHandler(rec, httptest.NewRequest("GET", "/hash/"+strconv.FormatUint(idNum, 10), nil))
+	if code := rec.Header().Get("X-JMPC-Error-Code"); code != string(codeNotFound) {
+		t.Errorf("Expected a lookup of a removed result to answer %s, got %s", codeNotFound, code)
+	}
+
+	rec = httptest.NewRecorder()
+	deleteResultHandler(rec, httptest.NewRequest("DELETE", "/hash/abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad ID to answer 400, got %d", rec.Code)
+	}
+
+	// With removal turned off, DELETE is refused, naming what's allowed.
+	defer withSavedConfig(t)()
+	allowDelete = false
+	rec = httptest.NewRecorder()
+	deleteResultHandler(rec, httptest.NewRequest("DELETE", "/hash/1", nil))
+	if rec.Code != http.StatusMethodNotAllowed || "GET" != rec.Header().Get("Allow") {
+		t.Errorf("Expected 405 allowing GET, got %d allowing %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestRemovedTenant(t *testing.T) {
+	idNum, _ := nextRequestID()
+	store.setOwner(idNum, "alice")
+	store.save(resultKey{"alice", idNum}, hashResult{b64Str: "digest", completedAt: time.Now()})
+
+	req := httptest.NewRequest("DELETE", "/hash/"+strconv.FormatUint(idNum, 10), nil)
+	req = req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: "alice"}))
+	rec := httptest.NewRecorder()
+	deleteResultHandler(rec, req)
+	if http.StatusNoContent != rec.Code {
+		t.Fatalf("Expected alice's result removed, got %d", rec.Code)
+	}
+
+	// The owner record goes, but the tombstone still scopes the ID.
+	if _, found := ownerMap.Load(idNum); found {
+		t.Errorf("Expected the owner record dropped with the result")
+	}
+	if "alice" != ownerOf(idNum) {
+		t.Errorf("Expected the removed ID still alice's, got %q", ownerOf(idNum))
+	}
+	if _, issued, _ := lookupJobStatus(context.Background(), "", idNum); issued {
+		t.Errorf("Expected alice's removed ID hidden from other tenants")
+	}
+	if status, _, _ := lookupJobStatus(context.Background(), "alice", idNum); jobRemoved != status.State {
+		t.Errorf("Expected status %s for alice, got %+v", jobRemoved, status)
+	}
+}
+
+func TestRemovedBounded(t *testing.T) {
+	removedResults.Lock()
+	saved, savedOrder, savedTo := removedResults.byID, removedResults.order, removedResults.forgottenTo
+	removedResults.byID, removedResults.order, removedResults.forgottenTo = map[uint64]removal{}, nil, 0
+	removedResults.Unlock()
+	defer func() {
+		removedResults.Lock()
+		removedResults.byID, removedResults.order, removedResults.forgottenTo = saved, savedOrder, savedTo
+		removedResults.Unlock()
+	}()
+
+	now := time.Now()
+	markRemoved(resultKey{id: 1}, now.Add(-removedRemembered))
+	markRemoved(resultKey{id: 2}, now)
+	if _, removed := removedFrom(1); removed || !wasRemoved(2) {
+		t.Errorf("Expected only the removal within %v remembered", removedRemembered)
+	}
+
+	for idNum := uint64(3); idNum < removedMax+3; idNum++ {
+		markRemoved(resultKey{id: idNum}, now)
+	}
+	if _, removed := removedFrom(2); removed || !wasRemoved(3) || removedMax != len(removedResults.byID) {
+		t.Errorf("Expected the oldest forgotten past %d removals, got %d", removedMax, len(removedResults.byID))
+	}
+}
+
+func TestForgottenRemovalsStaySettled(t *testing.T) {
+	removedResults.Lock()
+	saved, savedOrder, savedTo := removedResults.byID, removedResults.order, removedResults.forgottenTo
+	removedResults.byID, removedResults.order, removedResults.forgottenTo = map[uint64]removal{}, nil, 0
+	removedResults.Unlock()
+	defer func() {
+		removedResults.Lock()
+		removedResults.byID, removedResults.order, removedResults.forgottenTo = saved, savedOrder, savedTo
+		removedResults.Unlock()
+	}()
+
+	removedID, _ := nextRequestID()
+	pendingID, _ := nextRequestID()
+	laterID, _ := nextRequestID()
+	workers.mu.Lock()
+	workers.pending[pendingID] = time.Now()
+	workers.mu.Unlock()
+	defer func() {
+		workers.mu.Lock()
+		delete(workers.pending, pendingID)
+		workers.mu.Unlock()
+	}()
+
+	// Removed long enough ago to be forgotten, owner and all.
+	now := time.Now()
+	markRemoved(resultKey{id: laterID}, now.Add(-2*removedRemembered))
+	markRemoved(resultKey{id: removedID + 1<<40}, now)
+	if _, remembered := removedFrom(laterID); remembered {
+		t.Fatalf("Expected the removal of %d forgotten", laterID)
+	}
+
+	if !wasRemoved(removedID) || !wasRemoved(laterID) || wasRemoved(pendingID) {
+		t.Errorf("Expected %d and %d still removed and %d still pending", removedID, laterID, pendingID)
+	}
+	if _, code := findResult(httptest.NewRequest("GET", "/hash/x", nil), "", removedID); codeNotFound != code {
+		t.Errorf("Expected %s for a forgotten removal, got %s", codeNotFound, code)
+	}
+	if status, _, _ := lookupJobStatus(context.Background(), "", laterID); jobRemoved != status.State {
+		t.Errorf("Expected status %s for a forgotten removal, got %+v", jobRemoved, status)
+	}
+	if !mayYetBeStored(context.Background(), "", pendingID) || mayYetBeStored(context.Background(), "", removedID) {
+		t.Errorf("Expected only the queued request unsettled")
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	defer withSavedConfig(t)()
+	resultTTL = time.Hour
+
+	now := time.Now()
+	oldID, _ := nextRequestID()
+	newID, _ := nextRequestID()
+	(memoryStore{}).save(resultKey{id: oldID}, hashResult{b64Str: "old", completedAt: now.Add(-2 * time.Hour)})
+	(memoryStore{}).save(resultKey{id: newID}, hashResult{b64Str: "new", completedAt: now})
+	defer removeResult(resultKey{id: newID})
+
+	if swept := sweepExpired(now); swept != 1 {
+		t.Errorf("Expected one result swept, got %d", swept)
+	}
+	if _, found := resultMap.Load(resultKey{id: oldID}); found {
+		t.Errorf("Expected the old result to expire")
+	}
+	if _, found := resultMap.Load(resultKey{id: newID}); !found {
+		t.Errorf("Expected the new result to be kept")
+	}
+}
+
+func TestRemovalKeepsRecordForExport(t *testing.T) {
+	idNum, _ := nextRequestID()
+	rk := resultKey{id: idNum}
+	(memoryStore{}).save(rk, hashResult{b64Str: "digest", completedAt: time.Now()})
+
+	view := startExport(time.Now())
+	defer view.finish()
+	done := make(chan struct{})
+	go func() {
+		removeResult(rk)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected removal not to wait for the export in flight")
+	}
+	if _, found := store.load(rk); found {
+		t.Errorf("Expected the record removed from the store")
+	}
+	if record, found, _ := view.load(context.Background(), rk); !found || "digest" != record.hRes.b64Str {
+		t.Errorf("Expected the export in flight still to see the record, got %+v %v", record, found)
+	}
+	later := startExport(time.Now())
+	defer later.finish()
+	if _, found, _ := later.load(context.Background(), rk); found {
+		t.Errorf("Expected an export started since not to see the record")
+	}
+}
+
+func TestResultCacheControl(t *testing.T) {
+	now := time.Now()
+	hRes := hashResult{b64Str: "digest", completedAt: now.Add(-time.Hour)}
+	cases := []struct {
+		deletable bool
+		ttl       time.Duration
+		hRes      hashResult
+		expected  string
+	}{
+		{true, 0, hRes, "private, no-store"},
+		{true, 2 * time.Hour, hRes, "private, no-store"},
+		{false, 0, hRes, "private, max-age=31536000, immutable"},
+		{false, 2 * time.Hour, hRes, "private, max-age=3600"},
+		{false, 30 * time.Minute, hRes, "private, max-age=0"},
+		{false, 2 * time.Hour, hashResult{b64Str: "digest"}, "private, max-age=31536000, immutable"},
+	}
+	for _, c := range cases {
+		if got := resultCacheControl(c.hRes, c.deletable, c.ttl, now); c.expected != got {
+			t.Errorf("Expected %q deletable %v with ttl %v, got %q", c.expected, c.deletable, c.ttl, got)
+		}
+	}
+}
+
+func TestSweepInterval(t *testing.T) {
+	defer withSavedConfig(t)()
+	for ttl, want := range map[time.Duration]time.Duration{
+		time.Second: time.Second, time.Minute: 6 * time.Second, time.Hour: time.Minute} {
+		resultTTL = ttl
+		if got := sweepInterval(); got != want {
+			t.Errorf("Expected interval %v for ttl %v, got %v", want, ttl, got)
+		}
+	}
+}
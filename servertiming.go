@@ -0,0 +1,89 @@
+// Server-Timing support for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One metric in the Server-Timing header.
+type timingEntry struct {
+	name     string
+	duration time.Duration
+}
+
+// serverTiming collects the entries handlers report for one request.
+type serverTiming struct {
+	mu        sync.Mutex
+	startTime time.Time
+	entries   []timingEntry
+}
+
+// addServerTiming reports a named duration for the request's Server-Timing
+// header.  It is a no-op outside withServerTiming.
+func addServerTiming(r *http.Request, name string, duration time.Duration) {
+	st, ok := r.Context().Value(serverTimingKey).(*serverTiming)
+	if !ok {
+		return
+	}
+	st.mu.Lock()
+	st.entries = append(st.entries, timingEntry{name, duration})
+	st.mu.Unlock()
+}
+
+// header renders the entries, plus the total so far, in milliseconds as the
+// Server-Timing spec expects.
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	parts := make([]string, 0, len(st.entries)+1)
+	for _, e := range st.entries {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.3f", e.name, float64(e.duration.Microseconds())/1000))
+	}
+	total := time.Now().Sub(st.startTime)
+	parts = append(parts, fmt.Sprintf("total;dur=%.3f", float64(total.Microseconds())/1000))
+	return strings.Join(parts, ", ")
+}
+
+// timingResponseWriter sets the Server-Timing header just before the status
+// line goes out, the last moment headers can still change.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (tw *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+func (tw *timingResponseWriter) WriteHeader(statusCode int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set("Server-Timing", tw.timing.header())
+	}
+	tw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (tw *timingResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// withServerTiming emits a Server-Timing header on every response so browser
+// devtools and APM agents can break down where time went.
+func withServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &serverTiming{startTime: time.Now()}
+		ctx := context.WithValue(r.Context(), serverTimingKey, st)
+		next.ServeHTTP(&timingResponseWriter{ResponseWriter: w, timing: st}, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,34 @@
+// Unit Tests for the Server-Timing middleware.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTimingEntries(t *testing.T) {
+	h := withServerTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addServerTiming(r, "store", 1500*time.Microsecond)
+		http.Error(w, "nope", http.StatusNotFound)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/hash/1", nil))
+
+	header := rec.Header().Get("Server-Timing")
+	if !strings.HasPrefix(header, "store;dur=1.500, total;dur=") {
+		t.Errorf("Expected store then total entries, got [%s]", header)
+	}
+	if http.StatusNotFound != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestServerTimingOutsideMiddleware(t *testing.T) {
+	// Handlers may report timings whether or not the middleware is present.
+	addServerTiming(httptest.NewRequest("GET", "/stats", nil), "store", time.Millisecond)
+}
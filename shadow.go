@@ -0,0 +1,172 @@
+// Request shadowing to a secondary deployment.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Base URL of a secondary jmpc deployment, e.g. a new version, that a
+// share of requests is copied to, and the percentage copied.  Off if empty.
+var shadowURL string
+var shadowPercent float64 = 100
+
+// API key the copies carry to the secondary in place of the client's
+// credentials, which are never passed on.  Copies go unauthenticated if
+// empty.
+var shadowKey string
+
+// Headers that carry a client's credentials, stripped from every copy.
+var shadowStrippedHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key",
+	"X-JMPC-Replication-Key", "Cookie", "Connection"}
+
+// Shadow copies in flight at most; more are dropped rather than queued.
+const shadowMaxInFlight = 64
+
+// Public: shadowing counters for the stats endpoint.
+type shadowStats struct {
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// shadower copies requests to the secondary and throws its answers away.
+type shadower struct {
+	base     *url.URL
+	percent  float64
+	key      string
+	client   *http.Client
+	inFlight chan struct{}
+
+	sent    uint64
+	failed  uint64
+	dropped uint64
+}
+
+// The shadower in service, nil when shadow-url is empty.
+var shadow *shadower
+
+func newShadower(base *url.URL, percent float64, key string) *shadower {
+	return &shadower{
+		base:     base,
+		percent:  percent,
+		key:      key,
+		client:   newInternalClient(),
+		inFlight: make(chan struct{}, shadowMaxInFlight),
+	}
+}
+
+func (sh *shadower) stats() shadowStats {
+	return shadowStats{
+		Sent:    atomic.LoadUint64(&sh.sent),
+		Failed:  atomic.LoadUint64(&sh.failed),
+		Dropped: atomic.LoadUint64(&sh.dropped),
+	}
+}
+
+// shadowable picks what the secondary can replay without side effects
+// beyond hashing: submissions and reads.  Removals, share links, admin
+// requests, and the probes, which say nothing about the secondary, are
+// left out.
+func shadowable(r *http.Request) bool {
+	path := r.URL.Path
+	switch r.Method {
+	case http.MethodPost:
+		return path == "/hash" || path == "/hash/batch"
+	case http.MethodGet:
+		return !isAdminPath(path) && !strings.HasPrefix(path, "/healthz") && !strings.HasPrefix(path, "/readyz")
+	}
+	return false
+}
+
+// send copies one request, with its body already read, to the secondary.
+func (sh *shadower) send(r *http.Request, body []byte) {
+	defer func() { <-sh.inFlight }()
+
+	target := *sh.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequest(r.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		atomic.AddUint64(&sh.failed, 1)
+		return
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range shadowStrippedHeaders {
+		req.Header.Del(name)
+	}
+	if len(sh.key) > 0 {
+		req.Header.Set("X-Api-Key", sh.key)
+	}
+	req.Header.Set("X-Request-Id", requestID(r))
+	req.Header.Set("X-JMPC-Shadow", nodeID)
+
+	resp, err := sh.client.Do(req)
+	if err != nil {
+		atomic.AddUint64(&sh.failed, 1)
+		logDebug("Shadow request failed", "request_id", requestID(r), "error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	atomic.AddUint64(&sh.sent, 1)
+}
+
+// withShadow copies a sample of requests to the secondary in the
+// background.  The client is answered by this node alone, so it sits
+// inside withAuth and withRateLimit: only requests served here are copied.
+// The gRPC listener goes without it.
+func withShadow(sh *shadower, next http.Handler) http.Handler {
+	if sh == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !shadowable(r) || rand.Float64()*100 >= sh.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case sh.inFlight <- struct{}{}:
+		default:
+			atomic.AddUint64(&sh.dropped, 1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Both copies need the body, so read it up front.
+		body, err := io.ReadAll(io.LimitReader(r.Body, batchMaxBody+1))
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil || len(body) > batchMaxBody {
+			<-sh.inFlight
+			atomic.AddUint64(&sh.dropped, 1)
+		} else {
+			go sh.send(r.Clone(r.Context()), body)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateShadowConfig checks the shadowing settings and sets it up.
+func validateShadowConfig() error {
+	shadow = nil
+	if len(shadowURL) == 0 {
+		return nil
+	}
+	u, err := validateHTTPURL("shadow-url", shadowURL)
+	if err != nil {
+		return err
+	}
+	if shadowPercent <= 0 || shadowPercent > 100 {
+		return fmt.Errorf("shadow-percent %v must be above 0 and at most 100", shadowPercent)
+	}
+	shadow = newShadower(u, shadowPercent, shadowKey)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Unit Tests for request shadowing.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	type copied struct{ method, path, body, shadowHeader, authz, key string }
+	seen := make(chan copied, 10)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- copied{r.Method, r.URL.RequestURI(), string(body), r.Header.Get("X-JMPC-Shadow"),
+			r.Header.Get("Authorization"), r.Header.Get("X-Api-Key")}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer secondary.Close()
+
+	base, _ := url.Parse(secondary.URL + "/v2")
+	sh := newShadower(base, 100, "shadowsecret")
+	h := withShadow(sh, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if "password=angryMonkey" != string(body) && r.Method == "POST" {
+			t.Errorf("Expected the primary handler given the whole body, got %q", body)
+		}
+	}))
+
+	for _, tc := range []struct{ method, path string }{
+		{"POST", "/hash?wait=false"}, {"POST", "/admin/queue"}, {"GET", "/healthz"},
+		{"DELETE", "/hash/1"}, {"POST", "/hash/1/share"}, {"POST", "/jmpc.Hasher/SubmitHash"},
+		{"GET", "/hash/1"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("password=angryMonkey"))
+		req.Header.Set("Authorization", "Bearer usersecret")
+		req.Header.Set("X-Api-Key", "usersecret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if http.StatusOK != rec.Code {
+			t.Errorf("Expected the primary's answer, got StatusCode [%d]", rec.Code)
+		}
+	}
+
+	got := map[string]copied{}
+	for len(got) < 2 {
+		select {
+		case c := <-seen:
+			got[c.method] = c
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the submission and the read copied to the secondary, got %+v", got)
+		}
+	}
+	if c := got["POST"]; "/v2/hash?wait=false" != c.path || "password=angryMonkey" != c.body || nodeID != c.shadowHeader {
+		t.Errorf("Unexpected shadow copy %+v", c)
+	}
+	if c := got["GET"]; "/v2/hash/1" != c.path {
+		t.Errorf("Unexpected shadow copy %+v", c)
+	}
+	for _, c := range got {
+		if "" != c.authz || "shadowsecret" != c.key {
+			t.Errorf("Expected the client's credentials swapped for the shadow key, got %+v", c)
+		}
+	}
+	select {
+	case c := <-seen:
+		t.Errorf("Expected only submissions and reads copied, got %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := sh.stats(); 2 != stats.Sent || 0 != stats.Failed {
+		t.Errorf("Expected two copies sent, got %+v", stats)
+	}
+}
+
+func TestShadowConfig(t *testing.T) {
+	defer validateShadowConfig()
+	defer withSavedConfig(t)()
+
+	shadowURL, shadowPercent = "http://canary:8080", 5
+	if err := validateShadowConfig(); err != nil || shadow == nil {
+		t.Errorf("Expected a shadower, got %v", err)
+	}
+	for _, bad := range []struct {
+		url     string
+		percent float64
+	}{{"canary:8080", 5}, {"http://canary:8080", 0}, {"http://canary:8080", 101}, {"http://:8080", 5}} {
+		shadowURL, shadowPercent = bad.url, bad.percent
+		if err := validateShadowConfig(); err == nil {
+			t.Errorf("Expected %q at %v%% rejected", bad.url, bad.percent)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Signed share links for single results.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secret share links are signed with.  Left empty, a random one is made at
+// startup and links stop working across restarts or between nodes.
+var shareSecret string
+
+// Default and longest lifetime of a share link.
+var shareTTL time.Duration = 1 * time.Hour
+var shareMaxTTL time.Duration = 24 * time.Hour
+
+// Key actually used for signing.
+var shareKey []byte
+
+// Public: response body of POST /hash/{id}/share.
+type shareLink struct {
+	ID        uint64    `json:"id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// shareSignature signs an ID and expiry.
+func shareSignature(idNum uint64, expires int64) string {
+	mac := hmac.New(sha256.New, shareKey)
+	fmt.Fprintf(mac, "%d:%d", idNum, expires)
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validShareLink reports whether a request carries an unexpired signature
+// for the one result it asks for.
+func validShareLink(r *http.Request) bool {
+	if r.Method != http.MethodGet || len(shareKey) == 0 {
+		return false
+	}
+	query := r.URL.Query()
+	sig, expiresStr := query.Get("sig"), query.Get("expires")
+	if len(sig) == 0 || len(expiresStr) == 0 {
+		return false
+	}
+	idNum, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/hash/"), 10, 64)
+	if err != nil || !strings.HasPrefix(r.URL.Path, "/hash/") {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(shareSignature(idNum, expires)))
+}
+
+// shareHandler mints a link to one result that works without an API key
+// until it expires, for passing a digest to a third party.  An optional
+// "ttl" shortens or lengthens it, up to shareMaxTTL.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hash/"), "/share")
+	idNum, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		errMsg := fmt.Sprintf("Requested idNum not valid integer: %s", idStr)
+		writeCodedError(w, r, codeBadID, errMsg, http.StatusBadRequest)
+		return
+	}
+	// Only the tenant a request belongs to may share it.
+	if !idIssued(idNum) || isHoneyID(idNum) || ownerOf(idNum) != requestTenant(r) {
+		if isHoneyID(idNum) {
+			honeyTokenTripped(r, idNum)
+		}
+		errMsg := fmt.Sprintf("No request issued with idNum: %d", idNum)
+		writeError(w, r, errMsg, http.StatusNotFound)
+		return
+	}
+
+	ttl := shareTTL
+	if ttlStr := r.FormValue("ttl"); len(ttlStr) > 0 {
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 || ttl > shareMaxTTL {
+			errMsg := fmt.Sprintf("Field 'ttl' must be a duration up to %v.", shareMaxTTL)
+			writeError(w, r, errMsg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := shareLink{
+		ID: idNum,
+		URL: fmt.Sprintf("%s://%s/hash/%d?expires=%d&sig=%s", scheme, r.Host, idNum,
+			expiresAt.Unix(), shareSignature(idNum, expiresAt.Unix())),
+		ExpiresAt: expiresAt,
+	}
+	writeJSON(w, http.StatusOK, link)
+}
+
+// validateShareConfig settles the signing key.
+func validateShareConfig() error {
+	if shareTTL <= 0 || shareTTL > shareMaxTTL {
+		return fmt.Errorf("share-ttl %v must be positive and at most share-max-ttl %v", shareTTL, shareMaxTTL)
+	}
+	if len(shareSecret) > 0 {
+		shareKey = []byte(shareSecret)
+	}
+	return nil
+}
+
+// ensureShareKey makes a random signing key if none was configured.
+func ensureShareKey() {
+	if len(shareKey) > 0 {
+		return
+	}
+	shareKey = make([]byte, 32)
+	if _, err := rand.Read(shareKey); err != nil {
+		logFatal("Cannot make a share key", "error", err)
+	}
+	logWarn("No share-secret configured, share links will not survive a restart")
+}
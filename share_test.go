@@ -0,0 +1,67 @@
+// Unit Tests for signed share links.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShareLink(t *testing.T) {
+	savedRequests := atomic.LoadUint64(&hashRequests)
+	atomic.StoreUint64(&hashRequests, 7)
+	defer atomic.StoreUint64(&hashRequests, savedRequests)
+	ensureShareKey()
+
+	rec := postForm(hashHandler, "/hash/7/share", url.Values{"ttl": {"10m"}})
+	if http.StatusOK != rec.Code {
+		t.Fatalf("Expected StatusCode [%d], got [%d] %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var link shareLink
+	json.Unmarshal(rec.Body.Bytes(), &link)
+	if 7 != link.ID || time.Until(link.ExpiresAt) > 10*time.Minute || !strings.Contains(link.URL, "/hash/7?") {
+		t.Errorf("Unexpected link %s", rec.Body.String())
+	}
+
+	// The link gets past authentication on its own, for that ID only.
+	keys, _ := loadAPIKeys("usersecret", "")
+	h := withAuth(keys, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tryLink := func(target string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Code
+	}
+
+	if code := tryLink(link.URL); http.StatusOK != code {
+		t.Errorf("Expected the share link to be accepted, got [%d]", code)
+	}
+	if code := tryLink(strings.Replace(link.URL, "/hash/7?", "/hash/6?", 1)); http.StatusUnauthorized != code {
+		t.Errorf("Expected the signature not to carry over to another ID, got [%d]", code)
+	}
+	expired := time.Now().Add(-time.Minute).Unix()
+	stale := "/hash/7?expires=" + strconv.FormatInt(expired, 10) + "&sig=" + shareSignature(7, expired)
+	if code := tryLink(stale); http.StatusUnauthorized != code {
+		t.Errorf("Expected an expired link to be refused, got [%d]", code)
+	}
+
+	for _, c := range []struct {
+		path string
+		form url.Values
+		code int
+	}{
+		{"/hash/8/share", nil, http.StatusNotFound},
+		{"/hash/x/share", nil, http.StatusBadRequest},
+		{"/hash/7/share", url.Values{"ttl": {"48h"}}, http.StatusBadRequest},
+	} {
+		if rec := postForm(hashHandler, c.path, c.form); c.code != rec.Code {
+			t.Errorf("%s %v: expected StatusCode [%d], got [%d]", c.path, c.form, c.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Shutdown handling for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status code of the answer to /shutdown calls after the first, which
+// change nothing: 200, or 409 for callers that want a repeat flagged.
+var shutdownRepeatStatus int = http.StatusOK
+
+// Shutdown states reported by /shutdown.
+const (
+	shutdownDraining = "draining"
+	shutdownStopping = "stopping"
+)
+
+// Public: response body of /shutdown.
+type shutdownReport struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// Set when an earlier call already started the shutdown.
+	AlreadyRequested bool `json:"already_requested"`
+	// Requests queued or being hashed.
+	JobsRemaining int    `json:"jobs_remaining"`
+	Message       string `json:"message"`
+}
+
+// shutdownControl starts the shutdown once, however often it is asked
+// to, so repeated calls don't stack up more Shutdown calls.
+type shutdownControl struct {
+	mu       sync.Mutex
+	since    time.Time
+	stopping bool
+}
+
+var serverShutdown shutdownControl
+
+// request starts the shutdown if it hasn't been already: the node drains
+// for shutdownDrain, reporting not ready, then stop is called.  It reports
+// the state the shutdown is in either way.
+func (sc *shutdownControl) request(now time.Time, stop func()) shutdownReport {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	rep := shutdownReport{State: shutdownDraining, JobsRemaining: workers.remaining()}
+	if sc.since.IsZero() {
+		sc.since = now
+		atomic.StoreInt32(&shutdownRequested, 1)
+		go func() {
+			time.Sleep(shutdownDrain)
+			sc.mu.Lock()
+			sc.stopping = true
+			sc.mu.Unlock()
+			stop()
+		}()
+		rep.Since = now
+		rep.Message = fmt.Sprintf("Shutdown requested, %d jobs remaining.", rep.JobsRemaining)
+		return rep
+	}
+
+	if sc.stopping {
+		rep.State = shutdownStopping
+	}
+	rep.Since, rep.AlreadyRequested = sc.since, true
+	rep.Message = fmt.Sprintf("Already %s, %d jobs remaining.", rep.State, rep.JobsRemaining)
+	return rep
+}
+
+// shutdownHandler serves /shutdown, with stop closing the server down.
+func shutdownHandler(stop func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := serverShutdown.request(time.Now(), stop)
+		if rep.AlreadyRequested {
+			logInfo("Shutdown already requested", "request_id", requestID(r), "state", rep.State, "since", rep.Since)
+			writeJSON(w, shutdownRepeatStatus, rep)
+			return
+		}
+		logInfo("Shutdown requested", "request_id", requestID(r), "drain", shutdownDrain, "jobs_remaining", rep.JobsRemaining)
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
+
+// rejectIfShuttingDown answers 503 to a submission once a shutdown has
+// been requested, reporting whether it did.  Work already queued is still
+// finished, and lookups still served, while the node drains.
+func rejectIfShuttingDown(w http.ResponseWriter, r *http.Request) bool {
+	if atomic.LoadInt32(&shutdownRequested) == 0 {
+		return false
+	}
+	writeCodedError(w, r, codeShuttingDown, "Shutting down: new submissions are not accepted, "+
+		"existing results can still be fetched.", http.StatusServiceUnavailable)
+	return true
+}
+
+func validateShutdownConfig() error {
+	if shutdownRepeatStatus != http.StatusOK && shutdownRepeatStatus != http.StatusConflict {
+		return fmt.Errorf("shutdown-repeat-status %d must be 200 or 409", shutdownRepeatStatus)
+	}
+	return nil
+}
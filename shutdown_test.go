@@ -0,0 +1,48 @@
+// Unit Tests for shutdown handling.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownOnce(t *testing.T) {
+	defer withSavedConfig(t)()
+	defer atomic.StoreInt32(&shutdownRequested, 0)
+	shutdownDrain = 50 * time.Millisecond
+
+	var sc shutdownControl
+	var stops int32
+	stop := func() { atomic.AddInt32(&stops, 1) }
+	start := time.Now()
+
+	rep := sc.request(start, stop)
+	if rep.AlreadyRequested || shutdownDraining != rep.State || !start.Equal(rep.Since) {
+		t.Errorf("Expected a new shutdown draining, got %+v", rep)
+	}
+	if 0 == atomic.LoadInt32(&shutdownRequested) {
+		t.Errorf("Expected the node marked as shutting down")
+	}
+	rep = sc.request(start.Add(time.Second), stop)
+	if !rep.AlreadyRequested || shutdownDraining != rep.State || !start.Equal(rep.Since) {
+		t.Errorf("Expected the first shutdown reported, got %+v", rep)
+	}
+
+	time.Sleep(4 * shutdownDrain)
+	rep = sc.request(time.Now(), stop)
+	if shutdownStopping != rep.State {
+		t.Errorf("Expected the shutdown stopping once drained, got %+v", rep)
+	}
+	if n := atomic.LoadInt32(&stops); 1 != n {
+		t.Errorf("Expected the server stopped once, got %d", n)
+	}
+
+	for status, valid := range map[int]bool{200: true, 409: true, 202: false, 0: false} {
+		shutdownRepeatStatus = status
+		if err := validateShutdownConfig(); valid != (err == nil) {
+			t.Errorf("Expected shutdown-repeat-status %d valid %v, got %v", status, valid, err)
+		}
+	}
+}
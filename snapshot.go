@@ -0,0 +1,30 @@
+// Point-in-time snapshot of the service's figures.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"time"
+)
+
+// serviceSnapshot holds the totals, averages, latency percentiles, and
+// queue state as they stood at one moment.  Nothing in it is shared with
+// the live counters, so it may be kept and read from any goroutine.
+//
+// jmpc is built as a single binary, so there is no Server type for other
+// programs to embed; this is the one place that gathers everything, for
+// /stats and /admin/queue here and for any library split later.
+type serviceSnapshot struct {
+	Taken time.Time
+	Stats statsResult
+	Queue queueReport
+}
+
+// takeSnapshot copies out the figures as of now.  Each part is consistent
+// in itself, but the parts are read one after another, not under one lock.
+func takeSnapshot(now time.Time) serviceSnapshot {
+	return serviceSnapshot{
+		Taken: now,
+		Stats: currentStats(),
+		Queue: workers.report(now),
+	}
+}
@@ -0,0 +1,31 @@
+// Unit Tests for service snapshots.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotIsolated(t *testing.T) {
+	recordLatency(endpointStatsGet, 250*time.Microsecond)
+	snap := takeSnapshot(time.Now())
+	if snap.Taken.IsZero() || cap(hashRequestChannel) != snap.Queue.Capacity {
+		t.Errorf("Expected the snapshot stamped and the queue reported, got %+v", snap)
+	}
+	count := snap.Stats.Endpoints[endpointStatsGet].Lifetime.Count
+	if 0 == count {
+		t.Fatalf("Expected the recorded latency in the snapshot")
+	}
+
+	// Later activity, or changes to the copy, leave each other alone.
+	recordLatency(endpointStatsGet, 250*time.Microsecond)
+	if after := snap.Stats.Endpoints[endpointStatsGet].Lifetime.Count; count != after {
+		t.Errorf("Expected the snapshot unchanged, count went %d to %d", count, after)
+	}
+	snap.Stats.Endpoints[endpointStatsGet].Windows["1m"] = latencySummary{}
+	delete(snap.Stats.Endpoints, endpointStatsGet)
+	if fresh := takeSnapshot(time.Now()); fresh.Stats.Endpoints[endpointStatsGet].Lifetime.Count <= count {
+		t.Errorf("Expected the live figures untouched by the copy")
+	}
+}
@@ -0,0 +1,254 @@
+// The "jmpc soak" subcommand: sustained traffic at an in-process server.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the queue may take to empty once traffic stops, on top of the
+// hash delay, and the goroutines to wind down after it.
+const (
+	soakDrainTimeout  = 30 * time.Second
+	soakSettleTimeout = 5 * time.Second
+)
+
+// soakFigures are what a soak measured, before and after.
+type soakFigures struct {
+	// Counted by the traffic: submissions answered with an ID, and
+	// requests that failed or got a 5xx.
+	Submitted uint64
+	Failed    uint64
+	// Counted by the server since the traffic started: IDs issued,
+	// requests settled, and the growth in the stats total.
+	Issued     uint64
+	Settled    uint64
+	StatsTotal uint64
+
+	HeapBefore, HeapAfter             uint64
+	GoroutinesBefore, GoroutinesAfter int
+}
+
+// problems lists what a soak with these figures failed on, none if it
+// passed: failed requests, counters that don't reconcile, or memory and
+// goroutines that grew past the limits.
+func (sf soakFigures) problems(maxHeapGrowth uint64, maxGoroutineGrowth int) []string {
+	var found []string
+	if sf.Failed > 0 {
+		found = append(found, fmt.Sprintf("%d requests failed", sf.Failed))
+	}
+	if sf.Issued != sf.Submitted || sf.StatsTotal != sf.Submitted {
+		found = append(found, fmt.Sprintf("counters don't reconcile: %d submitted, %d issued, stats total grew %d",
+			sf.Submitted, sf.Issued, sf.StatsTotal))
+	}
+	if sf.Settled != sf.Issued {
+		found = append(found, fmt.Sprintf("%d of %d requests never settled", sf.Issued-sf.Settled, sf.Issued))
+	}
+	if sf.HeapAfter > sf.HeapBefore && sf.HeapAfter-sf.HeapBefore > maxHeapGrowth {
+		found = append(found, fmt.Sprintf("heap grew %d bytes, more than %d", sf.HeapAfter-sf.HeapBefore, maxHeapGrowth))
+	}
+	if sf.GoroutinesAfter-sf.GoroutinesBefore > maxGoroutineGrowth {
+		found = append(found, fmt.Sprintf("goroutines grew from %d to %d", sf.GoroutinesBefore, sf.GoroutinesAfter))
+	}
+	return found
+}
+
+// settledRequests counts requests the server is done with: hashed, or
+// discarded or held in quarantine, which never will be, or taken over from
+// a primary.
+func settledRequests() uint64 {
+	return atomic.LoadUint64(&resultMapCount) + atomic.LoadUint64(&discardedCount) + uint64(quarantineCount()) +
+		atomic.LoadUint64(&replicatedCount)
+}
+
+// heapInUse gives the live heap after a collection.
+func heapInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// soakClient makes requests of the server under soak.
+type soakClient struct {
+	base   string
+	apiKey string
+	client *http.Client
+}
+
+func (sc soakClient) do(method, path string, form url.Values) (int, string, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, sc.base+path, body)
+	if err != nil {
+		return 0, "", err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if len(sc.apiKey) > 0 {
+		req.Header.Set("X-Api-Key", sc.apiKey)
+	}
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	return resp.StatusCode, strings.TrimSpace(string(respBody)), err
+}
+
+// runSoak starts the service in this process, drives submissions, lookups,
+// and stats reads at it for a long while, then checks that memory and
+// goroutines came back down and the counters reconcile, to catch slow
+// leaks a short test run never would.  Arguments after "--" configure the
+// server as they would "jmpc" itself.  It returns the process exit code: 1
+// if the soak found a problem.
+func runSoak(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("jmpc soak", flag.ContinueOnError)
+	fs.SetOutput(out)
+	duration := fs.Duration("duration", time.Hour, "how long to drive traffic")
+	concurrency := fs.Int("concurrency", 8, "clients driving traffic at once")
+	delay := fs.Duration("hash-delay", 10*time.Millisecond, "hash delay for the server, overriding its own, so work keeps up")
+	apiKey := fs.String("key", "", "API key, if the server is configured to need one")
+	maxHeapMB := fs.Uint64("max-heap-growth-mb", 64, "most the live heap may grow, in MiB, before the soak fails")
+	maxGoroutines := fs.Int("max-goroutine-growth", 20, "most the goroutine count may grow before the soak fails")
+	every := fs.Duration("report", time.Minute, "how often progress is printed")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *duration <= 0 || *concurrency < 1 || *every <= 0 {
+		fmt.Fprintln(out, "jmpc soak: -duration and -report must be positive, and -concurrency at least 1")
+		return 2
+	}
+	// Request logs would drown the report, so the server logs warnings
+	// unless told otherwise.
+	if err := loadConfig(append([]string{"-log-level", "warn"}, fs.Args()...)); err != nil {
+		fmt.Fprintf(out, "jmpc soak: %v\n", err)
+		return 2
+	}
+	if tlsEnabled() {
+		fmt.Fprintln(out, "jmpc soak: the server must not use TLS")
+		return 2
+	}
+	hashDelay = *delay
+
+	go startupHTTPServices()
+	addr := fmt.Sprintf("127.0.0.1:%d", listenPort)
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			fmt.Fprintf(out, "jmpc soak: server never came up on %s: %v\n", addr, err)
+			return 1
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	transport := &http.Transport{MaxIdleConnsPerHost: *concurrency}
+	sc := soakClient{"http://" + addr, *apiKey, &http.Client{Transport: transport, Timeout: *delay + time.Minute}}
+	var figures soakFigures
+	statsBefore := currentStats().Total
+	issuedBefore, settledBefore := atomic.LoadUint64(&hashRequests), settledRequests()
+	figures.HeapBefore, figures.GoroutinesBefore = heapInUse(), runtime.NumGoroutine()
+	fmt.Fprintf(out, "soaking %s for %v with %d clients, heap %d KiB, %d goroutines\n",
+		sc.base, *duration, *concurrency, figures.HeapBefore>>10, figures.GoroutinesBefore)
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for c := 0; c < *concurrency; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for n := 0; time.Now().Before(deadline); n++ {
+				status, idStr, err := sc.do(http.MethodPost, "/hash", url.Values{"password": {fmt.Sprintf("jmpc-soak-%d-%d", c, n)}})
+				if err != nil || status != http.StatusOK {
+					atomic.AddUint64(&figures.Failed, 1)
+					continue
+				}
+				atomic.AddUint64(&figures.Submitted, 1)
+				for _, path := range []string{"/hash/" + idStr, "/hash/" + idStr + "/status"} {
+					if status, _, err := sc.do(http.MethodGet, path, nil); err != nil || status >= 500 {
+						atomic.AddUint64(&figures.Failed, 1)
+					}
+				}
+				if n%100 == 0 {
+					if status, _, err := sc.do(http.MethodGet, "/stats", nil); err != nil || status != http.StatusOK {
+						atomic.AddUint64(&figures.Failed, 1)
+					}
+				}
+			}
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(*every)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case now := <-ticker.C:
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			fmt.Fprintf(out, "%v: %d submitted, %d failed, heap %d KiB, %d goroutines\n",
+				now.Sub(start).Truncate(time.Second), atomic.LoadUint64(&figures.Submitted),
+				atomic.LoadUint64(&figures.Failed), ms.HeapAlloc>>10, runtime.NumGoroutine())
+		}
+	}
+	ticker.Stop()
+
+	// Let the queue empty, then the connections and their goroutines go.
+	drainBy := time.Now().Add(hashDelay + soakDrainTimeout)
+	for atomic.LoadUint64(&hashRequests)-issuedBefore != settledRequests()-settledBefore && time.Now().Before(drainBy) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	figures.StatsTotal = currentStats().Total - statsBefore
+	figures.Issued = atomic.LoadUint64(&hashRequests) - issuedBefore
+	figures.Settled = settledRequests() - settledBefore
+	transport.CloseIdleConnections()
+	settleBy := time.Now().Add(soakSettleTimeout)
+	for runtime.NumGoroutine()-figures.GoroutinesBefore > *maxGoroutines && time.Now().Before(settleBy) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	figures.HeapAfter, figures.GoroutinesAfter = heapInUse(), runtime.NumGoroutine()
+
+	fmt.Fprintf(out, "%d submitted, %d failed, %d issued, %d settled\n",
+		figures.Submitted, figures.Failed, figures.Issued, figures.Settled)
+	perRequest := ""
+	if figures.Submitted > 0 && figures.HeapAfter > figures.HeapBefore {
+		perRequest = ", " + strconv.FormatUint((figures.HeapAfter-figures.HeapBefore)/figures.Submitted, 10) + " bytes per submission"
+	}
+	fmt.Fprintf(out, "heap %d KiB to %d KiB%s; goroutines %d to %d\n",
+		figures.HeapBefore>>10, figures.HeapAfter>>10, perRequest, figures.GoroutinesBefore, figures.GoroutinesAfter)
+
+	found := figures.problems(*maxHeapMB<<20, *maxGoroutines)
+	for _, problem := range found {
+		fmt.Fprintf(out, "FAIL: %s\n", problem)
+	}
+	if len(found) > 0 {
+		return 1
+	}
+	fmt.Fprintln(out, "PASS")
+	return 0
+}
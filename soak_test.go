@@ -0,0 +1,45 @@
+// Unit Tests for the soak subcommand.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSoakProblems(t *testing.T) {
+	healthy := soakFigures{Submitted: 100, Issued: 100, Settled: 100, StatsTotal: 100,
+		HeapBefore: 1 << 20, HeapAfter: 2 << 20, GoroutinesBefore: 10, GoroutinesAfter: 12}
+	if found := healthy.problems(4<<20, 5); len(found) > 0 {
+		t.Errorf("Expected no problems, got %v", found)
+	}
+
+	cases := []struct {
+		change func(*soakFigures)
+		expect string
+	}{
+		{func(sf *soakFigures) { sf.Failed = 3 }, "3 requests failed"},
+		{func(sf *soakFigures) { sf.Issued, sf.Settled = 101, 101 }, "counters don't reconcile"},
+		{func(sf *soakFigures) { sf.StatsTotal = 99 }, "counters don't reconcile"},
+		{func(sf *soakFigures) { sf.Settled = 90 }, "10 of 100 requests never settled"},
+		{func(sf *soakFigures) { sf.HeapAfter = 6 << 20 }, "heap grew"},
+		{func(sf *soakFigures) { sf.GoroutinesAfter = 40 }, "goroutines grew from 10 to 40"},
+	}
+	for _, c := range cases {
+		sf := healthy
+		c.change(&sf)
+		found := sf.problems(4<<20, 5)
+		if 1 != len(found) || !strings.HasPrefix(found[0], c.expect) {
+			t.Errorf("Expected %q, got %v", c.expect, found)
+		}
+	}
+}
+
+func TestSoakUsage(t *testing.T) {
+	for _, args := range [][]string{{"-duration", "0"}, {"-concurrency", "0"}, {"-bogus"}} {
+		if code := runSoak(args, ioutil.Discard); 2 != code {
+			t.Errorf("Expected %v refused with exit code 2, got %d", args, code)
+		}
+	}
+}
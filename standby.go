@@ -0,0 +1,442 @@
+// Warm standby: a node tailing a primary's results, ready to take over.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Base URL of the primary a standby tails, none if empty.  A standby
+// serves lookups of what it has copied but accepts no submissions until
+// promoted with POST /admin/promote, so a failed primary can be replaced in
+// seconds without a consensus stack.  It copies with the primary's own
+// /export, resumed from before the first result it passed over as not yet
+// stored, so the stream can break off, or the primary go away, without
+// losing anything; records copied already are skipped.  Removals reach it
+// by rereading the whole export now and then, see reconcile.
+var standbyOf string
+
+// The primary's replication key, which /export is called with, how long to wait
+// between polls once caught up, how often the whole export is reread for
+// removals, and tenants copied besides requests made without
+// authenticating, comma separated.
+var (
+	standbyKey       string
+	standbyPoll      time.Duration = time.Second
+	standbyReconcile time.Duration = time.Minute
+	standbyTenants   string
+)
+
+// IDs a standby took over from its primary.  The request count is raised
+// to cover them, so IDs issued after promotion carry on past them; they
+// count as settled, as they were never this node's work to finish.
+var replicatedCount uint64
+
+// Public: response body of /admin/standby and /admin/promote.
+type standbyReport struct {
+	Role    string `json:"role"`
+	Primary string `json:"primary,omitempty"`
+	Copied  uint64 `json:"copied"`
+	// Results dropped as the primary no longer has them.
+	Dropped    uint64     `json:"dropped"`
+	LastSync   *time.Time `json:"last_sync,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty"`
+}
+
+// standbyState is the copying, while a standby, and what became of it.
+type standbyState struct {
+	mu         sync.Mutex
+	active     bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+	cursors    map[string]string
+	reconciled map[string]time.Time
+	copied     uint64
+	dropped    uint64
+	lastSync   time.Time
+	lastError  string
+	promotedAt time.Time
+}
+
+var standby standbyState
+
+// start makes this node a read-only standby of the primary at base and
+// starts copying from it.
+func (ss *standbyState) start(base string, client *http.Client, tenants []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ss.mu.Lock()
+	ss.active, ss.cancel, ss.done = true, cancel, make(chan struct{})
+	ss.cursors, ss.reconciled = map[string]string{}, map[string]time.Time{}
+	ss.mu.Unlock()
+	storeReadOnly.set(true, "standby of "+base)
+	logInfo("Standing by", "primary", base, "tenants", strings.Join(tenants, ","))
+
+	go func() {
+		defer close(ss.done)
+		for {
+			progressed := false
+			for _, tenant := range tenants {
+				n, err := ss.pull(ctx, base, client, tenant)
+				progressed = progressed || n > 0
+				if ctx.Err() != nil {
+					return
+				}
+				ss.synced(err)
+			}
+			// Straight back for more after a stream cut short part way.
+			if progressed {
+				continue
+			}
+			for _, tenant := range tenants {
+				if !ss.reconcileDue(tenant) {
+					continue
+				}
+				err := ss.reconcile(ctx, base, client, tenant)
+				if ctx.Err() != nil {
+					return
+				}
+				ss.synced(err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(standbyPoll):
+			}
+		}
+	}()
+}
+
+// pull copies one tenant's records from the primary, from where the last
+// pull left off, reporting how many it copied.
+func (ss *standbyState) pull(ctx context.Context, base string, client *http.Client, tenant string) (int, error) {
+	ss.mu.Lock()
+	cursor := ss.cursors[tenant]
+	ss.mu.Unlock()
+
+	// An export stopped at the primary's pageMaxScan is carried on at once.
+	// The next pull resumes before the first result passed over in any
+	// part, so a record's own resume is only taken until then.
+	copied, settled := 0, true
+	for {
+		end, err := streamExport(ctx, client, base, standbyKey, tenant, cursor, func(record exportRecord) error {
+			fresh, err := copyRecord(tenant, record)
+			if err != nil {
+				return err
+			}
+			ss.mu.Lock()
+			defer ss.mu.Unlock()
+			if settled {
+				ss.cursors[tenant] = record.Resume
+			}
+			if fresh {
+				copied++
+				ss.copied++
+			}
+			return nil
+		})
+		if err != nil || len(end.next) == 0 {
+			return copied, err
+		}
+		ss.mu.Lock()
+		if settled {
+			ss.cursors[tenant] = end.resume
+			settled = end.resume == end.next
+		}
+		ss.mu.Unlock()
+		cursor = end.next
+	}
+}
+
+// reconcileDue reports whether tenant's copies are due to be checked
+// against the primary again.
+func (ss *standbyState) reconcileDue(tenant string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return time.Since(ss.reconciled[tenant]) >= standbyReconcile
+}
+
+// reconcile rereads the primary's whole export of a tenant and drops the
+// results held here that it no longer lists: removed there, by request or
+// expiry, since they were copied.  Every result held here was listed by an
+// earlier export, so one missing from a later one is gone.  Only an export
+// the primary says ran to the end is trusted; one cut short drops nothing.
+func (ss *standbyState) reconcile(ctx context.Context, base string, client *http.Client, tenant string) error {
+	listed := map[uint64]bool{}
+	complete, err := streamWholeExport(ctx, client, base, standbyKey, tenant, func(record exportRecord) error {
+		listed[record.ID] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return fmt.Errorf("%s export of tenant %q ended early, nothing dropped", base, tenant)
+	}
+
+	var gone []resultKey
+	resultMap.Range(func(key, rec interface{}) bool {
+		if rk := key.(resultKey); rk.tenant == tenant && !listed[rk.id] {
+			gone = append(gone, rk)
+		}
+		return true
+	})
+	dropped := uint64(0)
+	for _, rk := range gone {
+		if found, _ := removeResult(rk); found {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		logInfo("Standby dropped results removed on primary", "tenant", tenant, "count", dropped)
+	}
+	ss.mu.Lock()
+	ss.reconciled[tenant] = time.Now()
+	ss.dropped += dropped
+	ss.mu.Unlock()
+	return nil
+}
+
+// The trailers an export ends with: one when it ran to the end, listing
+// every result it covers rather than being cut short, and two when it
+// stopped at pageMaxScan, with the cursor carrying the same export on and
+// the one a tail resumes from, before any result it passed over.
+const (
+	exportCompleteTrailer = "X-JMPC-Export-Complete"
+	exportNextTrailer     = "X-JMPC-Export-Next"
+	exportResumeTrailer   = "X-JMPC-Export-Resume"
+)
+
+// exportEnd is what an export's trailers said about how it ended.
+type exportEnd struct {
+	complete     bool
+	next, resume string
+}
+
+// streamExport calls fn with each record of another node's export of a
+// tenant's results, after cursor, "" for all, until one fails.  key is
+// that node's replication key, with which the tenant is always named.  It
+// reports how the export said it ended.
+func streamExport(ctx context.Context, client *http.Client, base, key, tenant, cursor string, fn func(exportRecord) error) (exportEnd, error) {
+	query := url.Values{"tenant": {tenant}}
+	if len(cursor) > 0 {
+		query.Set("cursor", cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/export?"+query.Encode(), nil)
+	if err != nil {
+		return exportEnd{}, err
+	}
+	if len(key) > 0 {
+		req.Header.Set("X-JMPC-Replication-Key", key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return exportEnd{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return exportEnd{}, fmt.Errorf("%s answered %d: %s", base, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var record exportRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			// Trailers are only read once the body is.
+			io.Copy(io.Discard, resp.Body)
+			return exportEnd{
+				complete: resp.Trailer.Get(exportCompleteTrailer) == "true",
+				next:     resp.Trailer.Get(exportNextTrailer),
+				resume:   resp.Trailer.Get(exportResumeTrailer),
+			}, nil
+		} else if err != nil {
+			return exportEnd{}, err
+		}
+		if err := fn(record); err != nil {
+			return exportEnd{}, err
+		}
+	}
+}
+
+// streamWholeExport is streamExport from the start, carried on wherever
+// the export stops at the other node's pageMaxScan.  It reports whether
+// the last part ran to the end.
+func streamWholeExport(ctx context.Context, client *http.Client, base, key, tenant string, fn func(exportRecord) error) (bool, error) {
+	cursor := ""
+	for {
+		end, err := streamExport(ctx, client, base, key, tenant, cursor, fn)
+		if err != nil || end.complete || len(end.next) == 0 {
+			return end.complete, err
+		}
+		cursor = end.next
+	}
+}
+
+func (ss *standbyState) synced(err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if err != nil {
+		if ss.lastError != err.Error() {
+			logWarn("Standby could not copy from primary", "error", err)
+		}
+		ss.lastError = err.Error()
+		return
+	}
+	ss.lastSync, ss.lastError = time.Now(), ""
+}
+
+// copyRecord stores a result copied from the primary as if this node had
+// made it, and takes its ID over, reporting whether it wasn't held already.
+// It keeps the primary's completion time, so results expire under
+// result-ttl when they would have there; one the primary didn't send is
+// taken as now.
+func copyRecord(tenant string, record exportRecord) (bool, error) {
+	if _, held := store.load(resultKey{tenant, record.ID}); held {
+		return false, nil
+	}
+	if err := store.setOwner(record.ID, tenant); err != nil {
+		return false, err
+	}
+	completedAt := fromUnixMicros(record.CompletedUs)
+	if completedAt.IsZero() {
+		completedAt = time.Now()
+	}
+	hRes := hashResult{
+		b64Str:      record.Digest,
+		queueTime:   time.Duration(record.QueueTimeUs) * time.Microsecond,
+		processTime: time.Duration(record.ProcessTimeUs) * time.Microsecond,
+		completedAt: completedAt,
+		labels:      record.Labels,
+		tags:        record.Tags,
+	}
+	if err := store.save(resultKey{tenant, record.ID}, hRes); err != nil {
+		return false, err
+	}
+	takeOverID(record.ID)
+	return true, nil
+}
+
+// takeOverID marks an ID the primary issued as issued here too.
+func takeOverID(idNum uint64) {
+	if _, counted := idGen.(sequentialIDs); !counted {
+		if issued.claim(idNum) {
+			atomic.AddUint64(&replicatedCount, 1)
+		}
+		return
+	}
+	for {
+		last := atomic.LoadUint64(&hashRequests)
+		if idNum <= last {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&hashRequests, last, idNum) {
+			atomic.AddUint64(&replicatedCount, idNum-last)
+			return
+		}
+	}
+}
+
+// promote stops copying and makes this node a primary, accepting
+// submissions.  It reports false if it wasn't a standby.
+func (ss *standbyState) promote() bool {
+	ss.mu.Lock()
+	if !ss.active {
+		ss.mu.Unlock()
+		return false
+	}
+	ss.active = false
+	ss.cancel()
+	done := ss.done
+	ss.mu.Unlock()
+
+	// Nothing more is copied once this returns.
+	<-done
+	ss.mu.Lock()
+	ss.promotedAt = time.Now()
+	ss.mu.Unlock()
+	storeReadOnly.set(false, "")
+	return true
+}
+
+func (ss *standbyState) report() standbyReport {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	rep := standbyReport{Role: "primary", Copied: ss.copied, Dropped: ss.dropped, LastError: ss.lastError}
+	if ss.active {
+		rep.Role, rep.Primary = "standby", standbyOf
+	}
+	if !ss.lastSync.IsZero() {
+		lastSync := ss.lastSync
+		rep.LastSync = &lastSync
+	}
+	if !ss.promotedAt.IsZero() {
+		promotedAt := ss.promotedAt
+		rep.PromotedAt = &promotedAt
+	}
+	return rep
+}
+
+// standbyHandler serves GET /admin/standby.
+func standbyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, standby.report())
+}
+
+// promoteHandler serves POST /admin/promote.
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !standby.promote() {
+		writeError(w, r, "This node is not a standby.", http.StatusConflict)
+		return
+	}
+	rep := standby.report()
+	logWarn("Promoted from standby", "primary", standbyOf, "copied", rep.Copied, "request_id", requestID(r))
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// standbyTenantList gives the tenants a standby copies, "" first.
+func standbyTenantList() []string {
+	tenants := []string{""}
+	for _, tenant := range strings.Split(standbyTenants, ",") {
+		if tenant = strings.TrimSpace(tenant); len(tenant) > 0 {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants
+}
+
+// validateStandbyConfig checks the standby settings.
+func validateStandbyConfig() error {
+	if len(standbyOf) == 0 {
+		return nil
+	}
+	if _, err := validateHTTPURL("standby-of", standbyOf); err != nil {
+		return err
+	}
+	standbyOf = strings.TrimSuffix(standbyOf, "/")
+	if storeBackend != "memory" {
+		return fmt.Errorf("standby-of needs store-backend memory; replicas sharing a store need no standby")
+	}
+	if standbyPoll <= 0 || standbyReconcile <= 0 {
+		return fmt.Errorf("standby-poll %v and standby-reconcile %v must be positive", standbyPoll, standbyReconcile)
+	}
+	return nil
+}
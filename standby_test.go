@@ -0,0 +1,298 @@
+// Unit Tests for the warm standby.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStandbyCopiesAndPromotes(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+	defer atomic.StoreUint64(&replicatedCount, atomic.LoadUint64(&replicatedCount))
+	defer storeReadOnly.set(false, "")
+
+	idStrategy = "random"
+	validateIDConfig()
+	standbyPoll, standbyKey = 10*time.Millisecond, "primary-replication"
+
+	// The primary has four results, and cuts its first export off after
+	// two, as a timeout would.
+	const base = 1 << 42
+	var records []exportRecord
+	for i := 0; i < 4; i++ {
+		records = append(records, exportRecord{ID: base + uint64(i), Digest: fmt.Sprintf("digest-%d", i),
+			ProcessTimeUs: 5, CompletedUs: 1600000000000000 + int64(i), Cursor: strconv.Itoa(i + 1), Resume: strconv.Itoa(i + 1), Tags: []string{"copied"}})
+	}
+	var exports int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "primary-replication" != r.Header.Get("X-JMPC-Replication-Key") || "/export" != r.URL.Path {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		from, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		to := len(records)
+		if 1 == atomic.AddInt32(&exports, 1) {
+			to = 2
+		}
+		enc := json.NewEncoder(w)
+		for _, record := range records[from:to] {
+			enc.Encode(record)
+		}
+	}))
+	defer primary.Close()
+	for _, record := range records {
+		defer resultMap.Delete(resultKey{id: record.ID})
+	}
+
+	var ss standbyState
+	ss.start(primary.URL, primary.Client(), []string{""})
+	if !storeReadOnly.get().ReadOnly {
+		t.Errorf("Expected a standby to refuse submissions")
+	}
+	if !waitFor(func() bool { return 4 == ss.report().Copied }) {
+		t.Fatalf("Expected all four records copied, got %+v", ss.report())
+	}
+	for _, record := range records {
+		hRes, found := store.load(resultKey{id: record.ID})
+		if !found || record.Digest != hRes.b64Str || !idIssued(record.ID) || 1 != len(hRes.tags) || "copied" != hRes.tags[0] ||
+			record.CompletedUs != hRes.completedAt.UnixMicro() {
+			t.Errorf("Expected %d copied and issued, got %+v %v", record.ID, hRes, found)
+		}
+	}
+	if rep := ss.report(); "standby" != rep.Role || nil == rep.LastSync {
+		t.Errorf("Expected a synced standby, got %+v", rep)
+	}
+
+	if !ss.promote() || storeReadOnly.get().ReadOnly {
+		t.Fatalf("Expected promotion to take submissions again")
+	}
+	// A request cancelled in flight may still reach the primary after.
+	time.Sleep(standbyPoll)
+	seen := atomic.LoadInt32(&exports)
+	time.Sleep(5 * standbyPoll)
+	if rep := ss.report(); "primary" != rep.Role || nil == rep.PromotedAt || seen != atomic.LoadInt32(&exports) {
+		t.Errorf("Expected copying stopped on promotion, got %+v after %d exports", rep, atomic.LoadInt32(&exports))
+	}
+	if ss.promote() {
+		t.Errorf("Expected a second promotion refused")
+	}
+}
+
+func TestStandbyResumesBeforeUnsettled(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+	defer atomic.StoreUint64(&replicatedCount, atomic.LoadUint64(&replicatedCount))
+	defer storeReadOnly.set(false, "")
+
+	idStrategy = "random"
+	validateIDConfig()
+	standbyPoll = 10 * time.Millisecond
+
+	// The primary's second result is only stored by its third export, and
+	// until then each export passes it over.
+	const base = 1<<42 + 100
+	var exports int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		stored := atomic.AddInt32(&exports, 1) >= 3
+		enc := json.NewEncoder(w)
+		unsettled, resume := false, ""
+		for i := from; i < 3; i++ {
+			if 1 == i && !stored {
+				unsettled, resume = true, strconv.Itoa(i)
+				continue
+			}
+			cursor := strconv.Itoa(i + 1)
+			if !unsettled {
+				resume = cursor
+			}
+			enc.Encode(exportRecord{ID: base + uint64(i), Digest: fmt.Sprintf("digest-%d", i), Cursor: cursor, Resume: resume})
+		}
+	}))
+	defer primary.Close()
+	for i := 0; i < 3; i++ {
+		defer resultMap.Delete(resultKey{id: base + uint64(i)})
+	}
+
+	var ss standbyState
+	ss.start(primary.URL, primary.Client(), []string{""})
+	defer ss.promote()
+	if !waitFor(func() bool { return 3 == ss.report().Copied }) {
+		t.Fatalf("Expected all three records copied, got %+v", ss.report())
+	}
+	if hRes, found := store.load(resultKey{id: base + 1}); !found || "digest-1" != hRes.b64Str {
+		t.Errorf("Expected the result stored late copied, got %+v %v", hRes, found)
+	}
+	time.Sleep(5 * standbyPoll)
+	if copied := ss.report().Copied; 3 != copied {
+		t.Errorf("Expected records sent again not counted twice, got %d copied", copied)
+	}
+}
+
+func TestStandbyDropsRemovedResults(t *testing.T) {
+	defer validateIDConfig()
+	defer withSavedConfig(t)()
+	defer withFreshIDs()()
+	defer atomic.StoreUint64(&replicatedCount, atomic.LoadUint64(&replicatedCount))
+	defer storeReadOnly.set(false, "")
+
+	idStrategy = "random"
+	validateIDConfig()
+	standbyPoll, standbyReconcile = 10*time.Millisecond, 10*time.Millisecond
+
+	// The primary removes its first result once the standby has it, and
+	// its exports say whether they ran to the end.
+	const base = 1<<42 + 200
+	var removed, cutShort atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", exportCompleteTrailer)
+		from, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		enc := json.NewEncoder(w)
+		for i := from; i < 2; i++ {
+			if 0 == i && removed.Load() {
+				continue
+			}
+			cursor := strconv.Itoa(i + 1)
+			enc.Encode(exportRecord{ID: base + uint64(i), Digest: fmt.Sprintf("digest-%d", i), Cursor: cursor, Resume: cursor})
+		}
+		if !cutShort.Load() {
+			w.Header().Set(exportCompleteTrailer, "true")
+		}
+	}))
+	defer primary.Close()
+	for i := 0; i < 2; i++ {
+		defer resultMap.Delete(resultKey{"mirrored", base + uint64(i)})
+	}
+
+	var ss standbyState
+	ss.start(primary.URL, primary.Client(), []string{"mirrored"})
+	defer ss.promote()
+	if !waitFor(func() bool { return 2 == ss.report().Copied }) {
+		t.Fatalf("Expected both records copied, got %+v", ss.report())
+	}
+
+	// Nothing is dropped on the word of an export cut short.
+	cutShort.Store(true)
+	removed.Store(true)
+	time.Sleep(10 * standbyReconcile)
+	if _, found := store.load(resultKey{"mirrored", base}); !found {
+		t.Errorf("Expected a result kept while exports end early")
+	}
+
+	cutShort.Store(false)
+	if !waitFor(func() bool { return 1 == ss.report().Dropped }) {
+		t.Fatalf("Expected the removed result dropped, got %+v", ss.report())
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", fmt.Sprintf("/hash/%d", uint64(base)), nil)
+	hashHandler(rec, req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: "mirrored"})))
+	if http.StatusNotFound != rec.Code {
+		t.Errorf("Expected the removed result no longer served, got [%d] %s", rec.Code, rec.Body)
+	}
+	if _, found := store.load(resultKey{"mirrored", base + 1}); !found {
+		t.Errorf("Expected the result still on the primary kept")
+	}
+}
+
+func TestTakeOverSequentialID(t *testing.T) {
+	savedRequests, savedReplicated := atomic.LoadUint64(&hashRequests), atomic.LoadUint64(&replicatedCount)
+	defer func() {
+		atomic.StoreUint64(&hashRequests, savedRequests)
+		atomic.StoreUint64(&replicatedCount, savedReplicated)
+	}()
+
+	takeOverID(savedRequests + 5)
+	takeOverID(savedRequests + 3)
+	if savedRequests+5 != store.lastID() || savedReplicated+5 != atomic.LoadUint64(&replicatedCount) {
+		t.Errorf("Expected IDs taken over up to %d, got last %d and %d taken over",
+			savedRequests+5, store.lastID(), atomic.LoadUint64(&replicatedCount)-savedReplicated)
+	}
+}
+
+func TestPromoteHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	promoteHandler(rec, httptest.NewRequest("POST", "/admin/promote", nil))
+	if http.StatusConflict != rec.Code {
+		t.Errorf("Expected a node that isn't a standby to refuse promotion, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	standbyHandler(rec, httptest.NewRequest("GET", "/admin/standby", nil))
+	var rep standbyReport
+	json.Unmarshal(rec.Body.Bytes(), &rep)
+	if http.StatusOK != rec.Code || "primary" != rep.Role {
+		t.Errorf("Expected a primary reported, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestStandbyConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+	for _, c := range []struct {
+		of, backend string
+		valid       bool
+	}{{"", "redis", true}, {"http://primary:8080/", "memory", true}, {"primary:8080", "memory", false}, {"http://primary:8080", "redis", false},
+		{"http://:8080", "memory", false}} {
+		standbyOf, storeBackend = c.of, c.backend
+		if err := validateStandbyConfig(); c.valid != (err == nil) {
+			t.Errorf("%q on %s: expected valid %v, got %v", c.of, c.backend, c.valid, err)
+		}
+	}
+}
+
+func TestExportOfAnotherTenantNeedsReplicationKey(t *testing.T) {
+	defer withSavedConfig(t)()
+	replicationKey = "replicate"
+	keys, err := loadAPIKeys("adminsecret:ops:admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withAuth(keys, exemptPathSet(""), http.HandlerFunc(exportHandler))
+
+	idNum, _ := nextRequestID()
+	store.save(resultKey{"alice", idNum}, hashResult{b64Str: "alice-digest"})
+	defer resultMap.Delete(resultKey{"alice", idNum})
+
+	cases := []struct {
+		path, header, value string
+		status              int
+	}{
+		{"/export?tenant=alice", "X-Api-Key", "adminsecret", http.StatusForbidden},
+		{"/export?tenant=ops", "X-Api-Key", "adminsecret", http.StatusOK},
+		{"/export?tenant=alice", "X-JMPC-Replication-Key", "wrong", http.StatusUnauthorized},
+		{"/export", "X-JMPC-Replication-Key", "replicate", http.StatusBadRequest},
+		{"/stats", "X-JMPC-Replication-Key", "replicate", http.StatusUnauthorized},
+		{"/export?tenant=alice", "X-JMPC-Replication-Key", "replicate", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Header.Set(c.header, c.value)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if c.status != rec.Code {
+			t.Errorf("%s %s=%q: expected StatusCode [%d], got [%d]", c.path, c.header, c.value, c.status, rec.Code)
+		}
+		if http.StatusOK == c.status && c.path == "/export?tenant=alice" {
+			exported := false
+			for dec := json.NewDecoder(rec.Body); ; {
+				var record exportRecord
+				if dec.Decode(&record) != nil {
+					break
+				}
+				exported = exported || (idNum == record.ID && "alice-digest" == record.Digest)
+			}
+			if !exported {
+				t.Errorf("Expected alice's result exported, got %q", rec.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Latency statistics for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The histogram is log-linear in the spirit of HDR histograms: values below
+// 2*histSubCount get a bucket each, and above that every power of two is split
+// into histSubCount buckets.  With 32 sub-buckets the reported percentiles are
+// within about 3% of the true value, in a fixed ~8KB of counters.
+const (
+	histSubBits  = 5
+	histSubCount = 1 << histSubBits
+	histMaxShift = 31 // Anything beyond ~37 hours of microseconds is clamped.
+	histBuckets  = (histMaxShift + 2) * histSubCount
+)
+
+// Rolling windows are built from fixed width time slots, so a window is just
+// the merge of the slots that fall inside it.
+const (
+	windowSlotWidth = 10 * time.Second
+	windowSlots     = 30 // Enough slots to cover the largest window.
+)
+
+// Longest a single timing sample counts for.  Durations measured in this
+// process come off the monotonic clock and a wall clock step can't touch
+// them, but one taken against a time from elsewhere, a stored record or
+// another node, can come out wildly long, and would swamp the averages.
+const maxTimingSample = 24 * time.Hour
+
+// Slots are counted on the monotonic clock from here, not from the wall
+// clock, so an NTP step doesn't file samples into the wrong window or age
+// out the ones already there.
+var statsClockStart = time.Now()
+
+// Reported rolling windows, name to width.
+var statsWindows = map[string]time.Duration{
+	"1m": 1 * time.Minute,
+	"5m": 5 * time.Minute,
+}
+
+// Endpoint names used as keys in the stats breakdown.
+const (
+	endpointHashPost   = "hash_post"
+	endpointHashGet    = "hash_get"
+	endpointHashBatch  = "hash_batch"
+	endpointHashLookup = "hash_lookup"
+	endpointStatsGet   = "stats"
+	endpointGRPC       = "grpc"
+)
+
+// Public: distribution of request latencies, all values in microseconds.
+type latencySummary struct {
+	Count uint64 `json:"count"`
+	Min   uint64 `json:"min"`
+	Max   uint64 `json:"max"`
+	Mean  uint64 `json:"mean"`
+	P50   uint64 `json:"p50"`
+	P95   uint64 `json:"p95"`
+	P99   uint64 `json:"p99"`
+}
+
+// Public: lifetime and rolling window latencies for one endpoint.
+type endpointLatency struct {
+	Lifetime latencySummary            `json:"lifetime"`
+	Windows  map[string]latencySummary `json:"windows"`
+}
+
+// latencyHistogram counts recorded values into log-linear buckets.  It is not
+// safe for concurrent use; endpointRecorder provides the locking.
+type latencyHistogram struct {
+	counts [histBuckets]uint64
+	count  uint64
+	sum    uint64
+	min    uint64
+	max    uint64
+}
+
+// histIndex maps a value to its bucket.
+func histIndex(v uint64) int {
+	if v < 2*histSubCount {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histSubBits - 1
+	if shift > histMaxShift {
+		return histBuckets - 1
+	}
+	return 2*histSubCount + (shift-1)*histSubCount + int(v>>uint(shift)) - histSubCount
+}
+
+// histValue maps a bucket back to a representative value, its midpoint.
+func histValue(idx int) uint64 {
+	if idx < 2*histSubCount {
+		return uint64(idx)
+	}
+	shift := uint((idx-2*histSubCount)/histSubCount + 1)
+	sub := uint64((idx-2*histSubCount)%histSubCount + histSubCount)
+	return sub<<shift + (uint64(1)<<shift)/2
+}
+
+func (h *latencyHistogram) record(v uint64) {
+	h.counts[histIndex(v)]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum = addCapped(h.sum, v)
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum = addCapped(h.sum, o.sum)
+}
+
+// percentile returns the value at or below which p percent of the recorded
+// values fall, clamped to the observed min and max.
+func (h *latencyHistogram) percentile(p float64) uint64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.count))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64 = 0
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			v := histValue(i)
+			if v < h.min {
+				v = h.min
+			}
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) summary() latencySummary {
+	if h.count == 0 {
+		return latencySummary{}
+	}
+	return latencySummary{
+		Count: h.count,
+		Min:   h.min,
+		Max:   h.max,
+		Mean:  h.sum / h.count,
+		P50:   h.percentile(50),
+		P95:   h.percentile(95),
+		P99:   h.percentile(99),
+	}
+}
+
+// One slot of the rolling window ring.  epoch identifies which slot width
+// interval the counts belong to, so stale slots can be recognized and reused.
+type windowSlot struct {
+	epoch int64
+	hist  latencyHistogram
+}
+
+// endpointRecorder tracks lifetime and rolling window latencies for one
+// endpoint.
+type endpointRecorder struct {
+	mu       sync.Mutex
+	lifetime latencyHistogram
+	slots    [windowSlots]*windowSlot
+}
+
+func slotEpoch(now time.Time) int64 {
+	since := int64(now.Sub(statsClockStart))
+	epoch := since / int64(windowSlotWidth)
+	if since < 0 && since%int64(windowSlotWidth) != 0 {
+		epoch-- // Round down, so slots before the start line up too.
+	}
+	return epoch
+}
+
+// slotIndex gives where in the ring an epoch's slot lives.
+func slotIndex(epoch int64) int {
+	return int((epoch%windowSlots + windowSlots) % windowSlots)
+}
+
+// timingMicros converts a duration to microseconds for the stats: a
+// negative one, from a clock that stepped back between two readings, counts
+// as 0, and one past maxTimingSample as that.
+func timingMicros(d time.Duration) uint64 {
+	if d < 0 {
+		return 0
+	}
+	if d > maxTimingSample {
+		d = maxTimingSample
+	}
+	return uint64(d.Microseconds())
+}
+
+// addCapped adds two totals, sticking at the largest value a uint64 can
+// hold rather than wrapping round to a small one.
+func addCapped(a, b uint64) uint64 {
+	if sum := a + b; sum >= a {
+		return sum
+	}
+	return math.MaxUint64
+}
+
+// addTiming adds a sample to an accumulator shared between goroutines.
+func addTiming(acc *uint64, microSecs uint64) {
+	for {
+		old := atomic.LoadUint64(acc)
+		if atomic.CompareAndSwapUint64(acc, old, addCapped(old, microSecs)) {
+			return
+		}
+	}
+}
+
+func (e *endpointRecorder) record(now time.Time, microSecs uint64) {
+	epoch := slotEpoch(now)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lifetime.record(microSecs)
+
+	slot := e.slots[slotIndex(epoch)]
+	if slot == nil {
+		slot = &windowSlot{epoch: epoch}
+		e.slots[slotIndex(epoch)] = slot
+	} else if slot.epoch != epoch {
+		*slot = windowSlot{epoch: epoch}
+	}
+	slot.hist.record(microSecs)
+}
+
+func (e *endpointRecorder) snapshot(now time.Time) endpointLatency {
+	epoch := slotEpoch(now)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := endpointLatency{
+		Lifetime: e.lifetime.summary(),
+		Windows:  make(map[string]latencySummary, len(statsWindows)),
+	}
+	for name, width := range statsWindows {
+		span := int64(width / windowSlotWidth)
+		var merged latencyHistogram
+		for _, slot := range e.slots {
+			if slot != nil && slot.epoch > epoch-span && slot.epoch <= epoch {
+				merged.merge(&slot.hist)
+			}
+		}
+		result.Windows[name] = merged.summary()
+	}
+	return result
+}
+
+// Per-endpoint recorders, plus one covering every endpoint.
+var endpointRecorders = map[string]*endpointRecorder{
+	endpointHashPost:   {},
+	endpointHashGet:    {},
+	endpointHashBatch:  {},
+	endpointHashLookup: {},
+	endpointStatsGet:   {},
+	endpointGRPC:       {},
+}
+var allEndpointsRecorder endpointRecorder
+
+// recordLatency files a handler duration under its endpoint.
+func recordLatency(endpoint string, duration time.Duration) {
+	now := time.Now()
+	microSecs := timingMicros(duration)
+	if rec, found := endpointRecorders[endpoint]; found {
+		rec.record(now, microSecs)
+	}
+	allEndpointsRecorder.record(now, microSecs)
+}
+
+// latencySnapshot gathers the overall and per-endpoint latency statistics.
+func latencySnapshot() (endpointLatency, map[string]endpointLatency) {
+	now := time.Now()
+	perEndpoint := make(map[string]endpointLatency, len(endpointRecorders))
+	for name, rec := range endpointRecorders {
+		perEndpoint[name] = rec.snapshot(now)
+	}
+	return allEndpointsRecorder.snapshot(now), perEndpoint
+}
@@ -0,0 +1,202 @@
+// Unit Tests for the latency statistics.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHistogramBucketsRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 1, 63, 64, 65, 127, 128, 1000, 5000000, 1 << 40} {
+		got := histValue(histIndex(v))
+		lo, hi := v-v/16, v+v/16
+		if v < 2*histSubCount {
+			lo, hi = v, v
+		}
+		if v < 1<<36 && (got < lo || got > hi) {
+			t.Errorf("Value %d mapped to %d, outside [%d, %d]", v, got, lo, hi)
+		}
+		if histIndex(v) >= histBuckets {
+			t.Errorf("Value %d mapped past the last bucket", v)
+		}
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	var h latencyHistogram
+	for v := uint64(1); v <= 1000; v++ {
+		h.record(v)
+	}
+
+	sum := h.summary()
+	if 1000 != sum.Count || 1 != sum.Min || 1000 != sum.Max || 500 != sum.Mean {
+		t.Errorf("Unexpected summary %+v", sum)
+	}
+
+	checks := []struct {
+		got, want uint64
+	}{{sum.P50, 500}, {sum.P95, 950}, {sum.P99, 990}}
+	for _, c := range checks {
+		if c.got < c.want-c.want/20 || c.got > c.want+c.want/20 {
+			t.Errorf("Expected percentile near %d, got %d", c.want, c.got)
+		}
+	}
+}
+
+func TestEndpointRecorderWindows(t *testing.T) {
+	var rec endpointRecorder
+	now := time.Now()
+
+	rec.record(now.Add(-4*time.Minute), 100)
+	rec.record(now.Add(-30*time.Second), 200)
+	rec.record(now, 300)
+
+	snap := rec.snapshot(now)
+	if 3 != snap.Lifetime.Count {
+		t.Errorf("Expected 3 lifetime samples, got %d", snap.Lifetime.Count)
+	}
+	if 2 != snap.Windows["1m"].Count {
+		t.Errorf("Expected 2 samples in 1m window, got %d", snap.Windows["1m"].Count)
+	}
+	if 3 != snap.Windows["5m"].Count {
+		t.Errorf("Expected 3 samples in 5m window, got %d", snap.Windows["5m"].Count)
+	}
+
+	// Ten minutes later the windows have rolled past everything.
+	later := rec.snapshot(now.Add(10 * time.Minute))
+	if 0 != later.Windows["5m"].Count || 3 != later.Lifetime.Count {
+		t.Errorf("Expected empty windows and 3 lifetime samples, got %+v", later)
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	defer withSavedConfig(t)()
+	statsMaxAge = time.Second
+	var sc statsCache
+
+	t0 := time.Now()
+	first, age := sc.get(t0)
+	if 0 != age {
+		t.Errorf("Expected fresh figures first, got age %v", age)
+	}
+	atomic.AddUint64(&hashRequests, 1)
+	defer atomic.AddUint64(&hashRequests, ^uint64(0))
+
+	if cached, age := sc.get(t0.Add(500 * time.Millisecond)); first.Stats.Total != cached.Stats.Total || 500*time.Millisecond != age {
+		t.Errorf("Expected the cached figures within the max age, got %d aged %v", cached.Stats.Total, age)
+	}
+	// Stale figures are still served, without waiting, while they refresh.
+	if stale, _ := sc.get(t0.Add(1500 * time.Millisecond)); first.Stats.Total != stale.Stats.Total {
+		t.Errorf("Expected the stale figures served during the refresh, got %d", stale.Stats.Total)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		sc.mu.Lock()
+		refreshing := sc.refreshing
+		sc.mu.Unlock()
+		if !refreshing {
+			break
+		}
+	}
+	if refreshed, _ := sc.get(time.Now()); first.Stats.Total+1 != refreshed.Stats.Total {
+		t.Errorf("Expected refreshed figures, got total %d after %d", refreshed.Stats.Total, first.Stats.Total)
+	}
+
+	// Past twice the max age the figures are too old to serve, and are
+	// gathered while the poll waits.
+	atomic.AddUint64(&hashRequests, 1)
+	defer atomic.AddUint64(&hashRequests, ^uint64(0))
+	if gathered, age := sc.get(time.Now().Add(2 * time.Second)); first.Stats.Total+2 != gathered.Stats.Total || 0 != age {
+		t.Errorf("Expected figures gathered past the hard bound, got total %d aged %v after %d", gathered.Stats.Total, age, first.Stats.Total)
+	}
+}
+
+func TestTimingClockSteps(t *testing.T) {
+	// A clock stepped back between two wall clock readings gives a negative
+	// duration, which must not wrap round into an enormous sample.
+	for _, c := range []struct {
+		d    time.Duration
+		want uint64
+	}{
+		{-time.Hour, 0},
+		{0, 0},
+		{1500 * time.Microsecond, 1500},
+		{400 * time.Hour, uint64(maxTimingSample.Microseconds())},
+	} {
+		if got := timingMicros(c.d); c.want != got {
+			t.Errorf("%v: expected %d us, got %d", c.d, c.want, got)
+		}
+	}
+
+	acc := uint64(math.MaxUint64 - 10)
+	addTiming(&acc, 100)
+	if math.MaxUint64 != acc {
+		t.Errorf("Expected the accumulator held at its largest, got %d", acc)
+	}
+	var h latencyHistogram
+	h.record(math.MaxUint64 - 1)
+	h.record(2)
+	if math.MaxUint64 != h.sum {
+		t.Errorf("Expected the histogram sum held at its largest, got %d", h.sum)
+	}
+
+	// Slots count from process start on the monotonic clock; ones before
+	// it, as a test's backdated samples are, still fall in their windows.
+	var rec endpointRecorder
+	before := statsClockStart.Add(-15 * time.Second)
+	rec.record(before, 100)
+	rec.record(statsClockStart.Add(-5*time.Second), 200)
+	if epoch := slotEpoch(before); -2 != epoch {
+		t.Errorf("Expected slot -2 for 15s before the start, got %d", epoch)
+	}
+	if snap := rec.snapshot(statsClockStart); 2 != snap.Windows["1m"].Count {
+		t.Errorf("Expected both samples in the 1m window, got %+v", snap.Windows["1m"])
+	}
+}
+
+func TestStatsUnits(t *testing.T) {
+	defer withSavedConfig(t)()
+
+	ls := latencySummary{Count: 3, Min: 400, Max: 2600, Mean: 1500, P50: 1499, P95: 2500, P99: 2600}
+	micro := statsResult{
+		Average:   1500,
+		Units:     statsUnitsMicro,
+		Latency:   endpointLatency{Lifetime: ls, Windows: map[string]latencySummary{"1m": ls}},
+		Endpoints: map[string]endpointLatency{endpointHashGet: {Lifetime: ls, Windows: map[string]latencySummary{}}},
+		Canaries:  []canaryStats{{Algorithm: "pbkdf2-sha512", Primary: ls, Candidate: ls}},
+	}
+	milli := micro.inUnits(statsUnitsMilli)
+	want := latencySummary{Count: 3, Min: 0, Max: 3, Mean: 2, P50: 1, P95: 3, P99: 3}
+	if statsUnitsMilli != milli.Units || 2 != milli.Average || want != milli.Latency.Windows["1m"] || want != milli.Endpoints[endpointHashGet].Lifetime {
+		t.Errorf("Expected figures rounded to milliseconds, got %+v", milli)
+	}
+	if 1 != len(milli.Canaries) || want != milli.Canaries[0].Primary || want != milli.Canaries[0].Candidate {
+		t.Errorf("Expected the tenant's canary rounded to milliseconds, got %+v", milli.Canaries)
+	}
+	if ls != micro.Latency.Windows["1m"] || ls != micro.Endpoints[endpointHashGet].Lifetime || ls != micro.Canaries[0].Primary {
+		t.Errorf("Expected the microsecond figures left alone, got %+v", micro)
+	}
+
+	statsUnits = statsUnitsMilli
+	for _, c := range []struct {
+		query, units string
+		status       int
+	}{{"", statsUnitsMilli, 200}, {"?units=us", statsUnitsMicro, 200}, {"?units=s", "", 400}} {
+		rec := httptest.NewRecorder()
+		statsHandler(rec, httptest.NewRequest("GET", "/stats"+c.query, nil))
+		var got statsResult
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		if c.status != rec.Code || c.units != got.Units {
+			t.Errorf("%q: expected %d in %q, got %d: %s", c.query, c.status, c.units, rec.Code, rec.Body)
+		}
+	}
+
+	statsUnits = "ns"
+	if err := validateStatsUnitsConfig(); err == nil {
+		t.Errorf("Expected units other than us and ms refused")
+	}
+}
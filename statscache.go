@@ -0,0 +1,73 @@
+// Cached figures for the stats endpoint.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Oldest figures /stats serves without refreshing them.  Older ones are
+// still served while a refresh runs in the background, so a monitoring
+// poll never waits on gathering them, nor contends with the workers for
+// the latency locks more than once a period.  Gathered on every request if
+// zero.
+var statsMaxAge time.Duration = time.Second
+
+// Multiple of statsMaxAge past which cached figures are too old to serve
+// at all, say when a refresh is stuck on a slow store, and a poll gathers
+// its own.
+const statsHardAgeFactor = 2
+
+// statsCache keeps the last snapshot taken.
+type statsCache struct {
+	mu         sync.Mutex
+	snap       serviceSnapshot
+	refreshing bool
+}
+
+var servedStats statsCache
+
+// get returns the cached snapshot and its age, starting a refresh when
+// it's stale.  Only a call with nothing cached, or with figures past the
+// hard bound, waits for one.
+func (sc *statsCache) get(now time.Time) (serviceSnapshot, time.Duration) {
+	if statsMaxAge == 0 {
+		return takeSnapshot(now), 0
+	}
+	sc.mu.Lock()
+	if sc.snap.Taken.IsZero() || now.Sub(sc.snap.Taken) >= statsHardAgeFactor*statsMaxAge {
+		sc.mu.Unlock()
+		fresh := takeSnapshot(now)
+		sc.mu.Lock()
+		if fresh.Taken.After(sc.snap.Taken) {
+			sc.snap = fresh
+		}
+	}
+	snap, age := sc.snap, now.Sub(sc.snap.Taken)
+	if age >= statsMaxAge && !sc.refreshing {
+		sc.refreshing = true
+		go sc.refresh()
+	}
+	sc.mu.Unlock()
+	return snap, age
+}
+
+func (sc *statsCache) refresh() {
+	fresh := takeSnapshot(time.Now())
+	sc.mu.Lock()
+	if fresh.Taken.After(sc.snap.Taken) {
+		sc.snap = fresh
+	}
+	sc.refreshing = false
+	sc.mu.Unlock()
+}
+
+// validateStatsCacheConfig checks the stats cache settings.
+func validateStatsCacheConfig() error {
+	if statsMaxAge < 0 {
+		return fmt.Errorf("stats-max-age %v must not be negative", statsMaxAge)
+	}
+	return nil
+}
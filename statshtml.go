@@ -0,0 +1,118 @@
+// HTML rendering of the stats endpoint.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the stats page reloads itself unless "refresh" says otherwise,
+// and the fastest it may.
+const (
+	statsRefreshDefault = 5 * time.Second
+	statsRefreshMin     = 1 * time.Second
+)
+
+// Values the stats page template is executed with.
+type statsPage struct {
+	Stats          statsResult
+	RefreshSeconds int
+	GeneratedAt    time.Time
+}
+
+var statsTemplate = template.Must(template.New("stats").Funcs(template.FuncMap{"rowsOf": rowsOf, "unitsName": unitsName}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if .RefreshSeconds}}<meta http-equiv="refresh" content="{{.RefreshSeconds}}">{{end}}
+<title>jmpc stats - {{.Stats.Node}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>Node {{.Stats.Node}}</h1>
+<p>{{.Stats.Total}} hash requests, averaging {{.Stats.Average}} {{unitsName .Stats.Units}} of handling each.
+Hashing lately takes {{.Stats.Processing.EWMA}} &plusmn; {{.Stats.Processing.StdDev}} {{unitsName .Stats.Units}}.
+{{with .Stats.RateLimit}}Rate limiter: {{.Allowed}} allowed, {{.Limited}} limited, {{.Clients}} clients.{{end}}</p>
+
+<h2>Latency, {{unitsName .Stats.Units}}</h2>
+<table>
+<tr><th>Endpoint</th><th>Period</th><th>Count</th><th>Min</th><th>Mean</th><th>p50</th><th>p95</th><th>p99</th><th>Max</th></tr>
+{{template "rows" (rowsOf "all" .Stats.Latency)}}
+{{range $name, $latency := .Stats.Endpoints}}{{template "rows" (rowsOf $name $latency)}}{{end}}
+</table>
+
+<p class="muted">Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}{{if .RefreshSeconds}}, refreshing every {{.RefreshSeconds}}s{{end}}.
+The same figures are served as JSON to clients that don't ask for HTML.</p>
+</body>
+</html>
+{{define "rows"}}{{$name := .Name}}{{range .Periods}}<tr><td>{{$name}}</td><td>{{.Period}}</td><td>{{.Summary.Count}}</td><td>{{.Summary.Min}}</td><td>{{.Summary.Mean}}</td><td>{{.Summary.P50}}</td><td>{{.Summary.P95}}</td><td>{{.Summary.P99}}</td><td>{{.Summary.Max}}</td></tr>
+{{end}}{{end}}`))
+
+// Table rows for one endpoint: lifetime first, then each window.
+type latencyRows struct {
+	Name    string
+	Periods []latencyPeriod
+}
+
+type latencyPeriod struct {
+	Period  string
+	Summary latencySummary
+}
+
+// sortedWindows lists the rolling windows, shortest first.
+func sortedWindows() []string {
+	names := make([]string, 0, len(statsWindows))
+	for name := range statsWindows {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return statsWindows[names[i]] < statsWindows[names[j]] })
+	return names
+}
+
+func rowsOf(name string, latency endpointLatency) latencyRows {
+	rows := latencyRows{Name: name, Periods: []latencyPeriod{{"lifetime", latency.Lifetime}}}
+	for _, window := range sortedWindows() {
+		rows.Periods = append(rows.Periods, latencyPeriod{window, latency.Windows[window]})
+	}
+	return rows
+}
+
+// wantsHTML reports whether the client, most likely a browser, asked for
+// HTML.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// writeStatsHTML renders the stats page.  "refresh" sets the reload
+// interval in seconds, 0 to turn it off.
+func writeStatsHTML(w http.ResponseWriter, r *http.Request, stats statsResult) {
+	refresh := statsRefreshDefault
+	if refreshStr := r.URL.Query().Get("refresh"); len(refreshStr) > 0 {
+		seconds, err := strconv.Atoi(refreshStr)
+		if err != nil || seconds < 0 {
+			writeError(w, r, "Field 'refresh' must be a number of seconds.", http.StatusBadRequest)
+			return
+		}
+		refresh = time.Duration(seconds) * time.Second
+		if refresh > 0 && refresh < statsRefreshMin {
+			refresh = statsRefreshMin
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := statsPage{Stats: stats, RefreshSeconds: int(refresh.Seconds()), GeneratedAt: time.Now()}
+	if err := statsTemplate.Execute(w, page); err != nil {
+		logError("Stats page failed to render", "request_id", requestID(r), "error", err)
+	}
+}
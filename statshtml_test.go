@@ -0,0 +1,50 @@
+// Unit Tests for the HTML stats view.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getStats(accept, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/stats"+query, nil)
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	statsHandler(rec, req)
+	return rec
+}
+
+func TestStatsHTML(t *testing.T) {
+	recordLatency(endpointHashGet, 1500)
+
+	rec := getStats("text/html,application/xhtml+xml,*/*;q=0.8", "")
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML page, got %s", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"Node " + nodeID, `content="5"`, "<td>hash_get</td><td>lifetime</td>", "<td>all</td><td>1m</td>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the page to contain %q", want)
+		}
+	}
+	if strings.Index(body, "<td>1m</td>") > strings.Index(body, "<td>5m</td>") {
+		t.Errorf("Expected windows listed shortest first")
+	}
+
+	if rec = getStats("text/html", "?refresh=0"); strings.Contains(rec.Body.String(), "http-equiv") {
+		t.Errorf("Expected no auto-refresh with refresh=0")
+	}
+	if rec = getStats("text/html", "?refresh=soon"); http.StatusBadRequest != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusBadRequest, rec.Code)
+	}
+
+	// API clients still get JSON.
+	if rec = getStats("", ""); "application/json" != rec.Header().Get("Content-Type") {
+		t.Errorf("Expected JSON by default, got %s", rec.Header().Get("Content-Type"))
+	}
+}
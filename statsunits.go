@@ -0,0 +1,102 @@
+// Units of the timing figures the stats endpoint reports.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Timing units /stats can report in.  Figures are kept in microseconds;
+// milliseconds are rounded to the nearest whole one, so the figures stay
+// integers whichever is asked for.
+const (
+	statsUnitsMicro = "us"
+	statsUnitsMilli = "ms"
+)
+
+// Units /stats reports timings in unless "units" says otherwise.
+var statsUnits string = statsUnitsMicro
+
+// validStatsUnits reports whether units is one /stats can report in.
+func validStatsUnits(units string) bool {
+	return units == statsUnitsMicro || units == statsUnitsMilli
+}
+
+// validateStatsUnitsConfig checks the default stats units.
+func validateStatsUnitsConfig() error {
+	if !validStatsUnits(statsUnits) {
+		return fmt.Errorf("stats-units %q must be us or ms", statsUnits)
+	}
+	return nil
+}
+
+// requestStatsUnits gives the units a stats request asked for with "units",
+// or the configured ones.
+func requestStatsUnits(r *http.Request) (string, error) {
+	units := r.URL.Query().Get("units")
+	if len(units) == 0 {
+		return statsUnits, nil
+	}
+	if !validStatsUnits(units) {
+		return "", fmt.Errorf("Field 'units' must be us or ms.")
+	}
+	return units, nil
+}
+
+// unitsName gives units as a reader would write them.
+func unitsName(units string) string {
+	if units == statsUnitsMilli {
+		return "ms"
+	}
+	return "µs"
+}
+
+// inUnits gives the figures with their timings in the units given.  The
+// figures may be shared, cached for other requests, so nothing they hold is
+// changed in place.
+func (sr statsResult) inUnits(units string) statsResult {
+	if units == sr.Units {
+		return sr
+	}
+	convert := func(us uint64) uint64 { return (us + 500) / 1000 }
+	summary := func(ls latencySummary) latencySummary {
+		ls.Min, ls.Max, ls.Mean = convert(ls.Min), convert(ls.Max), convert(ls.Mean)
+		ls.P50, ls.P95, ls.P99 = convert(ls.P50), convert(ls.P95), convert(ls.P99)
+		return ls
+	}
+	latency := func(el endpointLatency) endpointLatency {
+		windows := make(map[string]latencySummary, len(el.Windows))
+		for name, ls := range el.Windows {
+			windows[name] = summary(ls)
+		}
+		return endpointLatency{Lifetime: summary(el.Lifetime), Windows: windows}
+	}
+
+	sr.Units = units
+	sr.Average = convert(sr.Average)
+	sr.Processing.EWMA, sr.Processing.StdDev = convert(sr.Processing.EWMA), convert(sr.Processing.StdDev)
+	sr.Connections.OldestOpen, sr.Connections.Age = convert(sr.Connections.OldestOpen), summary(sr.Connections.Age)
+	sr.Latency = latency(sr.Latency)
+	endpoints := make(map[string]endpointLatency, len(sr.Endpoints))
+	for name, el := range sr.Endpoints {
+		endpoints[name] = latency(el)
+	}
+	sr.Endpoints = endpoints
+	canary := func(cs canaryStats) canaryStats {
+		cs.Primary, cs.Candidate = summary(cs.Primary), summary(cs.Candidate)
+		return cs
+	}
+	if sr.Canary != nil {
+		compared := canary(*sr.Canary)
+		sr.Canary = &compared
+	}
+	if sr.Canaries != nil {
+		canaries := make([]canaryStats, len(sr.Canaries))
+		for i, cs := range sr.Canaries {
+			canaries[i] = canary(cs)
+		}
+		sr.Canaries = canaries
+	}
+	return sr
+}
@@ -0,0 +1,148 @@
+// Result storage and ID allocation for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Which store results and IDs live in: "memory" for this process only, or
+// "redis" to share them between replicas behind a load balancer.
+var storeBackend string = "memory"
+
+// hashStore hands out request IDs and keeps results.  Whatever the backend,
+// hashRequests and resultMapCount count this process's own share of the
+// work, which is what shutdown waits on.
+//
+// Results live in their tenant's namespace: every load names the tenant as
+// well as the ID, so one tenant can't read another's results by guessing
+// IDs, whichever path the lookup comes by.
+type hashStore interface {
+	// nextID allocates a request ID.
+	nextID() (uint64, error)
+	// lastID is the highest ID allocated so far, by any replica.
+	lastID() uint64
+	load(rk resultKey) (hashResult, bool)
+	save(rk resultKey, hRes hashResult) error
+	// remove drops a result, and with it the record of who its ID was
+	// issued to, reporting whether there was one.
+	remove(rk resultKey) (bool, error)
+	// setOwner records which tenant an ID was issued to, and owner looks
+	// it up, "" if none did.  IDs are shared by every tenant, so scans
+	// over them, e.g. listings, use this to find each result's namespace.
+	setOwner(idNum uint64, tenant string) error
+	owner(idNum uint64) string
+	// forgetOwner drops the record of who an ID was issued to, for one
+	// that will never have a result.
+	forgetOwner(idNum uint64) error
+	// totals counts IDs allocated and results saved by every replica.
+	totals() (requests, completed uint64)
+}
+
+// resultKey names a result: the tenant it belongs to, "" for requests
+// made without authenticating, and its ID.
+type resultKey struct {
+	tenant string
+	id     uint64
+}
+
+// storeKey is where a result lives in a shared store.  Results with no
+// tenant keep the keys they had before results were namespaced.
+func (rk resultKey) storeKey() string {
+	if len(rk.tenant) == 0 {
+		return fmt.Sprintf("result:%d", rk.id)
+	}
+	return fmt.Sprintf("tenant:%s:result:%d", rk.tenant, rk.id)
+}
+
+// ownedKey is the key of idNum's result, in its owner's namespace.
+func ownedKey(idNum uint64) resultKey {
+	return resultKey{store.owner(idNum), idNum}
+}
+
+// The store in service.
+var store hashStore = memoryStore{}
+
+// memoryStore keeps everything in this process.
+type memoryStore struct{}
+
+func (memoryStore) nextID() (uint64, error) {
+	return atomic.AddUint64(&hashRequests, 1), nil
+}
+
+func (memoryStore) lastID() uint64 {
+	return atomic.LoadUint64(&hashRequests)
+}
+
+func (memoryStore) load(rk resultKey) (hashResult, bool) {
+	rec, recFound := resultMap.Load(rk)
+	if !recFound {
+		return hashResult{}, false
+	}
+	if pr, packed := rec.(packedResult); packed {
+		return pr.unpack(), true
+	}
+	return rec.(hashResult), true
+}
+
+func (memoryStore) save(rk resultKey, hRes hashResult) error {
+	if _, replaced := resultMap.Swap(rk, heldResult(hRes, memoryDigests)); !replaced {
+		atomic.AddInt64(&storedResults, 1)
+	}
+	return nil
+}
+
+func (memoryStore) remove(rk resultKey) (bool, error) {
+	_, found := resultMap.LoadAndDelete(rk)
+	if found {
+		atomic.AddInt64(&storedResults, -1)
+		ownerMap.Delete(rk.id)
+	}
+	return found, nil
+}
+
+func (memoryStore) setOwner(idNum uint64, tenant string) error {
+	if len(tenant) > 0 {
+		ownerMap.Store(idNum, tenant)
+	}
+	return nil
+}
+
+func (memoryStore) owner(idNum uint64) string {
+	if tenant, found := ownerMap.Load(idNum); found {
+		return tenant.(string)
+	}
+	return ""
+}
+
+func (memoryStore) forgetOwner(idNum uint64) error {
+	ownerMap.Delete(idNum)
+	return nil
+}
+
+func (memoryStore) totals() (uint64, uint64) {
+	return atomic.LoadUint64(&hashRequests), atomic.LoadUint64(&resultMapCount)
+}
+
+// validateStoreConfig picks the backend.
+func validateStoreConfig() error {
+	switch storeBackend {
+	case "memory":
+		store = memoryStore{}
+	case "redis":
+		if err := validateRedisConfig(); err != nil {
+			return err
+		}
+		if err := validateStoreCacheConfig(); err != nil {
+			return err
+		}
+		if err := validateCodecConfig(); err != nil {
+			return err
+		}
+		store = newRedisStore(newRedisClient(redisAddr, redisPassword, redisDB))
+	default:
+		return fmt.Errorf("store %q must be memory or redis", storeBackend)
+	}
+	return nil
+}
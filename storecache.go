@@ -0,0 +1,306 @@
+// Read-through cache in front of the shared store.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Results fetched from a shared store kept in this process, 0 for none,
+// and how long each is trusted before it is fetched again.
+var storeCacheSize int = 10000
+var storeCacheTTL time.Duration = 5 * time.Minute
+
+// How long an ID found missing from a shared store is taken as still
+// missing, 0 to always ask.  Kept short, since the result may be saved by
+// another replica at any moment.
+var storeMissTTL time.Duration = time.Second
+
+// Misses remembered at most; the set is emptied when it fills.
+const storeMissMax = 100000
+
+// ID owners remembered at most; likewise emptied when full.
+const storeOwnerMax = 100000
+
+// resultCache is a bounded LRU of results fetched from the shared store,
+// so pollers of a hot result don't each cost a round trip.
+//
+// A result removed through another replica is only dropped here once word
+// of it arrives, so the cache is only live, serving and taking results,
+// while removals are being followed; it starts out and falls back to not
+// live, and empty, whenever they aren't.  Each drop bumps a generation, so
+// a fetch that raced a removal isn't cached after it.
+type resultCache struct {
+	size int
+	ttl  time.Duration
+
+	mu         sync.Mutex
+	order      *list.List // Most recently used at the front.
+	entries    map[resultKey]*list.Element
+	live       bool
+	generation uint64
+	// Closed once live, for those waiting on it.
+	liveNow chan struct{}
+}
+
+type cachedResult struct {
+	rk      resultKey
+	hRes    hashResult
+	expires time.Time
+}
+
+// newResultCache returns nil, which caches nothing, for size 0.
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	if size == 0 {
+		return nil
+	}
+	return &resultCache{size: size, ttl: ttl, order: list.New(), entries: map[resultKey]*list.Element{},
+		liveNow: make(chan struct{})}
+}
+
+func (rc *resultCache) get(rk resultKey, now time.Time) (hashResult, bool) {
+	if rc == nil {
+		return hashResult{}, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if !rc.live {
+		return hashResult{}, false
+	}
+	el, found := rc.entries[rk]
+	if !found {
+		return hashResult{}, false
+	}
+	entry := el.Value.(*cachedResult)
+	if !now.Before(entry.expires) {
+		rc.order.Remove(el)
+		delete(rc.entries, rk)
+		return hashResult{}, false
+	}
+	rc.order.MoveToFront(el)
+	return entry.hRes, true
+}
+
+// currentGeneration is taken before a fetch and handed to put, which
+// caches nothing if a removal has been heard of since.
+func (rc *resultCache) currentGeneration() uint64 {
+	if rc == nil {
+		return 0
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.generation
+}
+
+// put caches hRes, fetched as of generation asOf.
+func (rc *resultCache) put(rk resultKey, hRes hashResult, now time.Time, asOf uint64) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if !rc.live || asOf != rc.generation {
+		return
+	}
+	if el, found := rc.entries[rk]; found {
+		el.Value = &cachedResult{rk, hRes, now.Add(rc.ttl)}
+		rc.order.MoveToFront(el)
+		return
+	}
+	rc.entries[rk] = rc.order.PushFront(&cachedResult{rk, hRes, now.Add(rc.ttl)})
+	if rc.order.Len() > rc.size {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedResult).rk)
+	}
+}
+
+// invalidate drops a result, e.g. once it is removed from the store.
+func (rc *resultCache) invalidate(rk resultKey) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	rc.generation++
+	if el, found := rc.entries[rk]; found {
+		rc.order.Remove(el)
+		delete(rc.entries, rk)
+	}
+	rc.mu.Unlock()
+}
+
+// setLive empties the cache and starts or stops it serving, as removals
+// start or stop being followed.
+func (rc *resultCache) setLive(live bool) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.generation++
+	rc.order.Init()
+	rc.entries = map[resultKey]*list.Element{}
+	if live && !rc.live {
+		close(rc.liveNow)
+	} else if !live && rc.live {
+		rc.liveNow = make(chan struct{})
+	}
+	rc.live = live
+}
+
+// awaitLive waits up to timeout for the cache to be live, reporting
+// whether it is.
+func (rc *resultCache) awaitLive(timeout time.Duration) bool {
+	if rc == nil {
+		return false
+	}
+	rc.mu.Lock()
+	liveNow := rc.liveNow
+	rc.mu.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-liveNow:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// missCache remembers results recently found missing from the shared store, so
+// aggressive polling or ID scans don't each cost a round trip.
+type missCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	expires map[resultKey]time.Time
+}
+
+func newMissCache(ttl time.Duration) *missCache {
+	return &missCache{ttl: ttl, expires: map[resultKey]time.Time{}}
+}
+
+func (mc *missCache) missing(rk resultKey, now time.Time) bool {
+	if mc.ttl == 0 {
+		return false
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	expires, found := mc.expires[rk]
+	if found && !now.Before(expires) {
+		delete(mc.expires, rk)
+		return false
+	}
+	return found
+}
+
+func (mc *missCache) add(rk resultKey, now time.Time) {
+	if mc.ttl == 0 {
+		return
+	}
+	mc.mu.Lock()
+	if len(mc.expires) >= storeMissMax {
+		mc.expires = map[resultKey]time.Time{}
+	}
+	mc.expires[rk] = now.Add(mc.ttl)
+	mc.mu.Unlock()
+}
+
+// forget drops a miss once the result is known to exist.
+func (mc *missCache) forget(rk resultKey) {
+	mc.mu.Lock()
+	delete(mc.expires, rk)
+	mc.mu.Unlock()
+}
+
+// ownerCache remembers which tenant IDs were issued to, so listings don't
+// look each one up in the shared store again.
+type ownerCache struct {
+	mu   sync.Mutex
+	byID map[uint64]string
+}
+
+func newOwnerCache() *ownerCache {
+	return &ownerCache{byID: map[uint64]string{}}
+}
+
+func (oc *ownerCache) get(idNum uint64) (string, bool) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	tenant, found := oc.byID[idNum]
+	return tenant, found
+}
+
+func (oc *ownerCache) add(idNum uint64, tenant string) {
+	oc.mu.Lock()
+	if len(oc.byID) >= storeOwnerMax {
+		oc.byID = map[uint64]string{}
+	}
+	oc.byID[idNum] = tenant
+	oc.mu.Unlock()
+}
+
+// forget drops an owner once its ID's result is removed.
+func (oc *ownerCache) forget(idNum uint64) {
+	oc.mu.Lock()
+	delete(oc.byID, idNum)
+	oc.mu.Unlock()
+}
+
+// lookupGroup coalesces concurrent lookups of one result, so a crowd polling
+// for the same result costs the shared store one lookup, not one each.
+type lookupGroup struct {
+	mu       sync.Mutex
+	inFlight map[resultKey]*lookupCall
+}
+
+type lookupCall struct {
+	done  chan struct{}
+	hRes  hashResult
+	found bool
+}
+
+// do runs fetch for rk unless a fetch for it is already running, in
+// which case it waits for and shares that one's answer.
+func (g *lookupGroup) do(rk resultKey, fetch func() (hashResult, bool)) (hashResult, bool) {
+	g.mu.Lock()
+	if call, found := g.inFlight[rk]; found {
+		g.mu.Unlock()
+		<-call.done
+		return call.hRes, call.found
+	}
+	if g.inFlight == nil {
+		g.inFlight = map[resultKey]*lookupCall{}
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	g.inFlight[rk] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.inFlight, rk)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.hRes, call.found = fetch()
+	return call.hRes, call.found
+}
+
+// validateStoreCacheConfig checks the cache settings.
+func validateStoreCacheConfig() error {
+	if storeCacheSize < 0 {
+		return fmt.Errorf("store-cache-size %d must not be negative", storeCacheSize)
+	}
+	if storeCacheSize > 0 && storeCacheTTL <= 0 {
+		return fmt.Errorf("store-cache-ttl %v must be positive", storeCacheTTL)
+	}
+	if storeMissTTL < 0 {
+		return fmt.Errorf("store-miss-ttl %v must not be negative", storeMissTTL)
+	}
+	return nil
+}
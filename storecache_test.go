@@ -0,0 +1,138 @@
+// Unit Tests for the shared store's local cache.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	now := time.Now()
+	rc := newResultCache(2, time.Minute)
+	rc.put(resultKey{id: 1}, hashResult{b64Str: "one"}, now, rc.currentGeneration())
+	if _, found := rc.get(resultKey{id: 1}, now); found {
+		t.Errorf("Expected nothing cached before the cache is live")
+	}
+	rc.setLive(true)
+	rc.put(resultKey{id: 1}, hashResult{b64Str: "one"}, now, rc.currentGeneration())
+	rc.put(resultKey{id: 2}, hashResult{b64Str: "two"}, now, rc.currentGeneration())
+	rc.get(resultKey{id: 1}, now)
+	rc.put(resultKey{id: 3}, hashResult{b64Str: "three"}, now, rc.currentGeneration())
+
+	if _, found := rc.get(resultKey{id: 2}, now); found {
+		t.Errorf("Expected the least recently used result dropped")
+	}
+	if hRes, found := rc.get(resultKey{id: 1}, now); !found || "one" != hRes.b64Str {
+		t.Errorf("Expected a recently used result kept, got %v %v", hRes, found)
+	}
+	if _, found := rc.get(resultKey{id: 3}, now.Add(time.Minute)); found {
+		t.Errorf("Expected an expired result fetched again")
+	}
+	asOf := rc.currentGeneration()
+	rc.invalidate(resultKey{id: 1})
+	if _, found := rc.get(resultKey{id: 1}, now); found {
+		t.Errorf("Expected an invalidated result gone")
+	}
+	rc.put(resultKey{id: 4}, hashResult{b64Str: "four"}, now, asOf)
+	if _, found := rc.get(resultKey{id: 4}, now); found {
+		t.Errorf("Expected a result fetched before a removal was heard of not cached")
+	}
+	rc.setLive(false)
+	if _, found := rc.get(resultKey{id: 3}, now); found {
+		t.Errorf("Expected the cache emptied once no longer live")
+	}
+
+	off := newResultCache(0, time.Minute)
+	off.put(resultKey{id: 1}, hashResult{}, now, off.currentGeneration())
+	if _, found := off.get(resultKey{id: 1}, now); found {
+		t.Errorf("Expected nothing cached at size 0")
+	}
+}
+
+func TestStoreCacheConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+
+	for _, bad := range []struct {
+		size int
+		ttl  time.Duration
+	}{{-1, time.Minute}, {10, 0}} {
+		storeCacheSize, storeCacheTTL = bad.size, bad.ttl
+		if err := validateStoreCacheConfig(); err == nil {
+			t.Errorf("Expected size %d and TTL %v rejected", bad.size, bad.ttl)
+		}
+	}
+}
+
+func TestLookupCoalescing(t *testing.T) {
+	var g lookupGroup
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() (hashResult, bool) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return hashResult{b64Str: "digest"}, true
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan hashResult, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hRes, _ := g.do(resultKey{id: 7}, fetch)
+			results <- hRes
+		}()
+	}
+	// Let every poller arrive before the one fetch finishes.
+	for {
+		g.mu.Lock()
+		started := g.inFlight[resultKey{id: 7}] != nil
+		g.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for hRes := range results {
+		if "digest" != hRes.b64Str {
+			t.Errorf("Expected every poller given the fetched result, got %v", hRes)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); 1 != n {
+		t.Errorf("Expected one fetch for concurrent lookups, got %d", n)
+	}
+	if hRes, _ := g.do(resultKey{id: 7}, func() (hashResult, bool) { return hashResult{b64Str: "again"}, true }); "again" != hRes.b64Str {
+		t.Errorf("Expected a later lookup to fetch afresh")
+	}
+}
+
+func TestMissCache(t *testing.T) {
+	now := time.Now()
+	mc := newMissCache(time.Second)
+	mc.add(resultKey{id: 5}, now)
+	if !mc.missing(resultKey{id: 5}, now) || mc.missing(resultKey{id: 6}, now) {
+		t.Errorf("Expected only the recorded miss remembered")
+	}
+	if mc.missing(resultKey{id: 5}, now.Add(time.Second)) {
+		t.Errorf("Expected a miss forgotten once it expires")
+	}
+	mc.add(resultKey{id: 5}, now)
+	mc.forget(resultKey{id: 5})
+	if mc.missing(resultKey{id: 5}, now) {
+		t.Errorf("Expected a miss forgotten once the result is saved")
+	}
+
+	off := newMissCache(0)
+	off.add(resultKey{id: 5}, now)
+	if off.missing(resultKey{id: 5}, now) {
+		t.Errorf("Expected no misses remembered at TTL 0")
+	}
+}
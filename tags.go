@@ -0,0 +1,156 @@
+// Operator tags on submissions, from the X-JMPC-Tags header.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tags name the batch job or run a submission belongs to, so operators can
+// slice logs and stats by their own identifiers.  Unlike labels they come
+// in a header, so a job runner can set them once for every request it
+// makes without touching the bodies.
+const (
+	tagsHeader   = "X-JMPC-Tags"
+	tagMaxCount  = 8
+	tagMaxLength = 64
+)
+
+// Most distinct tags /stats keeps counts for.  Tags are whatever callers
+// send, so past this many they are all counted under tagOverflow instead
+// of growing the figures without bound.
+var tagStatsMax int = 100
+
+// Where tags past tagStatsMax are counted; not a valid tag, so it can't
+// collide with one.
+const tagOverflow = "(other)"
+
+// Tags of requests not yet hashed, by request ID.  Once hashed they are
+// stored with the result, as labels are, and dropped here.  A tag list is
+// never modified once set.
+var resultTags = struct {
+	sync.Mutex
+	byID map[uint64][]string
+}{byID: map[uint64][]string{}}
+
+// parseTags reads the comma separated tags of every X-JMPC-Tags header,
+// sorted with duplicates dropped, nil if there are none.  Tags use the
+// characters label keys do.
+func parseTags(h http.Header) ([]string, error) {
+	seen := map[string]bool{}
+	for _, value := range h.Values(tagsHeader) {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if len(tag) == 0 {
+				continue
+			}
+			if !validLabelKey(tag) || len(tag) > tagMaxLength {
+				return nil, fmt.Errorf("Tag %q must be letters, digits, and \"_.-/\", at most %d bytes.", tag, tagMaxLength)
+			}
+			seen[tag] = true
+		}
+	}
+	if len(seen) > tagMaxCount {
+		return nil, fmt.Errorf("At most %d tags allowed, got %d.", tagMaxCount, len(seen))
+	}
+	if len(seen) == 0 {
+		return nil, nil
+	}
+	tags := make([]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func setTags(idNum uint64, tags []string) {
+	resultTags.Lock()
+	resultTags.byID[idNum] = tags
+	resultTags.Unlock()
+}
+
+func forgetTags(idNum uint64) {
+	resultTags.Lock()
+	delete(resultTags.byID, idNum)
+	resultTags.Unlock()
+}
+
+// tagsOf is the tags of a request not yet hashed.
+func tagsOf(idNum uint64) []string {
+	resultTags.Lock()
+	defer resultTags.Unlock()
+	return resultTags.byID[idNum]
+}
+
+// Public: what became of the requests carrying one tag.
+type tagCounts struct {
+	Submitted uint64 `json:"submitted"`
+	Completed uint64 `json:"completed"`
+	Failed    uint64 `json:"failed"`
+}
+
+// tagRecorder counts requests by tag, up to tagStatsMax tags.
+type tagRecorder struct {
+	mu     sync.Mutex
+	counts map[string]*tagCounts
+}
+
+var tagStats tagRecorder
+
+// attach counts every tagged request from here on through the job hooks.
+func (tr *tagRecorder) attach() {
+	onSubmit(func(ev jobEvent) { tr.count(ev.ID, func(tc *tagCounts) { tc.Submitted++ }) })
+	onComplete(func(ev jobEvent) { tr.count(ev.ID, func(tc *tagCounts) { tc.Completed++ }) })
+	onFail(func(ev jobEvent) { tr.count(ev.ID, func(tc *tagCounts) { tc.Failed++ }) })
+}
+
+func (tr *tagRecorder) count(idNum uint64, bump func(*tagCounts)) {
+	tags := tagsOf(idNum)
+	if len(tags) == 0 {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.counts == nil {
+		tr.counts = map[string]*tagCounts{}
+	}
+	for _, tag := range tags {
+		tc, found := tr.counts[tag]
+		if !found && len(tr.counts) >= tagStatsMax {
+			tag = tagOverflow
+			tc, found = tr.counts[tag]
+		}
+		if !found {
+			tc = &tagCounts{}
+			tr.counts[tag] = tc
+		}
+		bump(tc)
+	}
+}
+
+// snapshot copies the counts, nil if no tagged request has been seen.
+func (tr *tagRecorder) snapshot() map[string]tagCounts {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]tagCounts, len(tr.counts))
+	for tag, tc := range tr.counts {
+		counts[tag] = *tc
+	}
+	return counts
+}
+
+// validateTagConfig checks the tag settings.
+func validateTagConfig() error {
+	if tagStatsMax < 1 {
+		return fmt.Errorf("tag-stats-max %d must be at least 1", tagStatsMax)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Unit Tests for operator tags.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	h := http.Header{}
+	h.Add(tagsHeader, "nightly-7, billing")
+	h.Add(tagsHeader, "billing,,run/42")
+	tags, err := parseTags(h)
+	if err != nil || "billing nightly-7 run/42" != strings.Join(tags, " ") {
+		t.Errorf("Expected the tags sorted and deduplicated, got %v %v", tags, err)
+	}
+
+	if tags, err := parseTags(http.Header{}); tags != nil || err != nil {
+		t.Errorf("Expected no tags, got %v %v", tags, err)
+	}
+
+	tooMany := make([]string, tagMaxCount+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("t%d", i)
+	}
+	for _, value := range []string{"bad tag", "a=b", strings.Repeat("x", tagMaxLength+1), strings.Join(tooMany, ",")} {
+		h := http.Header{}
+		h.Set(tagsHeader, value)
+		if _, err := parseTags(h); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestTagStatsBounded(t *testing.T) {
+	defer withSavedConfig(t)()
+	tagStatsMax = 2
+	var tr tagRecorder
+	for i, tag := range []string{"a", "b", "c", "d", "a"} {
+		idNum := uint64(1<<41 + i)
+		setTags(idNum, []string{tag})
+		defer setTags(idNum, nil)
+		tr.count(idNum, func(tc *tagCounts) { tc.Submitted++ })
+	}
+	tr.count(1<<41, func(tc *tagCounts) { tc.Completed++ })
+
+	counts := tr.snapshot()
+	if 3 != len(counts) || (tagCounts{2, 1, 0}) != counts["a"] || 1 != counts["b"].Submitted || 2 != counts[tagOverflow].Submitted {
+		t.Errorf("Expected a and b counted and the rest as %s, got %v", tagOverflow, counts)
+	}
+}
+
+func TestTaggedSubmission(t *testing.T) {
+	post := func(tags string) (int, string) {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/hash", strings.NewReader(url.Values{"password": {"tagged"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(tagsHeader, tags)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := post("bad tag"); 400 != status {
+		t.Errorf("Expected a bad tag refused with 400, got %d", status)
+	}
+	status, idStr := post("tagged-submission-test")
+	if 200 != status {
+		t.Fatalf("Expected 200, got %d: %s", status, idStr)
+	}
+
+	resp, err := http.Get("http://localhost:8080/hash/" + idStr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var js jobStatus
+	json.NewDecoder(resp.Body).Decode(&js)
+	resp.Body.Close()
+	if 1 != len(js.Tags) || "tagged-submission-test" != js.Tags[0] {
+		t.Errorf("Expected the tag stored with the request, got %+v", js)
+	}
+
+	counts := currentStats().Tags["tagged-submission-test"]
+	if 1 != counts.Submitted {
+		t.Errorf("Expected the submission counted under its tag, got %+v", counts)
+	}
+}
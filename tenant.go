@@ -0,0 +1,154 @@
+// Per-tenant settings for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comma separated tenant:setting=value entries overriding the global
+// setting of that name for one tenant, i.e. one authenticated caller name,
+// e.g. "batch-team:hash-delay=30s,batch-team:rate-limit=50".
+var tenantOverrideList string
+
+// Settings resolved for one request.
+type tenantSettings struct {
+	hashDelay       time.Duration
+	rateLimit       float64
+	rateBurst       int
+	resultTTL       time.Duration
+	canaryAlgorithm string
+	canaryPercent   float64
+}
+
+// Parsed tenantOverrideList: the setters a tenant's values are applied with.
+var tenantOverrides = map[string][]func(*tenantSettings){}
+
+// parseTenantOverride turns one setting=value into a setter.  These are
+// the settings a tenant may override.
+func parseTenantOverride(setting, value string) (func(*tenantSettings), error) {
+	switch setting {
+	case "hash-delay":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("hash-delay %q must be a duration", value)
+		}
+		return func(ts *tenantSettings) { ts.hashDelay = d }, nil
+	case "rate-limit":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("rate-limit %q must be a rate, 0 for none", value)
+		}
+		return func(ts *tenantSettings) { ts.rateLimit = rate }, nil
+	case "rate-burst":
+		burst, err := strconv.Atoi(value)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("rate-burst %q must be at least 1", value)
+		}
+		return func(ts *tenantSettings) { ts.rateBurst = burst }, nil
+	case "result-ttl":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("result-ttl %q must be a duration, 0 for good", value)
+		}
+		return func(ts *tenantSettings) { ts.resultTTL = d }, nil
+	case "canary-algorithm":
+		if _, found := canaryAlgorithms[value]; !found && len(value) > 0 {
+			return nil, fmt.Errorf("canary-algorithm %q must be sha256, sha3-512, pbkdf2-sha512 or empty for none", value)
+		}
+		return func(ts *tenantSettings) { ts.canaryAlgorithm = value }, nil
+	case "canary-percent":
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("canary-percent %q must be above 0 and at most 100", value)
+		}
+		return func(ts *tenantSettings) { ts.canaryPercent = percent }, nil
+	}
+	return nil, fmt.Errorf("%s cannot be set per tenant", setting)
+}
+
+// settingsFor resolves the settings for a tenant, "" for none: the global
+// ones with the tenant's overrides on top.
+func settingsFor(tenant string) tenantSettings {
+	ts := tenantSettings{hashDelay: hashDelay, rateLimit: rateLimit, rateBurst: rateBurst,
+		resultTTL: resultTTL, canaryAlgorithm: canaryAlgorithm, canaryPercent: canaryPercent}
+	ts.override(tenant)
+	return ts
+}
+
+// override applies a tenant's overrides.
+func (ts *tenantSettings) override(tenant string) {
+	for _, set := range tenantOverrides[tenant] {
+		set(ts)
+	}
+}
+
+// requestTenant names the tenant a request is from, "" if unauthenticated.
+func requestTenant(r *http.Request) string {
+	if key, ok := authIdentity(r); ok {
+		return key.name
+	}
+	return ""
+}
+
+// maxHashDelay is the longest delay any tenant's work may have.
+func maxHashDelay() time.Duration {
+	longest := hashDelay
+	for tenant := range tenantOverrides {
+		if d := settingsFor(tenant).hashDelay; d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// anyRateLimit reports whether any tenant, or everyone, is rate limited.
+func anyRateLimit() bool {
+	if rateLimit > 0 {
+		return true
+	}
+	for tenant := range tenantOverrides {
+		if settingsFor(tenant).rateLimit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// shortestResultTTL is the shortest time any tenant's results are kept,
+// 0 if everyone's are kept for good.
+func shortestResultTTL() time.Duration {
+	shortest := resultTTL
+	for tenant := range tenantOverrides {
+		if d := settingsFor(tenant).resultTTL; d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+// validateTenantConfig parses the overrides.
+func validateTenantConfig() error {
+	overrides := map[string][]func(*tenantSettings){}
+	for _, entry := range strings.Split(tenantOverrideList, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		tenant, assignment, found := strings.Cut(entry, ":")
+		setting, value, assigned := strings.Cut(assignment, "=")
+		if !found || !assigned || len(tenant) == 0 {
+			return fmt.Errorf("tenant-overrides: entry %q must be tenant:setting=value", entry)
+		}
+		set, err := parseTenantOverride(strings.TrimSpace(setting), strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("tenant-overrides: %s: %v", tenant, err)
+		}
+		overrides[tenant] = append(overrides[tenant], set)
+	}
+	tenantOverrides = overrides
+	return nil
+}
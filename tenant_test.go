@@ -0,0 +1,78 @@
+// Unit Tests for per-tenant settings.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTenantOverrides(t *testing.T) {
+	defer validateTenantConfig()
+	defer withSavedConfig(t)()
+
+	tenantOverrideList = "batch:hash-delay=30s, batch:rate-limit=50, interactive:hash-delay=100ms, " +
+		"batch:result-ttl=1h, interactive:result-ttl=10m, batch:canary-algorithm=sha3-512, batch:canary-percent=5"
+	if err := validateTenantConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts := settingsFor("batch"); 30*time.Second != ts.hashDelay || 50 != ts.rateLimit || rateBurst != ts.rateBurst {
+		t.Errorf("Unexpected batch settings %+v", ts)
+	}
+	if ts := settingsFor("batch"); time.Hour != ts.resultTTL || "sha3-512" != ts.canaryAlgorithm || 5 != ts.canaryPercent {
+		t.Errorf("Unexpected batch retention and canary settings %+v", ts)
+	}
+	if ts := settingsFor("someone-else"); hashDelay != ts.hashDelay || rateLimit != ts.rateLimit || resultTTL != ts.resultTTL {
+		t.Errorf("Expected the global settings for a tenant without overrides, got %+v", ts)
+	}
+	if d := maxHashDelay(); 30*time.Second != d {
+		t.Errorf("Expected the longest tenant delay, got %v", d)
+	}
+	if !anyRateLimit() {
+		t.Errorf("Expected a tenant rate limit to need the limiter")
+	}
+	if d := shortestResultTTL(); 10*time.Minute != d {
+		t.Errorf("Expected the shortest tenant result-ttl, got %v", d)
+	}
+
+	for _, bad := range []string{"batch", "batch:hash-delay", ":rate-limit=5", "batch:workers=4", "batch:rate-burst=0",
+		"batch:result-ttl=-1h", "batch:canary-algorithm=md5", "batch:canary-percent=0"} {
+		tenantOverrideList = bad
+		if err := validateTenantConfig(); err == nil {
+			t.Errorf("Expected %q rejected", bad)
+		}
+	}
+}
+
+func TestTenantRateLimit(t *testing.T) {
+	defer validateTenantConfig()
+	defer withSavedConfig(t)()
+
+	// Only the "scraper" tenant is limited.
+	tenantOverrideList = "scraper:rate-limit=0.1,scraper:rate-burst=1"
+	validateTenantConfig()
+	h := withRateLimit(newRateLimiter(0, rateBurst), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	submit := func(tenant string) int {
+		req := httptest.NewRequest("POST", "/hash", nil)
+		req = req.WithContext(context.WithValue(req.Context(), authIdentityKey, apiKey{name: tenant}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := submit("free"); http.StatusOK != code {
+			t.Errorf("Expected an unlimited tenant let through, got StatusCode [%d]", code)
+		}
+	}
+	if code := submit("scraper"); http.StatusOK != code {
+		t.Errorf("Expected the first scraper submission let through, got StatusCode [%d]", code)
+	}
+	if code := submit("scraper"); http.StatusTooManyRequests != code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusTooManyRequests, code)
+	}
+}
@@ -0,0 +1,94 @@
+// Per-endpoint time budgets for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Longest a submission, a result lookup, and an admin call may take.  None
+// if zero.  They're context deadlines, so a handler stops at the next point
+// it waits on the request's context, e.g. a wait=true submission, a store
+// lookup, or an export or store scan between records, and answers or ends
+// as it would for a client gone away.
+var hashSubmitTimeout time.Duration
+var hashGetTimeout time.Duration
+var adminTimeout time.Duration
+
+// timeoutBudget picks the budget for a request, zero for none.
+func timeoutBudget(r *http.Request) time.Duration {
+	switch {
+	case isAdminPath(r.URL.Path):
+		return adminTimeout
+	case r.Method == http.MethodPost && (r.URL.Path == "/hash" || r.URL.Path == "/hash/batch" || r.URL.Path == grpcSubmitPath):
+		return hashSubmitTimeout
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/hash/"), r.URL.Path == "/hash/lookup", r.URL.Path == grpcGetPath:
+		return hashGetTimeout
+	}
+	return 0
+}
+
+// withTimeouts puts each request's budget on its context.
+func withTimeouts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget := timeoutBudget(r)
+		if budget <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// loadBefore looks rk up in the store, giving up with ctx's error once ctx
+// is done, so a stalled store can't hold a request past its budget.  A
+// lookup given up on carries on, bounded by the store's own timeouts.
+// Memory lookups never stall, so only remote ones are raced against ctx.
+func loadBefore(ctx context.Context, rk resultKey) (hashResult, bool, error) {
+	if _, local := store.(memoryStore); local || ctx.Done() == nil {
+		hRes, found := store.load(rk)
+		return hRes, found, nil
+	}
+	type loaded struct {
+		hRes  hashResult
+		found bool
+	}
+	st := store
+	done := make(chan loaded, 1)
+	go func() {
+		hRes, found := st.load(rk)
+		done <- loaded{hRes, found}
+	}()
+	select {
+	case l := <-done:
+		return l.hRes, l.found, nil
+	case <-ctx.Done():
+		return hashResult{}, false, ctx.Err()
+	}
+}
+
+// writeBudgetSpent answers a request whose budget ran out waiting on the
+// store.
+func writeBudgetSpent(w http.ResponseWriter, r *http.Request) {
+	writeCodedError(w, r, codeTimeout, "The request ran past its time budget, try again later.", http.StatusServiceUnavailable)
+}
+
+// validateTimeoutConfig checks the budgets.
+func validateTimeoutConfig() error {
+	for name, budget := range map[string]time.Duration{
+		"hash-submit-timeout": hashSubmitTimeout,
+		"hash-get-timeout":    hashGetTimeout,
+		"admin-timeout":       adminTimeout,
+	} {
+		if budget < 0 {
+			return fmt.Errorf("%s %v must not be negative", name, budget)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Unit Tests for per-endpoint time budgets.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimeoutBudgets(t *testing.T) {
+	defer validateTimeoutConfig()
+	defer withSavedConfig(t)()
+	hashSubmitTimeout, hashGetTimeout, adminTimeout = time.Second, 2*time.Second, time.Minute
+
+	cases := []struct {
+		method, path string
+		budget       time.Duration
+	}{
+		{"POST", "/hash", time.Second},
+		{"POST", "/hash/batch", time.Second},
+		{"GET", "/hash/42", 2 * time.Second},
+		{"POST", grpcSubmitPath, time.Second},
+		{"POST", grpcGetPath, 2 * time.Second},
+		{"GET", "/export", time.Minute},
+		{"POST", "/admin/fsck", time.Minute},
+		{"GET", "/stats", 0},
+		{"GET", "/healthz", 0},
+	}
+	for _, c := range cases {
+		var deadline time.Time
+		var bounded bool
+		h := withTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deadline, bounded = r.Context().Deadline()
+		}))
+		start := time.Now()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, nil))
+		if bounded != (c.budget > 0) || (bounded && (deadline.Before(start.Add(c.budget)) || deadline.After(time.Now().Add(c.budget)))) {
+			t.Errorf("%s %s: expected a budget of %v, got deadline %v", c.method, c.path, c.budget, deadline)
+		}
+	}
+
+	adminTimeout = -time.Second
+	if err := validateTimeoutConfig(); err == nil {
+		t.Errorf("Expected a negative budget rejected")
+	}
+}
+
+func TestSyncSubmitBudget(t *testing.T) {
+	defer withSavedConfig(t)()
+	hashSubmitTimeout = 10 * time.Millisecond
+
+	// The submission budget cuts a wait=true submission short of the
+	// longer sync timeout.
+	var waitErr error
+	start := time.Now()
+	withTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, waitErr = waitForSyncResult(r, 1<<52)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hash?wait=true", nil))
+	if waitErr == nil || time.Now().Sub(start) > syncWaitTimeout/2 {
+		t.Errorf("Expected the wait cut short by the budget, got %v after %v", waitErr, time.Now().Sub(start))
+	}
+}
+
+// stalledStore never answers a lookup until released.
+type stalledStore struct {
+	memoryStore
+	release chan struct{}
+}
+
+func (st stalledStore) load(rk resultKey) (hashResult, bool) {
+	<-st.release
+	return hashResult{}, false
+}
+
+func TestLookupBudgetWithStalledStore(t *testing.T) {
+	defer withSavedConfig(t)()
+	hashGetTimeout = 50 * time.Millisecond
+	stalled := stalledStore{release: make(chan struct{})}
+	defer close(stalled.release)
+	savedStore := store
+	defer func() { store = savedStore }()
+	store = stalled
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/hash/42", nil),
+		httptest.NewRequest("POST", "/hash/lookup", strings.NewReader("[42]")),
+	} {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		h := hashHandler
+		if req.URL.Path == "/hash/lookup" {
+			h = lookupHandler
+		}
+		withTimeouts(http.HandlerFunc(h)).ServeHTTP(rec, req)
+		if took := time.Now().Sub(start); http.StatusServiceUnavailable != rec.Code || took > time.Second {
+			t.Errorf("%s: expected 503 within the budget, got [%d] after %v", req.URL.Path, rec.Code, took)
+		}
+		if code := rec.Header().Get("X-JMPC-Error-Code"); string(codeTimeout) != code {
+			t.Errorf("%s: expected code %s, got %q", req.URL.Path, codeTimeout, code)
+		}
+	}
+}
+
+// Memory lookups are made in place, answering even once the budget is spent.
+func TestLookupBudgetWithMemoryStore(t *testing.T) {
+	rk := resultKey{"budgeted", 1 << 50}
+	store.save(rk, hashResult{b64Str: "ZGlnZXN0"})
+	defer store.remove(rk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if hRes, found, err := loadBefore(ctx, rk); err != nil || !found || "ZGlnZXN0" != hRes.b64Str {
+		t.Errorf("Expected the stored result, got %+v %v %v", hRes, found, err)
+	}
+}
+
+func TestStoreScansStopAtBudget(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	savedStore := store
+	defer func() { store = savedStore }()
+	store = rs
+	defer atomic.AddUint64(&hashRequests, ^uint64(1-1))
+	rs.nextID()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rs.fsck(ctx, false); err != context.Canceled {
+		t.Errorf("Expected fsck to stop once its context ended, got %v", err)
+	}
+	if _, err := rs.migrate(ctx); err != context.Canceled {
+		t.Errorf("Expected migrate to stop once its context ended, got %v", err)
+	}
+}
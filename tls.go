@@ -0,0 +1,211 @@
+// TLS support for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// PEM certificate and key to serve TLS with.  Both empty means plain HTTP.
+var tlsCertFile string
+var tlsKeyFile string
+
+// How often the certificate files are checked for rotation.
+var tlsReloadInterval time.Duration = 30 * time.Second
+
+// When non-zero, a plaintext listener on this port redirects to TLS.
+var tlsRedirectPort int = 0
+
+// PEM bundle of CAs client certificates are verified against.  When set,
+// clients may authenticate with a certificate instead of a key.
+var tlsClientCAFile string
+
+// Parsed tlsClientCAFile.
+var tlsClientCAs *x509.CertPool
+
+func tlsEnabled() bool {
+	return len(tlsCertFile) > 0
+}
+
+// certReloader serves the current certificate to TLS handshakes and swaps
+// in a new one when the files on disk change, so rotation needs no restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// newestModTime reports the later of the cert and key modification times,
+// since a rotation may touch them in either order.
+func (cr *certReloader) newestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// reloadIfChanged loads the key pair if either file changed since the last
+// load.  On error the previous certificate stays in service.
+func (cr *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := cr.newestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && modTime.Equal(cr.modTime)
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// watch polls for rotated files until stop is closed.
+func (cr *certReloader) watch(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := cr.reloadIfChanged()
+			if err != nil {
+				logError("TLS certificate reload failed, keeping current one", "error", err)
+			} else if reloaded {
+				logInfo("TLS certificate reloaded", "cert_file", cr.certFile)
+			}
+		}
+	}
+}
+
+// GetCertificate hands the current certificate to tls.Config.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// tlsRedirectHandler sends plaintext clients to the same path on the TLS
+// port.
+func tlsRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	target := fmt.Sprintf("https://%s%s", net.JoinHostPort(host, fmt.Sprint(listenPort)), r.URL.RequestURI())
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
+
+// validateTLSConfig checks the TLS settings hang together.
+func validateTLSConfig() error {
+	if len(tlsCertFile) > 0 != (len(tlsKeyFile) > 0) {
+		return fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+	if tlsRedirectPort != 0 {
+		if !tlsEnabled() {
+			return fmt.Errorf("tls-redirect-port requires tls-cert and tls-key")
+		}
+		if tlsRedirectPort < 0 || tlsRedirectPort > 65535 || tlsRedirectPort == listenPort {
+			return fmt.Errorf("tls-redirect-port %d must be a free port in range 1-65535", tlsRedirectPort)
+		}
+	}
+	if tlsReloadInterval <= 0 {
+		return fmt.Errorf("tls-reload-interval %v must be positive", tlsReloadInterval)
+	}
+
+	tlsClientCAs = nil
+	if len(tlsClientCAFile) > 0 {
+		if !tlsEnabled() {
+			return fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+		}
+		pemBytes, err := os.ReadFile(tlsClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsClientCAs = x509.NewCertPool()
+		if !tlsClientCAs.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf("tls-client-ca %s holds no PEM certificates", tlsClientCAFile)
+		}
+	}
+	return nil
+}
+
+// listenAndServe runs s with TLS when configured, including the certificate
+// watcher and the optional plaintext redirect listener.
+func listenAndServe(s *http.Server) error {
+	if !tlsEnabled() {
+		return s.ListenAndServe()
+	}
+
+	reloader, err := newCertReloader(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return err
+	}
+	stopWatch := make(chan struct{})
+	go reloader.watch(tlsReloadInterval, stopWatch)
+	s.RegisterOnShutdown(func() { close(stopWatch) })
+
+	s.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	// Certificates are optional, so key and token clients still get in.
+	if tlsClientCAs != nil {
+		s.TLSConfig.ClientCAs = tlsClientCAs
+		s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if tlsRedirectPort != 0 {
+		redirect := &http.Server{
+			Addr:    fmt.Sprintf(":%d", tlsRedirectPort),
+			Handler: http.HandlerFunc(tlsRedirectHandler),
+		}
+		s.RegisterOnShutdown(func() { redirect.Close() })
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logError("TLS redirect listener failed", "error", err)
+			}
+		}()
+	}
+
+	// Certificates come from GetCertificate, which also gets HTTP/2 set up.
+	return s.ListenAndServeTLS("", "")
+}
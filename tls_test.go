@@ -0,0 +1,133 @@
+// Unit Tests for TLS certificate reloading.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a throwaway key pair with the given serial
+// number, stamping the files with modTime.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func servedSerial(t *testing.T, cr *certReloader) int64 {
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	firstTime := time.Now().Add(-time.Minute)
+
+	writeSelfSignedCert(t, certFile, keyFile, 1, firstTime)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 1 != servedSerial(t, cr) {
+		t.Errorf("Expected the first certificate to be served")
+	}
+
+	if reloaded, _ := cr.reloadIfChanged(); reloaded {
+		t.Errorf("Expected no reload while the files are unchanged")
+	}
+
+	writeSelfSignedCert(t, certFile, keyFile, 2, time.Now())
+	if reloaded, err := cr.reloadIfChanged(); !reloaded || err != nil {
+		t.Errorf("Expected a reload after rotation, got %v, %v", reloaded, err)
+	}
+	if 2 != servedSerial(t, cr) {
+		t.Errorf("Expected the rotated certificate to be served")
+	}
+
+	// A broken rotation leaves the last good certificate in place.
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if _, err := cr.reloadIfChanged(); err == nil {
+		t.Errorf("Expected an error loading a broken key")
+	}
+	if 2 != servedSerial(t, cr) {
+		t.Errorf("Expected the last good certificate to stay in service")
+	}
+}
+
+func TestTLSRedirect(t *testing.T) {
+	rec := httptest.NewRecorder()
+	tlsRedirectHandler(rec, httptest.NewRequest("GET", "http://example.com:8000/hash/1?x=y", nil))
+
+	if http.StatusPermanentRedirect != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusPermanentRedirect, rec.Code)
+	}
+	want := "https://example.com:8080/hash/1?x=y"
+	if want != rec.Header().Get("Location") {
+		t.Errorf("Expected Location [%s], got [%s]", want, rec.Header().Get("Location"))
+	}
+}
+
+func TestValidateTLSConfig(t *testing.T) {
+	restore := withSavedConfig(t)
+
+	for _, args := range [][]string{
+		{"-tls-cert", "cert.pem"},
+		{"-tls-redirect-port", "8443"},
+		{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-tls-redirect-port", "8080"},
+	} {
+		if err := loadConfig(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,77 @@
+// Moving average of processing time for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Weight each new processing time gets in the moving average, the rest
+// going to what came before.  At 0.05 a sample's weight halves about every
+// 14 requests, so the average follows a drift within a few dozen requests
+// and shrugs off any single slow one.
+var statsEWMAAlpha float64 = 0.05
+
+// Public: exponentially weighted moving average and standard deviation of
+// the time taken to hash, in the stats' units.  Unlike the lifetime figures
+// they follow recent behaviour, so a dashboard can spot drift from two
+// numbers without keeping a history.
+type processingTrend struct {
+	Count  uint64  `json:"count"`
+	Alpha  float64 `json:"alpha"`
+	EWMA   uint64  `json:"ewma"`
+	StdDev uint64  `json:"stddev"`
+}
+
+// trendRecorder keeps the moving average and variance, in microseconds.
+type trendRecorder struct {
+	mu       sync.Mutex
+	count    uint64
+	mean     float64
+	variance float64
+}
+
+var processingTimes trendRecorder
+
+// record folds in a sample.  The first one seeds the average, and each
+// after moves it alpha of the way, with the variance updated to match, as
+// in Finch's "Incremental calculation of weighted mean and variance".
+func (tr *trendRecorder) record(alpha float64, microSecs uint64) {
+	v := float64(microSecs)
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.count++
+	if tr.count == 1 {
+		tr.mean, tr.variance = v, 0
+		return
+	}
+	diff := v - tr.mean
+	incr := alpha * diff
+	tr.mean += incr
+	tr.variance = (1 - alpha) * (tr.variance + diff*incr)
+}
+
+func (tr *trendRecorder) snapshot(alpha float64) processingTrend {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return processingTrend{
+		Count:  tr.count,
+		Alpha:  alpha,
+		EWMA:   uint64(math.Round(tr.mean)),
+		StdDev: uint64(math.Round(math.Sqrt(tr.variance))),
+	}
+}
+
+// validateTrendConfig checks the moving average weight.
+func validateTrendConfig() error {
+	return checkEWMAAlpha(statsEWMAAlpha)
+}
+
+func checkEWMAAlpha(alpha float64) error {
+	if !(alpha > 0 && alpha <= 1) {
+		return fmt.Errorf("stats-ewma-alpha %v must be above 0 and at most 1", alpha)
+	}
+	return nil
+}
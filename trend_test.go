@@ -0,0 +1,42 @@
+// Unit Tests for the processing time moving average.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"testing"
+)
+
+func TestTrendRecorder(t *testing.T) {
+	var tr trendRecorder
+	if got := tr.snapshot(0.1); 0 != got.Count || 0 != got.EWMA || 0 != got.StdDev {
+		t.Errorf("Expected nothing before any samples, got %+v", got)
+	}
+
+	// Steady at 1000us: the average sits there with no spread.
+	for i := 0; i < 50; i++ {
+		tr.record(0.1, 1000)
+	}
+	if got := tr.snapshot(0.1); 50 != got.Count || 1000 != got.EWMA || 0 != got.StdDev {
+		t.Errorf("Expected a steady 1000, got %+v", got)
+	}
+
+	// One slow request nudges it; a drift to 3000us carries it across.
+	tr.record(0.1, 11000)
+	if got := tr.snapshot(0.1); 2000 != got.EWMA || 3000 != got.StdDev {
+		t.Errorf("Expected one outlier to move the average a tenth of the way, got %+v", got)
+	}
+	for i := 0; i < 100; i++ {
+		tr.record(0.1, 3000)
+	}
+	if got := tr.snapshot(0.1); 3000 != got.EWMA || got.StdDev > 100 {
+		t.Errorf("Expected the average to follow the drift to 3000, got %+v", got)
+	}
+}
+
+func TestTrendConfig(t *testing.T) {
+	for alpha, valid := range map[float64]bool{0: false, -0.5: false, 0.05: true, 1: true, 1.5: false} {
+		if err := checkEWMAAlpha(alpha); valid != (err == nil) {
+			t.Errorf("%v: expected valid %v, got %v", alpha, valid, err)
+		}
+	}
+}
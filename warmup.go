@@ -0,0 +1,63 @@
+// Startup warm-up for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"crypto/sha512"
+	b64 "encoding/base64"
+	"sync/atomic"
+	"time"
+)
+
+// Warm up before reporting ready, so the first real requests don't pay for
+// a cold start.
+var warmupEnabled bool
+
+// Dummy hashes computed to warm the hashing path, and recent results read
+// from a shared store to prime the local cache.
+const (
+	warmupHashes  = 1000
+	warmupResults = 100
+)
+
+// Non-zero while warming up; /readyz fails meanwhile.
+var warmingUp int32
+
+// warmUp exercises the hashing path and, for a shared store st, primes the
+// local cache with the most recent results, which are the likeliest to be
+// polled for.  Nothing it does is counted in the stats.
+func warmUp(st hashStore) {
+	t0 := time.Now()
+	atomic.StoreInt32(&warmingUp, 1)
+	defer atomic.StoreInt32(&warmingUp, 0)
+
+	for i := 0; i < warmupHashes; i++ {
+		ckSum := sha512.Sum512([]byte("warm-up password"))
+		b64.StdEncoding.EncodeToString(ckSum[:])
+	}
+
+	primed := 0
+	// Results are only cached once removals are being followed.
+	if rs, shared := st.(*redisStore); shared && rs.cache.awaitLive(redisTimeout) {
+		last := rs.lastID()
+		var after uint64
+		if last > warmupResults {
+			after = last - warmupResults
+		}
+		prime := func(idNum uint64) bool {
+			if _, found := rs.load(resultKey{rs.owner(idNum), idNum}); found {
+				primed++
+			}
+			return true
+		}
+		if _, counted := idGen.(sequentialIDs); counted {
+			// The range comes off st, not whatever store is in service.
+			for idNum := after + 1; idNum <= last; idNum++ {
+				prime(idNum)
+			}
+		} else {
+			forEachIssuedID(after, prime)
+		}
+	}
+	logInfo("Warmed up", "took", time.Now().Sub(t0).Truncate(time.Millisecond), "results_primed", primed)
+}
@@ -0,0 +1,40 @@
+// Unit Tests for startup warm-up.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmUp(t *testing.T) {
+	defer withTestQueue(10, 0)()
+	fr := newFakeRedis(t, "")
+	defer fr.ln.Close()
+	rs := newRedisStore(newRedisClient(fr.ln.Addr().String(), "", 0))
+	followRemovals(t, rs)
+
+	// Results another replica computed.
+	fr.mu.Lock()
+	fr.keys["jmpc:ids"] = "2"
+	fr.mu.Unlock()
+	for id := uint64(1); id <= 2; id++ {
+		newRedisStore(rs.client).save(resultKey{id: id}, hashResult{b64Str: "digest"})
+	}
+
+	atomic.StoreInt32(&warmingUp, 1)
+	if code, report := probe(t, readyzHandler); http.StatusServiceUnavailable != code || healthFail != report.Components["warmup"].Status {
+		t.Errorf("Expected not ready while warming up, got [%d] %+v", code, report)
+	}
+	warmUp(rs)
+	if code, _ := probe(t, readyzHandler); http.StatusOK != code {
+		t.Errorf("Expected ready once warmed up, got [%d]", code)
+	}
+	for id := uint64(1); id <= 2; id++ {
+		if _, found := rs.cache.get(resultKey{id: id}, time.Now()); !found {
+			t.Errorf("Expected result %d primed in the local cache", id)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Completion webhooks for the hashing HTTP service.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery attempts per webhook, and the backoff between them, which
+// doubles after each failure up to webhookMaxBackoff.
+var webhookMaxAttempts int = 5
+var webhookBackoff time.Duration = 1 * time.Second
+var webhookMaxBackoff time.Duration = 1 * time.Minute
+
+// Retry settings for one round of delivery attempts, taken from the
+// globals above when the round starts.
+type webhookRetry struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+func currentWebhookRetry() webhookRetry {
+	return webhookRetry{webhookMaxAttempts, webhookBackoff, webhookMaxBackoff}
+}
+
+// Secrets payloads are signed with: webhookSecret by default, overridden
+// per tenant, i.e. per API key name, by "tenant:secret" entries in
+// webhookSecretList.  Without a secret payloads go unsigned.
+var webhookSecret string
+var webhookSecretList string
+
+// Parsed webhookSecretList.
+var webhookSecrets = map[string]string{}
+
+// Client for webhook POSTs, which go out under the egress controls since
+// the destination is client supplied.  The timeout is per attempt.
+var webhookClient = &http.Client{Timeout: outboundTimeout, Transport: egressTransport}
+
+// Webhook delivery states.
+const (
+	deliveryWaiting   = "waiting" // Hash not computed yet.
+	deliveryRetrying  = "retrying"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// Public: payload POSTed to a callback_url when its hash completes.
+type webhookPayload struct {
+	ID          uint64 `json:"id"`
+	Digest      string `json:"digest"`
+	Algorithm   string `json:"algorithm"`
+	DurationUs  int64  `json:"duration_us"`
+	QueueTimeUs int64  `json:"queue_time_us"`
+}
+
+// Public: delivery status of one webhook, reported by the job status
+// endpoint.
+type webhookDelivery struct {
+	URL         string     `json:"url"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+
+	// API key name of the submitter, which picks the signing secret.
+	tenant string
+}
+
+// Public: one entry of GET /admin/webhooks.
+type webhookListEntry struct {
+	ID uint64 `json:"id"`
+	webhookDelivery
+}
+
+// How long a delivered webhook's status is kept, and how often those
+// past it are swept.  Failed ones are kept until their result is removed,
+// for an admin to redeliver.
+const webhookRetained = 24 * time.Hour
+const webhookSweepEvery = time.Hour
+
+// Webhooks by request ID.
+var webhooks = struct {
+	sync.Mutex
+	byID      map[uint64]*webhookDelivery
+	lastSweep time.Time
+}{byID: map[uint64]*webhookDelivery{}}
+
+// parseCallbackURL checks a client supplied callback_url, turning away
+// destinations egress controls would refuse up front.
+func parseCallbackURL(raw string) (string, error) {
+	u, err := validateHTTPURL("callback_url", raw)
+	if err != nil {
+		return "", err
+	}
+	if err := checkEgressHost(u.Hostname()); err != nil {
+		return "", fmt.Errorf("callback_url not allowed: %v", err)
+	}
+	return u.String(), nil
+}
+
+// registerWebhook records that idNum's completion should be POSTed to
+// callbackURL, signed with tenant's secret.
+func registerWebhook(idNum uint64, callbackURL, tenant string) {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	if now := time.Now(); now.Sub(webhooks.lastSweep) > webhookSweepEvery {
+		sweepWebhooks(now)
+		webhooks.lastSweep = now
+	}
+	webhooks.byID[idNum] = &webhookDelivery{URL: callbackURL, State: deliveryWaiting, tenant: tenant}
+}
+
+// sweepWebhooks forgets deliveries made more than webhookRetained before
+// now.  The caller holds webhooks.
+func sweepWebhooks(now time.Time) {
+	for idNum, wd := range webhooks.byID {
+		if wd.State == deliveryDelivered && now.Sub(*wd.DeliveredAt) > webhookRetained {
+			delete(webhooks.byID, idNum)
+		}
+	}
+}
+
+// forgetWebhook drops idNum's delivery status, once its result is gone.
+func forgetWebhook(idNum uint64) {
+	webhooks.Lock()
+	delete(webhooks.byID, idNum)
+	webhooks.Unlock()
+}
+
+// webhookStatus returns a copy of idNum's delivery status, if it has one.
+func webhookStatus(idNum uint64) (webhookDelivery, bool) {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	wd, found := webhooks.byID[idNum]
+	if !found {
+		return webhookDelivery{}, false
+	}
+	return *wd, true
+}
+
+// fireWebhook starts delivery for a completed hash, if a webhook is
+// registered for it.
+func fireWebhook(idNum uint64, hRes hashResult) {
+	webhooks.Lock()
+	wd, found := webhooks.byID[idNum]
+	webhooks.Unlock()
+	if !found {
+		return
+	}
+	go deliverWebhook(wd, newWebhookPayload(idNum, hRes), currentWebhookRetry())
+}
+
+func newWebhookPayload(idNum uint64, hRes hashResult) webhookPayload {
+	return webhookPayload{
+		ID:          idNum,
+		Digest:      hRes.b64Str,
+		Algorithm:   "sha512",
+		DurationUs:  hRes.processTime.Microseconds(),
+		QueueTimeUs: hRes.queueTime.Microseconds(),
+	}
+}
+
+// deliverWebhook POSTs the payload, retrying with exponential backoff until
+// a 2xx or retry.maxAttempts runs out.
+func deliverWebhook(wd *webhookDelivery, payload webhookPayload, retry webhookRetry) {
+	body, _ := json.Marshal(payload)
+	backoff := retry.backoff
+
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(wd.URL, wd.tenant, body)
+		now := time.Now()
+
+		webhooks.Lock()
+		wd.Attempts = attempt
+		wd.LastAttempt = &now
+		if err == nil {
+			wd.State = deliveryDelivered
+			wd.LastError = ""
+			wd.DeliveredAt = &now
+		} else {
+			wd.LastError = err.Error()
+			wd.State = deliveryRetrying
+			if attempt >= retry.maxAttempts {
+				wd.State = deliveryFailed
+			}
+		}
+		state := wd.State
+		webhooks.Unlock()
+
+		if state != deliveryRetrying {
+			if state == deliveryFailed {
+				logWarn("Webhook delivery failed", "id", payload.ID, "attempts", attempt, "error", err)
+			}
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > retry.maxBackoff {
+			backoff = retry.maxBackoff
+		}
+	}
+}
+
+// signWebhook computes the X-JMPC-Signature value for a body sent at
+// timestamp: an HMAC-SHA256 over "timestamp.body", so a receiver can also
+// reject replays of old deliveries.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSecretFor picks the signing secret for a tenant, "" for none.
+func webhookSecretFor(tenant string) string {
+	if secret, found := webhookSecrets[tenant]; found {
+		return secret
+	}
+	return webhookSecret
+}
+
+func postWebhook(target, tenant string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := webhookSecretFor(tenant); len(secret) > 0 {
+		timestamp := time.Now().Unix()
+		req.Header.Set("X-JMPC-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-JMPC-Signature", signWebhook(secret, timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhooksHandler lists deliveries, only the failed ones by default or
+// those in the state given by "state".
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	if len(state) == 0 {
+		state = deliveryFailed
+	}
+
+	webhooks.Lock()
+	entries := []webhookListEntry{}
+	for idNum, wd := range webhooks.byID {
+		if wd.State == state {
+			entries = append(entries, webhookListEntry{idNum, *wd})
+		}
+	}
+	webhooks.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// redeliverHandler starts a fresh round of delivery attempts for a webhook
+// that has finished, whether it failed or the receiver wants it again.
+func redeliverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	idNum, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		writeCodedError(w, r, codeBadID, "Form field 'id' must be a request ID.", http.StatusBadRequest)
+		return
+	}
+
+	// Redelivery goes to the owner's own callback, so reads their result.
+	hRes, recFound, err := loadBefore(r.Context(), ownedKey(idNum))
+	if err != nil {
+		writeBudgetSpent(w, r)
+		return
+	}
+	webhooks.Lock()
+	wd, found := webhooks.byID[idNum]
+	if !found || !recFound {
+		webhooks.Unlock()
+		writeError(w, r, fmt.Sprintf("No completed webhook for request %d.", idNum), http.StatusNotFound)
+		return
+	}
+	if wd.State != deliveryFailed && wd.State != deliveryDelivered {
+		webhooks.Unlock()
+		writeError(w, r, fmt.Sprintf("Webhook for request %d is still being delivered.", idNum), http.StatusConflict)
+		return
+	}
+	wd.State = deliveryRetrying
+	wd.LastError = ""
+	wd.DeliveredAt = nil
+	webhooks.Unlock()
+
+	logInfo("Webhook redelivery requested", "id", idNum, "request_id", requestID(r))
+	go deliverWebhook(wd, newWebhookPayload(idNum, hRes), currentWebhookRetry())
+	fmt.Fprintf(w, "Redelivering %d.", idNum)
+}
+
+// validateWebhookConfig checks the delivery settings and parses the
+// per-tenant secrets.
+func validateWebhookConfig() error {
+	if webhookMaxAttempts < 1 {
+		return fmt.Errorf("webhook-max-attempts %d must be at least 1", webhookMaxAttempts)
+	}
+	if webhookBackoff <= 0 || webhookMaxBackoff < webhookBackoff {
+		return fmt.Errorf("webhook-backoff %v must be positive and at most webhook-max-backoff %v",
+			webhookBackoff, webhookMaxBackoff)
+	}
+
+	secrets := map[string]string{}
+	for _, entry := range strings.Split(webhookSecretList, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return fmt.Errorf("webhook-secrets: entry for %q must be tenant:secret", parts[0])
+		}
+		secrets[parts[0]] = parts[1]
+	}
+	webhookSecrets = secrets
+	return nil
+}
@@ -0,0 +1,237 @@
+// Unit Tests for completion webhooks and job status.
+// Copyright (C) 2020, Adam E. Hampton.  All Rights Reserved.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// allowLoopbackEgress lets webhooks reach httptest servers until the
+// returned func is called.
+func allowLoopbackEgress() func() {
+	saved := egressAllowPrivate
+	egressAllowPrivate = true
+	return func() { egressAllowPrivate = saved }
+}
+
+// withTestWebhook registers a webhook for an ID no submission will reach,
+// removing it again when the returned func is called.
+func withTestWebhook(idNum uint64, callbackURL string) (*webhookDelivery, func()) {
+	registerWebhook(idNum, callbackURL, "")
+	webhooks.Lock()
+	wd := webhooks.byID[idNum]
+	webhooks.Unlock()
+	return wd, func() {
+		webhooks.Lock()
+		delete(webhooks.byID, idNum)
+		webhooks.Unlock()
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	defer allowLoopbackEgress()()
+
+	// The receiver fails once, then accepts.
+	var calls int32
+	payloads := make(chan webhookPayload, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	defer hook.Close()
+
+	const idNum = 1<<51 + 1
+	wd, unregister := withTestWebhook(idNum, hook.URL)
+	defer unregister()
+	want := "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="
+	hRes := hashResult{b64Str: want, processTime: time.Millisecond}
+	deliverWebhook(wd, newWebhookPayload(idNum, hRes), webhookRetry{5, time.Millisecond, time.Millisecond})
+
+	select {
+	case p := <-payloads:
+		if want != p.Digest || "sha512" != p.Algorithm || idNum != p.ID || 1000 != p.DurationUs {
+			t.Errorf("Unexpected payload %+v", p)
+		}
+	default:
+		t.Fatalf("Expected the webhook to be delivered")
+	}
+	status, _ := webhookStatus(idNum)
+	if deliveryDelivered != status.State || 2 != status.Attempts || nil == status.DeliveredAt {
+		t.Errorf("Expected delivery on the second attempt, got %+v", status)
+	}
+}
+
+func jsonID(idNum uint64) string {
+	b, _ := json.Marshal(idNum)
+	return string(b)
+}
+
+// Delivered statuses are swept once old, and any goes with its result.
+func TestWebhookStatusForgotten(t *testing.T) {
+	const deliveredID, failedID = 1<<51 + 3, 1<<51 + 4
+	delivered, forget := withTestWebhook(deliveredID, "http://example.com/done")
+	defer forget()
+	failed, forget := withTestWebhook(failedID, "http://example.com/done")
+	defer forget()
+
+	now := time.Now()
+	webhooks.Lock()
+	longAgo := now.Add(-webhookRetained - time.Minute)
+	delivered.State, delivered.DeliveredAt = deliveryDelivered, &longAgo
+	failed.State, failed.LastAttempt = deliveryFailed, &longAgo
+	sweepWebhooks(now)
+	webhooks.Unlock()
+	if _, found := webhookStatus(deliveredID); found {
+		t.Errorf("Expected the old delivery swept")
+	}
+	if _, found := webhookStatus(failedID); !found {
+		t.Fatalf("Expected the failed delivery kept for redelivery")
+	}
+
+	(memoryStore{}).save(resultKey{id: failedID}, hashResult{b64Str: "digest", completedAt: now})
+	removeResult(resultKey{id: failedID})
+	if _, found := webhookStatus(failedID); found {
+		t.Errorf("Expected the delivery status dropped with its result")
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	defer allowLoopbackEgress()()
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer hook.Close()
+
+	wd := &webhookDelivery{URL: hook.URL, State: deliveryWaiting}
+	deliverWebhook(wd, webhookPayload{ID: 1}, webhookRetry{3, time.Millisecond, time.Millisecond})
+	if deliveryFailed != wd.State || 3 != wd.Attempts || len(wd.LastError) == 0 {
+		t.Errorf("Expected failure after 3 attempts, got %+v", wd)
+	}
+}
+
+func TestCallbackURLValidation(t *testing.T) {
+	for _, raw := range []string{"ftp://example.com/x", "/relative", "http://", "http://:8080/hook"} {
+		if _, err := parseCallbackURL(raw); err == nil {
+			t.Errorf("Expected %q to be rejected", raw)
+		}
+	}
+
+	rec := postForm(hashHandler, "/hash", url.Values{"password": {"angryMonkey"}, "callback_url": {"nope"}})
+	if http.StatusBadRequest != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	hashHandler(rec, httptest.NewRequest("GET", "/hash/99999999/status", nil))
+	if http.StatusNotFound != rec.Code {
+		t.Errorf("Expected StatusCode [%d] for an unissued ID, got [%d]", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	defer allowLoopbackEgress()()
+	savedSecret, savedSecrets := webhookSecret, webhookSecrets
+	webhookSecret, webhookSecrets = "default-secret", map[string]string{"acme": "acme-secret"}
+	defer func() { webhookSecret, webhookSecrets = savedSecret, savedSecrets }()
+
+	headers := make(chan http.Header, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer hook.Close()
+
+	body := []byte(`{"id":1}`)
+	for tenant, secret := range map[string]string{"acme": "acme-secret", "other": "default-secret"} {
+		if err := postWebhook(hook.URL, tenant, body); err != nil {
+			t.Fatal(err)
+		}
+		h := <-headers
+		timestamp, _ := strconv.ParseInt(h.Get("X-JMPC-Timestamp"), 10, 64)
+		if want := signWebhook(secret, timestamp, body); want != h.Get("X-JMPC-Signature") {
+			t.Errorf("Expected tenant %s signed with %s, got %q", tenant, secret, h.Get("X-JMPC-Signature"))
+		}
+	}
+
+	webhookSecret = ""
+	postWebhook(hook.URL, "other", body)
+	if sig := (<-headers).Get("X-JMPC-Signature"); len(sig) > 0 {
+		t.Errorf("Expected no signature without a secret, got %q", sig)
+	}
+}
+
+func TestWebhookRedelivery(t *testing.T) {
+	defer allowLoopbackEgress()()
+
+	var healthy int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "down", http.StatusBadGateway)
+		}
+	}))
+	defer hook.Close()
+
+	const idNum = 1<<51 + 2
+	wd, unregister := withTestWebhook(idNum, hook.URL)
+	defer unregister()
+	hRes := hashResult{b64Str: "digest"}
+	store.save(resultKey{id: idNum}, hRes)
+	defer resultMap.Delete(resultKey{id: idNum})
+	deliverWebhook(wd, newWebhookPayload(idNum, hRes), webhookRetry{1, time.Millisecond, time.Millisecond})
+	idStr := strconv.FormatUint(idNum, 10)
+
+	rec := httptest.NewRecorder()
+	webhooksHandler(rec, httptest.NewRequest("GET", "/admin/webhooks", nil))
+	var failed []webhookListEntry
+	json.Unmarshal(rec.Body.Bytes(), &failed)
+	listed := false
+	for _, entry := range failed {
+		listed = listed || (idNum == entry.ID && hook.URL == entry.URL)
+	}
+	if !listed {
+		t.Errorf("Expected request %s among failed webhooks, got %+v", idStr, failed)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	rec = postForm(redeliverHandler, "/admin/webhooks/redeliver", url.Values{"id": {idStr}})
+	if http.StatusOK != rec.Code {
+		t.Fatalf("Expected StatusCode [%d], got [%d] %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	redelivered := waitFor(func() bool {
+		status, _ := webhookStatus(idNum)
+		return deliveryDelivered == status.State
+	})
+	if !redelivered {
+		t.Errorf("Expected request %s redelivered", idStr)
+	}
+
+	rec = postForm(redeliverHandler, "/admin/webhooks/redeliver", url.Values{"id": {"99999999"}})
+	if http.StatusNotFound != rec.Code {
+		t.Errorf("Expected StatusCode [%d], got [%d]", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestWebhookSecretsConfig(t *testing.T) {
+	defer withSavedConfig(t)()
+
+	webhookSecretList = "acme:s1, beta:s2"
+	if err := validateWebhookConfig(); err != nil || "s2" != webhookSecrets["beta"] {
+		t.Errorf("Expected secrets parsed, got %v %v", webhookSecrets, err)
+	}
+	webhookSecretList = "acme"
+	if err := validateWebhookConfig(); err == nil {
+		t.Errorf("Expected an entry without a secret rejected")
+	}
+}